@@ -201,3 +201,39 @@ func generateRandomCarV2File(b *testing.B, path string, minTotalBlockSize int) {
 		totalBlockSize += size
 	}
 }
+
+// BenchmarkGenerateIndex generates the index of a sample CARv1, with and without preallocating
+// memory for the exact number of index records, to show the allocations saved by
+// carv2.PreallocIndexRecords.
+func BenchmarkGenerateIndex(b *testing.B) {
+	path := "testdata/sample-v1.car"
+	info, err := os.Stat(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var records int
+	if _, err := carv2.GenerateIndexFromFile(path, carv2.WithIndexRecordStats(func(s carv2.IndexRecordStats) {
+		records = s.PeakRecords
+	})); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bc := range []struct {
+		name string
+		opts []carv2.Option
+	}{
+		{"WithoutPrealloc", nil},
+		{"WithExactPrealloc", []carv2.Option{carv2.PreallocIndexRecords(records)}},
+	} {
+		bc := bc
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetBytes(info.Size())
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := carv2.GenerateIndexFromFile(path, bc.opts...); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
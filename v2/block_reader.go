@@ -1,14 +1,18 @@
 package car
 
 import (
+	"compress/gzip"
 	"fmt"
 	"io"
 
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	format "github.com/ipfs/go-ipld-format"
 	"github.com/ipld/go-car/v2/internal/carv1"
 	"github.com/ipld/go-car/v2/internal/carv1/util"
 	internalio "github.com/ipld/go-car/v2/internal/io"
+	"github.com/multiformats/go-multihash"
 )
 
 // BlockReader facilitates iteration over CAR blocks for both CARv1 and CARv2.
@@ -20,14 +24,22 @@ type BlockReader struct {
 	Roots []cid.Cid
 
 	// Used internally only, by BlockReader.Next during iteration over blocks.
-	r    io.Reader
-	opts Options
+	r         io.Reader
+	opts      Options
+	lateRoots []cid.Cid
+	metadata  map[string]string
 }
 
 // NewBlockReader instantiates a new BlockReader facilitating iteration over blocks in CARv1 or
 // CARv2 payload. Upon instantiation, the version is automatically detected and exposed via
 // BlockReader.Version. The root CIDs of the CAR payload are exposed via BlockReader.Roots
 //
+// The given r is only read forward and need not implement io.Seeker; when reading a CARv2, any
+// padding before its data payload is skipped by reading and discarding it. Therefore, BlockReader
+// can be used to stream blocks of either CAR version from non-seekable inputs such as network
+// connections, without branching on version. For random access to blocks see the blockstore
+// package.
+//
 // See BlockReader.Next
 func NewBlockReader(r io.Reader, opts ...Option) (*BlockReader, error) {
 	options := ApplyOptions(opts...)
@@ -96,6 +108,18 @@ func NewBlockReader(r io.Reader, opts ...Option) (*BlockReader, error) {
 	return br, nil
 }
 
+// NewBlockReaderGzip is like NewBlockReader, except that the CAR read from r is gzip-compressed as a
+// whole, as is commonly the case for CARs distributed as .car.gz files. The CAR is decompressed as
+// it is read, without buffering it in full, such that its blocks can be streamed with no temporary
+// space. See blockstore.OpenReadOnlyGzip for random access to the blocks of such a CAR.
+func NewBlockReaderGzip(r io.Reader, opts ...Option) (*BlockReader, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return NewBlockReader(zr, opts...)
+}
+
 // Next iterates over blocks in the underlying CAR payload with an io.EOF error indicating the end
 // is reached. Note, this function is forward-only; once the end has been reached it will always
 // return io.EOF.
@@ -122,5 +146,123 @@ func (br *BlockReader) Next() (blocks.Block, error) {
 		return nil, fmt.Errorf("mismatch in content integrity, expected: %s, got: %s", c, hashed)
 	}
 
+	if c.Prefix().Codec == rootsTrailerPrefix.Codec {
+		var trailer carv1.CarHeader
+		if err := cbor.DecodeInto(data, &trailer); err == nil && trailer.Version == 1 {
+			br.lateRoots = trailer.Roots
+		} else if md, ok := decodeMetadataTrailer(data); ok {
+			br.metadata = md
+		}
+	}
+
 	return blocks.NewBlockWithCid(data, c)
 }
+
+// LateRoots returns the roots listed by the roots trailer of the CAR payload, which is written when
+// EmitRootsTrailer is enabled. This allows clients that join a stream late, and therefore miss the
+// CARv1 header, to learn the roots.
+//
+// Since the trailer follows all the blocks, nil is returned until it has been read by Next, and
+// always for CARs written without it. The trailer is returned by Next as any other block.
+func (br *BlockReader) LateRoots() []cid.Cid {
+	return br.lateRoots
+}
+
+// Metadata returns the metadata held by the metadata trailer of the CAR payload, which is written
+// when WithMetadata is set.
+//
+// Like LateRoots, nil is returned until the trailer has been read by Next, and always for CARs
+// written without it.
+func (br *BlockReader) Metadata() map[string]string {
+	return br.metadata
+}
+
+// blockLinks returns the CIDs linked to by the given block. Blocks with the raw codec and trailer
+// blocks have no links; all other blocks are decoded using the decoders registered with
+// go-ipld-format.
+func blockLinks(blk blocks.Block) ([]cid.Cid, error) {
+	if blk.Cid().Prefix().Codec == cid.Raw || isTrailer(blk.Cid()) {
+		return nil, nil
+	}
+	nd, err := format.Decode(blk)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode block %s: %w", blk.Cid(), err)
+	}
+	links := make([]cid.Cid, 0, len(nd.Links()))
+	for _, l := range nd.Links() {
+		links = append(links, l.Cid)
+	}
+	return links, nil
+}
+
+// VerifyStreaming checks that r holds a valid and complete CAR, in a single forward-only pass over
+// its blocks. Therefore, r need not implement io.Seeker and may be a pipe or network connection.
+// Either CARv1 or CARv2 is accepted. If no roots are given, the roots in the CAR header are used.
+//
+// Every block is re-hashed against its CID as it is read, and the links of every block are
+// recorded. Once the payload is exhausted, the DAG under each root is walked over the recorded
+// links to confirm that every block reachable from a root is present in the stream, regardless of
+// the order in which blocks appear. The first failure encountered is returned, wrapped with the
+// CID of the offending block.
+//
+// Blocks are compared by multihash, and blocks with the raw codec are assumed to have no links,
+// as are trailers; see EmitRootsTrailer and WithMetadata. All other blocks are decoded using the
+// decoders registered with go-ipld-format in order to discover their links. Links with
+// multihash.IDENTITY code are always considered present, since their data is inlined in their CID.
+func VerifyStreaming(r io.Reader, roots []cid.Cid, opts ...Option) error {
+	br, err := NewBlockReader(r, opts...)
+	if err != nil {
+		return err
+	}
+	if len(roots) == 0 {
+		roots = br.Roots
+	}
+
+	links := make(map[string][]cid.Cid)
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read block %d: %w", len(links), err)
+		}
+		if _, ok := links[string(blk.Cid().Hash())]; ok {
+			continue
+		}
+		ls, err := blockLinks(blk)
+		if err != nil {
+			return err
+		}
+		links[string(blk.Cid().Hash())] = ls
+	}
+
+	visited := make(map[string]struct{}, len(links))
+	for _, root := range roots {
+		if root.Prefix().MhType == multihash.IDENTITY {
+			continue
+		}
+		if _, ok := links[string(root.Hash())]; !ok {
+			return fmt.Errorf("root %s is not present", root)
+		}
+		stack := []cid.Cid{root}
+		for len(stack) > 0 {
+			c := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if _, ok := visited[string(c.Hash())]; ok {
+				continue
+			}
+			visited[string(c.Hash())] = struct{}{}
+			for _, l := range links[string(c.Hash())] {
+				if l.Prefix().MhType == multihash.IDENTITY {
+					continue
+				}
+				if _, ok := links[string(l.Hash())]; !ok {
+					return fmt.Errorf("block %s linked from %s under root %s is not present", l, c, root)
+				}
+				stack = append(stack, l)
+			}
+		}
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package car_test
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/hex"
 	"io"
 	"os"
@@ -109,6 +110,91 @@ func TestBlockReader_WithCarV1Consistency(t *testing.T) {
 	}
 }
 
+func TestBlockReader_StreamsFromNonSeekableReader(t *testing.T) {
+	v1, err := os.ReadFile("testdata/sample-v1.car")
+	require.NoError(t, err)
+
+	// Construct a CARv2 with data padding and an index, to assert that the padding is skipped
+	// and the index is never read.
+	var v2 bytes.Buffer
+	h := carv2.NewHeader(uint64(len(v1))).WithDataPadding(13)
+	_, err = v2.Write(carv2.Pragma)
+	require.NoError(t, err)
+	_, err = h.WriteTo(&v2)
+	require.NoError(t, err)
+	_, err = v2.Write(make([]byte, 13))
+	require.NoError(t, err)
+	_, err = v2.Write(v1)
+	require.NoError(t, err)
+	_, err = v2.Write([]byte("not an index"))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		payload     []byte
+		wantVersion uint64
+	}{
+		{"CarV1", v1, 1},
+		{"CarV2WithDataPadding", v2.Bytes(), 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Hide all methods other than Read.
+			r := struct{ io.Reader }{bytes.NewReader(tt.payload)}
+			subject, err := carv2.NewBlockReader(r)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantVersion, subject.Version)
+
+			wantReader := requireNewCarV1ReaderFromV1File(t, "testdata/sample-v1.car", false)
+			require.Equal(t, wantReader.Header.Roots, subject.Roots)
+			for {
+				gotBlock, gotErr := subject.Next()
+				wantBlock, wantErr := wantReader.Next()
+				require.Equal(t, wantBlock, gotBlock)
+				require.Equal(t, wantErr, gotErr)
+				if gotErr == io.EOF {
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestNewBlockReaderGzip(t *testing.T) {
+	for _, path := range []string{"testdata/sample-v1.car", "testdata/sample-wrapped-v2.car"} {
+		path := path
+		t.Run(path, func(t *testing.T) {
+			plain, err := os.ReadFile(path)
+			require.NoError(t, err)
+			var compressed bytes.Buffer
+			zw := gzip.NewWriter(&compressed)
+			_, err = zw.Write(plain)
+			require.NoError(t, err)
+			require.NoError(t, zw.Close())
+
+			want, err := carv2.NewBlockReader(bytes.NewReader(plain))
+			require.NoError(t, err)
+			subject, err := carv2.NewBlockReaderGzip(&compressed)
+			require.NoError(t, err)
+			require.Equal(t, want.Version, subject.Version)
+			require.Equal(t, want.Roots, subject.Roots)
+			for {
+				wantBlock, wantErr := want.Next()
+				gotBlock, gotErr := subject.Next()
+				require.Equal(t, wantErr, gotErr)
+				if wantErr == io.EOF {
+					break
+				}
+				require.Equal(t, wantBlock, gotBlock)
+			}
+		})
+	}
+
+	// Assert input that is not gzip-compressed is an error.
+	_, err := carv2.NewBlockReaderGzip(requireReaderFromPath(t, "testdata/sample-v1.car"))
+	require.Error(t, err)
+}
+
 func TestMaxSectionLength(t *testing.T) {
 	// headerHex is the zero-roots CARv1 header
 	const headerHex = "11a265726f6f7473806776657273696f6e01"
@@ -1,11 +1,14 @@
 package blockstore_test
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"io"
 	mathrand "math/rand"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/ipfs/go-cid"
 	carv2 "github.com/ipld/go-car/v2"
@@ -78,3 +81,120 @@ func BenchmarkOpenReadOnlyV1(b *testing.B) {
 		}
 	})
 }
+
+// BenchmarkReadOnlyHas checks the presence of all blocks in a read-only blockstore, in a tight loop
+// that is dominated by reading and comparing the CIDs at indexed offsets.
+func BenchmarkReadOnlyHas(b *testing.B) {
+	path := "../testdata/sample-v1.car"
+	f, err := os.Open(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}()
+	var cids []cid.Cid
+	br, err := carv2.NewBlockReader(f)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for {
+		block, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+		cids = append(cids, block.Cid())
+	}
+
+	bs, err := blockstore.OpenReadOnly(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer bs.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, c := range cids {
+			if has, err := bs.Has(context.TODO(), c); err != nil {
+				b.Fatal(err)
+			} else if !has {
+				b.Fatalf("expected %s to be present", c)
+			}
+		}
+	}
+}
+
+// slowReaderAt delays every ReadAt, e.g. to mimic a backing over the network.
+type slowReaderAt struct {
+	r     io.ReaderAt
+	delay time.Duration
+}
+
+func (s *slowReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	time.Sleep(s.delay)
+	return s.r.ReadAt(p, off)
+}
+
+// BenchmarkReadOnlyGetSequential retrieves blocks in the order in which they appear in the CAR,
+// from a slow backing, with and without prefetching.
+func BenchmarkReadOnlyGetSequential(b *testing.B) {
+	data, err := os.ReadFile("../testdata/sample-v1.car")
+	if err != nil {
+		b.Fatal(err)
+	}
+	idx, err := carv2.GenerateIndex(bytes.NewReader(data))
+	if err != nil {
+		b.Fatal(err)
+	}
+	var cids []cid.Cid
+	br, err := carv2.NewBlockReader(bytes.NewReader(data))
+	if err != nil {
+		b.Fatal(err)
+	}
+	for {
+		block, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+		cids = append(cids, block.Cid())
+	}
+	// Only walk a prefix of the CAR to keep the benchmark reasonably fast despite the slow backing.
+	cids = cids[:256]
+	backing := &slowReaderAt{r: bytes.NewReader(data), delay: 50 * time.Microsecond}
+
+	for _, window := range []int{0, 16} {
+		window := window
+		b.Run(fmt.Sprintf("PrefetchWindow=%d", window), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				bs, err := blockstore.NewReadOnly(backing, idx, blockstore.PrefetchWindow(window))
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				for _, c := range cids {
+					if _, err := bs.Get(context.TODO(), c); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StopTimer()
+				if err := bs.Close(); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package blockstore
+
+import (
+	"context"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+)
+
+var _ blockstore.Blockstore = (*Budgeted)(nil)
+
+// Budgeted is a blockstore.Blockstore that caps the total number of bytes of block data served by
+// a wrapped blockstore via Get, e.g. to limit how much a single untrusted client can retrieve from
+// a ReadOnly blockstore. All other methods, including Has, GetSize and AllKeysChan, are passed
+// through to the wrapped blockstore unmodified and do not count against the budget.
+//
+// See NewBudgeted.
+type Budgeted struct {
+	blockstore.Blockstore
+	max int64
+
+	mu        sync.Mutex
+	served    int64
+	exhausted bool
+}
+
+// NewBudgeted wraps bs such that at most maxBytes bytes of block data in total are returned by Get.
+// Once a call to Get would return a block that takes the total beyond maxBytes, that call and all
+// subsequent ones return ErrBudgetExceeded without returning a block.
+func NewBudgeted(bs blockstore.Blockstore, maxBytes int64) *Budgeted {
+	return &Budgeted{Blockstore: bs, max: maxBytes}
+}
+
+// Get returns the block with the given CID from the wrapped blockstore, counting the length of its
+// data against the budget. ErrBudgetExceeded is returned if the budget is exhausted.
+// Errors returned by the wrapped blockstore do not count against the budget.
+func (b *Budgeted) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	if b.Remaining() < 0 {
+		return nil, ErrBudgetExceeded
+	}
+	blk, err := b.Blockstore.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	n := int64(len(blk.RawData()))
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.exhausted || n > b.max-b.served {
+		b.exhausted = true
+		return nil, ErrBudgetExceeded
+	}
+	b.served += n
+	return blk, nil
+}
+
+// Remaining returns the number of bytes of block data that can still be returned by Get, or -1 if
+// the budget is exhausted.
+func (b *Budgeted) Remaining() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.exhausted {
+		return -1
+	}
+	return b.max - b.served
+}
@@ -0,0 +1,65 @@
+package blockstore
+
+import (
+	"context"
+	"testing"
+
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBudgeted(t *testing.T) {
+	ctx := context.TODO()
+	robs, err := OpenReadOnly("../testdata/sample-v1.car")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, robs.Close()) })
+	records, err := robs.Manifest()
+	require.NoError(t, err)
+	require.Greater(t, len(records), 2)
+	first, second := records[0].Cid, records[1].Cid
+	firstSize, err := robs.GetSize(ctx, first)
+	require.NoError(t, err)
+	secondSize, err := robs.GetSize(ctx, second)
+	require.NoError(t, err)
+
+	// Budget for exactly the first block, twice.
+	subject := NewBudgeted(robs, 2*int64(firstSize))
+	require.Equal(t, 2*int64(firstSize), subject.Remaining())
+
+	// Assert misses and metadata lookups do not count against the budget.
+	_, err = subject.Get(ctx, merkledag.NewRawNode([]byte("lobstermuncher")).Cid())
+	require.True(t, format.IsNotFound(err))
+	has, err := subject.Has(ctx, second)
+	require.NoError(t, err)
+	require.True(t, has)
+	size, err := subject.GetSize(ctx, second)
+	require.NoError(t, err)
+	require.Equal(t, secondSize, size)
+	require.Equal(t, 2*int64(firstSize), subject.Remaining())
+
+	// Assert blocks are served up to the budget, inclusive.
+	for i := 0; i < 2; i++ {
+		blk, err := subject.Get(ctx, first)
+		require.NoError(t, err)
+		require.Equal(t, first, blk.Cid())
+	}
+	require.Zero(t, subject.Remaining())
+
+	// Assert the budget is exhausted once crossed, and remains so.
+	_, err = subject.Get(ctx, second)
+	require.ErrorIs(t, err, ErrBudgetExceeded)
+	require.False(t, format.IsNotFound(err))
+	require.Equal(t, int64(-1), subject.Remaining())
+	_, err = subject.Get(ctx, first)
+	require.ErrorIs(t, err, ErrBudgetExceeded)
+
+	// Assert keys can still be enumerated.
+	ch, err := subject.AllKeysChan(ctx)
+	require.NoError(t, err)
+	var count int
+	for range ch {
+		count++
+	}
+	require.NotZero(t, count)
+}
@@ -0,0 +1,81 @@
+package blockstore
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+)
+
+// ErrBudgetExceeded signals that serving a block from a Budgeted blockstore would exceed its maximum
+// total bytes served.
+var ErrBudgetExceeded = errors.New("blockstore budget of bytes served exceeded")
+
+// ErrCorruptCar signals that the section at an indexed offset of the data payload could not be
+// decoded, for example because it is truncated or its CID is malformed.
+// The underlying decoding error is available via errors.Unwrap.
+type ErrCorruptCar struct {
+	// Offset is the offset of the section within the data payload.
+	Offset uint64
+	// Err is the error that occurred while decoding the section.
+	Err error
+}
+
+func (e *ErrCorruptCar) Error() string {
+	return fmt.Sprintf("corrupt car section at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *ErrCorruptCar) Unwrap() error {
+	return e.Err
+}
+
+// ErrOffsetOutOfBounds signals that the index refers to an offset at or beyond the end of the
+// data payload, which typically means that the index does not belong to the payload.
+type ErrOffsetOutOfBounds struct {
+	// Offset is the offset of the section within the data payload, as recorded by the index.
+	Offset uint64
+}
+
+func (e *ErrOffsetOutOfBounds) Error() string {
+	return fmt.Sprintf("indexed offset %d is out of bounds of the car data payload", e.Offset)
+}
+
+// ErrCidMismatch signals that the section at an indexed offset holds a different CID than the one
+// looked up, which typically means that the index is stale.
+type ErrCidMismatch struct {
+	// Expected is the CID that was looked up.
+	Expected cid.Cid
+	// Got is the CID found at the indexed offset.
+	Got cid.Cid
+}
+
+func (e *ErrCidMismatch) Error() string {
+	return fmt.Sprintf("indexed section holds cid %s instead of %s", e.Got, e.Expected)
+}
+
+// ErrBufferTooSmall signals that the buffer given to ReadOnly.GetInto is too small to hold the
+// data of the block looked up.
+type ErrBufferTooSmall struct {
+	// Size is the length of the block data in bytes, i.e. the minimum length of the buffer.
+	Size int
+}
+
+func (e *ErrBufferTooSmall) Error() string {
+	return fmt.Sprintf("buffer is too small to hold block data of %d bytes", e.Size)
+}
+
+// notFoundError is a format.ErrNotFound that also matches a sentinel error via errors.Is.
+// See WithNotFoundError.
+type notFoundError struct {
+	format.ErrNotFound
+	sentinel error
+}
+
+func (e *notFoundError) Is(target error) bool {
+	return e.ErrNotFound.Is(target) || errors.Is(e.sentinel, target)
+}
+
+func (e *notFoundError) Unwrap() error {
+	return e.ErrNotFound
+}
@@ -24,6 +24,8 @@ var (
 	insertionIndexCodec = multicodec.Code(0x300003)
 )
 
+var _ index.SizedIndex = (*insertionIndex)(nil)
+
 type (
 	insertionIndex struct {
 		items llrb.LLRB
@@ -32,6 +34,10 @@ type (
 	recordDigest struct {
 		digest []byte
 		index.Record
+		// length is the length of the block data of the section, if sized is true. Records that
+		// are loaded via Load or Unmarshal have no known length.
+		length uint64
+		sized  bool
 	}
 )
 
@@ -49,20 +55,22 @@ func newRecordDigest(r index.Record) recordDigest {
 		panic(err)
 	}
 
-	return recordDigest{d.Digest, r}
+	return recordDigest{digest: d.Digest, Record: r}
 }
 
-func newRecordFromCid(c cid.Cid, at uint64) recordDigest {
+func newRecordFromCid(c cid.Cid, at uint64, length uint64) recordDigest {
 	d, err := multihash.Decode(c.Hash())
 	if err != nil {
 		panic(err)
 	}
 
-	return recordDigest{d.Digest, index.Record{Cid: c, Offset: at}}
+	return recordDigest{digest: d.Digest, Record: index.Record{Cid: c, Offset: at}, length: length, sized: true}
 }
 
-func (ii *insertionIndex) insertNoReplace(key cid.Cid, n uint64) {
-	ii.items.InsertNoReplace(newRecordFromCid(key, n))
+// insertNoReplace inserts a record of the section at offset n, whose block data is of the given
+// length.
+func (ii *insertionIndex) insertNoReplace(key cid.Cid, n uint64, length uint64) {
+	ii.items.InsertNoReplace(newRecordFromCid(key, n, length))
 }
 
 func (ii *insertionIndex) Get(c cid.Cid) (uint64, error) {
@@ -83,6 +91,25 @@ func (ii *insertionIndex) Get(c cid.Cid) (uint64, error) {
 	return r.Record.Offset, nil
 }
 
+// GetOffsetAndLength looks up the first record matching the given CID, returning the offset of its
+// section along with the length of its block data. errUnsupported is returned if the length of the
+// record is not known, i.e. if it was loaded via Load or Unmarshal.
+func (ii *insertionIndex) GetOffsetAndLength(c cid.Cid) (uint64, uint64, error) {
+	d, err := multihash.Decode(c.Hash())
+	if err != nil {
+		return 0, 0, err
+	}
+	e := ii.items.Get(recordDigest{digest: d.Digest})
+	if e == nil {
+		return 0, 0, index.ErrNotFound
+	}
+	r, ok := e.(recordDigest)
+	if !ok || !r.sized {
+		return 0, 0, errUnsupported
+	}
+	return r.Record.Offset, r.length, nil
+}
+
 func (ii *insertionIndex) GetAll(c cid.Cid, fn func(uint64) bool) error {
 	d, err := multihash.Decode(c.Hash())
 	if err != nil {
@@ -190,7 +217,8 @@ func (ii *insertionIndex) flatten(codec multicodec.Code) (index.Index, error) {
 	}
 	ii.items.AscendGreaterOrEqual(ii.items.Min(), iter)
 
-	if err := si.Load(rcrds); err != nil {
+	// The records are in ascending order of digest, as kept by the tree.
+	if err := index.LoadSorted(si, rcrds); err != nil {
 		return nil, err
 	}
 	return si, nil
@@ -0,0 +1,149 @@
+package blockstore
+
+import (
+	"context"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	format "github.com/ipfs/go-ipld-format"
+)
+
+var _ blockstore.Blockstore = (*Instrumented)(nil)
+
+// Hooks holds the callbacks through which an Instrumented blockstore reports accesses, e.g. to
+// record hit and miss counts, bytes read and latency histograms. Each callback is optional, and is
+// called synchronously after the corresponding call to the wrapped blockstore returns, along with
+// the duration of that call. Callbacks should therefore be cheap, and must be safe for concurrent
+// use if the blockstore is used concurrently.
+//
+// Not-found errors, i.e. errors matched by format.IsNotFound, are reported as misses via the found
+// parameter; any other error is reported via OnError.
+type Hooks struct {
+	// OnGet is called after Get, with the length of the block data if found.
+	OnGet func(c cid.Cid, found bool, bytes int, dur time.Duration)
+	// OnGetSize is called after GetSize, with the size of the block if found.
+	OnGetSize func(c cid.Cid, found bool, size int, dur time.Duration)
+	// OnHas is called after Has.
+	OnHas func(c cid.Cid, found bool, dur time.Duration)
+	// OnPut is called after Put and PutMany, with the number of blocks and the total length of
+	// their data.
+	OnPut func(count int, bytes int, dur time.Duration)
+	// OnDeleteBlock is called after DeleteBlock.
+	OnDeleteBlock func(c cid.Cid, dur time.Duration)
+	// OnError is called with the name of the blockstore method that failed, e.g. "Get", and its
+	// error. The CID is undefined for methods that do not take one.
+	OnError func(method string, c cid.Cid, err error)
+}
+
+// Instrumented is a blockstore.Blockstore that reports accesses to a wrapped blockstore via Hooks.
+// All methods are passed through to the wrapped blockstore unmodified.
+//
+// See NewInstrumented.
+type Instrumented struct {
+	bs    blockstore.Blockstore
+	hooks Hooks
+}
+
+// NewInstrumented wraps bs such that accesses to it are reported via the given hooks, e.g. to
+// expose metrics of a ReadOnly or ReadWrite blockstore without modifying its callers.
+func NewInstrumented(bs blockstore.Blockstore, hooks Hooks) *Instrumented {
+	return &Instrumented{bs: bs, hooks: hooks}
+}
+
+// reportErr reports err via OnError unless it is nil or a not-found error, and returns whether the
+// block was found, i.e. whether err is nil.
+func (i *Instrumented) reportErr(method string, c cid.Cid, err error) bool {
+	if err == nil {
+		return true
+	}
+	if i.hooks.OnError != nil && !format.IsNotFound(err) {
+		i.hooks.OnError(method, c, err)
+	}
+	return false
+}
+
+func (i *Instrumented) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	start := time.Now()
+	blk, err := i.bs.Get(ctx, c)
+	dur := time.Since(start)
+	found := i.reportErr("Get", c, err)
+	if i.hooks.OnGet != nil {
+		var n int
+		if found {
+			n = len(blk.RawData())
+		}
+		i.hooks.OnGet(c, found, n, dur)
+	}
+	return blk, err
+}
+
+func (i *Instrumented) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	start := time.Now()
+	size, err := i.bs.GetSize(ctx, c)
+	dur := time.Since(start)
+	found := i.reportErr("GetSize", c, err)
+	if i.hooks.OnGetSize != nil {
+		i.hooks.OnGetSize(c, found, size, dur)
+	}
+	return size, err
+}
+
+func (i *Instrumented) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	start := time.Now()
+	has, err := i.bs.Has(ctx, c)
+	dur := time.Since(start)
+	i.reportErr("Has", c, err)
+	if i.hooks.OnHas != nil {
+		i.hooks.OnHas(c, has, dur)
+	}
+	return has, err
+}
+
+func (i *Instrumented) Put(ctx context.Context, blk blocks.Block) error {
+	start := time.Now()
+	err := i.bs.Put(ctx, blk)
+	dur := time.Since(start)
+	if i.reportErr("Put", blk.Cid(), err) && i.hooks.OnPut != nil {
+		i.hooks.OnPut(1, len(blk.RawData()), dur)
+	}
+	return err
+}
+
+func (i *Instrumented) PutMany(ctx context.Context, blks []blocks.Block) error {
+	start := time.Now()
+	err := i.bs.PutMany(ctx, blks)
+	dur := time.Since(start)
+	if i.reportErr("PutMany", cid.Undef, err) && i.hooks.OnPut != nil {
+		var n int
+		for _, blk := range blks {
+			n += len(blk.RawData())
+		}
+		i.hooks.OnPut(len(blks), n, dur)
+	}
+	return err
+}
+
+func (i *Instrumented) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	start := time.Now()
+	err := i.bs.DeleteBlock(ctx, c)
+	dur := time.Since(start)
+	if i.reportErr("DeleteBlock", c, err) && i.hooks.OnDeleteBlock != nil {
+		i.hooks.OnDeleteBlock(c, dur)
+	}
+	return err
+}
+
+// AllKeysChan is passed through to the wrapped blockstore; it is not reported, since keys are
+// enumerated asynchronously. Errors returned when starting the enumeration are reported via
+// OnError.
+func (i *Instrumented) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	ch, err := i.bs.AllKeysChan(ctx)
+	i.reportErr("AllKeysChan", cid.Undef, err)
+	return ch, err
+}
+
+func (i *Instrumented) HashOnRead(enable bool) {
+	i.bs.HashOnRead(enable)
+}
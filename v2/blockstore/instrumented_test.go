@@ -0,0 +1,80 @@
+package blockstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstrumented(t *testing.T) {
+	ctx := context.TODO()
+	robs, err := OpenReadOnly("../testdata/sample-v1.car")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, robs.Close()) })
+	records, err := robs.Manifest()
+	require.NoError(t, err)
+	present := records[0].Cid
+	missing := merkledag.NewRawNode([]byte("lobstermuncher"))
+
+	type access struct {
+		method string
+		c      cid.Cid
+		found  bool
+		n      int
+	}
+	var got []access
+	var errs []string
+	subject := NewInstrumented(robs, Hooks{
+		OnGet: func(c cid.Cid, found bool, bytes int, _ time.Duration) {
+			got = append(got, access{"Get", c, found, bytes})
+		},
+		OnGetSize: func(c cid.Cid, found bool, size int, _ time.Duration) {
+			got = append(got, access{"GetSize", c, found, size})
+		},
+		OnHas: func(c cid.Cid, found bool, _ time.Duration) {
+			got = append(got, access{"Has", c, found, 0})
+		},
+		OnPut: func(count int, bytes int, _ time.Duration) {
+			got = append(got, access{"Put", cid.Undef, true, count})
+		},
+		OnError: func(method string, c cid.Cid, err error) {
+			require.Error(t, err)
+			errs = append(errs, method)
+		},
+	})
+
+	blk, err := subject.Get(ctx, present)
+	require.NoError(t, err)
+	_, err = subject.Get(ctx, missing.Cid())
+	require.True(t, format.IsNotFound(err))
+	size, err := subject.GetSize(ctx, present)
+	require.NoError(t, err)
+	_, err = subject.GetSize(ctx, missing.Cid())
+	require.True(t, format.IsNotFound(err))
+	has, err := subject.Has(ctx, present)
+	require.NoError(t, err)
+	require.True(t, has)
+	has, err = subject.Has(ctx, missing.Cid())
+	require.NoError(t, err)
+	require.False(t, has)
+	require.Equal(t, []access{
+		{"Get", present, true, len(blk.RawData())},
+		{"Get", missing.Cid(), false, 0},
+		{"GetSize", present, true, size},
+		{"GetSize", missing.Cid(), false, -1},
+		{"Has", present, true, 0},
+		{"Has", missing.Cid(), false, 0},
+	}, got)
+	require.Empty(t, errs)
+
+	// Assert errors other than not-found are reported, and failed writes are not.
+	require.ErrorIs(t, subject.Put(ctx, missing), errReadOnly)
+	require.ErrorIs(t, subject.DeleteBlock(ctx, present), errReadOnly)
+	require.Equal(t, []string{"Put", "DeleteBlock"}, errs)
+	require.Len(t, got, 6)
+}
@@ -0,0 +1,193 @@
+package blockstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/index"
+	"github.com/ipld/go-car/v2/internal/carv1"
+	internalio "github.com/ipld/go-car/v2/internal/io"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+)
+
+var _ index.SizedIndex = (*lazyIndex)(nil)
+
+// lazyIndex is an index that is generated incrementally from a CARv1 data payload as it is looked
+// up, rather than upfront. The sections scanned so far are recorded in a partial index, which is
+// consulted first. A lookup that is not satisfied by the partial index resumes the scan of the
+// payload where it left off, recording each section it reads, until a matching section is found
+// or the payload is exhausted. Therefore, the partial index converges to a complete index as
+// lookups are made, and each section is read at most once for indexing.
+//
+// Lookups are serialized while the payload is being scanned. Once the scan is complete, the
+// partial index is no longer modified and lookups are served from it concurrently.
+type lazyIndex struct {
+	mu      sync.Mutex
+	backing io.ReaderAt
+	opts    carv2.Options
+	partial *insertionIndex
+
+	// r reads the sections that are yet to be scanned, or is nil if the scan has not started.
+	r internalio.ReadSeekerAt
+	// next is the offset of the next section to scan.
+	next uint64
+	done bool
+}
+
+func newLazyIndex(backing io.ReaderAt, opts carv2.Options) *lazyIndex {
+	return &lazyIndex{
+		backing: backing,
+		opts:    opts,
+		partial: newInsertionIndex(),
+	}
+}
+
+func (li *lazyIndex) Codec() multicodec.Code {
+	return insertionIndexCodec
+}
+
+// Marshal is unsupported, since the index may be incomplete.
+func (li *lazyIndex) Marshal(io.Writer) (uint64, error) {
+	return 0, errUnsupported
+}
+
+// Unmarshal is unsupported, since the index is generated from the data payload.
+func (li *lazyIndex) Unmarshal(io.Reader) error {
+	return errUnsupported
+}
+
+func (li *lazyIndex) Load(records []index.Record) error {
+	li.mu.Lock()
+	defer li.mu.Unlock()
+	return li.partial.Load(records)
+}
+
+func (li *lazyIndex) GetAll(key cid.Cid, fn func(uint64) bool) error {
+	li.mu.Lock()
+	if li.done {
+		li.mu.Unlock()
+		return li.partial.GetAll(key, fn)
+	}
+	defer li.mu.Unlock()
+
+	var found, stop bool
+	err := li.partial.GetAll(key, func(offset uint64) bool {
+		found = true
+		stop = !fn(offset)
+		return !stop
+	})
+	if err != nil && err != index.ErrNotFound {
+		return err
+	}
+
+	want, err := multihash.Decode(key.Hash())
+	if err != nil {
+		return err
+	}
+	for !stop && !li.done {
+		offset := li.next
+		c, err := li.scanNext()
+		if err != nil {
+			return err
+		}
+		if !c.Defined() {
+			continue
+		}
+		// Match by digest, consistent with insertionIndex.GetAll.
+		if got, err := multihash.Decode(c.Hash()); err == nil && bytes.Equal(got.Digest, want.Digest) {
+			found = true
+			stop = !fn(offset)
+		}
+	}
+	if !found {
+		return index.ErrNotFound
+	}
+	return nil
+}
+
+// GetOffsetAndLength looks up the first record matching the given CID as described by
+// insertionIndex.GetOffsetAndLength, scanning the payload as GetAll does if it is not recorded yet.
+func (li *lazyIndex) GetOffsetAndLength(key cid.Cid) (uint64, uint64, error) {
+	if err := li.GetAll(key, func(uint64) bool { return false }); err != nil {
+		return 0, 0, err
+	}
+	li.mu.Lock()
+	defer li.mu.Unlock()
+	return li.partial.GetOffsetAndLength(key)
+}
+
+// complete scans the remainder of the payload, such that the index is complete. The error of ctx
+// is returned if it is done before then; the sections scanned so far remain recorded.
+func (li *lazyIndex) complete(ctx context.Context) error {
+	li.mu.Lock()
+	defer li.mu.Unlock()
+	for !li.done {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := li.scanNext(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanNext reads the next section of the payload and records it in the partial index, returning
+// its CID. cid.Undef is returned if the section is not indexed, or the scan is complete.
+// The caller must hold li.mu.
+func (li *lazyIndex) scanNext() (cid.Cid, error) {
+	if li.r == nil {
+		r, err := internalio.NewOffsetReadSeeker(li.backing, 0)
+		if err != nil {
+			return cid.Undef, err
+		}
+		header, err := carv1.ReadHeader(r, li.opts.MaxAllowedHeaderSize)
+		if err != nil {
+			return cid.Undef, err
+		}
+		headerSize, err := carv1.HeaderSize(header)
+		if err != nil {
+			return cid.Undef, err
+		}
+		li.r = r
+		li.next = headerSize
+		return cid.Undef, nil
+	}
+
+	sectionLen, err := readSectionLength(li.r, li.opts)
+	if err == io.EOF {
+		li.done = true
+		return cid.Undef, nil
+	} else if err != nil {
+		return cid.Undef, err
+	}
+	if sectionLen == 0 {
+		if li.opts.ZeroLengthSectionAsEOF {
+			li.done = true
+			return cid.Undef, nil
+		}
+		return cid.Undef, errZeroLengthSection
+	}
+	cidLen, c, err := cid.CidFromReader(li.r)
+	if err != nil {
+		return cid.Undef, err
+	}
+	offset := li.next
+	next, err := li.r.Seek(int64(sectionLen)-int64(cidLen), io.SeekCurrent)
+	if err != nil {
+		return cid.Undef, err
+	}
+	li.next = uint64(next)
+
+	// Skip IDENTITY CIDs, consistent with car.LoadIndex; they are never looked up in the index.
+	if c.Prefix().MhType == multihash.IDENTITY {
+		return cid.Undef, nil
+	}
+	li.partial.insertNoReplace(c, offset, sectionLen-uint64(cidLen))
+	return c, nil
+}
@@ -0,0 +1,212 @@
+package blockstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	format "github.com/ipfs/go-ipld-format"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/internal/carv1"
+	"github.com/ipld/go-car/v2/internal/carv1/util"
+)
+
+var _ blockstore.Blockstore = (*Memory)(nil)
+
+// Memory is a blockstore.Blockstore that holds its blocks in memory, and serializes them as a
+// CARv2 on demand via WriteCarV2. It is intended for tests and small DAGs that are assembled in
+// memory before being written as a CAR; use ReadWrite for larger ones.
+//
+// See NewMemory.
+type Memory struct {
+	roots []cid.Cid
+	opts  carv2.Options
+	wopts []carv2.Option
+
+	mu sync.RWMutex
+	// blks holds the blocks in the order in which they were first put; deleted blocks are nil.
+	blks []blocks.Block
+	// keys maps the key of each block, as returned by key, to its position in blks.
+	keys map[string]int
+}
+
+// NewMemory instantiates an empty Memory blockstore, which serializes as a CAR with the given
+// roots. The roots need not be among the blocks put.
+//
+// Like ReadWrite, blocks are deduplicated by multihash unless UseWholeCIDs is enabled, and blocks
+// with multihash.IDENTITY code are not stored unless StoreIdentityCIDs is enabled; keys with
+// IDENTITY code are always reported as present. The options are also used when writing the CAR;
+// see WriteCarV2.
+func NewMemory(roots []cid.Cid, opts ...carv2.Option) *Memory {
+	return &Memory{
+		roots: roots,
+		opts:  carv2.ApplyOptions(opts...),
+		wopts: opts,
+		keys:  make(map[string]int),
+	}
+}
+
+// key returns the key by which blocks with the given CID are stored.
+func (m *Memory) key(c cid.Cid) string {
+	if m.opts.BlockstoreUseWholeCIDs {
+		return c.KeyString()
+	}
+	return string(c.Hash())
+}
+
+// Put puts the given block, unless a block with the same key is already present.
+func (m *Memory) Put(ctx context.Context, blk blocks.Block) error {
+	return m.PutMany(ctx, []blocks.Block{blk})
+}
+
+// PutMany puts the given blocks, as described by Put.
+func (m *Memory) PutMany(_ context.Context, blks []blocks.Block) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, blk := range blks {
+		c := blk.Cid()
+		if !m.opts.StoreIdentityCIDs {
+			if _, ok, err := isIdentity(c); err != nil {
+				return err
+			} else if ok {
+				continue
+			}
+		}
+		k := m.key(c)
+		if _, ok := m.keys[k]; ok {
+			continue
+		}
+		m.keys[k] = len(m.blks)
+		m.blks = append(m.blks, blk)
+	}
+	return nil
+}
+
+// get returns the block stored under the key of the given CID, if any.
+// The caller must hold m.mu.
+func (m *Memory) get(c cid.Cid) (blocks.Block, bool) {
+	i, ok := m.keys[m.key(c)]
+	if !ok {
+		return nil, false
+	}
+	return m.blks[i], true
+}
+
+// Has indicates if the store contains a block that corresponds to the given key.
+// This function always returns true for any given key with multihash.IDENTITY code.
+func (m *Memory) Has(_ context.Context, key cid.Cid) (bool, error) {
+	if _, ok, err := isIdentity(key); err != nil {
+		return false, err
+	} else if ok {
+		return true, nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.get(key)
+	return ok, nil
+}
+
+// Get gets the block corresponding to the given key, with the given key as its CID.
+func (m *Memory) Get(_ context.Context, key cid.Cid) (blocks.Block, error) {
+	if digest, ok, err := isIdentity(key); err != nil {
+		return nil, err
+	} else if ok {
+		return blocks.NewBlockWithCid(digest, key)
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	blk, ok := m.get(key)
+	if !ok {
+		return nil, format.ErrNotFound{Cid: key}
+	}
+	return blocks.NewBlockWithCid(blk.RawData(), key)
+}
+
+// GetSize gets the size of the block corresponding to the given key.
+func (m *Memory) GetSize(_ context.Context, key cid.Cid) (int, error) {
+	if digest, ok, err := isIdentity(key); err != nil {
+		return 0, err
+	} else if ok {
+		return len(digest), nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	blk, ok := m.get(key)
+	if !ok {
+		return 0, format.ErrNotFound{Cid: key}
+	}
+	return len(blk.RawData()), nil
+}
+
+// DeleteBlock deletes the block corresponding to the given key, if present.
+func (m *Memory) DeleteBlock(_ context.Context, key cid.Cid) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := m.key(key)
+	if i, ok := m.keys[k]; ok {
+		m.blks[i] = nil
+		delete(m.keys, k)
+	}
+	return nil
+}
+
+// snapshot returns the blocks present, in the order in which they were first put.
+func (m *Memory) snapshot() []blocks.Block {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	blks := make([]blocks.Block, 0, len(m.keys))
+	for _, blk := range m.blks {
+		if blk != nil {
+			blks = append(blks, blk)
+		}
+	}
+	return blks
+}
+
+// AllKeysChan returns the CIDs of the blocks present, as they were put, in the order in which they
+// were first put. The keys are those present when this function is called.
+func (m *Memory) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	blks := m.snapshot()
+	ch := make(chan cid.Cid, 5)
+	go func() {
+		defer close(ch)
+		for _, blk := range blks {
+			select {
+			case ch <- blk.Cid():
+			case <-ctx.Done():
+				maybeReportError(ctx, ctx.Err())
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// HashOnRead is a no-op, since blocks held in memory are not re-hashed.
+func (m *Memory) HashOnRead(bool) {}
+
+// Roots returns the roots of the CAR written by WriteCarV2.
+func (m *Memory) Roots() []cid.Cid {
+	return m.roots
+}
+
+// WriteCarV2 writes the blocks present as an indexed CARv2 to w, in the order in which they were
+// first put, with the roots given to NewMemory. The CARv1 data payload is assembled in memory and
+// wrapped as a CARv2 as described by carv2.WrapV1, generating its index according to the options
+// given to NewMemory, e.g. carv2.UseIndexCodec.
+func (m *Memory) WriteCarV2(w io.Writer) error {
+	var v1 bytes.Buffer
+	if err := carv1.WriteHeader(&carv1.CarHeader{Roots: m.roots, Version: 1}, &v1); err != nil {
+		return err
+	}
+	for _, blk := range m.snapshot() {
+		if err := util.LdWrite(&v1, blk.Cid().Bytes(), blk.RawData()); err != nil {
+			return err
+		}
+	}
+	return carv2.WrapV1(bytes.NewReader(v1.Bytes()), w, m.wopts...)
+}
@@ -0,0 +1,108 @@
+package blockstore
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemory(t *testing.T) {
+	ctx := context.TODO()
+	fish := merkledag.NewRawNode([]byte("fish"))
+	lobster := merkledag.NewRawNode([]byte("lobster"))
+	root := &merkledag.ProtoNode{}
+	require.NoError(t, root.AddNodeLink("fish", fish))
+	require.NoError(t, root.AddNodeLink("lobster", lobster))
+	idmh, err := multihash.Sum([]byte("inlined"), multihash.IDENTITY, -1)
+	require.NoError(t, err)
+	identity, err := blocks.NewBlockWithCid([]byte("inlined"), cid.NewCidV1(cid.Raw, idmh))
+	require.NoError(t, err)
+	want := []blocks.Block{root, fish, lobster}
+
+	subject := NewMemory([]cid.Cid{root.Cid()}, carv2.UseIndexCodec(multicodec.CarMultihashIndexSorted))
+	require.NoError(t, subject.Put(ctx, root))
+	require.NoError(t, subject.PutMany(ctx, []blocks.Block{fish, lobster, fish, identity}))
+	require.Equal(t, []cid.Cid{root.Cid()}, subject.Roots())
+
+	for _, blk := range want {
+		has, err := subject.Has(ctx, blk.Cid())
+		require.NoError(t, err)
+		require.True(t, has)
+		got, err := subject.Get(ctx, blk.Cid())
+		require.NoError(t, err)
+		require.Equal(t, blk.RawData(), got.RawData())
+		size, err := subject.GetSize(ctx, blk.Cid())
+		require.NoError(t, err)
+		require.Equal(t, len(blk.RawData()), size)
+	}
+
+	// Assert blocks are looked up by multihash, and identity CIDs are always present.
+	otherCodec := cid.NewCidV1(cid.DagCBOR, fish.Cid().Hash())
+	got, err := subject.Get(ctx, otherCodec)
+	require.NoError(t, err)
+	require.Equal(t, otherCodec, got.Cid())
+	got, err = subject.Get(ctx, identity.Cid())
+	require.NoError(t, err)
+	require.Equal(t, identity.RawData(), got.RawData())
+
+	// Assert keys are listed once each, in the order in which they were first put, without the
+	// identity CID since it is not stored.
+	keys, err := subject.AllKeysChan(ctx)
+	require.NoError(t, err)
+	var gotKeys []cid.Cid
+	for k := range keys {
+		gotKeys = append(gotKeys, k)
+	}
+	require.Equal(t, []cid.Cid{root.Cid(), fish.Cid(), lobster.Cid()}, gotKeys)
+
+	// Assert the CARv2 written is indexed, and holds all the blocks in order.
+	var buf bytes.Buffer
+	require.NoError(t, subject.WriteCarV2(&buf))
+	cr, err := carv2.NewReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.True(t, cr.Header.HasIndex())
+	robs, err := NewReadOnly(bytes.NewReader(buf.Bytes()), nil)
+	require.NoError(t, err)
+	roots, err := robs.Roots()
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{root.Cid()}, roots)
+	for _, blk := range want {
+		got, err := robs.Get(ctx, blk.Cid())
+		require.NoError(t, err)
+		require.Equal(t, blk.RawData(), got.RawData())
+	}
+	br, err := carv2.NewBlockReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	for _, blk := range want {
+		got, err := br.Next()
+		require.NoError(t, err)
+		require.Equal(t, blk.Cid(), got.Cid())
+	}
+
+	// Assert deleted blocks are no longer present, nor written.
+	require.NoError(t, subject.DeleteBlock(ctx, fish.Cid()))
+	_, err = subject.Get(ctx, fish.Cid())
+	require.True(t, format.IsNotFound(err))
+	has, err := subject.Has(ctx, fish.Cid())
+	require.NoError(t, err)
+	require.False(t, has)
+	buf.Reset()
+	require.NoError(t, subject.WriteCarV2(&buf))
+	robs, err = NewReadOnly(bytes.NewReader(buf.Bytes()), nil)
+	require.NoError(t, err)
+	has, err = robs.Has(ctx, fish.Cid())
+	require.NoError(t, err)
+	require.False(t, has)
+	has, err = robs.Has(ctx, lobster.Cid())
+	require.NoError(t, err)
+	require.True(t, has)
+}
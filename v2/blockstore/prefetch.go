@@ -0,0 +1,170 @@
+package blockstore
+
+import (
+	"bufio"
+	"container/list"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	carv2 "github.com/ipld/go-car/v2"
+)
+
+// prefetchBufferSize is the size of the buffer through which prefetched sections are read, such
+// that consecutive sections are read from the backing in few large reads.
+const prefetchBufferSize = 128 << 10 // 128 KiB
+
+// PrefetchWindow is a read option which makes a CAR blockstore prefetch the given number of
+// sections that follow a block read via Get, in the background. Prefetched blocks are kept in a
+// small LRU cache, of twice the window size, which subsequent calls to Get consult before reading
+// from the backing. This speeds up reading blocks roughly in the order in which they appear in the
+// CAR, e.g. when re-walking a DAG written in traversal order, especially from a backing with high
+// latency per read.
+//
+// At most one prefetch is in progress at a time; a Get made while prefetching does not schedule
+// another one. Prefetching is stopped on Close, which waits for any prefetch in progress.
+//
+// Note that this option only affects ReadOnly blockstores, and is ignored by the root go-car/v2
+// package. Prefetching is disabled by default, i.e. when the window is not positive.
+func PrefetchWindow(n int) carv2.Option {
+	return func(o *carv2.Options) {
+		o.BlockstorePrefetchWindow = n
+	}
+}
+
+// prefetchEntry is a section read ahead by a prefetcher.
+type prefetchEntry struct {
+	offset uint64
+	cid    cid.Cid
+	data   []byte
+	// next is the offset of the section that follows this one.
+	next uint64
+}
+
+// prefetcher reads sections of a CARv1 data payload ahead of the sections read by ReadOnly.Get,
+// and caches them by offset in an LRU cache.
+type prefetcher struct {
+	backing io.ReaderAt
+	window  int
+	opts    carv2.Options
+
+	mu       sync.Mutex
+	entries  map[uint64]*list.Element
+	lru      *list.List
+	inflight bool
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+func newPrefetcher(backing io.ReaderAt, opts carv2.Options) *prefetcher {
+	return &prefetcher{
+		backing: backing,
+		window:  opts.BlockstorePrefetchWindow,
+		opts:    opts,
+		entries: make(map[uint64]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns the cached section at the given offset, if any.
+func (p *prefetcher) get(offset uint64) (*prefetchEntry, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.entries[offset]
+	if !ok {
+		return nil, false
+	}
+	p.lru.MoveToFront(e)
+	return e.Value.(*prefetchEntry), true
+}
+
+func (p *prefetcher) put(entry *prefetchEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.entries[entry.offset]; ok {
+		p.lru.MoveToFront(e)
+		return
+	}
+	p.entries[entry.offset] = p.lru.PushFront(entry)
+	for p.lru.Len() > 2*p.window {
+		oldest := p.lru.Back()
+		p.lru.Remove(oldest)
+		delete(p.entries, oldest.Value.(*prefetchEntry).offset)
+	}
+}
+
+// schedule prefetches the window of sections starting at the given offset in the background,
+// unless a prefetch is already in progress. Sections that are already cached are not read again.
+func (p *prefetcher) schedule(offset uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.inflight || p.closed {
+		return
+	}
+	p.inflight = true
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() {
+			p.mu.Lock()
+			p.inflight = false
+			p.mu.Unlock()
+		}()
+		p.prefetch(offset)
+	}()
+}
+
+func (p *prefetcher) prefetch(offset uint64) {
+	var r *bufio.Reader
+	for i := 0; i < p.window; i++ {
+		p.mu.Lock()
+		closed := p.closed
+		p.mu.Unlock()
+		if closed {
+			return
+		}
+		if e, ok := p.get(offset); ok {
+			// Skip over the cached section, and read the ones after it afresh.
+			offset = e.next
+			r = nil
+			continue
+		}
+		if r == nil {
+			r = bufio.NewReaderSize(io.NewSectionReader(p.backing, int64(offset), math.MaxInt64-int64(offset)), prefetchBufferSize)
+		}
+		// Any error, including reaching the end of the payload, simply stops the prefetch; Get
+		// reads from the backing and reports errors as usual.
+		sectionLen, err := readSectionLength(r, p.opts)
+		if err != nil || sectionLen == 0 {
+			return
+		}
+		section := make([]byte, sectionLen)
+		if _, err := io.ReadFull(r, section); err != nil {
+			return
+		}
+		n, c, err := cid.CidFromBytes(section)
+		if err != nil {
+			return
+		}
+		data := section[n:]
+		next := offset + sectionSize(c, data, p.opts)
+		p.put(&prefetchEntry{offset: offset, cid: c, data: data, next: next})
+		offset = next
+	}
+}
+
+// close stops prefetching and waits for any prefetch in progress.
+func (p *prefetcher) close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+// sectionSize returns the size in bytes of the section holding the given CID and block data,
+// including its length prefix in the format set via carv2.UseSectionLengthFormat.
+func sectionSize(c cid.Cid, data []byte, opts carv2.Options) uint64 {
+	l := uint64(c.ByteLen() + len(data))
+	return uint64(sectionLengthSize(l, opts)) + l
+}
@@ -1,12 +1,18 @@
 package blockstore
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
@@ -17,6 +23,8 @@ import (
 	"github.com/ipld/go-car/v2/internal/carv1"
 	"github.com/ipld/go-car/v2/internal/carv1/util"
 	internalio "github.com/ipld/go-car/v2/internal/io"
+	internalmmap "github.com/ipld/go-car/v2/internal/mmap"
+	"github.com/multiformats/go-multicodec"
 	"github.com/multiformats/go-multihash"
 	"github.com/multiformats/go-varint"
 	"golang.org/x/exp/mmap"
@@ -31,7 +39,21 @@ var (
 )
 
 // ReadOnly provides a read-only CAR Block Store.
+//
+// ReadOnly is safe for concurrent use: Get, Has, HasMany, GetSize and AllKeysChan only read from
+// the index and the backing data payload. Each lookup reads the backing via its own reader that
+// tracks its own position and only calls io.ReaderAt.ReadAt on the backing, which per the
+// io.ReaderAt contract is safe to call in parallel. This includes the memory-mapped backing used by
+// OpenReadOnly, which is safe for concurrent reads while the blockstore remains open.
 type ReadOnly struct {
+	// verified and verifyFailed count the blocks hashed on read by Get that matched and did not
+	// match their key respectively. They are accessed atomically, and are first in the struct to
+	// be 64-bit aligned. See VerificationStats.
+	verified     uint64
+	verifyFailed uint64
+	// hashOnRead is 1 if Get hashes blocks on read, accessed atomically. See HashOnRead.
+	hashOnRead uint32
+
 	// mu allows ReadWrite to be safe for concurrent use.
 	// It's in ReadOnly so that read operations also grab read locks,
 	// given that ReadWrite embeds ReadOnly for methods like Get and Has.
@@ -47,6 +69,8 @@ type ReadOnly struct {
 
 	// The backing containing the data payload in CARv1 format.
 	backing io.ReaderAt
+	// The offset of the data payload within the CAR, i.e. zero unless the CAR is a CARv2.
+	dataOffset uint64
 
 	// The CARv1 content index.
 	idx index.Index
@@ -54,6 +78,15 @@ type ReadOnly struct {
 	// If we called carv2.NewReaderMmap, remember to close it too.
 	carv2Closer io.Closer
 
+	// prefetch reads sections ahead of Get, or is nil if prefetching is disabled.
+	// See PrefetchWindow.
+	prefetch *prefetcher
+
+	// keysErr is the error that stopped the last AllKeysChan enumeration, guarded by keysErrMu
+	// since enumerations only hold a read lock on mu.
+	keysErrMu sync.Mutex
+	keysErr   error
+
 	opts carv2.Options
 }
 
@@ -85,6 +118,59 @@ func UseWholeCIDs(enable bool) carv2.Option {
 	}
 }
 
+// EquivalentCidVersions is a read option which makes a CAR blockstore with UseWholeCIDs enabled
+// treat the CIDv0 and CIDv1 forms of a dag-pb block as the same CID when looking up blocks, such
+// that e.g. Get succeeds with a CIDv0 key for a block stored under the equivalent CIDv1, and vice
+// versa. Blocks are still returned with the CID they are looked up by. CIDs are compared in their
+// normalized form as defined by index.NormalizeCid, i.e. CIDs of other codecs, including raw, must
+// still be equal.
+//
+// Without UseWholeCIDs, blocks are matched by multihash and this option has no effect. Note that
+// this option only affects lookups; AllKeysChan returns CIDs as stored, and Put deduplicates as
+// usual. It is ignored by the root go-car/v2 package.
+//
+// This option is disabled by default.
+func EquivalentCidVersions(enable bool) carv2.Option {
+	return func(o *carv2.Options) {
+		o.BlockstoreEquivalentCidVersions = enable
+	}
+}
+
+// TrustedReads is a read option which makes ReadOnly.GetRaw trust that the section at each offset
+// found in the index holds exactly the CID looked up, such that the CID of the section is skipped
+// over using the encoded length of the given CID, without being read or compared.
+// This avoids the cost of reading and comparing CIDs when serving blocks of a CAR that is known to
+// be well-formed, e.g. one that has been verified upon receipt.
+//
+// Since indices match blocks by multihash, the given CID must be encoded exactly as in the CAR,
+// e.g. as returned by AllKeysChan with UseWholeCIDs enabled; a CID of another version or codec
+// that shares the multihash would cause the wrong bytes to be returned. Note that this option
+// only affects GetRaw, and is ignored by the root go-car/v2 package.
+//
+// This option is disabled by default.
+func TrustedReads(enable bool) carv2.Option {
+	return func(o *carv2.Options) {
+		o.BlockstoreTrustedReads = enable
+	}
+}
+
+// WithNotFoundError is a read option which makes a CAR blockstore return errors that also match
+// the given sentinel via errors.Is when a block is not found, in addition to format.ErrNotFound.
+// This allows interoperability with code that checks for the sentinel not-found error defined by
+// older versions of go-ipfs-blockstore, e.g. blockstore.ErrNotFound, while still returning an error
+// that carries the CID of the block, as expected by newer versions.
+//
+// The returned errors can be unwrapped into format.ErrNotFound via errors.As. By default, i.e. if
+// the given sentinel is nil, format.ErrNotFound is returned as is.
+//
+// Note that this option only affects the blockstore, and is ignored by the root
+// go-car/v2 package.
+func WithNotFoundError(sentinel error) carv2.Option {
+	return func(o *carv2.Options) {
+		o.BlockstoreNotFoundError = sentinel
+	}
+}
+
 // NewReadOnly creates a new ReadOnly blockstore from the backing with a optional index as idx.
 // This function accepts both CARv1 and CARv2 backing.
 // The blockstore is instantiated with the given index if it is not nil.
@@ -93,8 +179,69 @@ func UseWholeCIDs(enable bool) carv2.Option {
 // * For a CARv1 backing an index is generated.
 // * For a CARv2 backing an index is only generated if Header.HasIndex returns false.
 //
+// An index read from a CARv2 backing with absolute offsets is rebased onto its data payload, while
+// a given index must always have offsets relative to the data payload.
+// See carv2.UseAbsoluteIndexOffsets.
+//
 // There is no need to call ReadOnly.Close on instances returned by this function.
+//
+// Concurrent use of the returned blockstore requires that backing honours the io.ReaderAt
+// contract of allowing parallel ReadAt calls, as os.File and bytes.Reader do.
 func NewReadOnly(backing io.ReaderAt, idx index.Index, opts ...carv2.Option) (*ReadOnly, error) {
+	return newReadOnly(backing, idx, false, opts...)
+}
+
+// OpenReadOnlyFromSeeker creates a new ReadOnly blockstore backed by rs, for sources that can seek
+// but not read at a position, such as some network-backed or decompressing readers. The
+// blockstore is instantiated as described by NewReadOnly, with the given optional index.
+//
+// Reads at a position are implemented by seeking rs and reading from it while holding a lock, so
+// rs need not be safe for concurrent use. Consequently, concurrent lookups on the returned
+// blockstore are serialised while reading from rs, which makes this less efficient under
+// concurrency than backing the blockstore with an io.ReaderAt; prefer NewReadOnly when one is
+// available. If rs implements io.ReaderAt, it is used as such.
+//
+// The position of rs is changed by the blockstore; rs must not be read from otherwise while it is
+// in use. There is no need to call ReadOnly.Close on instances returned by this function, and rs
+// is not closed by it.
+func OpenReadOnlyFromSeeker(rs io.ReadSeeker, idx index.Index, opts ...carv2.Option) (*ReadOnly, error) {
+	return NewReadOnly(internalio.ToReaderAt(rs), idx, opts...)
+}
+
+// OpenReadOnlyAt creates a new ReadOnly blockstore from a CAR (either v1 or v2) embedded within a
+// larger source, such as a section of an archive or container format, without extracting it first.
+// The CAR is the byte range [baseOffset, baseOffset+length) of ra; reads are shifted by baseOffset
+// and bounded to the range. Offsets in the index, whether embedded or generated, are relative to
+// the CAR as usual, i.e. to baseOffset, rather than to the start of ra.
+//
+// If attachIndex is true, the index embedded in a CARv2 is used if it has one, as by NewReadOnly.
+// Otherwise, an index is always generated from the data payload, ignoring any embedded one, e.g.
+// if it is not trusted. In either case, an index is generated for a CARv1.
+//
+// There is no need to call ReadOnly.Close on instances returned by this function, and ra is not
+// closed by it.
+func OpenReadOnlyAt(ra io.ReaderAt, baseOffset, length int64, attachIndex bool, opts ...carv2.Option) (*ReadOnly, error) {
+	if baseOffset < 0 {
+		return nil, fmt.Errorf("base offset must not be negative; got %d", baseOffset)
+	}
+	if length <= 0 {
+		return nil, fmt.Errorf("length must be positive; got %d", length)
+	}
+	if attachIndex {
+		return NewReadOnly(io.NewSectionReader(ra, baseOffset, length), nil, opts...)
+	}
+	// Generate the index through a separate section reader, since reading moves its position, from
+	// which NewReadOnly would then read the version.
+	idx, err := generateIndex(io.NewSectionReader(ra, baseOffset, length), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewReadOnly(io.NewSectionReader(ra, baseOffset, length), idx, opts...)
+}
+
+// newReadOnly instantiates a ReadOnly as described by NewReadOnly. If lazy is true, an index that
+// needs to be generated is generated lazily, as lookups are made; see newLazyIndex.
+func newReadOnly(backing io.ReaderAt, idx index.Index, lazy bool, opts ...carv2.Option) (*ReadOnly, error) {
 	b := &ReadOnly{
 		opts: carv2.ApplyOptions(opts...),
 	}
@@ -105,13 +252,16 @@ func NewReadOnly(backing io.ReaderAt, idx index.Index, opts ...carv2.Option) (*R
 	}
 	switch version {
 	case 1:
-		if idx == nil {
+		if idx == nil && lazy {
+			idx = newLazyIndex(backing, b.opts)
+		} else if idx == nil {
 			if idx, err = generateIndex(backing, opts...); err != nil {
 				return nil, err
 			}
 		}
 		b.backing = backing
 		b.idx = idx
+		b.initPrefetch()
 		return b, nil
 	case 2:
 		v2r, err := carv2.NewReader(backing, opts...)
@@ -128,12 +278,20 @@ func NewReadOnly(backing io.ReaderAt, idx index.Index, opts ...carv2.Option) (*R
 				if err != nil {
 					return nil, err
 				}
+				// Lookups are made relative to the data payload; rebase absolute offsets onto it.
+				if v2r.Header.Characteristics.HasAbsoluteIndexOffsets() {
+					if idx, err = index.Rebase(idx, -int64(v2r.Header.DataOffset)); err != nil {
+						return nil, err
+					}
+				}
 			} else {
 				dr, err := v2r.DataReader()
 				if err != nil {
 					return nil, err
 				}
-				if idx, err = generateIndex(dr, opts...); err != nil {
+				if lazy {
+					idx = newLazyIndex(dr, b.opts)
+				} else if idx, err = generateIndex(dr, opts...); err != nil {
 					return nil, err
 				}
 			}
@@ -142,13 +300,22 @@ func NewReadOnly(backing io.ReaderAt, idx index.Index, opts ...carv2.Option) (*R
 		if err != nil {
 			return nil, err
 		}
+		b.dataOffset = v2r.Header.DataOffset
 		b.idx = idx
+		b.initPrefetch()
 		return b, nil
 	default:
 		return nil, fmt.Errorf("unsupported car version: %v", version)
 	}
 }
 
+// initPrefetch enables prefetching from the backing if configured; see PrefetchWindow.
+func (b *ReadOnly) initPrefetch() {
+	if b.opts.BlockstorePrefetchWindow > 0 {
+		b.prefetch = newPrefetcher(b.backing, b.opts)
+	}
+}
+
 func readVersion(at io.ReaderAt, opts ...carv2.Option) (uint64, error) {
 	var rr io.Reader
 	switch r := at.(type) {
@@ -203,12 +370,430 @@ func OpenReadOnly(path string, opts ...carv2.Option) (*ReadOnly, error) {
 	return robs, nil
 }
 
-func (b *ReadOnly) readBlock(idx int64) (cid.Cid, []byte, error) {
-	r, err := internalio.NewOffsetReadSeeker(b.backing, idx)
+// DecompressGzipInMemory is a read option which makes OpenReadOnlyGzip decompress the CAR into
+// memory instead of into a temporary file. This avoids the need for temporary space at the cost of
+// holding the entire uncompressed CAR in memory, and is therefore best suited to small CARs.
+//
+// Note that this option only affects OpenReadOnlyGzip, and is ignored by the root go-car/v2
+// package.
+//
+// This option is disabled by default.
+func DecompressGzipInMemory(enable bool) carv2.Option {
+	return func(o *carv2.Options) {
+		o.BlockstoreGzipInMemory = enable
+	}
+}
+
+// OpenReadOnlyGzip opens a read-only blockstore from a CAR file (either v1 or v2) that is
+// gzip-compressed as a whole, such as a .car.gz file, removing the need to decompress it manually
+// before opening it.
+//
+// Since a gzip stream can only be read sequentially, the CAR is decompressed in full upon opening
+// in order to provide random access to its blocks. By default it is decompressed into a temporary
+// file in the directory returned by os.TempDir, which therefore requires as much free space as the
+// size of the uncompressed CAR; the file is removed by ReadOnly.Close. Alternatively, the CAR can
+// be decompressed into memory instead; see DecompressGzipInMemory. In either case, an index is then
+// read or generated as described by OpenReadOnly.
+//
+// See car.NewBlockReaderGzip for streaming the blocks of such a CAR with no temporary space.
+func OpenReadOnlyGzip(path string, opts ...carv2.Option) (*ReadOnly, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	if carv2.ApplyOptions(opts...).BlockstoreGzipInMemory {
+		data, err := io.ReadAll(zr)
+		if err != nil {
+			return nil, err
+		}
+		return NewReadOnly(bytes.NewReader(data), nil, opts...)
+	}
+
+	tmp, err := os.CreateTemp("", "go-car-gzip-*.car")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(tmp, zr)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	mf, err := mmap.Open(tmp.Name())
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	robs, err := NewReadOnly(mf, nil, opts...)
+	if err != nil {
+		mf.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	robs.carv2Closer = &tempFileCloser{Closer: mf, path: tmp.Name()}
+	return robs, nil
+}
+
+// tempFileCloser is an io.Closer that removes the temporary file at path once the wrapped
+// io.Closer over it is closed.
+type tempFileCloser struct {
+	io.Closer
+	path string
+}
+
+func (t *tempFileCloser) Close() error {
+	err := t.Closer.Close()
+	if rerr := os.Remove(t.path); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// OpenReadOnlyWithIndexPreference opens a read-only blockstore from a CAR file (either v1 or v2),
+// similar to OpenReadOnly, except that the index is chosen according to the given codec
+// preference. This allows different workloads to use different index structures over the same CAR
+// without rewriting it.
+//
+// The available indices are the one embedded in a CARv2, if any, and the standalone indices at the
+// given sidecar paths, as written by index.WriteTo, e.g. via car.WriteV1WithSidecar. Sidecar paths
+// that do not exist are ignored. Only the codec of each index is read to make a choice, and the
+// first preferred codec that is available is used, with the embedded index taking precedence over
+// sidecars of the same codec. If none of the preferred codecs is available, an index is read or
+// generated as described by OpenReadOnly.
+//
+// Sidecar indices must have offsets relative to the data payload of the CAR.
+func OpenReadOnlyWithIndexPreference(path string, prefer []multicodec.Code, sidecarPaths []string, opts ...carv2.Option) (*ReadOnly, error) {
+	f, err := mmap.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := readPreferredIndex(f, prefer, sidecarPaths, opts...)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	robs, err := NewReadOnly(f, idx, opts...)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	robs.carv2Closer = f
+	return robs, nil
+}
+
+// readPreferredIndex reads the first index available in the order of the given codec preference,
+// as described by OpenReadOnlyWithIndexPreference. A nil index is returned if none is available,
+// or if the preferred index is embedded in the CARv2 read from backing, which is then read by
+// NewReadOnly as usual.
+func readPreferredIndex(backing io.ReaderAt, prefer []multicodec.Code, sidecarPaths []string, opts ...carv2.Option) (index.Index, error) {
+	var embedded multicodec.Code
+	var hasEmbedded bool
+	version, err := readVersion(backing, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if version == 2 {
+		v2r, err := carv2.NewReader(backing, opts...)
+		if err != nil {
+			return nil, err
+		}
+		if v2r.Header.HasIndex() {
+			ir, err := v2r.IndexReader()
+			if err != nil {
+				return nil, err
+			}
+			if embedded, err = index.ReadCodec(ir); err != nil {
+				return nil, err
+			}
+			hasEmbedded = true
+		}
+	}
+
+	sidecars := make(map[multicodec.Code]string)
+	for _, p := range sidecarPaths {
+		codec, err := readIndexCodecFromFile(p)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if _, ok := sidecars[codec]; !ok {
+			sidecars[codec] = p
+		}
+	}
+
+	for _, codec := range prefer {
+		if hasEmbedded && codec == embedded {
+			return nil, nil
+		}
+		if p, ok := sidecars[codec]; ok {
+			f, err := os.Open(p)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			return index.ReadFrom(bufio.NewReader(f))
+		}
+	}
+	return nil, nil
+}
+
+func readIndexCodecFromFile(path string) (multicodec.Code, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return index.ReadCodec(f)
+}
+
+// OpenReadOnlyLazy opens a read-only blockstore from a CAR file (either v1 or v2), similar to
+// OpenReadOnly, except that an index that does not exist is generated lazily rather than upfront.
+// This avoids reading the entire file when only a few blocks are looked up, e.g. in huge CARs
+// without an index.
+//
+// The data payload is scanned on demand: a lookup for a block that has not been indexed yet reads
+// sections onwards from where the previous scan stopped, indexing each of them, until the block is
+// found. Therefore, the cost of indexing is paid by lookups as they are made, and a lookup for a
+// block that is absent reads the remainder of the payload. Once the whole payload has been
+// scanned, lookups perform the same as with a generated index.
+//
+// Lookups that scan the payload are serialized; see ReadOnly for concurrent use otherwise.
+func OpenReadOnlyLazy(path string, opts ...carv2.Option) (*ReadOnly, error) {
+	f, err := mmap.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	robs, err := newReadOnly(f, nil, true, opts...)
+	if err != nil {
+		return nil, err
+	}
+	robs.carv2Closer = f
+
+	return robs, nil
+}
+
+// OpenReadOnlyMmap opens a read-only blockstore from a CAR file (either v1 or v2), similar to
+// OpenReadOnly, except that a single memory mapping of the file serves both the data payload and
+// the index. If the CAR is a CARv2 with an embedded index.MappableIndexSorted, the index is used in
+// place, sliced out of the mapping without copying it onto the heap, and lookups only touch the
+// pages of the index needed for their binary search. This reduces the resident memory of opening
+// CARs with large indices.
+//
+// Other embedded index codecs, and indices with absolute offsets, are read as described by
+// OpenReadOnly, i.e. copied onto the heap, as is an index that needs to be generated. So are all
+// indices on platforms other than linux and darwin, where the file is opened via
+// golang.org/x/exp/mmap, which does not expose the mapped bytes. See
+// car.UseIndexCodec for writing CARs with an index.MappableIndexSorted.
+//
+// Note that, as with index.NewMappableIndexSortedFromBytes, the ordering of the records of an index
+// used in place is not validated.
+func OpenReadOnlyMmap(path string, opts ...carv2.Option) (*ReadOnly, error) {
+	f, err := internalmmap.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := mappedIndex(f, opts...)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	robs, err := newReadOnly(f, idx, false, opts...)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	robs.carv2Closer = f
+
+	return robs, nil
+}
+
+// mappedIndex returns the index.MappableIndexSorted embedded in the given mapped CAR, backed by
+// the mapping itself, or nil if the CAR has no such index with offsets relative to its data payload
+// or the mapped bytes are not exposed.
+func mappedIndex(f *internalmmap.ReaderAt, opts ...carv2.Option) (index.Index, error) {
+	if f.Bytes() == nil {
+		return nil, nil
+	}
+	version, err := readVersion(f, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if version != 2 {
+		return nil, nil
+	}
+	v2r, err := carv2.NewReader(f, opts...)
+	if err != nil {
+		return nil, err
+	}
+	h := v2r.Header
+	if !h.HasIndex() || h.Characteristics.HasAbsoluteIndexOffsets() || h.IndexOffset >= uint64(f.Len()) {
+		return nil, nil
+	}
+	data := f.Bytes()[h.IndexOffset:]
+	codec, n, err := varint.FromUvarint(data)
+	if err != nil {
+		return nil, err
+	}
+	if multicodec.Code(codec) != index.CarMappableIndexSorted {
+		return nil, nil
+	}
+	return index.NewMappableIndexSortedFromBytes(data[n:])
+}
+
+// readSectionLength reads the length prefix of a section from r in the format set via
+// carv2.UseSectionLengthFormat.
+func readSectionLength(r io.ByteReader, opts carv2.Options) (uint64, error) {
+	if opts.SectionLengthFormat == carv2.SectionLengthFixed32 {
+		return util.ReadSectionLengthFixed32(r, opts.MaxAllowedSectionSize)
+	}
+	return util.ReadSectionLength(r, opts.MaxAllowedSectionSize)
+}
+
+// decodeSectionLength decodes the length prefix of a section at the start of buf in the format set
+// via carv2.UseSectionLengthFormat, and returns it along with the size of the prefix.
+func decodeSectionLength(buf []byte, opts carv2.Options) (uint64, int, error) {
+	if opts.SectionLengthFormat == carv2.SectionLengthFixed32 {
+		if len(buf) < 4 {
+			return 0, 0, io.ErrUnexpectedEOF
+		}
+		return uint64(binary.BigEndian.Uint32(buf)), 4, nil
+	}
+	return varint.FromUvarint(buf)
+}
+
+// sectionLengthSize returns the size of the length prefix of a section of the given length in the
+// format set via carv2.UseSectionLengthFormat.
+func sectionLengthSize(l uint64, opts carv2.Options) int {
+	if opts.SectionLengthFormat == carv2.SectionLengthFixed32 {
+		return 4
+	}
+	return varint.UvarintSize(l)
+}
+
+// readSection reads the length and CID of the section at the given offset of the backing, and
+// returns a reader positioned at the start of the section's block data along with its length.
+// Failures to decode the section are returned as ErrOffsetOutOfBounds or ErrCorruptCar.
+func (b *ReadOnly) readSection(offset uint64) (io.Reader, cid.Cid, int, error) {
+	at, err := internalio.AddOffset(0, offset)
+	if err != nil {
+		return nil, cid.Undef, 0, &ErrCorruptCar{Offset: offset, Err: err}
+	}
+	rdr, err := internalio.NewOffsetReadSeeker(b.backing, at)
 	if err != nil {
-		return cid.Cid{}, nil, err
+		return nil, cid.Undef, 0, err
+	}
+	sectionLen, err := readSectionLength(rdr, b.opts)
+	if err == io.EOF {
+		return nil, cid.Undef, 0, &ErrOffsetOutOfBounds{Offset: offset}
+	} else if err != nil {
+		return nil, cid.Undef, 0, &ErrCorruptCar{Offset: offset, Err: err}
+	}
+	if sectionLen == 0 {
+		if b.opts.ZeroLengthSectionAsEOF {
+			// The zero-length section marks the end of the payload.
+			return nil, cid.Undef, 0, &ErrOffsetOutOfBounds{Offset: offset}
+		}
+		return nil, cid.Undef, 0, &ErrCorruptCar{Offset: offset, Err: errZeroLengthSection}
 	}
-	return util.ReadNode(r, b.opts.ZeroLengthSectionAsEOF, b.opts.MaxAllowedSectionSize)
+	cidLen, c, err := cid.CidFromReader(rdr)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, cid.Undef, 0, &ErrCorruptCar{Offset: offset, Err: err}
+	}
+	if uint64(cidLen) > sectionLen {
+		err = fmt.Errorf("cid length %d exceeds section length %d", cidLen, sectionLen)
+		return nil, cid.Undef, 0, &ErrCorruptCar{Offset: offset, Err: err}
+	}
+	return rdr, c, int(sectionLen) - cidLen, nil
+}
+
+func (b *ReadOnly) readBlock(offset uint64) (cid.Cid, []byte, error) {
+	r, c, dataLen, err := b.readSection(offset)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+	data := make([]byte, dataLen)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return cid.Undef, nil, &ErrCorruptCar{Offset: offset, Err: err}
+	}
+	return c, data, nil
+}
+
+// cidBufPool pools the buffers used by cidBytesEqual to read encoded CIDs.
+var cidBufPool = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+// cidBytesEqual reports whether the section at the given offset of the backing holds exactly the
+// CID key, by comparing the encoded bytes of the CID in place, i.e. without decoding the section
+// CID into a cid.Cid, which allocates. If so, the length of the block data in the section is also
+// returned.
+//
+// False is returned if the section holds another CID or cannot be read, in which case callers
+// should fall back onto readSection, which matches CIDs by multihash when needed and reports
+// errors as expected.
+func (b *ReadOnly) cidBytesEqual(offset uint64, key cid.Cid) (bool, int) {
+	keyStr := key.KeyString()
+	bufp := cidBufPool.Get().(*[]byte)
+	defer cidBufPool.Put(bufp)
+	need := binary.MaxVarintLen64 + len(keyStr)
+	if cap(*bufp) < need {
+		*bufp = make([]byte, need)
+	}
+	buf := (*bufp)[:need]
+	at, err := internalio.AddOffset(0, offset)
+	if err != nil {
+		return false, 0
+	}
+	// A short read is expected near the end of the backing; the bytes read are checked below.
+	n, _ := b.backing.ReadAt(buf, at)
+	buf = buf[:n]
+
+	sectionLen, vn, err := decodeSectionLength(buf, b.opts)
+	if err != nil || sectionLen > b.opts.MaxAllowedSectionSize || sectionLen < uint64(len(keyStr)) {
+		return false, 0
+	}
+	if len(buf)-vn < len(keyStr) || string(buf[vn:vn+len(keyStr)]) != keyStr {
+		return false, 0
+	}
+	return true, int(sectionLen) - len(keyStr)
+}
+
+// prefetchedBlock returns the section at the given offset if it has been prefetched.
+func (b *ReadOnly) prefetchedBlock(offset uint64) (*prefetchEntry, bool) {
+	if b.prefetch == nil {
+		return nil, false
+	}
+	return b.prefetch.get(offset)
+}
+
+// matchCid reports whether the CID read from an indexed section identifies the block looked up by
+// key. Since the index only yields offsets of sections with the multihash of key, a section with a
+// different multihash is reported as ErrCidMismatch.
+func (b *ReadOnly) matchCid(key, readCid cid.Cid) (bool, error) {
+	if !bytes.Equal(readCid.Hash(), key.Hash()) {
+		return false, &ErrCidMismatch{Expected: key, Got: readCid}
+	}
+	if b.opts.BlockstoreUseWholeCIDs {
+		if b.opts.BlockstoreEquivalentCidVersions {
+			return index.NormalizeCid(readCid).Equals(index.NormalizeCid(key)), nil
+		}
+		return readCid.Equals(key), nil
+	}
+	return true, nil
 }
 
 // DeleteBlock is unsupported and always errors.
@@ -218,6 +803,9 @@ func (b *ReadOnly) DeleteBlock(_ context.Context, _ cid.Cid) error {
 
 // Has indicates if the store contains a block that corresponds to the given key.
 // This function always returns true for any given key with multihash.IDENTITY code.
+//
+// An indexed section that cannot be read is reported as ErrOffsetOutOfBounds, ErrCorruptCar or
+// ErrCidMismatch, which can be inspected via errors.As; the same applies to Get and GetSize.
 func (b *ReadOnly) Has(ctx context.Context, key cid.Cid) (bool, error) {
 	// Check if the given CID has multihash.IDENTITY code
 	// Note, we do this without locking, since there is no shared information to lock for in order to perform the check.
@@ -234,31 +822,69 @@ func (b *ReadOnly) Has(ctx context.Context, key cid.Cid) (bool, error) {
 		return false, errClosed
 	}
 
+	return b.has(key)
+}
+
+// HasMany indicates, for each of the given keys, whether the store contains a corresponding block.
+// The returned slice is parallel to keys, i.e. the i-th element reports whether keys[i] is present.
+//
+// All lookups are performed while holding the lock once, in ascending order of key multihash, so
+// that consecutive lookups into a sorted index touch nearby regions of it.
+// Similar to Has, keys with multihash.IDENTITY code are always reported as present.
+func (b *ReadOnly) HasMany(ctx context.Context, keys []cid.Cid) ([]bool, error) {
+	found := make([]bool, len(keys))
+
+	// Filter out IDENTITY CIDs first; like Has, these do not need the lock.
+	pending := make([]int, 0, len(keys))
+	for i, key := range keys {
+		if _, ok, err := isIdentity(key); err != nil {
+			return nil, err
+		} else if ok {
+			found[i] = true
+		} else {
+			pending = append(pending, i)
+		}
+	}
+	if len(pending) == 0 {
+		return found, nil
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return bytes.Compare(keys[pending[i]].Hash(), keys[pending[j]].Hash()) < 0
+	})
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return nil, errClosed
+	}
+
+	for _, i := range pending {
+		has, err := b.has(keys[i])
+		if err != nil {
+			return nil, err
+		}
+		found[i] = has
+	}
+	return found, nil
+}
+
+// has checks whether the given non-IDENTITY key is present in the index and the backing payload.
+// The caller must hold b.mu.
+func (b *ReadOnly) has(key cid.Cid) (bool, error) {
 	var fnFound bool
 	var fnErr error
 	err := b.idx.GetAll(key, func(offset uint64) bool {
-		uar, err := internalio.NewOffsetReadSeeker(b.backing, int64(offset))
-		if err != nil {
-			fnErr = err
-			return false
-		}
-		_, err = varint.ReadUvarint(uar)
-		if err != nil {
-			fnErr = err
+		if fnFound, _ = b.cidBytesEqual(offset, key); fnFound {
 			return false
 		}
-		_, readCid, err := cid.CidFromReader(uar)
+		_, readCid, _, err := b.readSection(offset)
 		if err != nil {
 			fnErr = err
 			return false
 		}
-		if b.opts.BlockstoreUseWholeCIDs {
-			fnFound = readCid.Equals(key)
-			return !fnFound // continue looking if we haven't found it
-		} else {
-			fnFound = bytes.Equal(readCid.Hash(), key.Hash())
-			return false
-		}
+		fnFound, fnErr = b.matchCid(key, readCid)
+		return !fnFound && fnErr == nil // continue looking if we haven't found it
 	})
 	if errors.Is(err, index.ErrNotFound) {
 		return false, nil
@@ -287,41 +913,295 @@ func (b *ReadOnly) Get(ctx context.Context, key cid.Cid) (blocks.Block, error) {
 	}
 
 	var fnData []byte
+	var fnFound bool
 	var fnErr error
 	err := b.idx.GetAll(key, func(offset uint64) bool {
-		readCid, data, err := b.readBlock(int64(offset))
+		var readCid cid.Cid
+		var data []byte
+		if e, ok := b.prefetchedBlock(offset); ok {
+			readCid, data = e.cid, e.data
+		} else {
+			var err error
+			if readCid, data, err = b.readBlock(offset); err != nil {
+				fnErr = err
+				return false
+			}
+		}
+		match, err := b.matchCid(key, readCid)
 		if err != nil {
 			fnErr = err
 			return false
 		}
-		if b.opts.BlockstoreUseWholeCIDs {
-			if readCid.Equals(key) {
-				fnData = data
-				return false
-			} else {
-				return true // continue looking
-			}
-		} else {
-			if bytes.Equal(readCid.Hash(), key.Hash()) {
-				fnData = data
+		if match {
+			fnData, fnFound = data, true
+			if b.prefetch != nil {
+				b.prefetch.schedule(offset + sectionSize(readCid, data, b.opts))
 			}
 			return false
 		}
+		return true // continue looking
 	})
 	if errors.Is(err, index.ErrNotFound) {
-		return nil, format.ErrNotFound{Cid: key}
+		return nil, b.notFound(key)
 	} else if err != nil {
-		return nil, format.ErrNotFound{Cid: key}
+		return nil, b.notFound(key)
 	} else if fnErr != nil {
 		return nil, fnErr
 	}
-	if fnData == nil {
-		return nil, format.ErrNotFound{Cid: key}
+	if !fnFound {
+		return nil, b.notFound(key)
+	}
+	if atomic.LoadUint32(&b.hashOnRead) == 1 {
+		if err := b.verifyBlock(key, fnData); err != nil {
+			return nil, err
+		}
 	}
 	return blocks.NewBlockWithCid(fnData, key)
 }
 
+// GetWithChildren gets the block corresponding to the given key along with the blocks it links to,
+// allowing a DAG to be walked one level at a time with a single call per node. The children are
+// returned in the order in which the block links to them, omitting any that are not present in
+// this blockstore and any repeated links.
+//
+// Blocks with the raw codec have no links; all other blocks are decoded using the decoders
+// registered with go-ipld-format in order to discover their links, and an error is returned if the
+// block cannot be decoded. If the block itself is not found, the not found error is returned as by
+// Get.
+func (b *ReadOnly) GetWithChildren(ctx context.Context, key cid.Cid) (blocks.Block, []blocks.Block, error) {
+	blk, err := b.Get(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if blk.Cid().Prefix().Codec == cid.Raw {
+		return blk, nil, nil
+	}
+	nd, err := format.Decode(blk)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode block %s: %w", key, err)
+	}
+	var children []blocks.Block
+	seen := make(map[cid.Cid]struct{}, len(nd.Links()))
+	for _, l := range nd.Links() {
+		if _, ok := seen[l.Cid]; ok {
+			continue
+		}
+		seen[l.Cid] = struct{}{}
+		child, err := b.Get(ctx, l.Cid)
+		if err != nil {
+			if format.IsNotFound(err) {
+				continue
+			}
+			return nil, nil, err
+		}
+		children = append(children, child)
+	}
+	return blk, children, nil
+}
+
+// GetRaw returns the data of the block identified by key, without wrapping it in a blocks.Block.
+//
+// Unlike Get, the CID of the section found in the index is not decoded; instead it is compared
+// with key in its encoded form, and skipped over using the encoded length of key. A section whose
+// CID differs from key in encoding only, e.g. by version, is still matched by multihash unless
+// UseWholeCIDs is enabled, at the cost of decoding its CID. When TrustedReads is enabled the
+// comparison is skipped altogether, and the data of the first section found in the index is
+// returned. See TrustedReads.
+func (b *ReadOnly) GetRaw(key cid.Cid) ([]byte, error) {
+	// Check if the given CID has multihash.IDENTITY code
+	// Note, we do this without locking, since there is no shared information to lock for in order to perform the check.
+	if digest, ok, err := isIdentity(key); err != nil {
+		return nil, err
+	} else if ok {
+		return digest, nil
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return nil, errClosed
+	}
+
+	var fnData []byte
+	var fnFound bool
+	var fnErr error
+	err := b.idx.GetAll(key, func(offset uint64) bool {
+		if b.opts.BlockstoreTrustedReads {
+			fnData, fnErr = b.readRawData(offset, key.ByteLen())
+			fnFound = fnErr == nil
+			return false
+		}
+		if ok, _ := b.cidBytesEqual(offset, key); ok {
+			fnData, fnErr = b.readRawData(offset, key.ByteLen())
+			fnFound = fnErr == nil
+			return false
+		}
+		readCid, data, err := b.readBlock(offset)
+		if err != nil {
+			fnErr = err
+			return false
+		}
+		match, err := b.matchCid(key, readCid)
+		if err != nil {
+			fnErr = err
+			return false
+		}
+		if match {
+			fnData, fnFound = data, true
+			return false
+		}
+		return true // continue looking
+	})
+	if errors.Is(err, index.ErrNotFound) {
+		return nil, b.notFound(key)
+	} else if err != nil {
+		return nil, err
+	} else if fnErr != nil {
+		return nil, fnErr
+	}
+	if !fnFound {
+		return nil, b.notFound(key)
+	}
+	return fnData, nil
+}
+
+// readRawData reads the block data of the section at the given offset, skipping over its CID
+// given the CID's encoded length, cidLen.
+func (b *ReadOnly) readRawData(offset uint64, cidLen int) ([]byte, error) {
+	at, err := internalio.AddOffset(0, offset)
+	if err != nil {
+		return nil, &ErrCorruptCar{Offset: offset, Err: err}
+	}
+	var buf [binary.MaxVarintLen64]byte
+	n, err := b.backing.ReadAt(buf[:], at)
+	if n == 0 {
+		if err == nil || err == io.EOF {
+			return nil, &ErrOffsetOutOfBounds{Offset: offset}
+		}
+		return nil, &ErrCorruptCar{Offset: offset, Err: err}
+	}
+	sectionLen, vn, err := decodeSectionLength(buf[:n], b.opts)
+	if err != nil {
+		return nil, &ErrCorruptCar{Offset: offset, Err: err}
+	}
+	if sectionLen > b.opts.MaxAllowedSectionSize {
+		return nil, &ErrCorruptCar{Offset: offset, Err: util.ErrSectionTooLarge}
+	}
+	if sectionLen < uint64(cidLen) {
+		err = fmt.Errorf("cid length %d exceeds section length %d", cidLen, sectionLen)
+		return nil, &ErrCorruptCar{Offset: offset, Err: err}
+	}
+	dataAt, err := internalio.AddOffset(offset, uint64(vn+cidLen))
+	if err != nil {
+		return nil, &ErrCorruptCar{Offset: offset, Err: err}
+	}
+	data := make([]byte, sectionLen-uint64(cidLen))
+	// ReadAt may return io.EOF along with all of the data if it ends at the end of the backing.
+	if n, err := b.backing.ReadAt(data, dataAt); n < len(data) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, &ErrCorruptCar{Offset: offset, Err: err}
+	}
+	return data, nil
+}
+
+// ExportBlock writes the block identified by key to w as a CARv1 containing only that block, with
+// the block as its sole root. See carv2.SingleBlockCar.
+func (b *ReadOnly) ExportBlock(ctx context.Context, key cid.Cid, w io.Writer) error {
+	blk, err := b.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	return carv2.SingleBlockCar(blk, w)
+}
+
+// GetReader returns a reader over the data of the block identified by key, along with its length
+// in bytes, such that a large block can be streamed elsewhere without reading all of it into memory
+// first. The section of the block is located as described by Locate, which matches its CID against
+// key, and the returned reader reads the block data directly from the backing CAR. The reader also
+// implements io.ReaderAt and io.Seeker, and closing it is a no-op; it must not be used once the
+// blockstore is closed.
+//
+// Note that the data is read as is, i.e. it is not hashed to verify it against key.
+func (b *ReadOnly) GetReader(key cid.Cid) (io.ReadCloser, int64, error) {
+	// Check if the given CID has multihash.IDENTITY code
+	// Note, we do this without locking, since there is no shared information to lock for in order to perform the check.
+	if digest, ok, err := isIdentity(key); err != nil {
+		return nil, 0, err
+	} else if ok {
+		return sectionReadCloser{io.NewSectionReader(bytes.NewReader(digest), 0, int64(len(digest)))}, int64(len(digest)), nil
+	}
+
+	loc, err := b.Locate(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	dataStart := loc.Offset - int64(b.dataOffset) + loc.SectionLength - loc.DataLength
+	return sectionReadCloser{io.NewSectionReader(b.backing, dataStart, loc.DataLength)}, loc.DataLength, nil
+}
+
+// GetInto reads the data of the block identified by key into buf, returning the number of bytes
+// read, i.e. the length of the block data. This allows buffers to be reused across lookups, e.g.
+// by high-throughput servers, instead of allocating a block for each one as Get does.
+//
+// The section of the block is located as described by Locate, which matches its CID against key,
+// before any data is read. If buf is shorter than the block data, nothing is read into it and an
+// ErrBufferTooSmall is returned, holding the length required. Like GetReader, the data is read as
+// is, i.e. it is not hashed to verify it against key.
+func (b *ReadOnly) GetInto(key cid.Cid, buf []byte) (int, error) {
+	// Check if the given CID has multihash.IDENTITY code
+	// Note, we do this without locking, since there is no shared information to lock for in order to perform the check.
+	if digest, ok, err := isIdentity(key); err != nil {
+		return 0, err
+	} else if ok {
+		if len(buf) < len(digest) {
+			return 0, &ErrBufferTooSmall{Size: len(digest)}
+		}
+		return copy(buf, digest), nil
+	}
+
+	loc, err := b.Locate(key)
+	if err != nil {
+		return 0, err
+	}
+	if int64(len(buf)) < loc.DataLength {
+		return 0, &ErrBufferTooSmall{Size: int(loc.DataLength)}
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return 0, errClosed
+	}
+
+	sectionOffset := loc.Offset - int64(b.dataOffset)
+	n, err := b.backing.ReadAt(buf[:loc.DataLength], sectionOffset+loc.SectionLength-loc.DataLength)
+	if int64(n) == loc.DataLength {
+		// A ReaderAt may return io.EOF along with all bytes read at the end of the backing.
+		return n, nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, &ErrCorruptCar{Offset: uint64(sectionOffset), Err: err}
+}
+
+// sectionReadCloser is an io.SectionReader with a no-op Close.
+type sectionReadCloser struct {
+	*io.SectionReader
+}
+
+func (sectionReadCloser) Close() error { return nil }
+
 // GetSize gets the size of an item corresponding to the given key.
+//
+// If the index is an index.SizedIndex the size is looked up from the index without reading the
+// backing data payload, unless UseWholeCIDs is enabled, since matching whole CIDs requires
+// reading the CID of each candidate section. This is the case for the indices of ReadWrite and of
+// OpenReadOnlyLazy, which record the size of each block as it is written or scanned.
 func (b *ReadOnly) GetSize(ctx context.Context, key cid.Cid) (int, error) {
 	// Check if the given CID has multihash.IDENTITY code
 	// Note, we do this without locking, since there is no shared information to lock for in order to perform the check.
@@ -338,49 +1218,133 @@ func (b *ReadOnly) GetSize(ctx context.Context, key cid.Cid) (int, error) {
 		return 0, errClosed
 	}
 
-	fnSize := -1
+	if sized, ok := b.idx.(index.SizedIndex); ok && !b.opts.BlockstoreUseWholeCIDs {
+		_, length, err := sized.GetOffsetAndLength(key)
+		switch {
+		case err == nil:
+			return int(length), nil
+		case errors.Is(err, index.ErrNotFound):
+			return -1, b.notFound(key)
+		case err != errUnsupported:
+			return -1, err
+		}
+		// Otherwise, the size is not recorded; fall back on reading the data payload.
+	}
+
+	var fnSize int
+	var fnFound bool
 	var fnErr error
 	err := b.idx.GetAll(key, func(offset uint64) bool {
-		rdr, err := internalio.NewOffsetReadSeeker(b.backing, int64(offset))
+		if ok, dataLen := b.cidBytesEqual(offset, key); ok {
+			fnSize, fnFound = dataLen, true
+			return false
+		}
+		_, readCid, dataLen, err := b.readSection(offset)
 		if err != nil {
 			fnErr = err
 			return false
 		}
-		sectionLen, err := varint.ReadUvarint(rdr)
+		match, err := b.matchCid(key, readCid)
+		if err != nil {
+			fnErr = err
+			return false
+		}
+		if match {
+			fnSize, fnFound = dataLen, true
+			return false
+		}
+		return true // continue looking
+	})
+	if errors.Is(err, index.ErrNotFound) {
+		return -1, b.notFound(key)
+	} else if err != nil {
+		return -1, err
+	} else if fnErr != nil {
+		return -1, fnErr
+	}
+	if !fnFound {
+		return -1, b.notFound(key)
+	}
+	return fnSize, nil
+}
+
+// Location describes where a block is stored within a CAR.
+type Location struct {
+	// Offset is the byte offset of the section holding the block, relative to the start of the
+	// CAR; for a CARv2, this includes the pragma, the header and the data padding.
+	Offset int64
+	// SectionLength is the length of the section in bytes, including its length prefix and CID.
+	SectionLength int64
+	// DataLength is the length of the block data in bytes. The data occupies the last DataLength
+	// bytes of the section.
+	DataLength int64
+	// Cid is the CID of the block, as stored in the section.
+	Cid cid.Cid
+}
+
+// Locate returns the location of the block identified by key within the CAR, such that the block
+// can be served by reading a byte range of the CAR directly, e.g. without reading the block via
+// Get. Blocks with multihash.IDENTITY code are not stored in the CAR, and are therefore not found.
+//
+// Blocks are matched the same way as Get, and format.ErrNotFound is returned if no block matches.
+func (b *ReadOnly) Locate(key cid.Cid) (Location, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return Location{}, errClosed
+	}
+
+	var loc Location
+	var fnErr error
+	err := b.idx.GetAll(key, func(offset uint64) bool {
+		_, readCid, dataLen, err := b.readSection(offset)
 		if err != nil {
 			fnErr = err
 			return false
 		}
-		cidLen, readCid, err := cid.CidFromReader(rdr)
+		match, err := b.matchCid(key, readCid)
 		if err != nil {
 			fnErr = err
 			return false
 		}
-		if b.opts.BlockstoreUseWholeCIDs {
-			if readCid.Equals(key) {
-				fnSize = int(sectionLen) - cidLen
+		if match {
+			at, err := internalio.AddOffset(b.dataOffset, offset)
+			if err != nil {
+				fnErr = &ErrCorruptCar{Offset: offset, Err: err}
 				return false
-			} else {
-				return true // continue looking
 			}
-		} else {
-			if bytes.Equal(readCid.Hash(), key.Hash()) {
-				fnSize = int(sectionLen) - cidLen
+			sectionLen := uint64(readCid.ByteLen() + dataLen)
+			loc = Location{
+				Offset:        at,
+				SectionLength: int64(sectionLengthSize(sectionLen, b.opts)) + int64(sectionLen),
+				DataLength:    int64(dataLen),
+				Cid:           readCid,
 			}
 			return false
 		}
+		return true // continue looking
 	})
 	if errors.Is(err, index.ErrNotFound) {
-		return -1, format.ErrNotFound{Cid: key}
+		return Location{}, b.notFound(key)
 	} else if err != nil {
-		return -1, err
+		return Location{}, err
 	} else if fnErr != nil {
-		return -1, fnErr
+		return Location{}, fnErr
 	}
-	if fnSize == -1 {
-		return -1, format.ErrNotFound{Cid: key}
+	if !loc.Cid.Defined() {
+		return Location{}, b.notFound(key)
 	}
-	return fnSize, nil
+	return loc, nil
+}
+
+// notFound returns the error signalling that the block identified by key is not found.
+// See WithNotFoundError.
+func (b *ReadOnly) notFound(key cid.Cid) error {
+	if b.opts.BlockstoreNotFoundError == nil {
+		return format.ErrNotFound{Cid: key}
+	}
+	return &notFoundError{ErrNotFound: format.ErrNotFound{Cid: key}, sentinel: b.opts.BlockstoreNotFoundError}
 }
 
 func isIdentity(key cid.Cid) (digest []byte, ok bool, err error) {
@@ -413,9 +1377,10 @@ func WithAsyncErrorHandler(ctx context.Context, errHandler func(error)) context.
 // AllKeysChan returns the list of keys in the CAR data payload.
 // If the ctx is constructed using WithAsyncErrorHandler any errors that occur during asynchronous
 // retrieval of CIDs will be passed to the error handler function set in context.
-// Otherwise, errors will terminate the asynchronous operation silently.
+// Regardless, once the returned channel is closed, Err reports whether the enumeration was
+// stopped by an error, as opposed to reaching the end of the data payload.
 //
-// See WithAsyncErrorHandler
+// See WithAsyncErrorHandler, Err.
 func (b *ReadOnly) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
 	// We release the lock when the channel-sending goroutine stops.
 	// Note that we can't use a deferred unlock here,
@@ -456,12 +1421,22 @@ func (b *ReadOnly) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
 	go func() {
 		defer b.mu.RUnlock()
 		defer close(ch)
+		// Record the error before closing ch, so that it is visible via Err once ch is closed.
+		var scanErr error
+		defer func() {
+			if scanErr != nil {
+				maybeReportError(ctx, scanErr)
+			}
+			b.keysErrMu.Lock()
+			b.keysErr = scanErr
+			b.keysErrMu.Unlock()
+		}()
 
 		for {
-			length, err := varint.ReadUvarint(rdr)
+			length, err := readSectionLength(rdr, b.opts)
 			if err != nil {
 				if err != io.EOF {
-					maybeReportError(ctx, err)
+					scanErr = err
 				}
 				return
 			}
@@ -471,23 +1446,28 @@ func (b *ReadOnly) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
 				if b.opts.ZeroLengthSectionAsEOF {
 					break
 				} else {
-					maybeReportError(ctx, errZeroLengthSection)
+					scanErr = errZeroLengthSection
 					return
 				}
 			}
 
 			thisItemForNxt, err := rdr.Seek(0, io.SeekCurrent)
 			if err != nil {
-				maybeReportError(ctx, err)
+				scanErr = err
 				return
 			}
 			_, c, err := cid.CidFromReader(rdr)
 			if err != nil {
-				maybeReportError(ctx, err)
+				scanErr = err
 				return
 			}
-			if _, err := rdr.Seek(thisItemForNxt+int64(length), io.SeekStart); err != nil {
-				maybeReportError(ctx, err)
+			next, err := internalio.AddOffset(uint64(thisItemForNxt), length)
+			if err != nil {
+				scanErr = err
+				return
+			}
+			if _, err := rdr.Seek(next, io.SeekStart); err != nil {
+				scanErr = err
 				return
 			}
 
@@ -499,7 +1479,7 @@ func (b *ReadOnly) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
 			select {
 			case ch <- c:
 			case <-ctx.Done():
-				maybeReportError(ctx, ctx.Err())
+				scanErr = ctx.Err()
 				return
 			}
 		}
@@ -507,6 +1487,17 @@ func (b *ReadOnly) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
 	return ch, nil
 }
 
+// Err returns the error that stopped the last enumeration of keys started via AllKeysChan, or nil
+// if it reached the end of the data payload. An enumeration stopped by cancelling its context
+// results in the context error. Err should be called once the channel returned by AllKeysChan is
+// closed; when several enumerations run concurrently, the error of the last one to stop is
+// returned.
+func (b *ReadOnly) Err() error {
+	b.keysErrMu.Lock()
+	defer b.keysErrMu.Unlock()
+	return b.keysErr
+}
+
 // maybeReportError checks if an error handler is present in context associated to the key
 // asyncErrHandlerKey, and if preset it will pass the error to it.
 func maybeReportError(ctx context.Context, err error) {
@@ -516,9 +1507,43 @@ func maybeReportError(ctx context.Context, err error) {
 	}
 }
 
-// HashOnRead is currently unimplemented; hashing on reads never happens.
-func (b *ReadOnly) HashOnRead(bool) {
-	// TODO: implement before the final release?
+// HashOnRead sets whether Get hashes the data of each block it reads and checks that it matches the
+// multihash of the given key, returning blockstore.ErrHashMismatch if it does not. This detects
+// blocks whose data is corrupt, e.g. due to bit-rot, at the cost of hashing every block read. The
+// outcome of each check is counted; see VerificationStats.
+//
+// Note that only Get hashes blocks; GetRaw, GetReader and GetInto return the data as is.
+// Hashing on read is disabled by default, and may be enabled or disabled at any time.
+func (b *ReadOnly) HashOnRead(enabled bool) {
+	var v uint32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreUint32(&b.hashOnRead, v)
+}
+
+// VerificationStats returns the number of blocks hashed on read by Get whose data matched their
+// key, and the number whose data did not, over the lifetime of this blockstore. A rising number of
+// failures signals that the backing CAR is corrupt. See HashOnRead.
+//
+// VerificationStats is safe to call concurrently with Get.
+func (b *ReadOnly) VerificationStats() (verified, failed uint64) {
+	return atomic.LoadUint64(&b.verified), atomic.LoadUint64(&b.verifyFailed)
+}
+
+// verifyBlock hashes data with the multihash function of key and checks the result matches it,
+// counting the outcome.
+func (b *ReadOnly) verifyBlock(key cid.Cid, data []byte) error {
+	got, err := key.Prefix().Sum(data)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got.Hash(), key.Hash()) {
+		atomic.AddUint64(&b.verifyFailed, 1)
+		return blockstore.ErrHashMismatch
+	}
+	atomic.AddUint64(&b.verified, 1)
+	return nil
 }
 
 // Roots returns the root CIDs of the backing CAR.
@@ -534,6 +1559,59 @@ func (b *ReadOnly) Roots() ([]cid.Cid, error) {
 	return header.Roots, nil
 }
 
+// RootsUnique returns the root CIDs of the backing CAR like Roots, except that any root listed
+// more than once in the header is only returned once, at its first occurrence. Roots returns the
+// roots exactly as listed, for fidelity. CIDs are compared as a whole, so roots of the same
+// multihash but different codec or CID version are distinct.
+func (b *ReadOnly) RootsUnique() ([]cid.Cid, error) {
+	roots, err := b.Roots()
+	if err != nil {
+		return nil, err
+	}
+	seen := cid.NewSet()
+	unique := make([]cid.Cid, 0, len(roots))
+	for _, r := range roots {
+		if seen.Visit(r) {
+			unique = append(unique, r)
+		}
+	}
+	return unique, nil
+}
+
+// Manifest returns a manifest of the blocks in the backing CAR, listing the whole CID, section
+// offset and block data length of each indexed block, in the order in which they appear in the
+// data payload. See index.WriteManifest for persisting it.
+//
+// The index must be an index.IterableIndex, since its entries are listed via
+// index.ForEachOffsetOrder. Blocks that are not indexed, such as blocks with multihash.IDENTITY
+// code, are not listed. The whole CID and length of each block are read from the data payload,
+// since indices only record multihashes.
+func (b *ReadOnly) Manifest() ([]index.ManifestRecord, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return nil, errClosed
+	}
+	iterable, ok := b.idx.(index.IterableIndex)
+	if !ok {
+		return nil, fmt.Errorf("cannot list blocks of index of codec %v: index is not iterable", b.idx.Codec())
+	}
+	var records []index.ManifestRecord
+	err := index.ForEachOffsetOrder(iterable, func(_ cid.Cid, offset uint64) error {
+		_, c, dataLen, err := b.readSection(offset)
+		if err != nil {
+			return err
+		}
+		records = append(records, index.ManifestRecord{Cid: c, Offset: offset, Length: uint64(dataLen)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
 // Close closes the underlying reader if it was opened by OpenReadOnly.
 // After this call, the blockstore can no longer be used.
 //
@@ -548,6 +1626,9 @@ func (b *ReadOnly) Close() error {
 
 func (b *ReadOnly) closeWithoutMutex() error {
 	b.closed = true
+	if b.prefetch != nil {
+		b.prefetch.close()
+	}
 	if b.carv2Closer != nil {
 		return b.carv2Closer.Close()
 	}
@@ -2,19 +2,33 @@ package blockstore
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	format "github.com/ipfs/go-ipld-format"
 	"github.com/ipfs/go-merkledag"
 	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/index"
 	"github.com/ipld/go-car/v2/internal/carv1"
+	"github.com/ipld/go-car/v2/internal/carv1/util"
+	internalmmap "github.com/ipld/go-car/v2/internal/mmap"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/multiformats/go-varint"
 	"github.com/stretchr/testify/require"
 )
 
@@ -195,10 +209,38 @@ func TestReadOnlyAllKeysChanErrHandlerNeverCalled(t *testing.T) {
 				gotCids = append(gotCids, k)
 			}
 			require.Equal(t, tt.wantCIDs, gotCids)
+			require.NoError(t, subject.Err())
 		})
 	}
 }
 
+func TestReadOnlyAllKeysChanErrReportsCorruptPayload(t *testing.T) {
+	data, err := ioutil.ReadFile("../testdata/sample-v1.car")
+	require.NoError(t, err)
+	// Truncate the payload part way through the CID of its second section.
+	reader := bytes.NewReader(data)
+	_, err = carv1.ReadHeader(reader, carv1.DefaultMaxAllowedHeaderSize)
+	require.NoError(t, err)
+	_, _, err = util.ReadNode(reader, false, carv1.DefaultMaxAllowedSectionSize)
+	require.NoError(t, err)
+	secondSection, err := reader.Seek(0, io.SeekCurrent)
+	require.NoError(t, err)
+	data = data[:secondSection+3]
+
+	// Supply an index, since generating one from the corrupt payload fails.
+	subject, err := NewReadOnly(bytes.NewReader(data), index.NewMultihashSorted())
+	require.NoError(t, err)
+
+	keysChan, err := subject.AllKeysChan(context.Background())
+	require.NoError(t, err)
+	var count int
+	for range keysChan {
+		count++
+	}
+	require.Equal(t, 1, count)
+	require.Error(t, subject.Err())
+}
+
 func listCids(t *testing.T, v1r *carv1.CarReader) (cids []cid.Cid) {
 	for {
 		block, err := v1r.Next()
@@ -301,3 +343,1610 @@ func TestNewReadOnly_CarV1WithoutIndexWorksAsExpected(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, wantBlock, gotBlock)
 }
+
+func TestReadOnlyHasMany(t *testing.T) {
+	ctx := context.TODO()
+	subject, err := OpenReadOnly("../testdata/sample-v1.car")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+
+	v1r := newV1ReaderFromV1File(t, "../testdata/sample-v1.car", false)
+	wantCids := listCids(t, v1r)
+	nonExistingKey := merkledag.NewRawNode([]byte("lobstermuncher")).Block.Cid()
+
+	// Interleave a missing key to assert the result is parallel to the given keys.
+	keys := append([]cid.Cid{nonExistingKey}, wantCids...)
+	got, err := subject.HasMany(ctx, keys)
+	require.NoError(t, err)
+	require.Len(t, got, len(keys))
+	require.False(t, got[0])
+	for i, key := range wantCids {
+		want, err := subject.Has(ctx, key)
+		require.NoError(t, err)
+		require.Equal(t, want, got[i+1], "mismatch for key %s", key)
+	}
+
+	require.NoError(t, subject.Close())
+	_, err = subject.HasMany(ctx, keys)
+	require.Error(t, err)
+}
+
+func TestReadOnlyConcurrentReads(t *testing.T) {
+	carV1Bytes, err := ioutil.ReadFile("../testdata/sample-v1.car")
+	require.NoError(t, err)
+	v1r, err := carv1.NewCarReader(bytes.NewReader(carV1Bytes))
+	require.NoError(t, err)
+	var wantBlocks []blocks.Block
+	for {
+		b, err := v1r.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		wantBlocks = append(wantBlocks, b)
+	}
+
+	tests := []struct {
+		name    string
+		subject func(t *testing.T) *ReadOnly
+	}{
+		{
+			name: "MmapBackedCarV2",
+			subject: func(t *testing.T) *ReadOnly {
+				subject, err := OpenReadOnly("../testdata/sample-wrapped-v2.car")
+				require.NoError(t, err)
+				t.Cleanup(func() { require.NoError(t, subject.Close()) })
+				return subject
+			},
+		},
+		{
+			name: "BytesReaderBackedCarV1",
+			subject: func(t *testing.T) *ReadOnly {
+				subject, err := NewReadOnly(bytes.NewReader(carV1Bytes), nil)
+				require.NoError(t, err)
+				return subject
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.TODO()
+			subject := tt.subject(t)
+
+			const workers = 16
+			var wg sync.WaitGroup
+			errs := make(chan error, workers)
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					// Start each worker at a different block so that reads overlap in varying order.
+					for i := range wantBlocks {
+						want := wantBlocks[(i+w)%len(wantBlocks)]
+						got, err := subject.Get(ctx, want.Cid())
+						if err != nil {
+							errs <- err
+							return
+						}
+						if !bytes.Equal(want.RawData(), got.RawData()) {
+							errs <- fmt.Errorf("unexpected data for block %s", want.Cid())
+							return
+						}
+						if has, err := subject.Has(ctx, want.Cid()); err != nil || !has {
+							errs <- fmt.Errorf("expected block %s to be present: %v", want.Cid(), err)
+							return
+						}
+						if size, err := subject.GetSize(ctx, want.Cid()); err != nil || size != len(want.RawData()) {
+							errs <- fmt.Errorf("unexpected size %d for block %s: %v", size, want.Cid(), err)
+							return
+						}
+					}
+				}(w)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+// sizedIndex wraps an index.IterableIndex to implement index.SizedIndex, recording block lengths in memory.
+type sizedIndex struct {
+	index.IterableIndex
+	lengths map[string]uint64
+	lookups int
+}
+
+func newSizedIndex(t testing.TB, carV1Bytes []byte) *sizedIndex {
+	idx, err := carv2.GenerateIndex(bytes.NewReader(carV1Bytes))
+	require.NoError(t, err)
+	v1r, err := carv1.NewCarReader(bytes.NewReader(carV1Bytes))
+	require.NoError(t, err)
+	lengths := make(map[string]uint64)
+	for {
+		b, err := v1r.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		lengths[string(b.Cid().Hash())] = uint64(len(b.RawData()))
+	}
+	return &sizedIndex{IterableIndex: idx.(index.IterableIndex), lengths: lengths}
+}
+
+func (s *sizedIndex) GetOffsetAndLength(c cid.Cid) (uint64, uint64, error) {
+	s.lookups++
+	offset, err := index.GetFirst(s.IterableIndex, c)
+	if err != nil {
+		return 0, 0, err
+	}
+	return offset, s.lengths[string(c.Hash())], nil
+}
+
+func TestReadOnlyGetSizeUsesSizedIndex(t *testing.T) {
+	ctx := context.TODO()
+	carV1Bytes, err := ioutil.ReadFile("../testdata/sample-v1.car")
+	require.NoError(t, err)
+	v1r := newV1ReaderFromV1File(t, "../testdata/sample-v1.car", false)
+	var wantBlocks []blocks.Block
+	for {
+		b, err := v1r.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if b.Cid().Prefix().MhType == multihash.IDENTITY {
+			continue
+		}
+		wantBlocks = append(wantBlocks, b)
+	}
+
+	idx := newSizedIndex(t, carV1Bytes)
+	subject, err := NewReadOnly(bytes.NewReader(carV1Bytes), idx)
+	require.NoError(t, err)
+	for _, want := range wantBlocks {
+		got, err := subject.GetSize(ctx, want.Cid())
+		require.NoError(t, err)
+		require.Equal(t, len(want.RawData()), got)
+	}
+	require.Equal(t, len(wantBlocks), idx.lookups)
+
+	nonExistingKey := merkledag.NewRawNode([]byte("lobstermuncher")).Block.Cid()
+	_, err = subject.GetSize(ctx, nonExistingKey)
+	require.Equal(t, format.ErrNotFound{Cid: nonExistingKey}, err)
+
+	// Assert that matching whole CIDs falls back on reading the backing data payload.
+	idx.lookups = 0
+	subject, err = NewReadOnly(bytes.NewReader(carV1Bytes), idx, UseWholeCIDs(true))
+	require.NoError(t, err)
+	for _, want := range wantBlocks {
+		got, err := subject.GetSize(ctx, want.Cid())
+		require.NoError(t, err)
+		require.Equal(t, len(want.RawData()), got)
+	}
+	require.Zero(t, idx.lookups)
+}
+
+func TestReadOnlyGetSizeUsesRecordedSizes(t *testing.T) {
+	ctx := context.TODO()
+	carV1Bytes, err := ioutil.ReadFile("../testdata/sample-v1.car")
+	require.NoError(t, err)
+	v1r := newV1ReaderFromV1File(t, "../testdata/sample-v1.car", false)
+	var wantBlocks []blocks.Block
+	for {
+		b, err := v1r.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if b.Cid().Prefix().MhType == multihash.IDENTITY {
+			continue
+		}
+		wantBlocks = append(wantBlocks, b)
+	}
+
+	// Assert the sizes recorded by a lazily generated index are used without reading the backing.
+	backing := &countingReaderAt{ReaderAt: bytes.NewReader(carV1Bytes)}
+	subject, err := newReadOnly(backing, nil, true)
+	require.NoError(t, err)
+	require.NoError(t, subject.Warm(ctx))
+	before := backing.read
+	for _, want := range wantBlocks {
+		got, err := subject.GetSize(ctx, want.Cid())
+		require.NoError(t, err)
+		require.Equal(t, len(want.RawData()), got)
+	}
+	require.Equal(t, before, backing.read)
+
+	// Assert the sizes of the blocks put to a ReadWrite are recorded.
+	rw, err := OpenReadWrite(filepath.Join(t.TempDir(), "sized.car"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { rw.Discard() })
+	require.NoError(t, rw.PutMany(ctx, wantBlocks))
+	for _, want := range wantBlocks {
+		_, length, err := rw.idx.GetOffsetAndLength(want.Cid())
+		require.NoError(t, err)
+		require.Equal(t, uint64(len(want.RawData())), length)
+		got, err := rw.GetSize(ctx, want.Cid())
+		require.NoError(t, err)
+		require.Equal(t, len(want.RawData()), got)
+	}
+
+	// Assert records loaded without sizes fall back on reading the backing.
+	generated, err := carv2.GenerateIndex(bytes.NewReader(carV1Bytes))
+	require.NoError(t, err)
+	var records []index.Record
+	require.NoError(t, generated.(index.IterableIndex).ForEach(func(mh multihash.Multihash, offset uint64) error {
+		records = append(records, index.Record{Cid: cid.NewCidV1(cid.Raw, mh), Offset: offset})
+		return nil
+	}))
+	loaded := newInsertionIndex()
+	require.NoError(t, loaded.Load(records))
+	_, _, err = loaded.GetOffsetAndLength(wantBlocks[0].Cid())
+	require.Equal(t, errUnsupported, err)
+	subject, err = NewReadOnly(bytes.NewReader(carV1Bytes), loaded)
+	require.NoError(t, err)
+	for _, want := range wantBlocks {
+		got, err := subject.GetSize(ctx, want.Cid())
+		require.NoError(t, err)
+		require.Equal(t, len(want.RawData()), got)
+	}
+}
+
+func BenchmarkReadOnlyGetSize(b *testing.B) {
+	carV1Bytes, err := ioutil.ReadFile("../testdata/sample-v1.car")
+	require.NoError(b, err)
+	sized := newSizedIndex(b, carV1Bytes)
+	var cids []cid.Cid
+	require.NoError(b, sized.ForEach(func(mh multihash.Multihash, _ uint64) error {
+		cids = append(cids, cid.NewCidV1(cid.Raw, mh))
+		return nil
+	}))
+
+	for _, bb := range []struct {
+		name string
+		idx  index.Index
+	}{
+		{"ReadBacking", sized.IterableIndex},
+		{"SizedIndex", sized},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			subject, err := NewReadOnly(bytes.NewReader(carV1Bytes), bb.idx)
+			require.NoError(b, err)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, c := range cids {
+					if _, err := subject.GetSize(context.TODO(), c); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestReadOnlyStructuredReadErrors(t *testing.T) {
+	ctx := context.TODO()
+	carV1Bytes, err := ioutil.ReadFile("../testdata/sample-v1.car")
+	require.NoError(t, err)
+	header, err := carv1.ReadHeader(bytes.NewReader(carV1Bytes), carv1.DefaultMaxAllowedHeaderSize)
+	require.NoError(t, err)
+	headerSize, err := carv1.HeaderSize(header)
+	require.NoError(t, err)
+
+	v1r, err := carv1.NewCarReader(bytes.NewReader(carV1Bytes))
+	require.NoError(t, err)
+	var keys []cid.Cid
+	for {
+		b, err := v1r.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		keys = append(keys, b.Cid())
+	}
+	first, last := keys[0], keys[len(keys)-1]
+
+	idx, err := carv2.GenerateIndex(bytes.NewReader(carV1Bytes))
+	require.NoError(t, err)
+	lastOffset, err := index.GetFirst(idx, last)
+	require.NoError(t, err)
+
+	// An index that records the first key at the offset of the last block.
+	staleIdx, err := index.New(multicodec.CarMultihashIndexSorted)
+	require.NoError(t, err)
+	require.NoError(t, staleIdx.Load([]index.Record{{Cid: first, Offset: lastOffset}}))
+
+	// An index that records the first key at an offset beyond the maximum int64.
+	hugeIdx, err := index.New(multicodec.CarMultihashIndexSorted)
+	require.NoError(t, err)
+	require.NoError(t, hugeIdx.Load([]index.Record{{Cid: first, Offset: math.MaxInt64 + 1}}))
+
+	tests := []struct {
+		name    string
+		backing []byte
+		idx     index.Index
+		key     cid.Cid
+		check   func(t *testing.T, err error)
+	}{
+		{
+			name:    "OffsetOutOfBounds",
+			backing: carV1Bytes[:headerSize],
+			idx:     idx,
+			key:     last,
+			check: func(t *testing.T, err error) {
+				var target *ErrOffsetOutOfBounds
+				require.ErrorAs(t, err, &target)
+				require.Equal(t, lastOffset, target.Offset)
+			},
+		},
+		{
+			name:    "CorruptCar",
+			backing: carV1Bytes[:lastOffset+3],
+			idx:     idx,
+			key:     last,
+			check: func(t *testing.T, err error) {
+				var target *ErrCorruptCar
+				require.ErrorAs(t, err, &target)
+				require.Equal(t, lastOffset, target.Offset)
+				require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+			},
+		},
+		{
+			name:    "OffsetTooLarge",
+			backing: carV1Bytes,
+			idx:     hugeIdx,
+			key:     first,
+			check: func(t *testing.T, err error) {
+				var target *ErrCorruptCar
+				require.ErrorAs(t, err, &target)
+				require.Equal(t, uint64(math.MaxInt64+1), target.Offset)
+				require.ErrorIs(t, err, carv2.ErrOffsetTooLarge)
+			},
+		},
+		{
+			name:    "CidMismatch",
+			backing: carV1Bytes,
+			idx:     staleIdx,
+			key:     first,
+			check: func(t *testing.T, err error) {
+				var target *ErrCidMismatch
+				require.ErrorAs(t, err, &target)
+				require.Equal(t, first, target.Expected)
+				require.Equal(t, last, target.Got)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subject, err := NewReadOnly(bytes.NewReader(tt.backing), tt.idx)
+			require.NoError(t, err)
+
+			_, err = subject.Has(ctx, tt.key)
+			tt.check(t, err)
+			_, err = subject.Get(ctx, tt.key)
+			tt.check(t, err)
+			_, err = subject.GetSize(ctx, tt.key)
+			tt.check(t, err)
+		})
+	}
+}
+
+func TestReadOnlyHeaderTooLarge(t *testing.T) {
+	ctx := context.TODO()
+
+	// A CARv1 header that claims to be 1 TiB long.
+	path := filepath.Join(t.TempDir(), "huge-header.car")
+	require.NoError(t, ioutil.WriteFile(path, append(varint.ToUvarint(1<<40), 0xa2), 0o600))
+	_, err := OpenReadOnly(path)
+	require.ErrorIs(t, err, carv2.ErrHeaderTooLarge)
+
+	// The CARv2 pragma fits in the limit, so the inner header is only read by Roots and
+	// AllKeysChan, since the index is attached.
+	subject, err := OpenReadOnly("../testdata/sample-wrapped-v2.car", carv2.MaxAllowedHeaderSize(uint64(carv2.PragmaSize-1)))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+	_, err = subject.Roots()
+	require.ErrorIs(t, err, carv2.ErrHeaderTooLarge)
+	_, err = subject.AllKeysChan(ctx)
+	require.ErrorIs(t, err, carv2.ErrHeaderTooLarge)
+}
+
+func TestOpenReadOnlyLazy(t *testing.T) {
+	ctx := context.TODO()
+	tests := []struct {
+		name string
+		path string
+		opts []carv2.Option
+	}{
+		{"CarV1", "../testdata/sample-v1.car", nil},
+		{"CarV2Indexless", "../testdata/sample-v2-indexless.car", nil},
+		{"CarV1WithZeroLenSection", "../testdata/sample-v1-with-zero-len-section.car", []carv2.Option{carv2.ZeroLengthSectionAsEOF(true)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := OpenReadOnly(tt.path, tt.opts...)
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, want.Close()) })
+			subject, err := OpenReadOnlyLazy(tt.path, tt.opts...)
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, subject.Close()) })
+			lazy, ok := subject.idx.(*lazyIndex)
+			require.True(t, ok)
+
+			keysChan, err := want.AllKeysChan(ctx)
+			require.NoError(t, err)
+			var keys []cid.Cid
+			for c := range keysChan {
+				keys = append(keys, c)
+			}
+			require.NotEmpty(t, keys)
+
+			// Assert that looking up the first block only scans as far as needed.
+			first, err := subject.Get(ctx, keys[0])
+			require.NoError(t, err)
+			require.Equal(t, keys[0], first.Cid())
+			require.False(t, lazy.done)
+
+			// Look the blocks up in reverse order, so that the last lookup is served from the
+			// partial index.
+			for i := len(keys) - 1; i >= 0; i-- {
+				key := keys[i]
+				wantBlock, err := want.Get(ctx, key)
+				require.NoError(t, err)
+				gotBlock, err := subject.Get(ctx, key)
+				require.NoError(t, err)
+				require.Equal(t, wantBlock, gotBlock)
+
+				has, err := subject.Has(ctx, key)
+				require.NoError(t, err)
+				require.True(t, has)
+
+				wantSize, err := want.GetSize(ctx, key)
+				require.NoError(t, err)
+				gotSize, err := subject.GetSize(ctx, key)
+				require.NoError(t, err)
+				require.Equal(t, wantSize, gotSize)
+			}
+
+			// Assert that looking up an absent block completes the scan.
+			absent := merkledag.NewRawNode([]byte("lobstermuncher")).Block.Cid()
+			has, err := subject.Has(ctx, absent)
+			require.NoError(t, err)
+			require.False(t, has)
+			require.True(t, lazy.done)
+			_, err = subject.Get(ctx, absent)
+			require.True(t, format.IsNotFound(err))
+		})
+	}
+}
+
+func TestReadOnlyManifest(t *testing.T) {
+	subject, err := OpenReadOnly("../testdata/sample-wrapped-v2.car")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+
+	got, err := subject.Manifest()
+	require.NoError(t, err)
+
+	// Assert the manifest lists the non-identity blocks in payload order.
+	reader, err := carv2.OpenReader("../testdata/sample-wrapped-v2.car")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+	dr, err := reader.DataReader()
+	require.NoError(t, err)
+	br, err := carv2.NewBlockReader(dr)
+	require.NoError(t, err)
+	var want []cid.Cid
+	for {
+		b, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if b.Cid().Prefix().MhType != multihash.IDENTITY {
+			want = append(want, b.Cid())
+		}
+	}
+	require.Len(t, got, len(want))
+	for i, r := range got {
+		require.Equal(t, want[i], r.Cid)
+		offset, err := index.GetFirst(subject.idx, r.Cid)
+		require.NoError(t, err)
+		require.Equal(t, offset, r.Offset)
+		size, err := subject.GetSize(context.TODO(), r.Cid)
+		require.NoError(t, err)
+		require.Equal(t, uint64(size), r.Length)
+	}
+
+	// Assert the manifest survives a round trip.
+	var buf bytes.Buffer
+	require.NoError(t, index.WriteManifest(&buf, got))
+	roundTripped, err := index.ReadManifest(&buf)
+	require.NoError(t, err)
+	require.Equal(t, got, roundTripped)
+}
+
+func TestReadOnlyCidBytesEqual(t *testing.T) {
+	ctx := context.TODO()
+	subject, err := OpenReadOnly("../testdata/sample-v1.car")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+
+	// Note, AllKeysChan does not list whole CIDs by default; read them from the CAR instead.
+	f, err := os.Open("../testdata/sample-v1.car")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, f.Close()) })
+	br, err := carv2.NewBlockReader(f)
+	require.NoError(t, err)
+	for {
+		b, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		key := b.Cid()
+		if key.Prefix().MhType == multihash.IDENTITY {
+			continue
+		}
+		offset, err := index.GetFirst(subject.idx, key)
+		require.NoError(t, err)
+		blk, err := subject.Get(ctx, key)
+		require.NoError(t, err)
+
+		equal, dataLen := subject.cidBytesEqual(offset, key)
+		require.True(t, equal)
+		require.Equal(t, len(blk.RawData()), dataLen)
+
+		// Assert a CID with the same multihash but different codec is not equal, yet is still
+		// found by falling back onto matching multihashes.
+		other := cid.NewCidV1(cid.Raw, key.Hash())
+		if key.Prefix().Codec == cid.Raw {
+			other = cid.NewCidV1(cid.DagCBOR, key.Hash())
+		}
+		equal, _ = subject.cidBytesEqual(offset, other)
+		require.False(t, equal)
+		has, err := subject.Has(ctx, other)
+		require.NoError(t, err)
+		require.True(t, has)
+		size, err := subject.GetSize(ctx, other)
+		require.NoError(t, err)
+		require.Equal(t, len(blk.RawData()), size)
+	}
+}
+
+func TestReadOnlyLocate(t *testing.T) {
+	for _, path := range []string{"../testdata/sample-v1.car", "../testdata/sample-wrapped-v2.car"} {
+		path := path
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			subject, err := OpenReadOnly(path)
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, subject.Close()) })
+			file, err := os.ReadFile(path)
+			require.NoError(t, err)
+
+			f, err := os.Open(path)
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, f.Close()) })
+			br, err := carv2.NewBlockReader(f)
+			require.NoError(t, err)
+			for {
+				want, err := br.Next()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+
+				got, err := subject.Locate(want.Cid())
+				if want.Cid().Prefix().MhType == multihash.IDENTITY {
+					require.True(t, format.IsNotFound(err))
+					continue
+				}
+				require.NoError(t, err)
+				require.Equal(t, want.Cid(), got.Cid)
+				require.Equal(t, int64(len(want.RawData())), got.DataLength)
+
+				// Assert the located byte range of the file holds exactly the section of the block.
+				section := file[got.Offset : got.Offset+got.SectionLength]
+				gotCid, gotData, err := util.ReadNode(bytes.NewReader(section), false, carv2.DefaultMaxAllowedSectionSize)
+				require.NoError(t, err)
+				require.Equal(t, want.Cid(), gotCid)
+				require.Equal(t, want.RawData(), gotData)
+				require.Equal(t, want.RawData(), section[got.SectionLength-got.DataLength:])
+			}
+
+			_, err = subject.Locate(merkledag.NewRawNode([]byte("lobstermuncher")).Cid())
+			require.True(t, format.IsNotFound(err))
+		})
+	}
+}
+
+func TestReadOnlyGetRaw(t *testing.T) {
+	for _, path := range []string{"../testdata/sample-v1.car", "../testdata/sample-wrapped-v2.car"} {
+		path := path
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			subject, err := OpenReadOnly(path)
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, subject.Close()) })
+			trusted, err := OpenReadOnly(path, TrustedReads(true))
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, trusted.Close()) })
+			wholeCids, err := OpenReadOnly(path, UseWholeCIDs(true))
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, wholeCids.Close()) })
+
+			f, err := os.Open(path)
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, f.Close()) })
+			br, err := carv2.NewBlockReader(f)
+			require.NoError(t, err)
+			for {
+				want, err := br.Next()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+
+				for _, bs := range []*ReadOnly{subject, trusted, wholeCids} {
+					got, err := bs.GetRaw(want.Cid())
+					require.NoError(t, err)
+					require.Equal(t, want.RawData(), got)
+				}
+
+				// Assert a CID that only shares the multihash is matched unless whole CIDs are used.
+				if want.Cid().Prefix().MhType == multihash.IDENTITY {
+					continue
+				}
+				rawKey := cid.NewCidV1(cid.Raw, want.Cid().Hash())
+				if rawKey.Equals(want.Cid()) {
+					continue
+				}
+				got, err := subject.GetRaw(rawKey)
+				require.NoError(t, err)
+				require.Equal(t, want.RawData(), got)
+				_, err = wholeCids.GetRaw(rawKey)
+				require.True(t, format.IsNotFound(err))
+			}
+
+			_, err = subject.GetRaw(merkledag.NewRawNode([]byte("lobstermuncher")).Cid())
+			require.True(t, format.IsNotFound(err))
+			_, err = trusted.GetRaw(merkledag.NewRawNode([]byte("lobstermuncher")).Cid())
+			require.True(t, format.IsNotFound(err))
+		})
+	}
+
+	// Assert index errors other than not found are returned as is.
+	data, err := os.ReadFile("../testdata/sample-v1.car")
+	require.NoError(t, err)
+	idx, err := carv2.GenerateIndex(bytes.NewReader(data))
+	require.NoError(t, err)
+	errIndex := errors.New("index failure")
+	subject, err := NewReadOnly(bytes.NewReader(data), &failingIndex{Index: idx, err: errIndex})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+	_, err = subject.GetRaw(merkledag.NewRawNode([]byte("lobstermuncher")).Cid())
+	require.ErrorIs(t, err, errIndex)
+}
+
+// failingIndex wraps an index.Index, failing every lookup with err.
+type failingIndex struct {
+	index.Index
+	err error
+}
+
+func (f *failingIndex) GetAll(cid.Cid, func(uint64) bool) error {
+	return f.err
+}
+
+func TestReadOnlyEquivalentCidVersions(t *testing.T) {
+	ctx := context.TODO()
+	v0Node := merkledag.NodeWithData([]byte("fish"))
+	v0 := v0Node.Cid()
+	require.Equal(t, uint64(0), v0.Version())
+	v1Node := merkledag.NodeWithData([]byte("lobster"))
+	v1Node.SetCidBuilder(merkledag.V1CidPrefix())
+	v1 := v1Node.Cid()
+	rawNode := merkledag.NewRawNode([]byte("barreleye"))
+
+	// Write a CARv1 with a dag-pb block under CIDv0, another under CIDv1, and a raw block.
+	var buf bytes.Buffer
+	require.NoError(t, carv1.WriteHeader(&carv1.CarHeader{Roots: []cid.Cid{v0}, Version: 1}, &buf))
+	for _, blk := range []blocks.Block{v0Node, v1Node, rawNode} {
+		require.NoError(t, util.LdWrite(&buf, blk.Cid().Bytes(), blk.RawData()))
+	}
+
+	subject, err := NewReadOnly(bytes.NewReader(buf.Bytes()), nil, UseWholeCIDs(true), EquivalentCidVersions(true))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+	strict, err := NewReadOnly(bytes.NewReader(buf.Bytes()), nil, UseWholeCIDs(true))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, strict.Close()) })
+
+	for _, tc := range []struct {
+		key  cid.Cid
+		want []byte
+	}{
+		{cid.NewCidV1(cid.DagProtobuf, v0.Hash()), v0Node.RawData()},
+		{cid.NewCidV0(v1.Hash()), v1Node.RawData()},
+	} {
+		got, err := subject.Get(ctx, tc.key)
+		require.NoError(t, err)
+		require.Equal(t, tc.key, got.Cid())
+		require.Equal(t, tc.want, got.RawData())
+		has, err := subject.Has(ctx, tc.key)
+		require.NoError(t, err)
+		require.True(t, has)
+
+		_, err = strict.Get(ctx, tc.key)
+		require.True(t, format.IsNotFound(err))
+	}
+
+	// Assert CIDs of other codecs are not normalized.
+	has, err := subject.Has(ctx, cid.NewCidV1(cid.DagProtobuf, rawNode.Cid().Hash()))
+	require.NoError(t, err)
+	require.False(t, has)
+	has, err = subject.Has(ctx, cid.NewCidV1(cid.Raw, v1.Hash()))
+	require.NoError(t, err)
+	require.False(t, has)
+}
+
+func TestReadOnlySectionLengthFixed32(t *testing.T) {
+	ctx := context.TODO()
+	var blks []blocks.Block
+	for i := 0; i < 10; i++ {
+		blks = append(blks, merkledag.NewRawNode([]byte(fmt.Sprintf("fixed32-%d", i))))
+	}
+
+	// Write a CARv1 whose sections have fixed 4-byte big-endian length prefixes.
+	var buf bytes.Buffer
+	require.NoError(t, carv1.WriteHeader(&carv1.CarHeader{Roots: []cid.Cid{blks[0].Cid()}, Version: 1}, &buf))
+	var offsets []uint64
+	for _, blk := range blks {
+		offsets = append(offsets, uint64(buf.Len()))
+		var prefix [4]byte
+		binary.BigEndian.PutUint32(prefix[:], uint32(blk.Cid().ByteLen()+len(blk.RawData())))
+		buf.Write(prefix[:])
+		buf.Write(blk.Cid().Bytes())
+		buf.Write(blk.RawData())
+	}
+
+	// Assert the payload is rejected by default.
+	_, err := NewReadOnly(bytes.NewReader(buf.Bytes()), nil)
+	require.Error(t, err)
+
+	for _, lazy := range []bool{false, true} {
+		subject, err := newReadOnly(bytes.NewReader(buf.Bytes()), nil, lazy,
+			carv2.UseSectionLengthFormat(carv2.SectionLengthFixed32), PrefetchWindow(4))
+		require.NoError(t, err)
+		t.Cleanup(func() { require.NoError(t, subject.Close()) })
+
+		// Assert the sections following a Get are prefetched at their offsets.
+		_, err = subject.Get(ctx, blks[0].Cid())
+		require.NoError(t, err)
+		subject.prefetch.wg.Wait()
+		for i, want := range blks[1:5] {
+			e, ok := subject.prefetch.get(offsets[i+1])
+			require.True(t, ok)
+			require.Equal(t, want.Cid(), e.cid)
+			require.Equal(t, want.RawData(), e.data)
+		}
+
+		for _, want := range blks {
+			got, err := subject.Get(ctx, want.Cid())
+			require.NoError(t, err)
+			require.Equal(t, want.RawData(), got.RawData())
+			raw, err := subject.GetRaw(want.Cid())
+			require.NoError(t, err)
+			require.Equal(t, want.RawData(), raw)
+			size, err := subject.GetSize(ctx, want.Cid())
+			require.NoError(t, err)
+			require.Equal(t, len(want.RawData()), size)
+			loc, err := subject.Locate(want.Cid())
+			require.NoError(t, err)
+			require.Equal(t, int64(4+want.Cid().ByteLen()+len(want.RawData())), loc.SectionLength)
+			require.Equal(t, want.RawData(), buf.Bytes()[loc.Offset+loc.SectionLength-loc.DataLength:loc.Offset+loc.SectionLength])
+		}
+
+		keys, err := subject.AllKeysChan(ctx)
+		require.NoError(t, err)
+		var count int
+		for range keys {
+			count++
+		}
+		require.NoError(t, subject.Err())
+		require.Equal(t, len(blks), count)
+	}
+
+	_, err = OpenReadWrite(filepath.Join(t.TempDir(), "fixed32.car"), nil, carv2.UseSectionLengthFormat(carv2.SectionLengthFixed32))
+	require.Error(t, err)
+}
+
+func TestReadOnlyExportBlock(t *testing.T) {
+	ctx := context.TODO()
+	subject, err := OpenReadOnly("../testdata/sample-v1.car", UseWholeCIDs(true))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+	records, err := subject.Manifest()
+	require.NoError(t, err)
+	want, err := subject.Get(ctx, records[1].Cid)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, subject.ExportBlock(ctx, want.Cid(), &buf))
+	exported, err := NewReadOnly(bytes.NewReader(buf.Bytes()), nil, UseWholeCIDs(true))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, exported.Close()) })
+	roots, err := exported.Roots()
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{want.Cid()}, roots)
+	got, err := exported.Get(ctx, want.Cid())
+	require.NoError(t, err)
+	require.Equal(t, want.RawData(), got.RawData())
+
+	err = subject.ExportBlock(ctx, merkledag.NewRawNode([]byte("lobstermuncher")).Cid(), &buf)
+	require.True(t, format.IsNotFound(err))
+}
+
+func TestOpenReadOnlyMmap(t *testing.T) {
+	ctx := context.TODO()
+	mappablePath := filepath.Join(t.TempDir(), "mappable.car")
+	src, err := os.Open("../testdata/sample-v1.car")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, src.Close()) })
+	dst, err := os.Create(mappablePath)
+	require.NoError(t, err)
+	require.NoError(t, carv2.WrapV1(src, dst, carv2.UseIndexCodec(index.CarMappableIndexSorted)))
+	require.NoError(t, dst.Close())
+
+	tests := []struct {
+		name        string
+		path        string
+		wantInPlace bool
+	}{
+		{"CarV1", "../testdata/sample-v1.car", false},
+		{"CarV2WithSortedIndex", "../testdata/sample-wrapped-v2.car", false},
+		{"CarV2WithMappableIndex", mappablePath, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := OpenReadOnly(tt.path)
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, want.Close()) })
+			subject, err := OpenReadOnlyMmap(tt.path)
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, subject.Close()) })
+
+			// Assert a mappable index is backed by the mapping of the file itself.
+			mappable, ok := subject.idx.(*index.MappableIndexSorted)
+			require.Equal(t, tt.wantInPlace, ok)
+			if ok {
+				mapped := subject.carv2Closer.(*internalmmap.ReaderAt).Bytes()
+				idxBytes := mappable.Bytes()
+				require.Equal(t, &mapped[len(mapped)-len(idxBytes)], &idxBytes[0])
+			}
+
+			keysChan, err := want.AllKeysChan(ctx)
+			require.NoError(t, err)
+			var n int
+			for key := range keysChan {
+				wantBlock, err := want.Get(ctx, key)
+				require.NoError(t, err)
+				gotBlock, err := subject.Get(ctx, key)
+				require.NoError(t, err)
+				require.Equal(t, wantBlock, gotBlock)
+				n++
+			}
+			require.NotZero(t, n)
+		})
+	}
+}
+
+func TestReadOnlyGetReader(t *testing.T) {
+	for _, path := range []string{"../testdata/sample-v1.car", "../testdata/sample-wrapped-v2.car"} {
+		path := path
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			subject, err := OpenReadOnly(path)
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, subject.Close()) })
+
+			f, err := os.Open(path)
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, f.Close()) })
+			br, err := carv2.NewBlockReader(f)
+			require.NoError(t, err)
+			var n int
+			for {
+				want, err := br.Next()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				r, size, err := subject.GetReader(want.Cid())
+				require.NoError(t, err)
+				require.Equal(t, int64(len(want.RawData())), size)
+				got, err := io.ReadAll(r)
+				require.NoError(t, err)
+				require.NoError(t, r.Close())
+				require.Equal(t, want.RawData(), got)
+				n++
+			}
+			require.NotZero(t, n)
+
+			_, _, err = subject.GetReader(merkledag.NewRawNode([]byte("lobstermuncher")).Cid())
+			require.True(t, format.IsNotFound(err))
+		})
+	}
+}
+
+func TestReadOnlyGetInto(t *testing.T) {
+	for _, path := range []string{"../testdata/sample-v1.car", "../testdata/sample-wrapped-v2.car"} {
+		path := path
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			subject, err := OpenReadOnly(path)
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, subject.Close()) })
+
+			f, err := os.Open(path)
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, f.Close()) })
+			br, err := carv2.NewBlockReader(f)
+			require.NoError(t, err)
+
+			// Reuse a single buffer across lookups, growing it when too small.
+			var buf []byte
+			var grown int
+			for {
+				want, err := br.Next()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				n, err := subject.GetInto(want.Cid(), buf)
+				var tooSmall *ErrBufferTooSmall
+				if errors.As(err, &tooSmall) {
+					require.Equal(t, len(want.RawData()), tooSmall.Size)
+					require.Less(t, len(buf), tooSmall.Size)
+					buf = make([]byte, tooSmall.Size)
+					grown++
+					n, err = subject.GetInto(want.Cid(), buf)
+				}
+				require.NoError(t, err)
+				require.Equal(t, want.RawData(), buf[:n])
+			}
+			require.NotZero(t, grown)
+
+			_, err = subject.GetInto(merkledag.NewRawNode([]byte("lobstermuncher")).Cid(), buf)
+			require.True(t, format.IsNotFound(err))
+		})
+	}
+}
+
+func TestReadOnlyEmptyBlock(t *testing.T) {
+	ctx := context.TODO()
+	empty := merkledag.NewRawNode([]byte{})
+	path := filepath.Join(t.TempDir(), "empty-block.car")
+	rw, err := OpenReadWrite(path, []cid.Cid{empty.Cid()})
+	require.NoError(t, err)
+	require.NoError(t, rw.Put(ctx, empty))
+	require.NoError(t, rw.Finalize())
+
+	// Assert that a block with no data is found, rather than mistaken for a missing one.
+	subject, err := OpenReadOnly(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+	has, err := subject.Has(ctx, empty.Cid())
+	require.NoError(t, err)
+	require.True(t, has)
+	got, err := subject.Get(ctx, empty.Cid())
+	require.NoError(t, err)
+	require.Empty(t, got.RawData())
+	raw, err := subject.GetRaw(empty.Cid())
+	require.NoError(t, err)
+	require.Empty(t, raw)
+	size, err := subject.GetSize(ctx, empty.Cid())
+	require.NoError(t, err)
+	require.Zero(t, size)
+}
+
+func TestOpenReadOnlyFromSeeker(t *testing.T) {
+	ctx := context.TODO()
+	for _, path := range []string{"../testdata/sample-v1.car", "../testdata/sample-wrapped-v2.car"} {
+		path := path
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+			want, err := OpenReadOnly(path)
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, want.Close()) })
+
+			subject, err := OpenReadOnlyFromSeeker(&exclusiveReadSeeker{rs: bytes.NewReader(data)}, nil)
+			require.NoError(t, err)
+			keys, err := want.AllKeysChan(ctx)
+			require.NoError(t, err)
+
+			// Assert concurrent lookups are served correctly while serialising access to the seeker.
+			var wg sync.WaitGroup
+			errs := make(chan error, 1)
+			for key := range keys {
+				key := key
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					wantBlock, err := want.Get(ctx, key)
+					if err == nil {
+						var gotBlock blocks.Block
+						if gotBlock, err = subject.Get(ctx, key); err == nil && !bytes.Equal(wantBlock.RawData(), gotBlock.RawData()) {
+							err = fmt.Errorf("block mismatch for %s", key)
+						}
+					}
+					if err != nil {
+						select {
+						case errs <- err:
+						default:
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			require.NoError(t, <-errs)
+		})
+	}
+}
+
+// exclusiveReadSeeker is an io.ReadSeeker which fails if it is used concurrently.
+type exclusiveReadSeeker struct {
+	rs    io.ReadSeeker
+	mu    sync.Mutex
+	inUse bool
+}
+
+func (e *exclusiveReadSeeker) acquire() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.inUse {
+		return errors.New("concurrent use of read seeker")
+	}
+	e.inUse = true
+	return nil
+}
+
+func (e *exclusiveReadSeeker) release() {
+	e.mu.Lock()
+	e.inUse = false
+	e.mu.Unlock()
+}
+
+func (e *exclusiveReadSeeker) Read(p []byte) (int, error) {
+	if err := e.acquire(); err != nil {
+		return 0, err
+	}
+	defer e.release()
+	// Return short reads to assert they are completed as io.ReaderAt requires.
+	if len(p) > 3 {
+		p = p[:3]
+	}
+	return e.rs.Read(p)
+}
+
+func (e *exclusiveReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	if err := e.acquire(); err != nil {
+		return 0, err
+	}
+	defer e.release()
+	return e.rs.Seek(offset, whence)
+}
+
+func TestOpenReadOnlyAt(t *testing.T) {
+	ctx := context.TODO()
+	for _, path := range []string{"../testdata/sample-v1.car", "../testdata/sample-wrapped-v2.car"} {
+		path := path
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+			want, err := OpenReadOnly(path)
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, want.Close()) })
+
+			// Embed the CAR between unrelated bytes.
+			prefix, suffix := bytes.Repeat([]byte{0xfe}, 1234), bytes.Repeat([]byte{0xef}, 567)
+			container := bytes.NewReader(append(append(append([]byte{}, prefix...), data...), suffix...))
+
+			for _, attachIndex := range []bool{true, false} {
+				subject, err := OpenReadOnlyAt(container, int64(len(prefix)), int64(len(data)), attachIndex)
+				require.NoError(t, err)
+				wantRoots, err := want.Roots()
+				require.NoError(t, err)
+				gotRoots, err := subject.Roots()
+				require.NoError(t, err)
+				require.Equal(t, wantRoots, gotRoots)
+
+				keys, err := want.AllKeysChan(ctx)
+				require.NoError(t, err)
+				for key := range keys {
+					wantBlock, err := want.Get(ctx, key)
+					require.NoError(t, err)
+					gotBlock, err := subject.Get(ctx, key)
+					require.NoError(t, err)
+					require.Equal(t, wantBlock, gotBlock)
+				}
+			}
+		})
+	}
+
+	_, err := OpenReadOnlyAt(bytes.NewReader(nil), -1, 10, true)
+	require.Error(t, err)
+	_, err = OpenReadOnlyAt(bytes.NewReader(nil), 0, 0, true)
+	require.Error(t, err)
+}
+
+func TestReadOnlyRejectsNonCanonicalSectionLength(t *testing.T) {
+	blk := merkledag.NewRawNode([]byte("fish"))
+	var buf bytes.Buffer
+	require.NoError(t, carv1.WriteHeader(&carv1.CarHeader{Roots: []cid.Cid{blk.Cid()}, Version: 1}, &buf))
+	offset := uint64(buf.Len())
+	// The section length with a redundant continuation byte.
+	buf.Write([]byte{byte(len(blk.Cid().Bytes())+len(blk.RawData())) | 0x80, 0x00})
+	buf.Write(blk.Cid().Bytes())
+	buf.Write(blk.RawData())
+
+	idx := index.NewMultihashSorted()
+	require.NoError(t, idx.Load([]index.Record{{Cid: blk.Cid(), Offset: offset}}))
+	subject, err := NewReadOnly(bytes.NewReader(buf.Bytes()), idx)
+	require.NoError(t, err)
+	_, err = subject.Get(context.TODO(), blk.Cid())
+	require.ErrorIs(t, err, carv2.ErrNonCanonicalVarint)
+	var corrupt *ErrCorruptCar
+	require.ErrorAs(t, err, &corrupt)
+	require.Equal(t, offset, corrupt.Offset)
+}
+
+func TestReadOnlyHashOnRead(t *testing.T) {
+	ctx := context.Background()
+	original, err := ioutil.ReadFile("../testdata/sample-v1.car")
+	require.NoError(t, err)
+	br, err := carv2.NewBlockReader(bytes.NewReader(original))
+	require.NoError(t, err)
+	var keys []cid.Cid
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if blk.Cid().Prefix().MhType != multihash.IDENTITY {
+			keys = append(keys, blk.Cid())
+		}
+	}
+	require.Greater(t, len(keys), 1)
+
+	// Corrupt the last byte of the data of the first block.
+	intact, err := NewReadOnly(bytes.NewReader(original), nil)
+	require.NoError(t, err)
+	loc, err := intact.Locate(keys[0])
+	require.NoError(t, err)
+	corrupted := append([]byte{}, original...)
+	corrupted[loc.Offset+loc.SectionLength-1] ^= 0xff
+	subject, err := NewReadOnly(bytes.NewReader(corrupted), nil)
+	require.NoError(t, err)
+
+	// Assert blocks are not hashed by default.
+	_, err = subject.Get(ctx, keys[0])
+	require.NoError(t, err)
+	verified, failed := subject.VerificationStats()
+	require.Zero(t, verified)
+	require.Zero(t, failed)
+
+	// Assert intact blocks are verified, and counted safely under concurrent reads.
+	subject.HashOnRead(true)
+	errs := make(chan error, len(keys)-1)
+	var wg sync.WaitGroup
+	for _, key := range keys[1:] {
+		key := key
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := subject.Get(ctx, key)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	verified, failed = subject.VerificationStats()
+	require.Equal(t, uint64(len(keys)-1), verified)
+	require.Zero(t, failed)
+
+	// Assert the corrupt block fails verification.
+	_, err = subject.Get(ctx, keys[0])
+	require.ErrorIs(t, err, blockstore.ErrHashMismatch)
+	verified, failed = subject.VerificationStats()
+	require.Equal(t, uint64(len(keys)-1), verified)
+	require.Equal(t, uint64(1), failed)
+
+	// Assert hashing can be disabled again.
+	subject.HashOnRead(false)
+	_, err = subject.Get(ctx, keys[0])
+	require.NoError(t, err)
+	_, failed = subject.VerificationStats()
+	require.Equal(t, uint64(1), failed)
+}
+
+func TestOpenReadOnlyGzip(t *testing.T) {
+	ctx := context.Background()
+	for _, path := range []string{"../testdata/sample-v1.car", "../testdata/sample-wrapped-v2.car"} {
+		plain, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		gzPath := filepath.Join(t.TempDir(), filepath.Base(path)+".gz")
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		_, err = zw.Write(plain)
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+		require.NoError(t, ioutil.WriteFile(gzPath, compressed.Bytes(), 0o666))
+
+		want, err := NewReadOnly(bytes.NewReader(plain), nil)
+		require.NoError(t, err)
+		wantRoots, err := want.Roots()
+		require.NoError(t, err)
+		keys, err := want.AllKeysChan(ctx)
+		require.NoError(t, err)
+		var wantBlocks []blocks.Block
+		for key := range keys {
+			blk, err := want.Get(ctx, key)
+			require.NoError(t, err)
+			wantBlocks = append(wantBlocks, blk)
+		}
+		require.NotEmpty(t, wantBlocks)
+
+		for _, inMemory := range []bool{false, true} {
+			inMemory := inMemory
+			t.Run(fmt.Sprintf("%s/InMemory=%t", filepath.Base(path), inMemory), func(t *testing.T) {
+				// Decompress into a dedicated temporary directory, to assert it is cleaned up.
+				tmpDir := t.TempDir()
+				t.Setenv("TMPDIR", tmpDir)
+
+				subject, err := OpenReadOnlyGzip(gzPath, DecompressGzipInMemory(inMemory))
+				require.NoError(t, err)
+				tmpFiles, err := os.ReadDir(tmpDir)
+				require.NoError(t, err)
+				if inMemory {
+					require.Empty(t, tmpFiles)
+				} else {
+					require.Len(t, tmpFiles, 1)
+				}
+
+				gotRoots, err := subject.Roots()
+				require.NoError(t, err)
+				require.Equal(t, wantRoots, gotRoots)
+				for _, wantBlock := range wantBlocks {
+					got, err := subject.Get(ctx, wantBlock.Cid())
+					require.NoError(t, err)
+					require.Equal(t, wantBlock.RawData(), got.RawData())
+				}
+
+				require.NoError(t, subject.Close())
+				tmpFiles, err = os.ReadDir(tmpDir)
+				require.NoError(t, err)
+				require.Empty(t, tmpFiles)
+			})
+		}
+	}
+
+	// Assert a CAR that is not gzip-compressed is an error.
+	_, err := OpenReadOnlyGzip("../testdata/sample-v1.car")
+	require.Error(t, err)
+}
+
+func TestReadOnlyGetWithChildren(t *testing.T) {
+	ctx := context.Background()
+	rawChild := merkledag.NewRawNode([]byte("fish"))
+	pbChild := merkledag.NodeWithData([]byte("lobster"))
+	missing := merkledag.NewRawNode([]byte("lobstermuncher"))
+	parent := merkledag.NodeWithData([]byte("barreleye"))
+	require.NoError(t, parent.AddNodeLink("a", rawChild))
+	require.NoError(t, parent.AddNodeLink("b", pbChild))
+	require.NoError(t, parent.AddNodeLink("c", missing))
+	require.NoError(t, parent.AddNodeLink("d", rawChild))
+
+	path := filepath.Join(t.TempDir(), "children.car")
+	rw, err := OpenReadWrite(path, []cid.Cid{parent.Cid()})
+	require.NoError(t, err)
+	require.NoError(t, rw.PutMany(ctx, []blocks.Block{parent, rawChild, pbChild}))
+
+	// Assert the present children are returned once each, in the order in which they are linked.
+	check := func(subject interface {
+		GetWithChildren(context.Context, cid.Cid) (blocks.Block, []blocks.Block, error)
+	}) {
+		gotBlk, gotChildren, err := subject.GetWithChildren(ctx, parent.Cid())
+		require.NoError(t, err)
+		require.Equal(t, parent.RawData(), gotBlk.RawData())
+		require.Len(t, gotChildren, 2)
+		require.Equal(t, rawChild.Cid(), gotChildren[0].Cid())
+		require.Equal(t, rawChild.RawData(), gotChildren[0].RawData())
+		require.Equal(t, pbChild.Cid(), gotChildren[1].Cid())
+		require.Equal(t, pbChild.RawData(), gotChildren[1].RawData())
+
+		// Assert a raw block has no children, and a missing block is not found.
+		gotBlk, gotChildren, err = subject.GetWithChildren(ctx, rawChild.Cid())
+		require.NoError(t, err)
+		require.Equal(t, rawChild.RawData(), gotBlk.RawData())
+		require.Empty(t, gotChildren)
+		_, _, err = subject.GetWithChildren(ctx, missing.Cid())
+		require.True(t, format.IsNotFound(err))
+	}
+	check(rw)
+	require.NoError(t, rw.Finalize())
+
+	subject, err := OpenReadOnly(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+	check(subject)
+}
+
+// countingReaderAt counts the bytes read from the wrapped io.ReaderAt.
+type countingReaderAt struct {
+	io.ReaderAt
+	read int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.ReaderAt.ReadAt(p, off)
+	c.read += int64(n)
+	return n, err
+}
+
+func TestReadOnlyWarm(t *testing.T) {
+	ctx := context.Background()
+
+	// Assert a lazily generated index is completed.
+	subject, err := OpenReadOnlyLazy("../testdata/sample-v1.car")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+	lazy, ok := subject.idx.(*lazyIndex)
+	require.True(t, ok)
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	require.ErrorIs(t, subject.Warm(cancelled), context.Canceled)
+	require.False(t, lazy.done)
+	require.NoError(t, subject.Warm(ctx))
+	require.True(t, lazy.done)
+
+	// Assert the data payload is only read if enabled.
+	data, err := ioutil.ReadFile("../testdata/sample-wrapped-v2.car")
+	require.NoError(t, err)
+	v2r, err := carv2.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	for _, warmData := range []bool{false, true} {
+		backing := &countingReaderAt{ReaderAt: bytes.NewReader(data)}
+		subject, err := NewReadOnly(backing, nil, WarmDataPayload(warmData))
+		require.NoError(t, err)
+		before := backing.read
+		require.NoError(t, subject.Warm(ctx))
+		if warmData {
+			require.Equal(t, int64(v2r.Header.DataSize), backing.read-before)
+			require.ErrorIs(t, subject.Warm(cancelled), context.Canceled)
+		} else {
+			require.Equal(t, before, backing.read)
+		}
+		require.NoError(t, subject.Close())
+		require.Error(t, subject.Warm(ctx))
+	}
+
+	// Assert an index used in place from the mapping of the CAR is read, unlike one decoded upfront.
+	mappablePath := filepath.Join(t.TempDir(), "mappable.car")
+	dst, err := os.Create(mappablePath)
+	require.NoError(t, err)
+	require.NoError(t, carv2.WrapV1(bytes.NewReader(data[v2r.Header.DataOffset:v2r.Header.DataOffset+v2r.Header.DataSize]), dst, carv2.UseIndexCodec(index.CarMappableIndexSorted)))
+	require.NoError(t, dst.Close())
+	decoded, err := OpenReadOnly(mappablePath)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, decoded.Close()) })
+	require.NoError(t, decoded.Warm(cancelled))
+	mapped, err := OpenReadOnlyMmap(mappablePath)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, mapped.Close()) })
+	require.ErrorIs(t, mapped.Warm(cancelled), context.Canceled)
+	require.NoError(t, mapped.Warm(ctx))
+
+	// Assert one byte is read per page.
+	pageSize := os.Getpagesize()
+	pages := make([]byte, 3*pageSize+1)
+	for i := 0; i < len(pages); i += pageSize {
+		pages[i] = 1
+	}
+	sum, err := touchPages(ctx, pages)
+	require.NoError(t, err)
+	require.Equal(t, byte(4), sum)
+}
+
+func TestReadOnlyRootsUnique(t *testing.T) {
+	fish := merkledag.NewRawNode([]byte("fish"))
+	lobster := merkledag.NewRawNode([]byte("lobster"))
+	fishV1 := cid.NewCidV1(cid.DagCBOR, fish.Cid().Hash())
+	roots := []cid.Cid{fish.Cid(), lobster.Cid(), fish.Cid(), fishV1, lobster.Cid()}
+
+	var buf bytes.Buffer
+	require.NoError(t, carv1.WriteHeader(&carv1.CarHeader{Roots: roots, Version: 1}, &buf))
+	for _, nd := range []*merkledag.RawNode{fish, lobster} {
+		require.NoError(t, util.LdWrite(&buf, nd.Cid().Bytes(), nd.RawData()))
+	}
+	subject, err := NewReadOnly(bytes.NewReader(buf.Bytes()), nil)
+	require.NoError(t, err)
+
+	// Assert Roots returns the roots verbatim, and RootsUnique in order of first occurrence.
+	got, err := subject.Roots()
+	require.NoError(t, err)
+	require.Equal(t, roots, got)
+	got, err = subject.RootsUnique()
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{fish.Cid(), lobster.Cid(), fishV1}, got)
+
+	// Assert roots that are already unique are returned as they are.
+	subject, err = OpenReadOnly("../testdata/sample-v1.car")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+	want, err := subject.Roots()
+	require.NoError(t, err)
+	got, err = subject.RootsUnique()
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+}
+
+func TestReadOnlyWithNotFoundError(t *testing.T) {
+	ctx := context.TODO()
+	sentinel := errors.New("blockstore: block not found")
+	missing := merkledag.NewRawNode([]byte("lobstermuncher")).Cid()
+
+	subject, err := OpenReadOnly("../testdata/sample-v1.car", WithNotFoundError(sentinel))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+
+	_, err = subject.Get(ctx, missing)
+	requireNotFound := func(t *testing.T, err error) {
+		require.ErrorIs(t, err, sentinel)
+		require.True(t, format.IsNotFound(err))
+		var nf format.ErrNotFound
+		require.True(t, errors.As(err, &nf))
+		require.Equal(t, missing, nf.Cid)
+		require.Equal(t, format.ErrNotFound{Cid: missing}.Error(), err.Error())
+	}
+	requireNotFound(t, err)
+	_, err = subject.GetSize(ctx, missing)
+	requireNotFound(t, err)
+	_, err = subject.Locate(missing)
+	requireNotFound(t, err)
+
+	// Assert that format.ErrNotFound is returned as is by default.
+	subject, err = OpenReadOnly("../testdata/sample-v1.car")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+	_, err = subject.Get(ctx, missing)
+	require.Equal(t, format.ErrNotFound{Cid: missing}, err)
+	require.False(t, errors.Is(err, sentinel))
+}
+
+func TestReadOnlyPrefetchWindow(t *testing.T) {
+	ctx := context.TODO()
+	want, err := OpenReadOnly("../testdata/sample-v1.car")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, want.Close()) })
+	records, err := want.Manifest()
+	require.NoError(t, err)
+	require.Greater(t, len(records), 10)
+
+	subject, err := OpenReadOnly("../testdata/sample-v1.car", PrefetchWindow(4))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+	require.NotNil(t, subject.prefetch)
+
+	// Assert the sections following a Get are prefetched.
+	got, err := subject.Get(ctx, records[0].Cid)
+	require.NoError(t, err)
+	require.Equal(t, records[0].Length, uint64(len(got.RawData())))
+	subject.prefetch.wg.Wait()
+	for _, r := range records[1:5] {
+		e, ok := subject.prefetch.get(r.Offset)
+		require.True(t, ok)
+		require.Equal(t, r.Cid, e.cid)
+		require.Equal(t, r.Length, uint64(len(e.data)))
+	}
+	_, ok := subject.prefetch.get(records[5].Offset)
+	require.False(t, ok)
+
+	// Assert blocks read concurrently, in and out of order, match the ones read without prefetching.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range records {
+				r := records[(j+i*len(records)/4)%len(records)]
+				wantBlk, err := want.Get(ctx, r.Cid)
+				require.NoError(t, err)
+				gotBlk, err := subject.Get(ctx, r.Cid)
+				require.NoError(t, err)
+				require.Equal(t, wantBlk.RawData(), gotBlk.RawData())
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Assert the cache is bounded to twice the window.
+	subject.prefetch.wg.Wait()
+	require.LessOrEqual(t, subject.prefetch.lru.Len(), 8)
+	require.Len(t, subject.prefetch.entries, subject.prefetch.lru.Len())
+}
+
+func TestOpenReadOnlyWithIndexPreference(t *testing.T) {
+	ctx := context.TODO()
+	path := "../testdata/sample-wrapped-v2.car"
+	v2r, err := carv2.OpenReader(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, v2r.Close()) })
+	ir, err := v2r.IndexReader()
+	require.NoError(t, err)
+	embedded, err := index.ReadCodec(ir)
+	require.NoError(t, err)
+	require.NotEqual(t, index.CarMappableIndexSorted, embedded)
+
+	// Write a sidecar index in a codec other than the embedded one.
+	dr, err := v2r.DataReader()
+	require.NoError(t, err)
+	generated, err := carv2.GenerateIndex(dr)
+	require.NoError(t, err)
+	mappable, err := index.Convert(generated, index.CarMappableIndexSorted)
+	require.NoError(t, err)
+	sidecar := filepath.Join(t.TempDir(), "sample-wrapped-v2.carindex")
+	f, err := os.Create(sidecar)
+	require.NoError(t, err)
+	_, err = index.WriteTo(mappable, f)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	sidecars := []string{filepath.Join(t.TempDir(), "nonexistent.carindex"), sidecar}
+
+	tests := []struct {
+		name      string
+		prefer    []multicodec.Code
+		wantCodec multicodec.Code
+	}{
+		{"Sidecar", []multicodec.Code{index.CarMappableIndexSorted, embedded}, index.CarMappableIndexSorted},
+		{"Embedded", []multicodec.Code{embedded, index.CarMappableIndexSorted}, embedded},
+		{"Unavailable", []multicodec.Code{multicodec.CarIndexSorted}, embedded},
+		{"None", nil, embedded},
+	}
+	if embedded == multicodec.CarIndexSorted {
+		tests[2].prefer = []multicodec.Code{multicodec.CarMultihashIndexSorted}
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			subject, err := OpenReadOnlyWithIndexPreference(path, tt.prefer, sidecars)
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, subject.Close()) })
+			require.Equal(t, tt.wantCodec, subject.idx.Codec())
+
+			dr, err := v2r.DataReader()
+			require.NoError(t, err)
+			br, err := carv2.NewBlockReader(dr)
+			require.NoError(t, err)
+			for {
+				want, err := br.Next()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				got, err := subject.Get(ctx, want.Cid())
+				require.NoError(t, err)
+				require.Equal(t, want.RawData(), got.RawData())
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package blockstore
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -15,11 +16,15 @@ import (
 	"github.com/ipld/go-car/v2/internal/carv1"
 	"github.com/ipld/go-car/v2/internal/carv1/util"
 	internalio "github.com/ipld/go-car/v2/internal/io"
-	"github.com/multiformats/go-varint"
 )
 
 var _ blockstore.Blockstore = (*ReadWrite)(nil)
 
+// ErrSizeChanged signals that a block cannot be replaced in place, since the length of its
+// replacement data differs from the length of the data it replaces.
+// See ReadWrite.Replace.
+var ErrSizeChanged = errors.New("cannot replace block in place with data of different length")
+
 // ReadWrite implements a blockstore that stores blocks in CARv2 format.
 // Blocks put into the blockstore can be read back once they are successfully written.
 // This implementation is preferable for a write-heavy workload.
@@ -99,6 +104,9 @@ func AllowDuplicatePuts(allow bool) carv2.Option {
 // Resuming from finalized files is allowed. However, resumption will regenerate the index
 // regardless by scanning every existing block in file.
 func OpenReadWrite(path string, roots []cid.Cid, opts ...carv2.Option) (*ReadWrite, error) {
+	if carv2.ApplyOptions(opts...).SectionLengthFormat != carv2.SectionLengthUvarint {
+		return nil, errors.New("section length formats other than uvarint are not supported for writing")
+	}
 	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o666) // TODO: Should the user be able to configure FileMode permissions?
 	if err != nil {
 		return nil, fmt.Errorf("could not open read/write file: %w", err)
@@ -144,6 +152,7 @@ func OpenReadWrite(path string, roots []cid.Cid, opts ...carv2.Option) (*ReadWri
 		return nil, err
 	}
 	rwbs.ronly.backing = v1r
+	rwbs.ronly.dataOffset = uint64(offset)
 	rwbs.ronly.idx = rwbs.idx
 	rwbs.ronly.carv2Closer = rwbs.f
 
@@ -274,8 +283,7 @@ func (b *ReadWrite) resumeWithRoots(v2 bool, roots []cid.Cid) error {
 
 	for {
 		// Grab the length of the section.
-		// Note that ReadUvarint wants a ByteReader.
-		length, err := varint.ReadUvarint(v1r)
+		length, err := util.ReadSectionLength(v1r, b.opts.MaxAllowedSectionSize)
 		if err != nil {
 			if err == io.EOF {
 				break
@@ -297,7 +305,7 @@ func (b *ReadWrite) resumeWithRoots(v2 bool, roots []cid.Cid) error {
 		if err != nil {
 			return err
 		}
-		b.idx.insertNoReplace(c, uint64(sectionOffset))
+		b.idx.insertNoReplace(c, uint64(sectionOffset), length-uint64(n))
 
 		// Seek to the next section by skipping the block.
 		// The section length includes the CID, so subtract it.
@@ -369,11 +377,98 @@ func (b *ReadWrite) PutMany(ctx context.Context, blks []blocks.Block) error {
 		if err := util.LdWrite(b.dataWriter, c.Bytes(), bl.RawData()); err != nil {
 			return err
 		}
-		b.idx.insertNoReplace(c, n)
+		b.idx.insertNoReplace(c, n, uint64(len(bl.RawData())))
 	}
 	return nil
 }
 
+// Replace overwrites, in place, the data of the block written for the given key with the given
+// data, without rewriting any other part of the file. The section of the block, including its
+// offset and its CID as written, is left unchanged; only its data is patched.
+//
+// The given data must have the same length as the data it replaces, otherwise ErrSizeChanged is
+// returned. Further, the data must match the given key, i.e. hashing it must result in the same
+// multihash as the key, which is checked regardless of HashOnRead. Since the data already written
+// is expected to match the key too, this is typically useful for repairing corrupt sections.
+// Blocks are matched by multihash, or by whole CID if UseWholeCIDs is enabled;
+// format.ErrNotFound is returned if no block matches the key.
+// Blocks with multihash.IDENTITY code are never written and therefore cannot be replaced.
+func (b *ReadWrite) Replace(key cid.Cid, data []byte) error {
+	b.ronly.mu.Lock()
+	defer b.ronly.mu.Unlock()
+
+	if b.ronly.closed {
+		return errClosed
+	}
+
+	var dataOffset int64 = -1
+	var fnErr error
+	err := b.idx.GetAll(key, func(offset uint64) bool {
+		rdr, err := internalio.NewOffsetReadSeeker(b.ronly.backing, int64(offset))
+		if err != nil {
+			fnErr = err
+			return false
+		}
+		sectionLen, err := util.ReadSectionLength(rdr, b.opts.MaxAllowedSectionSize)
+		if err != nil {
+			fnErr = err
+			return false
+		}
+		cidLen, readCid, err := cid.CidFromReader(rdr)
+		if err != nil {
+			fnErr = err
+			return false
+		}
+		if b.opts.BlockstoreUseWholeCIDs && !readCid.Equals(key) {
+			return true // continue looking
+		}
+		if !bytes.Equal(readCid.Hash(), key.Hash()) {
+			return false
+		}
+		if sectionLen-uint64(cidLen) != uint64(len(data)) {
+			fnErr = ErrSizeChanged
+			return false
+		}
+		pos, err := rdr.Seek(0, io.SeekCurrent)
+		if err != nil {
+			fnErr = err
+			return false
+		}
+		dataOffset = int64(offset) + pos
+		return false
+	})
+	if errors.Is(err, index.ErrNotFound) {
+		return b.ronly.notFound(key)
+	} else if err != nil {
+		return err
+	} else if fnErr != nil {
+		return fnErr
+	}
+	if dataOffset < 0 {
+		return b.ronly.notFound(key)
+	}
+
+	// Check the data matches key only after the length, so that ErrSizeChanged is returned for
+	// data of different length regardless.
+	want, err := key.Prefix().Sum(data)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(want.Hash(), key.Hash()) {
+		return fmt.Errorf("data does not match key %s; got %s", key, want)
+	}
+	_, err = b.f.WriteAt(data, b.dataOffset()+dataOffset)
+	return err
+}
+
+// dataOffset returns the offset of the data payload in the file.
+func (b *ReadWrite) dataOffset() int64 {
+	if b.opts.WriteAsCarV1 {
+		return 0
+	}
+	return int64(b.header.DataOffset)
+}
+
 // Discard closes this blockstore without finalizing its header and index.
 // After this call, the blockstore can no longer be used.
 //
@@ -409,6 +504,10 @@ func (b *ReadWrite) Finalize() error {
 
 	// TODO check if add index option is set and don't write the index then set index offset to zero.
 	b.header = b.header.WithDataSize(uint64(b.dataWriter.Position()))
+	if a := b.opts.IndexAlignment; a > 0 {
+		_, p := carv2.PaddingForAlignment(b.header.DataOffset, b.header.IndexOffset-b.header.DataOffset, a)
+		b.header = b.header.WithIndexPadding(p)
+	}
 	b.header.Characteristics.SetFullyIndexed(b.opts.StoreIdentityCIDs)
 
 	// Note that we can't use b.Close here, as that tries to grab the same
@@ -420,6 +519,12 @@ func (b *ReadWrite) Finalize() error {
 	if err != nil {
 		return err
 	}
+	if b.opts.AbsoluteIndexOffsets {
+		b.header.Characteristics.SetAbsoluteIndexOffsets(true)
+		if fi, err = index.Rebase(fi, int64(b.header.DataOffset)); err != nil {
+			return err
+		}
+	}
 	if _, err := index.WriteTo(fi, internalio.NewOffsetWriter(b.f, int64(b.header.IndexOffset))); err != nil {
 		return err
 	}
@@ -441,14 +546,47 @@ func (b *ReadWrite) Has(ctx context.Context, key cid.Cid) (bool, error) {
 	return b.ronly.Has(ctx, key)
 }
 
+func (b *ReadWrite) HasMany(ctx context.Context, keys []cid.Cid) ([]bool, error) {
+	return b.ronly.HasMany(ctx, keys)
+}
+
 func (b *ReadWrite) Get(ctx context.Context, key cid.Cid) (blocks.Block, error) {
 	return b.ronly.Get(ctx, key)
 }
 
+// GetWithChildren gets the block identified by key along with the blocks it links to that are
+// present. See ReadOnly.GetWithChildren.
+func (b *ReadWrite) GetWithChildren(ctx context.Context, key cid.Cid) (blocks.Block, []blocks.Block, error) {
+	return b.ronly.GetWithChildren(ctx, key)
+}
+
+// ExportBlock writes the block identified by key to w as a single-block CARv1.
+// See ReadOnly.ExportBlock.
+func (b *ReadWrite) ExportBlock(ctx context.Context, key cid.Cid, w io.Writer) error {
+	return b.ronly.ExportBlock(ctx, key, w)
+}
+
+// GetRaw returns the data of the block identified by key. See ReadOnly.GetRaw.
+func (b *ReadWrite) GetRaw(key cid.Cid) ([]byte, error) {
+	return b.ronly.GetRaw(key)
+}
+
+// GetReader returns a reader over the data of the block identified by key, along with its length.
+// See ReadOnly.GetReader.
+func (b *ReadWrite) GetReader(key cid.Cid) (io.ReadCloser, int64, error) {
+	return b.ronly.GetReader(key)
+}
+
 func (b *ReadWrite) GetSize(ctx context.Context, key cid.Cid) (int, error) {
 	return b.ronly.GetSize(ctx, key)
 }
 
+// Locate returns the location of the block identified by key within the CAR being written.
+// See ReadOnly.Locate.
+func (b *ReadWrite) Locate(key cid.Cid) (Location, error) {
+	return b.ronly.Locate(key)
+}
+
 func (b *ReadWrite) DeleteBlock(_ context.Context, _ cid.Cid) error {
 	return fmt.Errorf("ReadWrite blockstore does not support deleting blocks")
 }
@@ -457,6 +595,28 @@ func (b *ReadWrite) HashOnRead(enable bool) {
 	b.ronly.HashOnRead(enable)
 }
 
+// Warm prepares the blockstore for serving lookups with low latency. See ReadOnly.Warm.
+func (b *ReadWrite) Warm(ctx context.Context) error {
+	return b.ronly.Warm(ctx)
+}
+
+// VerificationStats returns the number of blocks hashed on read that matched and did not match
+// their key. See ReadOnly.VerificationStats.
+func (b *ReadWrite) VerificationStats() (verified, failed uint64) {
+	return b.ronly.VerificationStats()
+}
+
+// Err returns the error that stopped the last enumeration of keys started via AllKeysChan.
+// See ReadOnly.Err.
+func (b *ReadWrite) Err() error {
+	return b.ronly.Err()
+}
+
 func (b *ReadWrite) Roots() ([]cid.Cid, error) {
 	return b.ronly.Roots()
 }
+
+// RootsUnique returns the roots of the CAR with duplicates removed. See ReadOnly.RootsUnique.
+func (b *ReadWrite) RootsUnique() ([]cid.Cid, error) {
+	return b.ronly.RootsUnique()
+}
@@ -1,6 +1,7 @@
 package blockstore_test
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha512"
 	"fmt"
@@ -993,3 +994,124 @@ func TestBlockstore_IdentityCidWithEmptyDataIsIndexed(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 1, count)
 }
+
+func TestReadWriteReplace(t *testing.T) {
+	ctx := context.TODO()
+	path := filepath.Join(t.TempDir(), "readwrite-replace.car")
+	subject, err := blockstore.OpenReadWrite(path, []cid.Cid{oneTestBlockWithCidV1.Cid()}, carv2.UseDataPadding(7))
+	require.NoError(t, err)
+	require.NoError(t, subject.PutMany(ctx, []blocks.Block{oneTestBlockWithCidV1, anotherTestBlockWithCidV0}))
+
+	// Corrupt the data of a block by overwriting it in the file directly.
+	want := anotherTestBlockWithCidV0
+	f, err := os.OpenFile(path, os.O_RDWR, 0o666)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, f.Close()) })
+	content, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	at := bytes.Index(content, want.RawData())
+	require.NotEqual(t, -1, at)
+	corrupt := bytes.Repeat([]byte{'x'}, len(want.RawData()))
+	_, err = f.WriteAt(corrupt, int64(at))
+	require.NoError(t, err)
+	got, err := subject.Get(ctx, want.Cid())
+	require.NoError(t, err)
+	require.Equal(t, corrupt, got.RawData())
+
+	// Assert data of different length or not matching the key cannot be replaced.
+	require.ErrorIs(t, subject.Replace(want.Cid(), append(want.RawData(), 'x')), blockstore.ErrSizeChanged)
+	require.Error(t, subject.Replace(want.Cid(), corrupt))
+	missing := merkledag.NewRawNode([]byte("lobstermuncher")).Block
+	require.Equal(t, format.ErrNotFound{Cid: missing.Cid()}, subject.Replace(missing.Cid(), missing.RawData()))
+
+	// Assert the block is repaired in place.
+	require.NoError(t, subject.Replace(want.Cid(), want.RawData()))
+	got, err = subject.Get(ctx, want.Cid())
+	require.NoError(t, err)
+	require.Equal(t, want.RawData(), got.RawData())
+	require.NoError(t, subject.Finalize())
+
+	patched, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, want.RawData(), patched[at:at+len(want.RawData())])
+	robs, err := blockstore.OpenReadOnly(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, robs.Close()) })
+	got, err = robs.Get(ctx, want.Cid())
+	require.NoError(t, err)
+	require.Equal(t, want.RawData(), got.RawData())
+}
+
+func TestReadWriteWithAbsoluteIndexOffsets(t *testing.T) {
+	ctx := context.TODO()
+	path := filepath.Join(t.TempDir(), "readwrite-absolute-index-offsets.car")
+	var blks []blocks.Block
+	for i := 0; i < 10; i++ {
+		blks = append(blks, merkledag.NewRawNode([]byte(fmt.Sprintf("absolute-%d", i))))
+	}
+	subject, err := blockstore.OpenReadWrite(path, []cid.Cid{blks[0].Cid()},
+		carv2.UseDataPadding(7), carv2.UseAbsoluteIndexOffsets(true))
+	require.NoError(t, err)
+	require.NoError(t, subject.PutMany(ctx, blks))
+	require.NoError(t, subject.Finalize())
+
+	v2r, err := carv2.OpenReader(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, v2r.Close()) })
+	require.True(t, v2r.Header.Characteristics.HasAbsoluteIndexOffsets())
+	ir, err := v2r.IndexReader()
+	require.NoError(t, err)
+	idx, err := index.ReadFrom(ir)
+	require.NoError(t, err)
+	dr, err := v2r.DataReader()
+	require.NoError(t, err)
+	wantIdx, err := carv2.GenerateIndex(dr)
+	require.NoError(t, err)
+	for _, blk := range blks {
+		want, err := index.GetFirst(wantIdx, blk.Cid())
+		require.NoError(t, err)
+		got, err := index.GetFirst(idx, blk.Cid())
+		require.NoError(t, err)
+		require.Equal(t, v2r.Header.DataOffset+want, got)
+	}
+
+	// Assert that blocks are found via the index, once rebased onto the data payload.
+	robs, err := blockstore.OpenReadOnly(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, robs.Close()) })
+	for _, want := range blks {
+		got, err := robs.Get(ctx, want.Cid())
+		require.NoError(t, err)
+		require.Equal(t, want.RawData(), got.RawData())
+	}
+}
+
+func TestReadWriteAlignIndexTo(t *testing.T) {
+	ctx := context.TODO()
+	path := filepath.Join(t.TempDir(), "readwrite-align-index.car")
+	var blks []blocks.Block
+	for i := 0; i < 10; i++ {
+		blks = append(blks, merkledag.NewRawNode([]byte(fmt.Sprintf("aligned-%d", i))))
+	}
+	subject, err := blockstore.OpenReadWrite(path, []cid.Cid{blks[0].Cid()},
+		carv2.UseDataPadding(7), carv2.UseIndexPadding(3), carv2.AlignIndexTo(512))
+	require.NoError(t, err)
+	require.NoError(t, subject.PutMany(ctx, blks))
+	require.NoError(t, subject.Finalize())
+
+	v2r, err := carv2.OpenReader(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, v2r.Close()) })
+	h := v2r.Header
+	require.Zero(t, h.IndexOffset%512)
+	require.GreaterOrEqual(t, h.IndexOffset, h.DataOffset+h.DataSize+3)
+
+	robs, err := blockstore.OpenReadOnly(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, robs.Close()) })
+	for _, want := range blks {
+		got, err := robs.Get(ctx, want.Cid())
+		require.NoError(t, err)
+		require.Equal(t, want.RawData(), got.RawData())
+	}
+}
@@ -0,0 +1,96 @@
+package blockstore
+
+import (
+	"context"
+	"io"
+	"os"
+
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/index"
+	internalmmap "github.com/ipld/go-car/v2/internal/mmap"
+)
+
+// warmBufferSize is the size of the reads made by ReadOnly.Warm over the data payload.
+const warmBufferSize = 1 << 20
+
+// WarmDataPayload is a read option which makes ReadOnly.Warm read the entire data payload too,
+// pulling it into the page cache of the operating system when the blockstore is backed by a file.
+//
+// Note that this option only affects ReadOnly.Warm, and is ignored by the root go-car/v2 package.
+//
+// This option is disabled by default.
+func WarmDataPayload(enable bool) carv2.Option {
+	return func(o *carv2.Options) {
+		o.BlockstoreWarmData = enable
+	}
+}
+
+// Warm prepares the blockstore for serving lookups with low latency, as a deterministic warmup
+// step after opening a large CAR rather than relying on lookups to gradually warm it up. The index
+// is completed if it is generated lazily, as by OpenReadOnlyLazy, by scanning the remainder of the
+// data payload. An index that is used in place from the memory mapping of the CAR, as by
+// OpenReadOnlyMmap, is read one byte per page, which faults all of its pages in; other indices
+// read from a CARv2 or generated upfront are already decoded in memory when the blockstore is
+// opened. If WarmDataPayload is enabled, the data payload is then read sequentially from start to
+// end, which pulls the pages of a memory-mapped or file backing into the page cache of the
+// operating system.
+//
+// Warm stops with the error of ctx once it is done. Lookups may be made concurrently, though they
+// wait for the index to be completed when it is generated lazily.
+func (b *ReadOnly) Warm(ctx context.Context) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return errClosed
+	}
+
+	if li, ok := b.idx.(*lazyIndex); ok {
+		if err := li.complete(ctx); err != nil {
+			return err
+		}
+	}
+	if _, mapped := b.carv2Closer.(*internalmmap.ReaderAt); mapped {
+		if mi, ok := b.idx.(*index.MappableIndexSorted); ok {
+			if _, err := touchPages(ctx, mi.Bytes()); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !b.opts.BlockstoreWarmData {
+		return nil
+	}
+	buf := make([]byte, warmBufferSize)
+	for offset := int64(0); ; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := b.backing.ReadAt(buf, offset)
+		offset += int64(n)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// touchPages reads one byte of every page of b, which faults in the pages of a memory-mapped b,
+// checking ctx every warmBufferSize bytes. The sum of the bytes read is returned, and the function
+// is not inlined, such that the reads cannot be optimised away.
+//
+//go:noinline
+func touchPages(ctx context.Context, b []byte) (byte, error) {
+	pageSize := os.Getpagesize()
+	var sum byte
+	for i := 0; i < len(b); i += pageSize {
+		if i%warmBufferSize == 0 {
+			if err := ctx.Err(); err != nil {
+				return sum, err
+			}
+		}
+		sum += b[i]
+	}
+	return sum, nil
+}
@@ -4,6 +4,10 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2/internal/carv1"
+	internalio "github.com/ipld/go-car/v2/internal/io"
 )
 
 const (
@@ -47,6 +51,10 @@ type (
 // fullyIndexedCharPos is the position of Characteristics.Hi bit that specifies whether the index is a catalog af all CIDs or not.
 const fullyIndexedCharPos = 7 // left-most bit
 
+// absoluteIndexOffsetsCharPos is the position of Characteristics.Hi bit that specifies whether
+// the offsets in the index are relative to the start of the CARv2, rather than its data payload.
+const absoluteIndexOffsetsCharPos = 6
+
 // WriteTo writes this characteristics to the given w.
 func (c Characteristics) WriteTo(w io.Writer) (n int64, err error) {
 	buf := make([]byte, 16)
@@ -83,6 +91,23 @@ func (c *Characteristics) SetFullyIndexed(b bool) {
 	}
 }
 
+// HasAbsoluteIndexOffsets specifies whether the offsets in the index of CARv2 are relative to the
+// start of the CARv2 itself, rather than the start of its CARv1 data payload.
+// See UseAbsoluteIndexOffsets
+func (c *Characteristics) HasAbsoluteIndexOffsets() bool {
+	return isBitSet(c.Hi, absoluteIndexOffsetsCharPos)
+}
+
+// SetAbsoluteIndexOffsets sets whether the offsets in the index of CARv2 are relative to the start
+// of the CARv2 itself.
+func (c *Characteristics) SetAbsoluteIndexOffsets(b bool) {
+	if b {
+		c.Hi = setBit(c.Hi, absoluteIndexOffsetsCharPos)
+	} else {
+		c.Hi = unsetBit(c.Hi, absoluteIndexOffsetsCharPos)
+	}
+}
+
 func setBit(n uint64, pos uint) uint64 {
 	n |= 1 << pos
 	return n
@@ -109,6 +134,39 @@ func NewHeader(dataSize uint64) Header {
 	return header
 }
 
+// HeaderLength returns the length in bytes of everything that precedes the first section of a
+// CARv2 with the given roots and no data padding, i.e. the pragma, the CARv2 header and the CARv1
+// header of the data payload. The length of the CARv1 header depends on the number and size of the
+// roots, so this is the offset at which the sections of the data payload begin. It allows callers
+// that write CARs in place, e.g. reserving space for headers to patch later, to compute the layout
+// up front; add any data padding to it. See NewDeferredRootsWriter.
+func HeaderLength(roots []cid.Cid) (uint64, error) {
+	v1Size, err := carv1.HeaderSize(&carv1.CarHeader{Roots: roots, Version: 1})
+	if err != nil {
+		return 0, err
+	}
+	return PragmaSize + HeaderSize + v1Size, nil
+}
+
+// PaddingForAlignment computes the minimal padding for a CARv2, whose data payload of dataSize bytes
+// begins at dataOffset, such that its index begins at a multiple of align, e.g. the page size to
+// allow memory-mapping the index. The index begins at dataOffset + carV1Padding + dataSize +
+// indexPadding, and its alignment is reached by padding the index alone; therefore carV1Padding
+// is always zero and indexPadding is less than align. An align of zero or one requires no padding.
+//
+// The dataOffset is usually the DataOffset of a Header, i.e. PragmaSize + HeaderSize plus any data
+// padding. The paddings can be applied via UseDataPadding and UseIndexPadding, or directly via
+// AlignIndexTo.
+func PaddingForAlignment(dataOffset, dataSize, align uint64) (carV1Padding, indexPadding uint64) {
+	if align <= 1 {
+		return 0, 0
+	}
+	if r := (dataOffset + dataSize) % align; r != 0 {
+		indexPadding = align - r
+	}
+	return 0, indexPadding
+}
+
 // WithIndexPadding sets the index offset from the beginning of the file for this header and returns
 // the header for convenient chained calls.
 // The index offset is calculated as the sum of PragmaSize, HeaderSize,
@@ -186,6 +244,10 @@ func (h *Header) ReadFrom(r io.Reader) (int64, error) {
 	if int64(indexOffset) < 0 {
 		return n, fmt.Errorf("invalid index offset: %v", indexOffset)
 	}
+	// Assert the end of the data payload is within the offsets that can be read at.
+	if _, err := internalio.AddOffset(dataOffset, dataSize); err != nil {
+		return n, fmt.Errorf("%w: data payload of size %d at offset %d", err, dataSize, dataOffset)
+	}
 	h.DataOffset = dataOffset
 	h.DataSize = dataSize
 	h.IndexOffset = indexOffset
@@ -2,12 +2,15 @@ package car_test
 
 import (
 	"bytes"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 
 	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/index"
 	"github.com/ipld/go-car/v2/internal/carv1"
+	"github.com/multiformats/go-multihash"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -146,11 +149,27 @@ func TestHeader_ReadFrom(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"DataPayloadEndingBeyondMaxInt64IsRejected",
+			[]byte{
+				0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
+				0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
+				0x63, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
+				0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f,
+				0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
+			},
+			carv2.Header{},
+			true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			gotHeader := carv2.Header{}
 			gotRead, err := gotHeader.ReadFrom(bytes.NewReader(tt.target))
+			if tt.wantErr {
+				assert.ErrorIs(t, err, carv2.ErrOffsetTooLarge)
+				return
+			}
 			assert.NoError(t, err)
 			assert.Equal(t, int64(carv2.HeaderSize), gotRead)
 			assert.Equal(t, tt.wantHeader, gotHeader)
@@ -205,6 +224,40 @@ func TestNewHeaderHasExpectedValues(t *testing.T) {
 	assert.Equal(t, want, got, "NewHeader got = %v, want = %v", got, want)
 }
 
+func TestHeaderLength(t *testing.T) {
+	v1, err := os.ReadFile("testdata/sample-v1.car")
+	require.NoError(t, err)
+	var v2 bytes.Buffer
+	require.NoError(t, carv2.WrapV1(bytes.NewReader(v1), &v2))
+	cr, err := carv2.NewReader(bytes.NewReader(v2.Bytes()))
+	require.NoError(t, err)
+	roots, err := cr.Roots()
+	require.NoError(t, err)
+
+	// Assert the length is the offset of the first section.
+	dr, err := cr.DataReader()
+	require.NoError(t, err)
+	idx := index.NewLinear()
+	require.NoError(t, carv2.LoadIndex(idx, dr, carv2.StoreIdentityCIDs(true)))
+	var offsets []uint64
+	require.NoError(t, idx.ForEach(func(_ multihash.Multihash, offset uint64) error {
+		offsets = append(offsets, offset)
+		return nil
+	}))
+	require.NotEmpty(t, offsets)
+	got, err := carv2.HeaderLength(roots)
+	require.NoError(t, err)
+	require.Equal(t, cr.Header.DataOffset+offsets[0], got)
+
+	// Assert the length grows with the roots.
+	none, err := carv2.HeaderLength(nil)
+	require.NoError(t, err)
+	require.Less(t, none, got)
+	more, err := carv2.HeaderLength(append(roots, roots...))
+	require.NoError(t, err)
+	require.Greater(t, more, got)
+}
+
 func TestCharacteristics_StoreIdentityCIDs(t *testing.T) {
 	subject := carv2.Characteristics{}
 	require.False(t, subject.IsFullyIndexed())
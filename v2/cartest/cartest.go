@@ -0,0 +1,92 @@
+// Package cartest provides helpers for testing code that reads and writes CAR files via go-car.
+//
+// The helpers exercise the same write and read paths as the blockstore package, and fail the test
+// they are given upon any error or mismatch. This package is only intended to be imported from
+// tests, so that it is not pulled into production builds.
+package cartest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/blockstore"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+// RoundTrip writes the given blocks and roots to a CARv2 file in a temporary directory via
+// blockstore.ReadWrite, in the given order, then reads it back and asserts that it holds exactly
+// the given roots and blocks. The returned blockstore is opened over the written file via MustOpen,
+// allowing further assertions; it is closed when the test completes.
+//
+// The blocks are read back twice: streamed in order via car.BlockReader, and looked up by CID via
+// blockstore.ReadOnly. As with blockstore.ReadWrite, blocks with multihash.IDENTITY code are not
+// written, and only the first of several blocks with the same multihash is.
+func RoundTrip(t testing.TB, blks []blocks.Block, roots []cid.Cid) *blockstore.ReadOnly {
+	t.Helper()
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "roundtrip.car")
+	rw, err := blockstore.OpenReadWrite(path, roots)
+	require.NoError(t, err)
+	require.NoError(t, rw.PutMany(ctx, blks))
+	require.NoError(t, rw.Finalize())
+
+	// Assert the blocks are streamed in the order in which they were written.
+	var want []blocks.Block
+	seen := make(map[string]struct{})
+	for _, b := range blks {
+		if b.Cid().Prefix().MhType == multihash.IDENTITY {
+			continue
+		}
+		if _, ok := seen[string(b.Cid().Hash())]; ok {
+			continue
+		}
+		seen[string(b.Cid().Hash())] = struct{}{}
+		want = append(want, b)
+	}
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	br, err := carv2.NewBlockReader(f)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), br.Version)
+	require.Equal(t, roots, br.Roots)
+	for _, w := range want {
+		got, err := br.Next()
+		require.NoError(t, err)
+		require.Equal(t, w.Cid(), got.Cid())
+		require.True(t, bytes.Equal(w.RawData(), got.RawData()), "data of block %s differs", w.Cid())
+	}
+	_, err = br.Next()
+	require.Equal(t, io.EOF, err)
+
+	// Assert every block, including identity blocks, can be looked up.
+	subject := MustOpen(t, path)
+	gotRoots, err := subject.Roots()
+	require.NoError(t, err)
+	require.Equal(t, roots, gotRoots)
+	for _, b := range blks {
+		got, err := subject.Get(ctx, b.Cid())
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(b.RawData(), got.RawData()), "data of block %s differs", b.Cid())
+	}
+	return subject
+}
+
+// MustOpen opens a read-only blockstore over the CAR file at the given path via
+// blockstore.OpenReadOnly, failing the test if it cannot be opened. The blockstore is closed when
+// the test completes.
+func MustOpen(t testing.TB, path string, opts ...carv2.Option) *blockstore.ReadOnly {
+	t.Helper()
+	subject, err := blockstore.OpenReadOnly(path, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+	return subject
+}
@@ -0,0 +1,48 @@
+package cartest_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipld/go-car/v2/cartest"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundTrip(t *testing.T) {
+	root := merkledag.NodeWithData([]byte("cartest-root"))
+	var blks []blocks.Block
+	for i := 0; i < 8; i++ {
+		leaf := merkledag.NewRawNode([]byte(fmt.Sprintf("cartest-leaf-%d", i)))
+		require.NoError(t, root.AddNodeLink(fmt.Sprintf("leaf-%d", i), leaf))
+		blks = append(blks, leaf)
+	}
+	identityMh, err := multihash.Sum([]byte("cartest-identity"), multihash.IDENTITY, -1)
+	require.NoError(t, err)
+	identity, err := blocks.NewBlockWithCid([]byte("cartest-identity"), cid.NewCidV1(cid.Raw, identityMh))
+	require.NoError(t, err)
+	// Include an identity block and a duplicate block, neither of which are written.
+	blks = append(blks, root, identity, blks[0])
+
+	subject := cartest.RoundTrip(t, blks, []cid.Cid{root.Cid()})
+	keys, err := subject.AllKeysChan(context.Background())
+	require.NoError(t, err)
+	var count int
+	for range keys {
+		count++
+	}
+	require.Equal(t, 9, count)
+}
+
+func TestMustOpen(t *testing.T) {
+	for _, path := range []string{"../testdata/sample-v1.car", "../testdata/sample-wrapped-v2.car"} {
+		subject := cartest.MustOpen(t, path)
+		roots, err := subject.Roots()
+		require.NoError(t, err)
+		require.NotEmpty(t, roots)
+	}
+}
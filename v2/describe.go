@@ -0,0 +1,165 @@
+package car
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2/index"
+	internalmmap "github.com/ipld/go-car/v2/internal/mmap"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"golang.org/x/exp/mmap"
+)
+
+// Description summarises the format and features of a CAR, as returned by Describe.
+type Description struct {
+	// Version is the version of the CAR, i.e. 1 or 2.
+	Version uint64
+	// Roots are the root CIDs in the header of the CARv1 data payload.
+	Roots []cid.Cid
+	// Characteristics are the characteristics in the CARv2 header; always zero for a CARv1.
+	Characteristics Characteristics
+	// DataSize is the size of the CARv1 data payload in bytes. For a CARv1, this is the total size
+	// if it is known, and zero otherwise.
+	DataSize uint64
+	// IndexCodec is the codec of the index, or zero if the CAR has no index.
+	IndexCodec multicodec.Code
+	// BlockCount is the number of records in the index. It is only set if BlockCountKnown is true,
+	// i.e. if the CAR has an index whose records can be iterated over.
+	// Note that depending on how the index was generated, it may not record identity CIDs nor all
+	// occurrences of duplicate blocks; see Characteristics.IsFullyIndexed.
+	BlockCount      uint64
+	BlockCountKnown bool
+	// Size is the total size of the CAR in bytes, or -1 if the size of the given io.ReaderAt cannot be
+	// determined.
+	Size int64
+	// DataPadding is the number of bytes between the CARv2 header and the data payload, and
+	// IndexPadding the number of bytes between the data payload and the index.
+	DataPadding, IndexPadding uint64
+	// PaddingZeroed is whether all padding bytes are zero, as the specification recommends.
+	// It is true if there is no padding.
+	PaddingZeroed bool
+	// Metadata is the metadata held by the metadata trailer of the data payload, if any; see
+	// WithMetadata.
+	Metadata map[string]string
+}
+
+// Describe summarises the format and features of the CAR read from r, such as its version, roots,
+// characteristics, index codec and padding, without reading the blocks in it.
+//
+// Unlike Reader.Inspect, blocks are neither validated nor counted by walking the data payload;
+// instead, the block count is that of the records in the index, if present. The index is read in
+// full to do so. To find the metadata trailer, if any, the sections of the data payload are skipped
+// through by their lengths, reading only the data of trailers. The total size is determined if r
+// has a Size method, such as bytes.Reader and io.SectionReader, or is an os.File or a
+// memory-mapped file as opened by OpenReader.
+func Describe(r io.ReaderAt, opts ...Option) (Description, error) {
+	cr, err := NewReader(r, opts...)
+	if err != nil {
+		return Description{}, err
+	}
+	if cr.Version == 2 {
+		// Sanity-check the CARv2 header, such that padding sizes do not underflow.
+		h := cr.Header
+		if h.DataOffset < PragmaSize+HeaderSize {
+			return Description{}, fmt.Errorf("malformed CARv2; data offset too small: %d", h.DataOffset)
+		}
+		if h.HasIndex() && h.IndexOffset < h.DataOffset+h.DataSize {
+			return Description{}, fmt.Errorf("malformed CARv2; index offset overlaps data payload: %d", h.IndexOffset)
+		}
+	}
+	d := Description{
+		Version:       cr.Version,
+		Size:          readerAtSize(r),
+		PaddingZeroed: true,
+	}
+	if d.Roots, err = cr.Roots(); err != nil {
+		return Description{}, err
+	}
+	if d.Metadata, err = readMetadataTrailer(r, ApplyOptions(opts...)); err != nil {
+		return Description{}, err
+	}
+
+	if d.Version == 1 {
+		if d.Size > 0 {
+			d.DataSize = uint64(d.Size)
+		}
+		return d, nil
+	}
+
+	d.Characteristics = cr.Header.Characteristics
+	d.DataSize = cr.Header.DataSize
+	d.DataPadding = cr.Header.DataOffset - PragmaSize - HeaderSize
+	if err := checkZeroed(r, PragmaSize+HeaderSize, d.DataPadding, &d.PaddingZeroed); err != nil {
+		return Description{}, err
+	}
+	if !cr.Header.HasIndex() {
+		return d, nil
+	}
+	dataEnd := cr.Header.DataOffset + cr.Header.DataSize
+	d.IndexPadding = cr.Header.IndexOffset - dataEnd
+	if err := checkZeroed(r, int64(dataEnd), d.IndexPadding, &d.PaddingZeroed); err != nil {
+		return Description{}, err
+	}
+
+	ir, err := cr.IndexReader()
+	if err != nil {
+		return Description{}, err
+	}
+	idx, err := index.ReadFrom(ir)
+	if err != nil {
+		return Description{}, err
+	}
+	d.IndexCodec = idx.Codec()
+	if iidx, ok := idx.(index.IterableIndex); ok {
+		if err := iidx.ForEach(func(multihash.Multihash, uint64) error {
+			d.BlockCount++
+			return nil
+		}); err != nil {
+			return Description{}, err
+		}
+		d.BlockCountKnown = true
+	}
+	return d, nil
+}
+
+// readerAtSize returns the size of r, or -1 if it cannot be determined.
+func readerAtSize(r io.ReaderAt) int64 {
+	switch r := r.(type) {
+	case interface{ Size() int64 }:
+		return r.Size()
+	case *os.File:
+		if fi, err := r.Stat(); err == nil {
+			return fi.Size()
+		}
+	case *mmap.ReaderAt:
+		return int64(r.Len())
+	case *internalmmap.ReaderAt:
+		return int64(r.Len())
+	}
+	return -1
+}
+
+// checkZeroed sets zeroed to false if any of the n bytes of r at offset off are not zero.
+func checkZeroed(r io.ReaderAt, off int64, n uint64, zeroed *bool) error {
+	buf := make([]byte, 4<<10)
+	sr := io.NewSectionReader(r, off, int64(n))
+	for *zeroed {
+		read, err := sr.Read(buf)
+		for _, b := range buf[:read] {
+			if b != 0 {
+				*zeroed = false
+				break
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
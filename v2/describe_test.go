@@ -0,0 +1,93 @@
+package car_test
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multicodec"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDescribe(t *testing.T) {
+	// Assert a CARv1 is described by its header and size only.
+	v1, err := os.Open("testdata/sample-v1.car")
+	require.NoError(t, err)
+	t.Cleanup(func() { v1.Close() })
+	fi, err := v1.Stat()
+	require.NoError(t, err)
+	got, err := carv2.Describe(v1)
+	require.NoError(t, err)
+	cr, err := carv2.NewReader(v1)
+	require.NoError(t, err)
+	roots, err := cr.Roots()
+	require.NoError(t, err)
+	require.Equal(t, carv2.Description{
+		Version:       1,
+		Roots:         roots,
+		DataSize:      uint64(fi.Size()),
+		Size:          fi.Size(),
+		PaddingZeroed: true,
+	}, got)
+
+	// Assert the block count of a CARv2 is that of its index, and padding is reported.
+	v1Data, err := os.ReadFile("testdata/sample-v1.car")
+	require.NoError(t, err)
+	idx, err := carv2.GenerateIndex(bytes.NewReader(v1Data))
+	require.NoError(t, err)
+	var v2 bytes.Buffer
+	v2.Write(carv2.Pragma)
+	_, err = carv2.NewHeader(uint64(len(v1Data))).WithDataPadding(13).WithIndexPadding(7).WriteTo(&v2)
+	require.NoError(t, err)
+	v2.Write(make([]byte, 13))
+	v2.Write(v1Data)
+	v2.Write(make([]byte, 7))
+	_, err = index.WriteTo(idx, &v2)
+	require.NoError(t, err)
+	got, err = carv2.Describe(bytes.NewReader(v2.Bytes()))
+	require.NoError(t, err)
+	stats, err := carv2.NewReader(bytes.NewReader(v2.Bytes()))
+	require.NoError(t, err)
+	wantStats, err := stats.Inspect(false)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), got.Version)
+	require.Equal(t, roots, got.Roots)
+	require.Equal(t, stats.Header.Characteristics, got.Characteristics)
+	require.Equal(t, uint64(fi.Size()), got.DataSize)
+	require.Equal(t, multicodec.CarMultihashIndexSorted, got.IndexCodec)
+	require.True(t, got.BlockCountKnown)
+	// Identity CIDs are not indexed by default.
+	require.Equal(t, wantStats.BlockCount-wantStats.MhTypeCounts[multicodec.Identity], got.BlockCount)
+	require.Equal(t, int64(v2.Len()), got.Size)
+	require.Equal(t, uint64(13), got.DataPadding)
+	require.Equal(t, uint64(7), got.IndexPadding)
+	require.True(t, got.PaddingZeroed)
+
+	// Assert non-zero padding is reported, and the size is unknown for readers without one.
+	padded := append([]byte{}, v2.Bytes()...)
+	padded[carv2.PragmaSize+carv2.HeaderSize+5] = 0xff
+	got, err = carv2.Describe(readerAtOnly{bytes.NewReader(padded)})
+	require.NoError(t, err)
+	require.False(t, got.PaddingZeroed)
+	require.Equal(t, int64(-1), got.Size)
+
+	// Assert a CARv2 without an index has no block count.
+	got, err = carv2.Describe(mustOpen(t, "testdata/sample-v2-indexless.car"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), got.Version)
+	require.Zero(t, got.IndexCodec)
+	require.False(t, got.BlockCountKnown)
+}
+
+type readerAtOnly struct{ r *bytes.Reader }
+
+func (r readerAtOnly) ReadAt(p []byte, off int64) (int, error) { return r.r.ReadAt(p, off) }
+
+func mustOpen(t *testing.T, path string) *os.File {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+	return f
+}
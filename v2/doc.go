@@ -5,4 +5,12 @@
 //
 // The blockstore sub-package contains an implementation of the
 // go-ipfs-blockstore interface.
+//
+// Note that writing a CARv2 requires the size of its data payload to be known before the payload
+// is written, since it is recorded in the CARv2 header that precedes the payload; the spec does
+// not define a trailer that could carry it instead. APIs that write to a plain io.Writer, such as
+// NewSelectiveWriter and WriteFromBlockstore, therefore learn the payload size by walking the DAG
+// ahead of writing it, rather than buffering the payload. APIs that write blocks as they come,
+// such as TraverseToFile, WriteSortedStream and blockstore.ReadWrite, write to files or an
+// io.WriteSeeker and seek back to fill in the header once the payload is written.
 package car
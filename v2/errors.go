@@ -1,9 +1,45 @@
 package car
 
 import (
+	"errors"
 	"fmt"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2/internal/carv1/util"
+	internalio "github.com/ipld/go-car/v2/internal/io"
+	"github.com/multiformats/go-varint"
 )
 
+// ErrSectionTooLarge signals that the length prefix of a section is larger than the maximum
+// allowed section size.
+// See: MaxAllowedSectionSize.
+var ErrSectionTooLarge = util.ErrSectionTooLarge
+
+// ErrHeaderTooLarge signals that the length prefix of a CARv1 header, or of the CARv2 pragma, is
+// larger than the maximum allowed header size.
+// See: MaxAllowedHeaderSize.
+var ErrHeaderTooLarge = util.ErrHeaderTooLarge
+
+// ErrNonCanonicalVarint signals that a varint, such as the length prefix of a section, is not
+// minimally encoded, e.g. it has trailing zero continuation bytes. The CAR specification requires
+// minimal encodings, and since a non-minimal one allows the same payload to be encoded in more than
+// one way, it is always rejected when reading the CAR header, sections and CIDs.
+var ErrNonCanonicalVarint = varint.ErrNotMinimal
+
+// ErrOffsetTooLarge signals that an offset, such as one in the CARv2 header or in an index, cannot
+// be represented as an int64 as required to read at it. Offsets are unsigned in the CAR format, but
+// reading at one beyond the signed boundary would otherwise silently seek to a negative position.
+var ErrOffsetTooLarge = internalio.ErrOffsetTooLarge
+
+// ErrTruncated signals that the data payload ends part way through a section, as opposed to
+// cleanly at a section boundary.
+var ErrTruncated = errors.New("car data payload is truncated")
+
+// ErrInvalidPragma signals that a payload declaring version 2 does not start with the exact bytes
+// of the CARv2 pragma.
+// See: ReadPragma.
+var ErrInvalidPragma = errors.New("invalid CARv2 pragma")
+
 var _ (error) = (*ErrCidTooLarge)(nil)
 
 // ErrCidTooLarge signals that a CID is too large to include in CARv2 index.
@@ -16,3 +52,36 @@ type ErrCidTooLarge struct {
 func (e *ErrCidTooLarge) Error() string {
 	return fmt.Sprintf("cid size is larger than max allowed (%d > %d)", e.CurrentSize, e.MaxSize)
 }
+
+var _ (error) = (*ErrFileSizeMismatch)(nil)
+
+// ErrFileSizeMismatch signals that a CARv2 is smaller than its header claims, i.e. its data payload
+// or index, as located by the header, would extend past the end of it. This typically indicates a
+// truncated file, such as an incomplete download.
+// See: NewReader.
+type ErrFileSizeMismatch struct {
+	// HeaderSize is the minimum size of the CARv2 in bytes, as implied by its header.
+	HeaderSize uint64
+	// ActualSize is the actual size of the CARv2 in bytes.
+	ActualSize uint64
+}
+
+func (e *ErrFileSizeMismatch) Error() string {
+	return fmt.Sprintf("car size is smaller than its header claims (%d < %d); the file may be truncated", e.ActualSize, e.HeaderSize)
+}
+
+var _ (error) = (*ErrOutOfOrder)(nil)
+
+// ErrOutOfOrder signals that a block is not stored in the expected order relative to the other
+// blocks of a DAG.
+// See: VerifyOrder.
+type ErrOutOfOrder struct {
+	// Expected is the block expected next in the order.
+	Expected cid.Cid
+	// Got is the block stored in its place.
+	Got cid.Cid
+}
+
+func (e *ErrOutOfOrder) Error() string {
+	return fmt.Sprintf("block %s is out of order; expected %s in its place", e.Got, e.Expected)
+}
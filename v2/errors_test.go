@@ -1,8 +1,12 @@
 package car
 
 import (
+	"bytes"
 	"testing"
 
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipld/go-car/v2/internal/carv1"
 	"github.com/stretchr/testify/require"
 )
 
@@ -10,3 +14,35 @@ func TestNewErrCidTooLarge_ErrorContainsSizes(t *testing.T) {
 	subject := &ErrCidTooLarge{MaxSize: 1413, CurrentSize: 1414}
 	require.EqualError(t, subject, "cid size is larger than max allowed (1414 > 1413)")
 }
+
+func TestNonCanonicalVarintIsRejected(t *testing.T) {
+	blk := merkledag.NewRawNode([]byte("fish"))
+	sectionLen := len(blk.Cid().Bytes()) + len(blk.RawData())
+	require.Less(t, sectionLen, 0x80)
+
+	encode := func(t *testing.T, lengthPrefix []byte) []byte {
+		var buf bytes.Buffer
+		require.NoError(t, carv1.WriteHeader(&carv1.CarHeader{Roots: []cid.Cid{blk.Cid()}, Version: 1}, &buf))
+		buf.Write(lengthPrefix)
+		buf.Write(blk.Cid().Bytes())
+		buf.Write(blk.RawData())
+		return buf.Bytes()
+	}
+	canonical := encode(t, []byte{byte(sectionLen)})
+	// The same length with a redundant continuation byte.
+	nonCanonical := encode(t, []byte{byte(sectionLen) | 0x80, 0x00})
+
+	_, err := GenerateIndex(bytes.NewReader(canonical))
+	require.NoError(t, err)
+	_, err = GenerateIndex(bytes.NewReader(nonCanonical))
+	require.ErrorIs(t, err, ErrNonCanonicalVarint)
+
+	br, err := NewBlockReader(bytes.NewReader(canonical))
+	require.NoError(t, err)
+	_, err = br.Next()
+	require.NoError(t, err)
+	br, err = NewBlockReader(bytes.NewReader(nonCanonical))
+	require.NoError(t, err)
+	_, err = br.Next()
+	require.ErrorIs(t, err, ErrNonCanonicalVarint)
+}
@@ -2,5 +2,9 @@ package index
 
 import "errors"
 
-// ErrNotFound signals a record is not found in the index.
-var ErrNotFound = errors.New("not found")
+var (
+	// ErrNotFound signals a record is not found in the index.
+	ErrNotFound = errors.New("not found")
+	// ErrEmpty signals that an index contains no records.
+	ErrEmpty = errors.New("index is empty")
+)
@@ -0,0 +1,97 @@
+package index
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// exportRecord is a record of an index as exported by ExportCSV and ExportJSON.
+type exportRecord struct {
+	Cid    string `json:"cid"`
+	Offset uint64 `json:"offset"`
+}
+
+// ExportCSV writes the records of idx to w as CSV, for inspecting an index with common tools.
+// The first row is a header naming the columns, i.e. "cid" and "offset". Each following row holds
+// one record: its CID as a string, and its offset in decimal. Block lengths are not exported, since
+// indices do not record them; they can be read from the data payload at each offset.
+//
+// Since indices do not preserve whole CIDs, the CID of each record is a CIDv1 of raw codec
+// carrying the indexed multihash; see ForEachOffsetOrder. The index must be an IterableIndex, and
+// its records are written in the order in which IterableIndex.ForEach visits them, which is
+// deterministic for a given index.
+func ExportCSV(idx Index, w io.Writer) error {
+	iterable, err := exportable(idx)
+	if err != nil {
+		return err
+	}
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"cid", "offset"}); err != nil {
+		return err
+	}
+	if err := forEachExportRecord(iterable, func(r exportRecord) error {
+		return cw.Write([]string{r.Cid, strconv.FormatUint(r.Offset, 10)})
+	}); err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ExportJSON writes the records of idx to w as a JSON array, with one object per record on each
+// line, for inspecting an index with common tools. Each object holds the CID of the record as a
+// string under "cid" and its offset under "offset".
+//
+// The records are written as described by ExportCSV, and idx must be an IterableIndex.
+func ExportJSON(idx Index, w io.Writer) error {
+	iterable, err := exportable(idx)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString("["); err != nil {
+		return err
+	}
+	sep := "\n"
+	if err := forEachExportRecord(iterable, func(r exportRecord) error {
+		obj, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		if _, err := bw.WriteString(sep); err != nil {
+			return err
+		}
+		sep = ",\n"
+		_, err = bw.Write(obj)
+		return err
+	}); err != nil {
+		return err
+	}
+	if _, err := bw.WriteString("\n]\n"); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// exportable returns idx as an IterableIndex, or an error if it is not one.
+func exportable(idx Index) (IterableIndex, error) {
+	iterable, ok := idx.(IterableIndex)
+	if !ok {
+		return nil, fmt.Errorf("cannot export index of codec %v: index is not iterable", idx.Codec())
+	}
+	return iterable, nil
+}
+
+// forEachExportRecord calls fn with each record of idx.
+func forEachExportRecord(idx IterableIndex, fn func(exportRecord) error) error {
+	return idx.ForEach(func(mh multihash.Multihash, offset uint64) error {
+		return fn(exportRecord{Cid: cid.NewCidV1(cid.Raw, mh).String(), Offset: offset})
+	})
+}
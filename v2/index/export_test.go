@@ -0,0 +1,53 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExport(t *testing.T) {
+	var records []Record
+	for i := 0; i < 3; i++ {
+		mh, err := multihash.Sum([]byte(fmt.Sprintf("export-%d", i)), multihash.SHA2_256, -1)
+		require.NoError(t, err)
+		records = append(records, Record{Cid: cid.NewCidV1(cid.DagCBOR, mh), Offset: uint64(100 * i)})
+	}
+	idx := NewLinear()
+	require.NoError(t, idx.Load(records))
+	raw := func(i int) string { return cid.NewCidV1(cid.Raw, records[i].Hash()).String() }
+
+	// Assert records are exported with CIDs of raw codec, in the order of ForEach.
+	var buf bytes.Buffer
+	require.NoError(t, ExportCSV(idx, &buf))
+	require.Equal(t, fmt.Sprintf("cid,offset\n%s,0\n%s,100\n%s,200\n", raw(0), raw(1), raw(2)), buf.String())
+
+	buf.Reset()
+	require.NoError(t, ExportJSON(idx, &buf))
+	require.Equal(t, fmt.Sprintf("[\n"+
+		`{"cid":"%s","offset":0},`+"\n"+
+		`{"cid":"%s","offset":100},`+"\n"+
+		`{"cid":"%s","offset":200}`+"\n]\n", raw(0), raw(1), raw(2)), buf.String())
+
+	// Assert an empty index is exported as a header, or an empty array.
+	buf.Reset()
+	require.NoError(t, ExportCSV(NewLinear(), &buf))
+	require.Equal(t, "cid,offset\n", buf.String())
+	buf.Reset()
+	require.NoError(t, ExportJSON(NewLinear(), &buf))
+	require.Equal(t, "[\n]\n", buf.String())
+	var got []map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+	require.Empty(t, got)
+
+	// Assert an index that is not iterable is rejected.
+	buf.Reset()
+	require.Error(t, ExportCSV(newSorted(), &buf))
+	require.Error(t, ExportJSON(newSorted(), &buf))
+	require.Zero(t, buf.Len())
+}
@@ -0,0 +1,332 @@
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/multiformats/go-varint"
+)
+
+// DefaultExternalSortRunSize is the default maximum number of records an ExternalSorter holds in
+// memory before spilling them to disk as a sorted run.
+const DefaultExternalSortRunSize = 1 << 20
+
+// externalSortBufferSize is the size of the buffers through which runs are written and read.
+const externalSortBufferSize = 64 << 10 // 64 KiB
+
+var errExternalSorterClosed = errors.New("external sorter is closed")
+
+// ExternalSorter accumulates index records and encodes them as a MultihashIndexSorted, with the
+// records held in memory bounded regardless of how many are added. Records are buffered up to the
+// run size, at which point they are sorted and spilled to a temporary file as a run. Once all
+// records are added, WriteTo merges the runs and streams the encoded index to a writer. Runs whose
+// records are added in sorted order are spilled without sorting them, so that records that come
+// from an already sorted source are never sorted.
+//
+// The encoding written by WriteTo is identical to that of index.WriteTo given a
+// MultihashIndexSorted loaded with the same records, except that records with equal multihashes
+// are always ordered by offset. Therefore, the encoded index can be read via ReadFrom.
+//
+// Close must be called once the sorter is no longer needed to remove its temporary files.
+type ExternalSorter struct {
+	dir     string
+	runSize int
+
+	buf []externalRecord
+	// unsorted is whether the records in buf were added out of order, and need sorting.
+	unsorted bool
+	runs     []*os.File
+	// counts is the number of records added per multihash code and digest length, which is known
+	// up front since the bucket sizes are encoded before the records.
+	counts map[uint64]map[int]uint64
+	closed bool
+}
+
+// externalRecord is an index record decoded into the components by which it is sorted.
+type externalRecord struct {
+	code   uint64
+	digest []byte
+	offset uint64
+}
+
+func (r externalRecord) less(o externalRecord) bool {
+	if r.code != o.code {
+		return r.code < o.code
+	}
+	if len(r.digest) != len(o.digest) {
+		return len(r.digest) < len(o.digest)
+	}
+	if c := bytes.Compare(r.digest, o.digest); c != 0 {
+		return c < 0
+	}
+	return r.offset < o.offset
+}
+
+// NewExternalSorter instantiates a new ExternalSorter which spills runs of at most runSize records
+// to temporary files in dir. If dir is empty, os.TempDir is used. If runSize is not positive,
+// DefaultExternalSortRunSize is used.
+func NewExternalSorter(dir string, runSize int) *ExternalSorter {
+	if runSize <= 0 {
+		runSize = DefaultExternalSortRunSize
+	}
+	return &ExternalSorter{
+		dir:     dir,
+		runSize: runSize,
+		counts:  make(map[uint64]map[int]uint64),
+	}
+}
+
+// Add adds the given record to the sorter, spilling the buffered records to disk if the run size
+// is reached.
+func (s *ExternalSorter) Add(r Record) error {
+	if s.closed {
+		return errExternalSorterClosed
+	}
+	dmh, err := multihash.Decode(r.Hash())
+	if err != nil {
+		return err
+	}
+	byLen, ok := s.counts[dmh.Code]
+	if !ok {
+		byLen = make(map[int]uint64)
+		s.counts[dmh.Code] = byLen
+	}
+	byLen[len(dmh.Digest)]++
+	er := externalRecord{code: dmh.Code, digest: dmh.Digest, offset: r.Offset}
+	if n := len(s.buf); n > 0 && er.less(s.buf[n-1]) {
+		s.unsorted = true
+	}
+	s.buf = append(s.buf, er)
+	if len(s.buf) >= s.runSize {
+		return s.spill()
+	}
+	return nil
+}
+
+// spill sorts the buffered records, unless they were added in order, and writes them to a new run
+// file.
+func (s *ExternalSorter) spill() error {
+	if s.unsorted {
+		sort.Slice(s.buf, func(i, j int) bool { return s.buf[i].less(s.buf[j]) })
+	}
+	f, err := os.CreateTemp(s.dir, "car-index-run-*")
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, f)
+	w := bufio.NewWriterSize(f, externalSortBufferSize)
+	scratch := make([]byte, 2*binary.MaxVarintLen64)
+	for _, r := range s.buf {
+		n := varint.PutUvarint(scratch, r.code)
+		n += varint.PutUvarint(scratch[n:], uint64(len(r.digest)))
+		if _, err := w.Write(scratch[:n]); err != nil {
+			return err
+		}
+		if _, err := w.Write(r.digest); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, r.offset); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	// Release the buffered records, retaining the capacity for the next run.
+	for i := range s.buf {
+		s.buf[i] = externalRecord{}
+	}
+	s.buf = s.buf[:0]
+	s.unsorted = false
+	return nil
+}
+
+// WriteTo merges the records added so far and writes them to w as a MultihashIndexSorted, along
+// with its codec as written by index.WriteTo. It implements io.WriterTo.
+func (s *ExternalSorter) WriteTo(w io.Writer) (int64, error) {
+	if s.closed {
+		return 0, errExternalSorterClosed
+	}
+	if len(s.buf) > 0 {
+		if err := s.spill(); err != nil {
+			return 0, err
+		}
+	}
+
+	bw := bufio.NewWriterSize(w, externalSortBufferSize)
+	cw := &countingWriter{w: bw}
+	if err := s.writeIndex(cw); err != nil {
+		return cw.n, err
+	}
+	return cw.n, bw.Flush()
+}
+
+func (s *ExternalSorter) writeIndex(w io.Writer) error {
+	var m mergeHeap
+	for _, f := range s.runs {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		rr := &runReader{r: bufio.NewReaderSize(f, externalSortBufferSize)}
+		ok, err := rr.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			m = append(m, rr)
+		}
+	}
+	heap.Init(&m)
+
+	codes := make([]uint64, 0, len(s.counts))
+	for code := range s.counts {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := varint.PutUvarint(buf, uint64(multicodec.CarMultihashIndexSorted))
+	if _, err := w.Write(buf[:n]); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, int32(len(codes))); err != nil {
+		return err
+	}
+	for _, code := range codes {
+		byLen := s.counts[code]
+		lens := make([]int, 0, len(byLen))
+		for l := range byLen {
+			lens = append(lens, l)
+		}
+		sort.Ints(lens)
+
+		if err := binary.Write(w, binary.LittleEndian, code); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, int32(len(lens))); err != nil {
+			return err
+		}
+		for _, l := range lens {
+			width := uint32(l + 8)
+			count := byLen[l]
+			if err := binary.Write(w, binary.LittleEndian, width); err != nil {
+				return err
+			}
+			if err := binary.Write(w, binary.LittleEndian, int64(count*uint64(width))); err != nil {
+				return err
+			}
+			// The runs are sorted by code, then digest length, then digest; therefore, the next
+			// count records of the merge make up this bucket.
+			for i := uint64(0); i < count; i++ {
+				if len(m) == 0 {
+					return errors.New("external sort runs ended prematurely")
+				}
+				r := m[0].cur
+				if r.code != code || len(r.digest) != l {
+					return errors.New("external sort runs are out of order")
+				}
+				if _, err := w.Write(r.digest); err != nil {
+					return err
+				}
+				if err := binary.Write(w, binary.LittleEndian, r.offset); err != nil {
+					return err
+				}
+				ok, err := m[0].next()
+				if err != nil {
+					return err
+				}
+				if ok {
+					heap.Fix(&m, 0)
+				} else {
+					heap.Pop(&m)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Close removes the temporary files of the sorter. The sorter cannot be used after it is closed.
+func (s *ExternalSorter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.buf = nil
+	var firstErr error
+	for _, f := range s.runs {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := os.Remove(f.Name()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.runs = nil
+	return firstErr
+}
+
+// runReader reads the records of a run written by ExternalSorter.spill in order.
+type runReader struct {
+	r   *bufio.Reader
+	cur externalRecord
+}
+
+// next reads the next record of the run into cur, and reports whether there was one.
+func (rr *runReader) next() (bool, error) {
+	code, err := varint.ReadUvarint(rr.r)
+	if err != nil {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, err
+	}
+	l, err := varint.ReadUvarint(rr.r)
+	if err != nil {
+		return false, unexpectedEOF(err)
+	}
+	digest := make([]byte, l)
+	if _, err := io.ReadFull(rr.r, digest); err != nil {
+		return false, unexpectedEOF(err)
+	}
+	var offset uint64
+	if err := binary.Read(rr.r, binary.LittleEndian, &offset); err != nil {
+		return false, unexpectedEOF(err)
+	}
+	rr.cur = externalRecord{code: code, digest: digest, offset: offset}
+	return true, nil
+}
+
+// mergeHeap is a min-heap of runs ordered by their current record.
+type mergeHeap []*runReader
+
+func (h mergeHeap) Len() int            { return len(h) }
+func (h mergeHeap) Less(i, j int) bool  { return h[i].cur.less(h[j].cur) }
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*runReader)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+// countingWriter counts the number of bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
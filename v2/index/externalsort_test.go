@@ -0,0 +1,92 @@
+package index_test
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExternalSorter(t *testing.T) {
+	rng := rand.New(rand.NewSource(1413))
+	var records []index.Record
+	for _, code := range []uint64{multihash.SHA2_512, multihash.SHA2_256, multihash.SHA3_224} {
+		records = append(records, generateIndexRecords(t, code, rng)...)
+	}
+	rng.Shuffle(len(records), func(i, j int) { records[i], records[j] = records[j], records[i] })
+
+	want, err := index.New(multicodec.CarMultihashIndexSorted)
+	require.NoError(t, err)
+	require.NoError(t, want.Load(records))
+	var wantBuf bytes.Buffer
+	_, err = index.WriteTo(want, &wantBuf)
+	require.NoError(t, err)
+
+	// Records added in sorted order are spilled without sorting them, and must encode identically.
+	sorted := append([]index.Record{}, records...)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, err := multihash.Decode(sorted[i].Hash())
+		require.NoError(t, err)
+		b, err := multihash.Decode(sorted[j].Hash())
+		require.NoError(t, err)
+		if a.Code != b.Code {
+			return a.Code < b.Code
+		}
+		if len(a.Digest) != len(b.Digest) {
+			return len(a.Digest) < len(b.Digest)
+		}
+		if c := bytes.Compare(a.Digest, b.Digest); c != 0 {
+			return c < 0
+		}
+		return sorted[i].Offset < sorted[j].Offset
+	})
+
+	for _, added := range [][]index.Record{records, sorted} {
+		for _, runSize := range []int{1, 7, len(records), 0} {
+			testExternalSorter(t, added, runSize, wantBuf.Bytes())
+		}
+	}
+}
+
+func testExternalSorter(t *testing.T, records []index.Record, runSize int, want []byte) {
+	dir := t.TempDir()
+	subject := index.NewExternalSorter(dir, runSize)
+	for _, r := range records {
+		require.NoError(t, subject.Add(r))
+	}
+	var gotBuf bytes.Buffer
+	n, err := subject.WriteTo(&gotBuf)
+	require.NoError(t, err)
+	require.Equal(t, int64(gotBuf.Len()), n)
+	require.Equal(t, want, gotBuf.Bytes(), "run size %d", runSize)
+
+	got, err := index.ReadFrom(bytes.NewReader(gotBuf.Bytes()))
+	require.NoError(t, err)
+	requireContainsAll(t, got, records)
+
+	// Assert the runs are removed on close.
+	require.NoError(t, subject.Close())
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	require.Error(t, subject.Add(records[0]))
+}
+
+func TestExternalSorter_Empty(t *testing.T) {
+	subject := index.NewExternalSorter(t.TempDir(), 0)
+	defer subject.Close()
+	var got bytes.Buffer
+	_, err := subject.WriteTo(&got)
+	require.NoError(t, err)
+
+	var want bytes.Buffer
+	_, err = index.WriteTo(index.NewMultihashSorted(), &want)
+	require.NoError(t, err)
+	require.Equal(t, want.Bytes(), got.Bytes())
+}
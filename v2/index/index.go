@@ -1,11 +1,16 @@
 package index
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"sort"
 
 	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2/internal/carv1/util"
 	internalio "github.com/ipld/go-car/v2/internal/io"
 
 	"github.com/multiformats/go-multicodec"
@@ -89,10 +94,74 @@ type (
 		// The order of calls to the given function is deterministic, but entirely index-specific.
 		ForEach(func(multihash.Multihash, uint64) error) error
 	}
+
+	// SizedIndex is an index which additionally records the length of the block data in each
+	// indexed section, allowing the size of blocks to be looked up without reading the data
+	// payload.
+	SizedIndex interface {
+		Index
+
+		// GetOffsetAndLength looks up the first block matching the given CID, returning the
+		// offset of its section along with the length of its block data, i.e. the length of the
+		// section excluding the CID.
+		//
+		// If the CID isn't indexed, ErrNotFound is returned.
+		GetOffsetAndLength(cid.Cid) (offset uint64, length uint64, err error)
+	}
+
+	// RangeIndex is an index which can look up all records whose multihash digest falls within a
+	// range, e.g. to route lookups to, or replicate, the part of a CAR that a node owns when CIDs
+	// are partitioned by range. See Range.
+	RangeIndex interface {
+		Index
+
+		// GetRange returns the records whose multihash digest is within the range between the
+		// digests of the multihashes of min and max, inclusive, in byte order. The records are in
+		// ascending order of digest, and records with equal digests are in the order in which
+		// IterableIndex.ForEach visits them. The CID of each record is a CIDv1 of raw codec
+		// carrying the indexed multihash; see ForEachOffsetOrder.
+		//
+		// An empty slice is returned if no record is within the range, including if min is
+		// greater than max.
+		GetRange(min, max cid.Cid) ([]Record, error)
+	}
+
+	// SortedLoader is an index which can load records that are already sorted, skipping the sort
+	// that Index.Load performs internally. This avoids wasted work when the records come from an
+	// already sorted source, such as another sorted index or a merge of several.
+	//
+	// Note that IndexSorted does not implement SortedLoader: it groups records by digest length
+	// alone, such that records of differing multihash codes with the same digest length, e.g.
+	// sha2-256 and blake2b-256, are compared by digest regardless of their code.
+	SortedLoader interface {
+		Index
+
+		// LoadSorted inserts a number of records into the index, as Index.Load does, assuming they
+		// are in ascending byte order of their multihashes. The index only relies on the order of
+		// the digests of records with the same multihash code and digest length, which records
+		// sorted by whole multihash satisfy. Records with equal multihashes may be in any order.
+		//
+		// The order is not validated. Loading unsorted records results in an index that is
+		// malformed without any error being returned: lookups may fail to find records that were
+		// loaded, and the marshalled index violates the CARv2 specification.
+		LoadSorted([]Record) error
+	}
 )
 
+// LoadSorted loads the given records into idx via SortedLoader.LoadSorted if idx implements it,
+// or via Index.Load otherwise. The records must be sorted as described by SortedLoader.
+func LoadSorted(idx Index, records []Record) error {
+	if sl, ok := idx.(SortedLoader); ok {
+		return sl.LoadSorted(records)
+	}
+	return idx.Load(records)
+}
+
 // GetFirst is a wrapper over Index.GetAll, returning the offset for the first
 // matching indexed CID.
+//
+// If the CID isn't indexed, ErrNotFound is returned along with an offset of zero; since zero is
+// also a valid offset, callers should check the error before using the offset, or use Get instead.
 func GetFirst(idx Index, key cid.Cid) (uint64, error) {
 	var firstOffset uint64
 	err := idx.GetAll(key, func(offset uint64) bool {
@@ -102,6 +171,183 @@ func GetFirst(idx Index, key cid.Cid) (uint64, error) {
 	return firstOffset, err
 }
 
+// Get is a wrapper over Index.GetAll, returning the offset for the first matching indexed CID
+// along with whether one was found. Unlike GetFirst, a CID that isn't indexed is not an error;
+// instead, found is false. This avoids the ambiguity of a zero offset, which is both a valid
+// offset and the zero value returned when the CID isn't indexed.
+func Get(idx Index, key cid.Cid) (offset uint64, found bool, err error) {
+	err = idx.GetAll(key, func(o uint64) bool {
+		offset, found = o, true
+		return false
+	})
+	if errors.Is(err, ErrNotFound) {
+		return 0, false, nil
+	}
+	return offset, found, err
+}
+
+// ForEachOffsetOrder calls fn for every entry in the given index in ascending order of offset,
+// i.e. in the order in which the indexed sections appear in the CAR data payload. This allows
+// the indexed sections to be read sequentially, as opposed to the index-specific order of
+// IterableIndex.ForEach which typically results in random access.
+//
+// The entries are collected and sorted in memory prior to calling fn. The CID passed to fn is a
+// CIDv1 of raw codec carrying the indexed multihash, since indices do not preserve whole CIDs.
+// If fn returns a non-nil error, the iteration is aborted and the error is returned.
+func ForEachOffsetOrder(idx IterableIndex, fn func(cid.Cid, uint64) error) error {
+	var records []Record
+	if err := idx.ForEach(func(mh multihash.Multihash, offset uint64) error {
+		records = append(records, Record{Cid: cid.NewCidV1(cid.Raw, mh), Offset: offset})
+		return nil
+	}); err != nil {
+		return err
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Offset < records[j].Offset })
+	for _, r := range records {
+		if err := fn(r.Cid, r.Offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Range returns the smallest and largest multihash covered by the given index, in byte order, as
+// CIDv1 of raw codec; see ForEachOffsetOrder. Since sorted indices look up records by multihash,
+// a CID whose multihash falls outside the range cannot be in the index, which allows e.g. a
+// router over range-partitioned CARs to rule out a shard without looking up the CID in it.
+//
+// For MultihashIndexSorted and MappableIndexSorted, whose records are sorted by digest within
+// buckets of the same multihash code and digest length, only the first and last record of each
+// bucket are read. Any other index must be an IterableIndex, and its entries are visited via
+// IterableIndex.ForEach without being retained in memory. ErrEmpty is returned if the index
+// contains no entries.
+func Range(idx Index) (min, max cid.Cid, err error) {
+	var minMh, maxMh multihash.Multihash
+	extend := func(mh multihash.Multihash, _ uint64) error {
+		if minMh == nil || bytes.Compare(mh, minMh) < 0 {
+			minMh = mh
+		}
+		if maxMh == nil || bytes.Compare(mh, maxMh) > 0 {
+			maxMh = mh
+		}
+		return nil
+	}
+	switch idx := idx.(type) {
+	case *MultihashIndexSorted:
+		for code, mwci := range *idx {
+			for _, swi := range mwci.multiWidthIndex {
+				if err := bucketEnds(swi.index, int(swi.width), code, extend); err != nil {
+					return cid.Undef, cid.Undef, err
+				}
+			}
+		}
+	case *MappableIndexSorted:
+		for _, b := range idx.buckets {
+			if err := bucketEnds(b.records, int(b.width), b.code, extend); err != nil {
+				return cid.Undef, cid.Undef, err
+			}
+		}
+	case IterableIndex:
+		if err := idx.ForEach(extend); err != nil {
+			return cid.Undef, cid.Undef, err
+		}
+	default:
+		return cid.Undef, cid.Undef, fmt.Errorf("cannot get range of index of codec %v: index is not iterable", idx.Codec())
+	}
+	if minMh == nil {
+		return cid.Undef, cid.Undef, ErrEmpty
+	}
+	return cid.NewCidV1(cid.Raw, minMh), cid.NewCidV1(cid.Raw, maxMh), nil
+}
+
+// bucketEnds calls fn with the first and last record of a bucket of fixed-width records of the
+// given multihash code sorted by digest, as described by appendRange, unless the bucket is empty.
+// Since the multihashes of a bucket share their code and digest length, and therefore the prefix
+// of their encoding, these are the smallest and largest multihash of the bucket in byte order.
+func bucketEnds(records []byte, width int, code uint64, fn func(multihash.Multihash, uint64) error) error {
+	count := len(records) / width
+	if count == 0 {
+		return nil
+	}
+	for _, i := range []int{0, count - 1} {
+		mh, err := multihash.Encode(records[i*width:(i+1)*width-8], code)
+		if err != nil {
+			return err
+		}
+		if err := fn(mh, binary.LittleEndian.Uint64(records[(i+1)*width-8:])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rangeRecord is a record found by RangeIndex.GetRange, along with its digest to sort by.
+type rangeRecord struct {
+	digest []byte
+	Record
+}
+
+// rangeBounds returns the digests of the multihashes of min and max.
+func rangeBounds(min, max cid.Cid) (lo, hi []byte, err error) {
+	dmin, err := multihash.Decode(min.Hash())
+	if err != nil {
+		return nil, nil, err
+	}
+	dmax, err := multihash.Decode(max.Hash())
+	if err != nil {
+		return nil, nil, err
+	}
+	return dmin.Digest, dmax.Digest, nil
+}
+
+// appendRange appends to dst the records of the given multihash code in a bucket of fixed-width
+// records sorted by digest, each consisting of a digest followed by a little-endian uint64 offset,
+// whose digest is within [lo, hi]. The bounds are found via binary search.
+func appendRange(dst []rangeRecord, records []byte, width int, code uint64, lo, hi []byte) ([]rangeRecord, error) {
+	count := len(records) / width
+	digestAt := func(i int) []byte { return records[i*width : (i+1)*width-8] }
+	start := sort.Search(count, func(i int) bool { return bytes.Compare(digestAt(i), lo) >= 0 })
+	end := sort.Search(count, func(i int) bool { return bytes.Compare(digestAt(i), hi) > 0 })
+	for i := start; i < end; i++ {
+		mh, err := multihash.Encode(digestAt(i), code)
+		if err != nil {
+			return nil, err
+		}
+		dst = append(dst, rangeRecord{
+			digest: digestAt(i),
+			Record: Record{Cid: cid.NewCidV1(cid.Raw, mh), Offset: binary.LittleEndian.Uint64(records[(i+1)*width-8:])},
+		})
+	}
+	return dst, nil
+}
+
+// sortRangeRecords returns the records of the given range records in ascending order of digest,
+// keeping the order of records with equal digests. The returned slice is never nil.
+func sortRangeRecords(rs []rangeRecord) []Record {
+	sort.SliceStable(rs, func(i, j int) bool { return bytes.Compare(rs[i].digest, rs[j].digest) < 0 })
+	records := make([]Record, len(rs))
+	for i, r := range rs {
+		records[i] = r.Record
+	}
+	return records
+}
+
+// NormalizeCid returns the form of c under which the CIDv0 and CIDv1 forms of a block are equal.
+// A CIDv0, which always has the dag-pb codec and a sha2-256 multihash, is normalized to the CIDv1
+// with the dag-pb codec and the same multihash; any other CID, including CIDv1 of the raw codec,
+// is returned as is. Therefore, two CIDs are equivalent if their normalized forms are equal, which
+// is only the case for dag-pb CIDs that differ in version alone.
+//
+// Note that indices match entries by multihash, and therefore already find blocks regardless of
+// the version or codec of the CID looked up. Normalization matters where whole CIDs are compared,
+// such as in blockstores with UseWholeCIDs enabled; see blockstore.EquivalentCidVersions.
+func NormalizeCid(c cid.Cid) cid.Cid {
+	if c.Version() == 0 {
+		return cid.NewCidV1(cid.DagProtobuf, c.Hash())
+	}
+	return c
+}
+
 // New constructs a new index corresponding to the given CAR index codec.
 func New(codec multicodec.Code) (Index, error) {
 	switch codec {
@@ -109,11 +355,232 @@ func New(codec multicodec.Code) (Index, error) {
 		return newSorted(), nil
 	case multicodec.CarMultihashIndexSorted:
 		return NewMultihashSorted(), nil
+	case CarMappableIndexSorted:
+		return NewMappableIndexSorted(), nil
+	case CarLinearIndex:
+		return NewLinear(), nil
 	default:
 		return nil, fmt.Errorf("unknwon index codec: %v", codec)
 	}
 }
 
+// Convert returns a new index of the given target codec, loaded with all the records in src.
+// This allows an index to be re-encoded in a different codec without access to the CAR it was
+// generated from.
+//
+// The src index must be an IterableIndex, since its records are read via IterableIndex.ForEach.
+// The records are loaded into the target index with CIDv1 of raw codec, carrying the multihash
+// of each entry. Therefore, whole CIDs are not preserved; this has no effect on lookups since
+// indices match entries by multihash.
+func Convert(src Index, targetCodec multicodec.Code) (Index, error) {
+	iterable, ok := src.(IterableIndex)
+	if !ok {
+		return nil, fmt.Errorf("cannot convert index of codec %v: index is not iterable", src.Codec())
+	}
+	var records []Record
+	if err := iterable.ForEach(func(mh multihash.Multihash, offset uint64) error {
+		records = append(records, Record{Cid: cid.NewCidV1(cid.Raw, mh), Offset: offset})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	target, err := New(targetCodec)
+	if err != nil {
+		return nil, err
+	}
+	if err := target.Load(records); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// Rebase returns a new index of the same codec as src, loaded with all the records in src with
+// delta added to their offsets. This allows the offsets of an index to be converted between being
+// relative to the start of the CARv1 data payload, which is the default, and being relative to the
+// start of the CARv2 file, by rebasing onto the data offset or its negation respectively.
+// See car.UseAbsoluteIndexOffsets. Similarly, when a data payload is relocated by a constant, e.g.
+// when a CARv1 is embedded at some offset of a larger container, its index can be rebased by that
+// constant rather than regenerated from the payload.
+//
+// The src index must be an IterableIndex, and is read as described by Convert. An error is
+// returned if any of the rebased offsets would be negative or would overflow.
+func Rebase(src Index, delta int64) (Index, error) {
+	iterable, ok := src.(IterableIndex)
+	if !ok {
+		return nil, fmt.Errorf("cannot rebase index of codec %v: index is not iterable", src.Codec())
+	}
+	var records []Record
+	if err := iterable.ForEach(func(mh multihash.Multihash, offset uint64) error {
+		if (delta < 0 && offset < uint64(-delta)) || (delta > 0 && offset > math.MaxUint64-uint64(delta)) {
+			return fmt.Errorf("cannot rebase offset %d of multihash %s by %d", offset, mh, delta)
+		}
+		records = append(records, Record{Cid: cid.NewCidV1(cid.Raw, mh), Offset: uint64(int64(offset) + delta)})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	target, err := New(src.Codec())
+	if err != nil {
+		return nil, err
+	}
+	if err := target.Load(records); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// Validate checks that the entries of idx are consistent with the given CARv1 data payload of
+// dataSize bytes, with offsets relative to the start of the payload. The length prefix of each
+// indexed section is read from the payload to find where the section ends. When sorted by offset,
+// each indexed section must lie within the payload and must end exactly where the next indexed
+// section begins, i.e. the indexed sections must neither overlap nor leave gaps between them.
+// Entries of differing multihashes at the same offset are reported as overlapping, whereas entries
+// repeated at the same offset are ignored. This allows an index received alongside a CAR to be
+// sanity checked before it is trusted, and the output of writers to be self-checked.
+// When dealing with a CARv2, the data payload can be obtained via car.Reader.DataReader.
+//
+// Note that sections which are present in the payload but not indexed, such as those of identity
+// CIDs, are reported as gaps. Null padding after the last section is only allowed if
+// ZeroLengthSectionAsEOF is set. The payload header precedes the first section and is not checked.
+// Unlike VerifyAgainst, only the length prefix of each indexed section is read; CIDs are not.
+//
+// The index must be an IterableIndex; its entries are collected and sorted in memory.
+func Validate(idx Index, car io.ReaderAt, dataSize uint64, opts ...Option) error {
+	iterable, ok := idx.(IterableIndex)
+	if !ok {
+		return fmt.Errorf("cannot validate index of codec %v: index is not iterable", idx.Codec())
+	}
+	o := ApplyOptions(opts...)
+	var records []Record
+	if err := iterable.ForEach(func(mh multihash.Multihash, offset uint64) error {
+		records = append(records, Record{Cid: cid.NewCidV1(cid.Raw, mh), Offset: offset})
+		return nil
+	}); err != nil {
+		return err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Offset != records[j].Offset {
+			return records[i].Offset < records[j].Offset
+		}
+		return bytes.Compare(records[i].Hash(), records[j].Hash()) < 0
+	})
+
+	// Remove entries repeated at the same offset, rejecting distinct ones.
+	var sections []Record
+	for _, r := range records {
+		if len(sections) > 0 {
+			last := sections[len(sections)-1]
+			if last.Offset == r.Offset {
+				if !bytes.Equal(last.Hash(), r.Hash()) {
+					return fmt.Errorf("sections of multihash %s and %s overlap at offset %d", last.Hash(), r.Hash(), r.Offset)
+				}
+				continue
+			}
+		}
+		sections = append(sections, r)
+	}
+
+	for i, s := range sections {
+		if s.Offset >= dataSize {
+			return fmt.Errorf("section of multihash %s at offset %d is beyond data payload of size %d", s.Hash(), s.Offset, dataSize)
+		}
+		end, err := sectionEnd(car, s, o)
+		if err != nil {
+			return err
+		}
+		next := dataSize
+		if i+1 < len(sections) {
+			next = sections[i+1].Offset
+		}
+		switch {
+		case end > next && i+1 < len(sections):
+			return fmt.Errorf("section of multihash %s at offset %d overlaps next section at offset %d", s.Hash(), s.Offset, next)
+		case end > next:
+			return fmt.Errorf("section of multihash %s at offset %d extends beyond data payload of size %d", s.Hash(), s.Offset, dataSize)
+		case end < next && i+1 == len(sections) && o.ZeroLengthSectionAsEOF && isNullPadding(car, end, o):
+		case end < next:
+			return fmt.Errorf("gap of %d bytes after section of multihash %s at offset %d", next-end, s.Hash(), s.Offset)
+		}
+	}
+	return nil
+}
+
+// sectionEnd returns the offset at which the section of s ends in the given data payload,
+// exclusive, by reading its length prefix.
+func sectionEnd(car io.ReaderAt, s Record, o Options) (uint64, error) {
+	off, err := internalio.AddOffset(0, s.Offset)
+	if err != nil {
+		return 0, err
+	}
+	r, err := internalio.NewOffsetReadSeeker(car, off)
+	if err != nil {
+		return 0, err
+	}
+	length, err := util.ReadSectionLength(r, o.MaxAllowedSectionSize)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read length of section of multihash %s at offset %d: %w", s.Hash(), s.Offset, err)
+	}
+	// A section holds at least the CID, which is at least as long as its multihash, i.e. a CIDv0.
+	if length < uint64(len(s.Hash())) {
+		return 0, fmt.Errorf("section of multihash %s at offset %d has length %d, shorter than its multihash", s.Hash(), s.Offset, length)
+	}
+	prefixLen, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	return s.Offset + uint64(prefixLen) + length, nil
+}
+
+// isNullPadding reports whether a zero-length section begins at the given offset of the data payload.
+func isNullPadding(car io.ReaderAt, offset uint64, o Options) bool {
+	off, err := internalio.AddOffset(0, offset)
+	if err != nil {
+		return false
+	}
+	r, err := internalio.NewOffsetReadSeeker(car, off)
+	if err != nil {
+		return false
+	}
+	length, err := util.ReadSectionLength(r, o.MaxAllowedSectionSize)
+	return err == nil && length == 0
+}
+
+// EstimateSize returns an upper bound on the number of bytes written by WriteTo for an index of
+// the given codec containing numBlocks records, where avgCidLen is the average length of the
+// indexed CIDs in bytes. This allows space to be reserved for an index, e.g. via index padding,
+// without generating it first.
+//
+// The estimate assumes that all indexed CIDs use the same multihash code and digest length, which
+// is typically the case; each additional combination of code and digest length adds a few tens of
+// bytes. Since the digest is part of a CID, avgCidLen bounds the average digest length.
+//
+// Zero is returned for CarIndexNone, and for codecs whose size does not depend on the records
+// alone or is not known, such as CarIndexSparse.
+func EstimateSize(numBlocks int, avgCidLen int, codec multicodec.Code) uint64 {
+	if numBlocks < 0 || avgCidLen < 0 {
+		return 0
+	}
+	// Each record consists of the digest followed by a uint64 offset.
+	records := uint64(numBlocks) * uint64(avgCidLen+8)
+	var overhead uint64
+	switch codec {
+	case multicodec.CarIndexSorted:
+		// The bucket count, followed by the width and length of each bucket.
+		overhead = 4 + 4 + 8
+	case multicodec.CarMultihashIndexSorted:
+		// The code count, followed by the code and a CarIndexSorted per code.
+		overhead = 4 + 8 + 4 + 4 + 8
+	case CarMappableIndexSorted:
+		overhead = mappableCountSize + mappableBucketHeaderSize
+	case CarLinearIndex:
+		// The record count, followed by the length of each multihash.
+		overhead = 8 + uint64(numBlocks)*uint64(varint.UvarintSize(uint64(avgCidLen)))
+	default:
+		return 0
+	}
+	return uint64(varint.UvarintSize(uint64(codec))) + overhead + records
+}
+
 // WriteTo writes the given idx into w.
 // The written bytes include the index encoding.
 // This can then be read back using index.ReadFrom
@@ -2,15 +2,21 @@ package index
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"testing"
 
 	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-car/v2/internal/carv1"
 	"github.com/ipld/go-car/v2/internal/carv1/util"
 	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
 	"github.com/multiformats/go-varint"
 	"github.com/stretchr/testify/require"
 )
@@ -27,6 +33,11 @@ func TestNew(t *testing.T) {
 			codec: multicodec.CarIndexSorted,
 			want:  newSorted(),
 		},
+		{
+			name:  "CarLinearIndexCodecIsConstructed",
+			codec: CarLinearIndex,
+			want:  NewLinear(),
+		},
 		{
 			name:    "ValidMultiCodecButUnknwonToIndexIsError",
 			codec:   multicodec.Cidv1,
@@ -84,9 +95,10 @@ func TestReadFrom(t *testing.T) {
 		require.NotZero(t, gotOffset)
 
 		// Get offset from the index in alternative format for a CID and assert it exists
-		gotOffset2, err := GetFirst(subjectInAltFormat, wantCid)
+		gotOffset2, found, err := Get(subjectInAltFormat, wantCid)
 		require.NoError(t, err)
-		require.NotZero(t, gotOffset2)
+		require.True(t, found)
+		require.Equal(t, gotOffset, gotOffset2)
 
 		// Seek to the offset on CARv1 file
 		_, err = crf.Seek(int64(gotOffset), io.SeekStart)
@@ -166,3 +178,488 @@ func TestMarshalledIndexStartsWithCodec(t *testing.T) {
 		})
 	}
 }
+
+func TestConvert(t *testing.T) {
+	idxf, err := os.Open("../testdata/sample-multihash-index-sorted.carindex")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, idxf.Close()) })
+	src, err := ReadFrom(idxf)
+	require.NoError(t, err)
+
+	crf, err := os.Open("../testdata/sample-v1.car")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, crf.Close()) })
+	cr, err := carv1.NewCarReader(crf)
+	require.NoError(t, err)
+	var wantCids []cid.Cid
+	for {
+		b, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		// Skip IDENTITY CIDs since they are not indexed.
+		if b.Cid().Prefix().MhType == multihash.IDENTITY {
+			continue
+		}
+		wantCids = append(wantCids, b.Cid())
+	}
+
+	for _, codec := range []multicodec.Code{multicodec.CarIndexSorted, multicodec.CarMultihashIndexSorted, CarMappableIndexSorted, CarLinearIndex} {
+		codec := codec
+		t.Run(codec.String(), func(t *testing.T) {
+			got, err := Convert(src, codec)
+			require.NoError(t, err)
+			require.Equal(t, codec, got.Codec())
+
+			// Assert the converted index survives a round trip in its own codec.
+			buf := new(bytes.Buffer)
+			_, err = WriteTo(got, buf)
+			require.NoError(t, err)
+			got, err = ReadFrom(buf)
+			require.NoError(t, err)
+
+			for _, c := range wantCids {
+				wantOffset, err := GetFirst(src, c)
+				require.NoError(t, err)
+				gotOffset, err := GetFirst(got, c)
+				require.NoError(t, err)
+				require.Equal(t, wantOffset, gotOffset)
+			}
+		})
+	}
+
+	t.Run("NonIterableSourceIsError", func(t *testing.T) {
+		sorted, err := Convert(src, multicodec.CarIndexSorted)
+		require.NoError(t, err)
+		_, err = Convert(sorted, multicodec.CarMultihashIndexSorted)
+		require.Error(t, err)
+	})
+
+	t.Run("UnknownTargetCodecIsError", func(t *testing.T) {
+		_, err := Convert(src, multicodec.Cidv1)
+		require.Error(t, err)
+	})
+}
+
+func TestForEachOffsetOrder(t *testing.T) {
+	idxf, err := os.Open("../testdata/sample-multihash-index-sorted.carindex")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, idxf.Close()) })
+	subject, err := ReadFrom(idxf)
+	require.NoError(t, err)
+
+	// Collect the sections in the order in which they appear in the CAR.
+	crf, err := os.Open("../testdata/sample-v1.car")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, crf.Close()) })
+	_, err = carv1.ReadHeader(crf, carv1.DefaultMaxAllowedHeaderSize)
+	require.NoError(t, err)
+	var wantMhs []multihash.Multihash
+	for {
+		c, _, err := util.ReadNode(crf, false, carv1.DefaultMaxAllowedSectionSize)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if c.Prefix().MhType != multihash.IDENTITY {
+			wantMhs = append(wantMhs, c.Hash())
+		}
+	}
+
+	var gotMhs []multihash.Multihash
+	var lastOffset uint64
+	err = ForEachOffsetOrder(subject.(IterableIndex), func(c cid.Cid, offset uint64) error {
+		require.GreaterOrEqual(t, offset, lastOffset)
+		lastOffset = offset
+		gotMhs = append(gotMhs, c.Hash())
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, wantMhs, gotMhs)
+
+	// Assert iteration stops at the first error.
+	var calls int
+	wantErr := errors.New("lobster")
+	err = ForEachOffsetOrder(subject.(IterableIndex), func(cid.Cid, uint64) error {
+		calls++
+		return wantErr
+	})
+	require.Equal(t, wantErr, err)
+	require.Equal(t, 1, calls)
+}
+
+func TestEstimateSize(t *testing.T) {
+	crf, err := os.Open("../testdata/sample-v1.car")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, crf.Close()) })
+	cr, err := carv1.NewCarReader(crf)
+	require.NoError(t, err)
+	var records []Record
+	var cidLens int
+	for {
+		b, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if b.Cid().Prefix().MhType == multihash.IDENTITY {
+			continue
+		}
+		records = append(records, Record{Cid: b.Cid(), Offset: uint64(len(records))})
+		cidLens += b.Cid().ByteLen()
+	}
+	avgCidLen := (cidLens + len(records) - 1) / len(records)
+
+	for _, codec := range []multicodec.Code{multicodec.CarIndexSorted, multicodec.CarMultihashIndexSorted, CarMappableIndexSorted, CarLinearIndex} {
+		codec := codec
+		t.Run(codec.String(), func(t *testing.T) {
+			idx, err := New(codec)
+			require.NoError(t, err)
+			require.NoError(t, idx.Load(records))
+			got, err := WriteTo(idx, io.Discard)
+			require.NoError(t, err)
+
+			estimate := EstimateSize(len(records), avgCidLen, codec)
+			require.GreaterOrEqual(t, estimate, got)
+			// Assert the estimate is in the right ballpark.
+			require.Less(t, estimate, 2*got)
+		})
+	}
+
+	require.Zero(t, EstimateSize(len(records), avgCidLen, CarIndexNone))
+	require.Zero(t, EstimateSize(len(records), avgCidLen, CarIndexSparse))
+}
+
+func TestGet(t *testing.T) {
+	present, err := multihash.Sum([]byte("present"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	absent, err := multihash.Sum([]byte("absent"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+
+	for _, codec := range []multicodec.Code{multicodec.CarIndexSorted, multicodec.CarMultihashIndexSorted, CarMappableIndexSorted, CarLinearIndex} {
+		t.Run(codec.String(), func(t *testing.T) {
+			subject, err := New(codec)
+			require.NoError(t, err)
+			// Assert an offset of zero is distinguishable from a missing record.
+			require.NoError(t, subject.Load([]Record{{Cid: cid.NewCidV1(cid.Raw, present), Offset: 0}}))
+
+			offset, found, err := Get(subject, cid.NewCidV1(cid.Raw, present))
+			require.NoError(t, err)
+			require.True(t, found)
+			require.Zero(t, offset)
+
+			offset, found, err = Get(subject, cid.NewCidV1(cid.Raw, absent))
+			require.NoError(t, err)
+			require.False(t, found)
+			require.Zero(t, offset)
+
+			_, err = GetFirst(subject, cid.NewCidV1(cid.Raw, absent))
+			require.ErrorIs(t, err, ErrNotFound)
+		})
+	}
+}
+
+func TestLoadSorted(t *testing.T) {
+	// Generate records of several multihash codes and digest lengths, sorted by multihash, including
+	// differing codes of the same digest length.
+	var records []Record
+	for i := 0; i < 64; i++ {
+		data := []byte(fmt.Sprintf("sorted-%d", i))
+		for _, code := range []uint64{multihash.SHA2_256, multihash.SHA3_256, multihash.BLAKE2B_MIN + 31, multihash.SHA2_512, multihash.BLAKE2B_MIN + 19} {
+			mh, err := multihash.Sum(data, code, -1)
+			require.NoError(t, err)
+			records = append(records, Record{Cid: cid.NewCidV1(cid.Raw, mh), Offset: uint64(len(records))})
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return bytes.Compare(records[i].Hash(), records[j].Hash()) < 0 })
+
+	for _, codec := range []multicodec.Code{multicodec.CarIndexSorted, multicodec.CarMultihashIndexSorted, CarMappableIndexSorted, CarLinearIndex} {
+		codec := codec
+		t.Run(codec.String(), func(t *testing.T) {
+			want, err := New(codec)
+			require.NoError(t, err)
+			require.NoError(t, want.Load(records))
+			subject, err := New(codec)
+			require.NoError(t, err)
+			// IndexSorted is loaded via Load, since it does not group records by multihash code.
+			_, isSortedLoader := subject.(SortedLoader)
+			require.Equal(t, codec != multicodec.CarIndexSorted, isSortedLoader)
+			require.NoError(t, LoadSorted(subject, records))
+
+			// Assert the index is the same as one loaded via Load.
+			var wantBuf, gotBuf bytes.Buffer
+			_, err = WriteTo(want, &wantBuf)
+			require.NoError(t, err)
+			_, err = WriteTo(subject, &gotBuf)
+			require.NoError(t, err)
+			require.Equal(t, wantBuf.Bytes(), gotBuf.Bytes())
+			for _, r := range records {
+				offset, err := GetFirst(subject, r.Cid)
+				require.NoError(t, err)
+				require.Equal(t, r.Offset, offset)
+			}
+		})
+	}
+
+	// Assert an index that does not implement SortedLoader is loaded via Load.
+	plain := struct{ Index }{NewMultihashSorted()}
+	require.NoError(t, LoadSorted(plain, records[:1]))
+	offset, err := GetFirst(plain, records[0].Cid)
+	require.NoError(t, err)
+	require.Equal(t, records[0].Offset, offset)
+}
+
+func TestRange(t *testing.T) {
+	idxf, err := os.Open("../testdata/sample-multihash-index-sorted.carindex")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, idxf.Close()) })
+	src, err := ReadFrom(idxf)
+	require.NoError(t, err)
+
+	var mhs []multihash.Multihash
+	require.NoError(t, src.(IterableIndex).ForEach(func(mh multihash.Multihash, _ uint64) error {
+		mhs = append(mhs, mh)
+		return nil
+	}))
+	require.NotEmpty(t, mhs)
+	sort.Slice(mhs, func(i, j int) bool { return bytes.Compare(mhs[i], mhs[j]) < 0 })
+
+	for _, codec := range []multicodec.Code{multicodec.CarMultihashIndexSorted, CarMappableIndexSorted, CarLinearIndex} {
+		t.Run(codec.String(), func(t *testing.T) {
+			subject, err := Convert(src, codec)
+			require.NoError(t, err)
+			gotMin, gotMax, err := Range(subject)
+			require.NoError(t, err)
+			require.Equal(t, mhs[0], gotMin.Hash())
+			require.Equal(t, mhs[len(mhs)-1], gotMax.Hash())
+
+			empty, err := New(codec)
+			require.NoError(t, err)
+			_, _, err = Range(empty)
+			require.ErrorIs(t, err, ErrEmpty)
+		})
+	}
+
+	// Assert the range spans all buckets, i.e. multihash codes and digest lengths.
+	var records []Record
+	mhs = nil
+	for i := 0; i < 10; i++ {
+		data := []byte(fmt.Sprintf("range-%d", i))
+		for _, sum := range []struct {
+			code   uint64
+			length int
+		}{{multihash.SHA2_256, -1}, {multihash.SHA2_256, 20}, {multihash.SHA2_512, -1}} {
+			mh, err := multihash.Sum(data, sum.code, sum.length)
+			require.NoError(t, err)
+			mhs = append(mhs, mh)
+			records = append(records, Record{Cid: cid.NewCidV1(cid.Raw, mh), Offset: uint64(len(records))})
+		}
+	}
+	sort.Slice(mhs, func(i, j int) bool { return bytes.Compare(mhs[i], mhs[j]) < 0 })
+	for _, codec := range []multicodec.Code{multicodec.CarMultihashIndexSorted, CarMappableIndexSorted, CarLinearIndex} {
+		t.Run(codec.String()+"/Buckets", func(t *testing.T) {
+			subject, err := New(codec)
+			require.NoError(t, err)
+			require.NoError(t, subject.Load(records))
+			gotMin, gotMax, err := Range(subject)
+			require.NoError(t, err)
+			require.Equal(t, mhs[0], gotMin.Hash())
+			require.Equal(t, mhs[len(mhs)-1], gotMax.Hash())
+		})
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	var records []Record
+	for i := 0; i < 100; i++ {
+		data := []byte(fmt.Sprintf("range-%d", i))
+		for _, code := range []uint64{multihash.SHA2_256, multihash.SHA2_512} {
+			mh, err := multihash.Sum(data, code, -1)
+			require.NoError(t, err)
+			records = append(records, Record{Cid: cid.NewCidV1(cid.Raw, mh), Offset: uint64(len(records))})
+		}
+	}
+	// Add a duplicate of a record at another offset.
+	records = append(records, Record{Cid: records[7].Cid, Offset: uint64(len(records))})
+	digest := func(c cid.Cid) []byte {
+		dmh, err := multihash.Decode(c.Hash())
+		require.NoError(t, err)
+		return dmh.Digest
+	}
+	sorted := append([]Record{}, records...)
+	sort.SliceStable(sorted, func(i, j int) bool { return bytes.Compare(digest(sorted[i].Cid), digest(sorted[j].Cid)) < 0 })
+	inRange := func(min, max cid.Cid) map[Record]bool {
+		want := make(map[Record]bool)
+		for _, r := range records {
+			d := digest(r.Cid)
+			if bytes.Compare(d, digest(min)) >= 0 && bytes.Compare(d, digest(max)) <= 0 {
+				want[r] = true
+			}
+		}
+		return want
+	}
+
+	for _, codec := range []multicodec.Code{multicodec.CarMultihashIndexSorted, CarMappableIndexSorted, CarLinearIndex} {
+		codec := codec
+		t.Run(codec.String(), func(t *testing.T) {
+			idx, err := New(codec)
+			require.NoError(t, err)
+			require.NoError(t, idx.Load(records))
+			subject, ok := idx.(RangeIndex)
+			require.True(t, ok)
+
+			for _, bounds := range [][2]int{{10, 150}, {0, len(sorted) - 1}, {42, 42}, {7, 8}} {
+				min, max := sorted[bounds[0]].Cid, sorted[bounds[1]].Cid
+				got, err := subject.GetRange(min, max)
+				require.NoError(t, err)
+				want := inRange(min, max)
+				require.Len(t, got, len(want))
+				for i, r := range got {
+					require.True(t, want[r], "unexpected record %v", r)
+					if i > 0 {
+						require.LessOrEqual(t, bytes.Compare(digest(got[i-1].Cid), digest(r.Cid)), 0)
+					}
+				}
+			}
+
+			// Assert the duplicate record is found at both of its offsets.
+			got, err := subject.GetRange(records[7].Cid, records[7].Cid)
+			require.NoError(t, err)
+			require.ElementsMatch(t, []Record{records[7], records[len(records)-1]}, got)
+
+			// Assert an empty range results in an empty slice.
+			got, err = subject.GetRange(sorted[20].Cid, sorted[10].Cid)
+			require.NoError(t, err)
+			require.NotNil(t, got)
+			require.Empty(t, got)
+		})
+	}
+}
+
+func TestRebase(t *testing.T) {
+	var records []Record
+	for i := 0; i < 10; i++ {
+		mh, err := multihash.Sum([]byte(fmt.Sprintf("rebase-%d", i)), multihash.SHA2_256, -1)
+		require.NoError(t, err)
+		records = append(records, Record{Cid: cid.NewCidV1(cid.Raw, mh), Offset: uint64(100 + i*10)})
+	}
+
+	for _, codec := range []multicodec.Code{multicodec.CarMultihashIndexSorted, CarMappableIndexSorted, CarLinearIndex} {
+		codec := codec
+		t.Run(codec.String(), func(t *testing.T) {
+			src, err := New(codec)
+			require.NoError(t, err)
+			require.NoError(t, src.Load(records))
+
+			got, err := Rebase(src, 51)
+			require.NoError(t, err)
+			require.Equal(t, codec, got.Codec())
+			for _, r := range records {
+				offset, err := GetFirst(got, r.Cid)
+				require.NoError(t, err)
+				require.Equal(t, r.Offset+51, offset)
+			}
+
+			// Assert rebasing back results in the original offsets.
+			got, err = Rebase(got, -51)
+			require.NoError(t, err)
+			for _, r := range records {
+				offset, err := GetFirst(got, r.Cid)
+				require.NoError(t, err)
+				require.Equal(t, r.Offset, offset)
+			}
+
+			// Assert offsets that would become negative or overflow are rejected.
+			_, err = Rebase(src, -101)
+			require.Error(t, err)
+			overflowing, err := New(codec)
+			require.NoError(t, err)
+			require.NoError(t, overflowing.Load([]Record{{Cid: records[0].Cid, Offset: math.MaxUint64 - 1}}))
+			_, err = Rebase(overflowing, 2)
+			require.Error(t, err)
+			_, err = Rebase(overflowing, 1)
+			require.NoError(t, err)
+		})
+	}
+
+	// Assert an index that is not iterable is rejected.
+	_, err := Rebase(newSorted(), 1)
+	require.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	// Write a payload of raw blocks preceded by a header-sized gap.
+	var payload bytes.Buffer
+	payload.Write(make([]byte, 42))
+	var records []Record
+	for i := 0; i < 5; i++ {
+		data := []byte(fmt.Sprintf("validate-%d", i))
+		mh, err := multihash.Sum(data, multihash.SHA2_256, -1)
+		require.NoError(t, err)
+		c := cid.NewCidV1(cid.Raw, mh)
+		records = append(records, Record{Cid: c, Offset: uint64(payload.Len())})
+		require.NoError(t, util.LdWrite(&payload, c.Bytes(), data))
+	}
+	dataSize := uint64(payload.Len())
+	car := bytes.NewReader(payload.Bytes())
+
+	load := func(t *testing.T, records []Record) *MultihashIndexSorted {
+		idx := NewMultihashSorted()
+		require.NoError(t, idx.Load(records))
+		return idx
+	}
+
+	idx := load(t, records)
+	require.NoError(t, Validate(idx, car, dataSize))
+
+	// Assert entries repeated at the same offset are ignored.
+	require.NoError(t, Validate(load(t, append(records[:len(records):len(records)], records[2])), car, dataSize))
+
+	// Assert sections beyond or extending beyond the data payload are rejected.
+	requireErrorContains(t, Validate(idx, car, records[4].Offset), "is beyond data payload")
+	requireErrorContains(t, Validate(idx, car, dataSize-1), "extends beyond data payload")
+
+	// Assert gaps are detected from the section lengths in the payload, including after the last section.
+	withGap := append(append([]Record{}, records[:2]...), records[3:]...)
+	requireErrorContains(t, Validate(load(t, withGap), car, dataSize), fmt.Sprintf("gap of %d bytes", records[3].Offset-records[2].Offset))
+	requireErrorContains(t, Validate(load(t, records[:4]), car, dataSize), fmt.Sprintf("gap of %d bytes", dataSize-records[4].Offset))
+
+	// Assert null padding after the last section is only allowed via ZeroLengthSectionAsEOF.
+	padded := bytes.NewReader(append(payload.Bytes(), 0))
+	requireErrorContains(t, Validate(idx, padded, dataSize+1), "gap of 1 bytes")
+	require.NoError(t, Validate(idx, padded, dataSize+1, ZeroLengthSectionAsEOF(true)))
+
+	// Assert overlapping sections are rejected.
+	overlapping := append([]Record{}, records...)
+	overlapping[3].Offset = overlapping[2].Offset + 1
+	requireErrorContains(t, Validate(load(t, overlapping), car, dataSize), "overlaps next section")
+	overlapping[3].Offset = overlapping[2].Offset
+	requireErrorContains(t, Validate(load(t, overlapping), car, dataSize), "overlap at offset")
+
+	// Assert section lengths are capped and must fit the multihash.
+	require.ErrorIs(t, Validate(idx, car, dataSize, MaxAllowedSectionSize(1)), util.ErrSectionTooLarge)
+	shifted := append([]Record{}, records...)
+	shifted[0].Offset = 0
+	requireErrorContains(t, Validate(load(t, shifted), car, dataSize), "shorter than its multihash")
+
+	// Assert an index that is not iterable is rejected.
+	require.Error(t, Validate(newSorted(), car, dataSize))
+}
+
+func TestNormalizeCid(t *testing.T) {
+	mh, err := multihash.Sum([]byte("fish"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	v0 := cid.NewCidV0(mh)
+	v1 := cid.NewCidV1(cid.DagProtobuf, mh)
+	raw := cid.NewCidV1(cid.Raw, mh)
+
+	require.Equal(t, v1, NormalizeCid(v0))
+	require.Equal(t, v1, NormalizeCid(v1))
+	require.Equal(t, raw, NormalizeCid(raw))
+}
+
+func requireErrorContains(t *testing.T, err error, contains string) {
+	require.Error(t, err)
+	require.Contains(t, err.Error(), contains)
+}
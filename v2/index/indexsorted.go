@@ -152,7 +152,7 @@ func (s *singleWidthIndex) getAll(d []byte, fn func(uint64) bool) error {
 
 func (s *singleWidthIndex) Load(items []Record) error {
 	m := make(multiWidthIndex)
-	if err := m.Load(items); err != nil {
+	if err := m.load(items, false); err != nil {
 		return err
 	}
 	if len(m) != 1 {
@@ -262,6 +262,14 @@ func (m *multiWidthIndex) Unmarshal(r io.Reader) error {
 }
 
 func (m *multiWidthIndex) Load(items []Record) error {
+	return m.load(items, false)
+}
+
+// load loads the given records, skipping the sort if sorted is true, in which case the records must
+// be in ascending order of digest within each digest length. Since records are grouped by digest
+// length alone, records of differing multihash codes sorted by whole multihash are not sorted in
+// this order; this therefore only holds for records of a single code, as in MultihashIndexSorted.
+func (m *multiWidthIndex) load(items []Record, sorted bool) error {
 	// Split cids on their digest length
 	idxs := make(map[int][]digestRecord)
 	for _, item := range items {
@@ -279,9 +287,11 @@ func (m *multiWidthIndex) Load(items []Record) error {
 		idxs[len(digest)] = append(idx, digestRecord{digest, item.Offset})
 	}
 
-	// Sort each list. then write to compact form.
+	// Sort each list, unless already sorted, then write to compact form.
 	for width, lst := range idxs {
-		sort.Sort(recordSet(lst))
+		if !sorted {
+			sort.Sort(recordSet(lst))
+		}
 		rcrdWdth := width + 8
 		compact := make([]byte, rcrdWdth*len(lst))
 		for off, itm := range lst {
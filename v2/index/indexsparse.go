@@ -0,0 +1,370 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2/internal/carv1"
+	internalio "github.com/ipld/go-car/v2/internal/io"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+)
+
+// CarIndexSparse is a reserved multicodec code used for SparseIndex.
+// This index type is not defined in the CARv2 spec and cannot be constructed via New or ReadFrom,
+// since it depends on the data payload it was generated from to fulfill lookups.
+const CarIndexSparse = 0x300004
+
+var _ Index = (*SparseIndex)(nil)
+
+type (
+	// SparseIndex is an index that only stores the offset of every Nth section in a CARv1 data
+	// payload, where N is the index stride. The sections between two consecutive sampled offsets
+	// are referred to as a window.
+	//
+	// Since sections in a CAR are not ordered by CID, the index additionally keeps a 4-byte
+	// fingerprint of each indexed multihash digest, mapped to the window that contains it. A lookup
+	// finds the candidate windows for the given CID by its fingerprint, seeks to the sampled offset
+	// at the start of each window and scans forward through the window to find the matching
+	// sections. Lookups read at most one window of sections from the backing data payload per
+	// candidate window; with 4-byte fingerprints false candidates are rare.
+	//
+	// The index holds 8 bytes per window plus 8 bytes per indexed section, instead of the full
+	// multihash digest and offset of each section. Its memory use is therefore still linear in the
+	// number of sections, only with a smaller constant than that of the other index types. The
+	// stride controls the trade-off between the memory used for window offsets and the latency of
+	// lookups, each of which scans up to stride sections.
+	//
+	// See: GenerateSparse.
+	SparseIndex struct {
+		backing io.ReaderAt
+		opts    Options
+		stride  uint32
+		// windows holds the sampled section offsets, in ascending order.
+		windows []uint64
+		// entries holds the fingerprints of indexed digests, sorted by fingerprint.
+		entries []sparseEntry
+	}
+	sparseEntry struct {
+		fingerprint uint32
+		window      uint32
+	}
+)
+
+// NewSparse instantiates a new empty SparseIndex that samples every stride-th section of the
+// given CARv1 data payload. Records must be loaded into the index via SparseIndex.Load or
+// SparseIndex.Unmarshal before use. The given opts apply to reading the data payload on lookup.
+func NewSparse(backing io.ReaderAt, stride int, opts ...Option) (*SparseIndex, error) {
+	if stride < 1 {
+		return nil, fmt.Errorf("stride must be at least 1; got %d", stride)
+	}
+	if uint64(stride) > uint64(^uint32(0)) {
+		return nil, fmt.Errorf("stride is too large: %d", stride)
+	}
+	return &SparseIndex{
+		backing: backing,
+		opts:    ApplyOptions(opts...),
+		stride:  uint32(stride),
+	}, nil
+}
+
+// GenerateSparse generates a SparseIndex for the given CARv1 data payload by sampling the offset
+// of every stride-th section.
+// When dealing with a CARv2, the data payload can be obtained via car.Reader.DataReader.
+//
+// A zero-length section is an error unless ZeroLengthSectionAsEOF is set, in which case it is
+// treated as the end of the data payload. The opts are retained to read the data payload on lookup.
+func GenerateSparse(car io.ReaderAt, stride int, opts ...Option) (*SparseIndex, error) {
+	idx, err := NewSparse(car, stride, opts...)
+	if err != nil {
+		return nil, err
+	}
+	r, err := internalio.NewOffsetReadSeeker(car, 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := carv1.ReadHeader(r, idx.opts.MaxAllowedHeaderSize); err != nil {
+		return nil, fmt.Errorf("error reading car header: %w", err)
+	}
+	sectionOffset, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Record
+	for {
+		sectionLen, err := readSectionLength(r, idx.opts)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		cidLen, c, err := cid.CidFromReader(r)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, Record{Cid: c, Offset: uint64(sectionOffset)})
+		if sectionOffset, err = r.Seek(int64(sectionLen)-int64(cidLen), io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
+	if err := idx.Load(records); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// Stride returns the number of indexed sections in each window of this index.
+func (s *SparseIndex) Stride() int {
+	return int(s.stride)
+}
+
+func (s *SparseIndex) Codec() multicodec.Code {
+	return CarIndexSparse
+}
+
+// Load populates this index with the given records.
+// The records are grouped into windows of stride records in ascending order of offset.
+func (s *SparseIndex) Load(records []Record) error {
+	sorted := make([]Record, len(records))
+	copy(sorted, records)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Offset < sorted[j].Offset })
+
+	s.windows = make([]uint64, 0, (len(sorted)+int(s.stride)-1)/int(s.stride))
+	s.entries = make([]sparseEntry, 0, len(sorted))
+	for i, r := range sorted {
+		if i%int(s.stride) == 0 {
+			s.windows = append(s.windows, r.Offset)
+		}
+		fp, err := sparseFingerprint(r.Hash())
+		if err != nil {
+			return err
+		}
+		s.entries = append(s.entries, sparseEntry{fingerprint: fp, window: uint32(len(s.windows) - 1)})
+	}
+	s.sortEntries()
+	return nil
+}
+
+func (s *SparseIndex) sortEntries() {
+	sort.Slice(s.entries, func(i, j int) bool {
+		if s.entries[i].fingerprint == s.entries[j].fingerprint {
+			return s.entries[i].window < s.entries[j].window
+		}
+		return s.entries[i].fingerprint < s.entries[j].fingerprint
+	})
+}
+
+// GetAll calls fn with the offset of each section in the backing data payload whose CID has the
+// same multihash as the given CID.
+func (s *SparseIndex) GetAll(c cid.Cid, fn func(uint64) bool) error {
+	if s.backing == nil {
+		return errors.New("sparse index has no backing data payload")
+	}
+	key := c.Hash()
+	fp, err := sparseFingerprint(key)
+	if err != nil {
+		return err
+	}
+
+	var any bool
+	i := sort.Search(len(s.entries), func(i int) bool { return s.entries[i].fingerprint >= fp })
+	lastWindow := -1
+	for ; i < len(s.entries) && s.entries[i].fingerprint == fp; i++ {
+		w := int(s.entries[i].window)
+		if w == lastWindow {
+			// Already scanned; the same fingerprint may appear more than once per window.
+			continue
+		}
+		lastWindow = w
+		found, stop, err := s.scanWindow(w, key, fn)
+		if err != nil {
+			return err
+		}
+		any = any || found
+		if stop {
+			break
+		}
+	}
+	if !any {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// scanWindow reads the sections of the given window, calling fn with the offset of any section
+// with multihash equal to key. The returned stop is true if fn signalled to stop.
+func (s *SparseIndex) scanWindow(w int, key multihash.Multihash, fn func(uint64) bool) (found bool, stop bool, err error) {
+	start := s.windows[w]
+	end := uint64(0) // zero signals that the window continues to the end of payload.
+	if w+1 < len(s.windows) {
+		end = s.windows[w+1]
+	}
+	r, err := internalio.NewOffsetReadSeeker(s.backing, int64(start))
+	if err != nil {
+		return false, false, err
+	}
+	offset := start
+	for end == 0 || offset < end {
+		sectionLen, err := readSectionLength(r, s.opts)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return found, false, err
+		}
+		cidLen, readCid, err := cid.CidFromReader(r)
+		if err != nil {
+			return found, false, err
+		}
+		if bytes.Equal(readCid.Hash(), key) {
+			found = true
+			if !fn(offset) {
+				return found, true, nil
+			}
+		}
+		next, err := r.Seek(int64(sectionLen)-int64(cidLen), io.SeekCurrent)
+		if err != nil {
+			return found, false, err
+		}
+		offset = start + uint64(next)
+	}
+	return found, false, nil
+}
+
+// Marshal encodes this index in serial form.
+// Note that the backing data payload is not included; an unmarshalled SparseIndex must be given
+// the same data payload via NewSparse in order to be used.
+func (s *SparseIndex) Marshal(w io.Writer) (uint64, error) {
+	l := uint64(0)
+	if err := binary.Write(w, binary.LittleEndian, s.stride); err != nil {
+		return l, err
+	}
+	l += 4
+	if err := binary.Write(w, binary.LittleEndian, uint64(len(s.windows))); err != nil {
+		return l, err
+	}
+	l += 8
+	if err := binary.Write(w, binary.LittleEndian, s.windows); err != nil {
+		return l, err
+	}
+	l += uint64(len(s.windows)) * 8
+	if err := binary.Write(w, binary.LittleEndian, uint64(len(s.entries))); err != nil {
+		return l, err
+	}
+	l += 8
+	buf := make([]byte, 8)
+	for _, e := range s.entries {
+		binary.LittleEndian.PutUint32(buf[:4], e.fingerprint)
+		binary.LittleEndian.PutUint32(buf[4:], e.window)
+		n, err := w.Write(buf)
+		l += uint64(n)
+		if err != nil {
+			return l, err
+		}
+	}
+	return l, nil
+}
+
+// Unmarshal decodes the index from its serial form, replacing the stride of this index with the
+// one in serialized index.
+func (s *SparseIndex) Unmarshal(r io.Reader) error {
+	var stride uint32
+	if err := binary.Read(r, binary.LittleEndian, &stride); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if stride < 1 {
+		return errors.New("malformed sparse index; stride must be at least 1")
+	}
+	windows, err := readSparseCount(r)
+	if err != nil {
+		return err
+	}
+	// Read windows and entries in bounded chunks, such that the slices only grow as the serialized
+	// data actually arrives rather than being allocated upfront based on an untrusted count.
+	s.windows = make([]uint64, 0, minSparseCount(windows))
+	buf := make([]byte, 8*sparseReadChunk)
+	for remaining := windows; remaining > 0; {
+		n := minSparseCount(remaining)
+		if _, err := io.ReadFull(r, buf[:8*n]); err != nil {
+			return unexpectedEOF(err)
+		}
+		for i := uint64(0); i < n; i++ {
+			s.windows = append(s.windows, binary.LittleEndian.Uint64(buf[8*i:]))
+		}
+		remaining -= n
+	}
+	entries, err := readSparseCount(r)
+	if err != nil {
+		return err
+	}
+	s.entries = make([]sparseEntry, 0, minSparseCount(entries))
+	for remaining := entries; remaining > 0; {
+		n := minSparseCount(remaining)
+		if _, err := io.ReadFull(r, buf[:8*n]); err != nil {
+			return unexpectedEOF(err)
+		}
+		for i := uint64(0); i < n; i++ {
+			e := sparseEntry{
+				fingerprint: binary.LittleEndian.Uint32(buf[8*i:]),
+				window:      binary.LittleEndian.Uint32(buf[8*i+4:]),
+			}
+			if uint64(e.window) >= windows {
+				return fmt.Errorf("malformed sparse index; window out of range: %d", e.window)
+			}
+			s.entries = append(s.entries, e)
+		}
+		remaining -= n
+	}
+	s.stride = stride
+	s.sortEntries()
+	return nil
+}
+
+// sparseReadChunk is the maximum number of windows or entries read at a time by
+// SparseIndex.Unmarshal.
+const sparseReadChunk = 4096
+
+func minSparseCount(count uint64) uint64 {
+	if count < sparseReadChunk {
+		return count
+	}
+	return sparseReadChunk
+}
+
+func readSparseCount(r io.Reader) (uint64, error) {
+	var count uint64
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	// Windows and entries are referenced by uint32 window index.
+	const maxCount = 1 << 32
+	if count > maxCount {
+		return 0, errors.New("index too big; sparse index count is larger than allowed maximum")
+	}
+	return count, nil
+}
+
+// sparseFingerprint returns the first 4 bytes of the digest of mh, zero-padded if the digest is
+// shorter.
+func sparseFingerprint(mh multihash.Multihash) (uint32, error) {
+	dmh, err := multihash.Decode(mh)
+	if err != nil {
+		return 0, err
+	}
+	var buf [4]byte
+	copy(buf[:], dmh.Digest)
+	return binary.BigEndian.Uint32(buf[:]), nil
+}
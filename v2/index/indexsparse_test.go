@@ -0,0 +1,139 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipld/go-car/v2/internal/carv1"
+	"github.com/ipld/go-car/v2/internal/carv1/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSparseIndex_GetAll(t *testing.T) {
+	f, err := os.Open("../testdata/sample-v1.car")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, f.Close()) })
+
+	cr, err := carv1.NewCarReader(f)
+	require.NoError(t, err)
+	var blks []Record
+	for {
+		blk, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		blks = append(blks, Record{Cid: blk.Cid()})
+	}
+
+	for _, stride := range []int{1, 3, 64} {
+		subject, err := GenerateSparse(f, stride)
+		require.NoError(t, err)
+		require.Equal(t, stride, subject.Stride())
+
+		for _, blk := range blks {
+			var gotOffsets []uint64
+			err := subject.GetAll(blk.Cid, func(o uint64) bool {
+				gotOffsets = append(gotOffsets, o)
+				return true
+			})
+			require.NoError(t, err)
+			require.NotEmpty(t, gotOffsets)
+
+			// Assert that each offset points at a section with the expected CID.
+			for _, o := range gotOffsets {
+				_, err := f.Seek(int64(o), io.SeekStart)
+				require.NoError(t, err)
+				c, _, err := util.ReadNode(f, false, carv1.DefaultMaxAllowedSectionSize)
+				require.NoError(t, err)
+				require.Equal(t, blk.Hash(), c.Hash())
+			}
+		}
+
+		nonExistingKey := merkledag.NewRawNode([]byte("lobstermuncher")).Block.Cid()
+		_, err = GetFirst(subject, nonExistingKey)
+		require.Equal(t, ErrNotFound, err)
+	}
+}
+
+func TestSparseIndex_MarshalUnmarshal(t *testing.T) {
+	f, err := os.Open("../testdata/sample-v1.car")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, f.Close()) })
+
+	want, err := GenerateSparse(f, 7)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	n, err := want.Marshal(&buf)
+	require.NoError(t, err)
+	require.Equal(t, uint64(buf.Len()), n)
+
+	got, err := NewSparse(f, 1)
+	require.NoError(t, err)
+	require.NoError(t, got.Unmarshal(&buf))
+	require.Equal(t, want, got)
+}
+
+func TestSparseIndex_UnmarshalHostileCountIsError(t *testing.T) {
+	// A serialized index claiming the maximum number of windows, followed by only a few of them,
+	// must fail on the missing data rather than allocating for the claimed count.
+	var buf bytes.Buffer
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, uint32(7)))
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, uint64(1<<32)))
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, []uint64{0, 42, 87}))
+
+	subject, err := NewSparse(bytes.NewReader(nil), 1)
+	require.NoError(t, err)
+	require.ErrorIs(t, subject.Unmarshal(&buf), io.ErrUnexpectedEOF)
+
+	// As must one claiming the maximum number of entries.
+	buf.Reset()
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, uint32(7)))
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, uint64(1)))
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, uint64(0)))
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, uint64(1<<32)))
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, []uint32{0xcafe, 0}))
+	require.ErrorIs(t, subject.Unmarshal(&buf), io.ErrUnexpectedEOF)
+}
+
+func TestGenerateSparse_Options(t *testing.T) {
+	f, err := os.Open("../testdata/sample-v1-with-zero-len-section.car")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, f.Close()) })
+
+	// Null padding is an error by default.
+	_, err = GenerateSparse(f, 3)
+	requireErrorContains(t, err, "null padding not allowed")
+
+	// Sections larger than the maximum allowed section size are an error.
+	_, err = GenerateSparse(f, 3, ZeroLengthSectionAsEOF(true), MaxAllowedSectionSize(1))
+	require.ErrorIs(t, err, util.ErrSectionTooLarge)
+
+	subject, err := GenerateSparse(f, 64, ZeroLengthSectionAsEOF(true))
+	require.NoError(t, err)
+
+	// Lookups scan the last window up to the null padding, which must honour the same options.
+	cr, err := carv1.NewCarReaderWithZeroLengthSectionAsEOF(f)
+	require.NoError(t, err)
+	var count int
+	for {
+		blk, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, subject.GetAll(blk.Cid(), func(uint64) bool { return true }))
+		count++
+	}
+	require.NotZero(t, count)
+}
+
+func TestNewSparse_InvalidStrideIsError(t *testing.T) {
+	_, err := NewSparse(nil, 0)
+	require.Error(t, err)
+}
@@ -0,0 +1,179 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	internalio "github.com/ipld/go-car/v2/internal/io"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/multiformats/go-varint"
+)
+
+// CarLinearIndex is a reserved multicodec code used for LinearIndex.
+// This index type is not defined in the CARv2 spec.
+const CarLinearIndex = 0x300006
+
+var (
+	_ Index         = (*LinearIndex)(nil)
+	_ IterableIndex = (*LinearIndex)(nil)
+	_ SortedLoader  = (*LinearIndex)(nil)
+	_ RangeIndex    = (*LinearIndex)(nil)
+)
+
+type (
+	// LinearIndex is an index that keeps its records in the order in which they were loaded, and
+	// looks them up by scanning over all of them. It is intended for CARs with a handful of blocks,
+	// where sorting records and grouping them by multihash code and digest length, as the sorted
+	// indices do, costs more than it saves; a lookup is linear in the number of records instead.
+	//
+	// The serialized index consists of a little-endian uint64 record count followed by the
+	// records, each of which consists of the uvarint length of the multihash, the multihash, and
+	// the little-endian uint64 offset.
+	LinearIndex struct {
+		records []linearRecord
+	}
+	linearRecord struct {
+		mh     multihash.Multihash
+		offset uint64
+	}
+)
+
+// NewLinear instantiates a new empty LinearIndex.
+func NewLinear() *LinearIndex {
+	return &LinearIndex{}
+}
+
+func (l *LinearIndex) Codec() multicodec.Code {
+	return CarLinearIndex
+}
+
+// Load appends the given records to this index, keeping their order.
+func (l *LinearIndex) Load(records []Record) error {
+	for _, r := range records {
+		l.records = append(l.records, linearRecord{mh: r.Hash(), offset: r.Offset})
+	}
+	return nil
+}
+
+// LoadSorted is the same as Load, since this index keeps records in the order in which they were
+// loaded regardless.
+func (l *LinearIndex) LoadSorted(records []Record) error {
+	return l.Load(records)
+}
+
+// GetAll calls fn with the offset of each indexed record with the same multihash as the given CID,
+// in the order in which they were loaded.
+func (l *LinearIndex) GetAll(c cid.Cid, fn func(uint64) bool) error {
+	key := c.Hash()
+	var any bool
+	for _, r := range l.records {
+		if !bytes.Equal(r.mh, key) {
+			continue
+		}
+		any = true
+		if !fn(r.offset) {
+			break
+		}
+	}
+	if !any {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetRange returns the records whose multihash digest is within the range between the digests of
+// min and max, inclusive. See RangeIndex. Since records are not sorted, all of them are scanned.
+func (l *LinearIndex) GetRange(min, max cid.Cid) ([]Record, error) {
+	lo, hi, err := rangeBounds(min, max)
+	if err != nil {
+		return nil, err
+	}
+	var found []rangeRecord
+	for _, r := range l.records {
+		dmh, err := multihash.Decode(r.mh)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Compare(dmh.Digest, lo) < 0 || bytes.Compare(dmh.Digest, hi) > 0 {
+			continue
+		}
+		found = append(found, rangeRecord{
+			digest: dmh.Digest,
+			Record: Record{Cid: cid.NewCidV1(cid.Raw, r.mh), Offset: r.offset},
+		})
+	}
+	return sortRangeRecords(found), nil
+}
+
+// ForEach calls f for every multihash and its associated offset stored by this index, in the
+// order in which they were loaded.
+func (l *LinearIndex) ForEach(f func(mh multihash.Multihash, offset uint64) error) error {
+	for _, r := range l.records {
+		if err := f(r.mh, r.offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *LinearIndex) Marshal(w io.Writer) (uint64, error) {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(len(l.records)))
+	n, err := w.Write(buf)
+	written := uint64(n)
+	if err != nil {
+		return written, err
+	}
+	for _, r := range l.records {
+		buf = append(buf[:0], varint.ToUvarint(uint64(len(r.mh)))...)
+		buf = append(buf, r.mh...)
+		var offset [8]byte
+		binary.LittleEndian.PutUint64(offset[:], r.offset)
+		buf = append(buf, offset[:]...)
+		n, err := w.Write(buf)
+		written += uint64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (l *LinearIndex) Unmarshal(r io.Reader) error {
+	var count uint64
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return unexpectedEOF(err)
+	}
+	br := internalio.ToByteReader(r)
+	// Grow the records as they are read rather than allocating the count upfront, so that a
+	// corrupt count cannot cause a large allocation.
+	var records []linearRecord
+	for i := uint64(0); i < count; i++ {
+		mhLen, err := varint.ReadUvarint(br)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if int64(mhLen) < 0 {
+			return errors.New("index too big; LinearIndex multihash length is overflowing int64")
+		}
+		var mhBuf bytes.Buffer
+		if _, err := io.CopyN(&mhBuf, r, int64(mhLen)); err != nil {
+			return unexpectedEOF(err)
+		}
+		mh, err := multihash.Cast(mhBuf.Bytes())
+		if err != nil {
+			return err
+		}
+		var offset uint64
+		if err := binary.Read(r, binary.LittleEndian, &offset); err != nil {
+			return unexpectedEOF(err)
+		}
+		records = append(records, linearRecord{mh: mh, offset: offset})
+	}
+	l.records = records
+	return nil
+}
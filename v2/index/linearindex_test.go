@@ -0,0 +1,78 @@
+package index_test
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinearIndex_Codec(t *testing.T) {
+	subject, err := index.New(index.CarLinearIndex)
+	require.NoError(t, err)
+	require.Equal(t, multicodec.Code(index.CarLinearIndex), subject.Codec())
+}
+
+func TestLinearIndex_MarshalUnmarshal(t *testing.T) {
+	rng := rand.New(rand.NewSource(1416))
+	records := generateIndexRecords(t, multihash.SHA2_256, rng)
+	records = append(records, generateIndexRecords(t, multihash.SHA2_512, rng)...)
+
+	subject := index.NewLinear()
+	require.NoError(t, subject.Load(records))
+	requireContainsAll(t, subject, records)
+
+	// Write the index with its codec and read it back in.
+	buf := new(bytes.Buffer)
+	_, err := index.WriteTo(subject, buf)
+	require.NoError(t, err)
+	// Append trailing bytes to assert unmarshal reads exactly the index bytes.
+	buf.WriteString("fish")
+	umSubject, err := index.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "fish", buf.String())
+	requireContainsAll(t, umSubject, records)
+
+	nonExistingKey := merkledag.NewRawNode([]byte("lobstermuncher")).Block.Cid()
+	_, err = index.GetFirst(umSubject, nonExistingKey)
+	require.Equal(t, index.ErrNotFound, err)
+
+	// Assert a truncated index is an error.
+	var encoded bytes.Buffer
+	_, err = subject.Marshal(&encoded)
+	require.NoError(t, err)
+	err = index.NewLinear().Unmarshal(bytes.NewReader(encoded.Bytes()[:encoded.Len()-1]))
+	require.Error(t, err)
+}
+
+func TestLinearIndex_ForEachIsInInsertionOrder(t *testing.T) {
+	rng := rand.New(rand.NewSource(1417))
+	records := generateIndexRecords(t, multihash.SHA2_256, rng)
+	// Add a duplicate of the first record at a later offset.
+	records = append(records, index.Record{Cid: records[0].Cid, Offset: records[len(records)-1].Offset + 1})
+
+	subject := index.NewLinear()
+	require.NoError(t, subject.Load(records[:3]))
+	require.NoError(t, subject.Load(records[3:]))
+
+	var i int
+	require.NoError(t, subject.ForEach(func(mh multihash.Multihash, offset uint64) error {
+		require.Equal(t, records[i].Hash(), mh)
+		require.Equal(t, records[i].Offset, offset)
+		i++
+		return nil
+	}))
+	require.Equal(t, len(records), i)
+
+	var offsets []uint64
+	require.NoError(t, subject.GetAll(records[0].Cid, func(o uint64) bool {
+		offsets = append(offsets, o)
+		return true
+	}))
+	require.Equal(t, []uint64{records[0].Offset, records[len(records)-1].Offset}, offsets)
+}
@@ -0,0 +1,156 @@
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+)
+
+// LintReport summarises the structure of an encoded index, as checked by Lint.
+type LintReport struct {
+	// Codec is the codec of the index, as read from its prefix.
+	Codec multicodec.Code
+	// Records is the number of records in the index.
+	Records int
+	// DuplicateDigests is the number of records whose multihash is the same as that of another
+	// record. Note that an index of a CAR carrying duplicate blocks legitimately holds such records,
+	// one per occurrence; therefore, they are only reported as a problem if their offsets are equal
+	// too.
+	DuplicateDigests int
+	// MinOffset and MaxOffset are the smallest and largest offsets of the records, or zero if the
+	// index has none.
+	MinOffset, MaxOffset uint64
+	// Problems describes the structural problems found in the index, if any.
+	Problems []string
+}
+
+// OK returns whether no problems were found in the index.
+func (r LintReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Lint checks the structure of the encoded index read from r, e.g. a .carindex file as written by
+// WriteTo, without the CAR it indexes. This allows indices to be checked in isolation, e.g. in CI
+// for generated indices or when debugging reports of corruption.
+//
+// The index is decoded as described by ReadFrom, after which its records are checked such that:
+//   - the codec is a known index codec, and the index decodes without leftover bytes;
+//   - the records of each bucket, i.e. of each multihash code and digest length, are sorted by
+//     digest, as lookups depend on;
+//   - no two records have both the same multihash and offset; and
+//   - offsets are neither zero, where the header of a CAR is, nor beyond what io.ReaderAt supports.
+//
+// Since the CAR is not available, offsets are not checked against its sections; see Validate.
+//
+// Problems found are listed in the returned report rather than returned as an error, such that
+// all of them are reported at once; decoding stops at the first problem that prevents it. An error
+// is only returned if r cannot be read. Note that the whole index is read into memory.
+func Lint(r io.Reader) (LintReport, error) {
+	var report LintReport
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return report, err
+	}
+	br := bytes.NewReader(data)
+	codec, err := ReadCodec(br)
+	if err != nil {
+		report.Problems = append(report.Problems, fmt.Sprintf("cannot read codec: %v", err))
+		return report, nil
+	}
+	report.Codec = codec
+	idx, err := New(codec)
+	if err != nil {
+		report.Problems = append(report.Problems, err.Error())
+		return report, nil
+	}
+	if err := idx.Unmarshal(br); err != nil {
+		report.Problems = append(report.Problems, fmt.Sprintf("cannot decode index: %v", err))
+		return report, nil
+	}
+	if br.Len() > 0 {
+		report.Problems = append(report.Problems, fmt.Sprintf("%d bytes left over after index", br.Len()))
+	}
+
+	// Records are visited in the order in which they are encoded; each bucket is encoded as a
+	// contiguous run of records, which must be sorted by digest.
+	type bucket struct {
+		code   uint64
+		length int
+	}
+	type bucketState struct {
+		last        []byte
+		lastOffsets []uint64
+		unsorted    bool
+	}
+	buckets := make(map[bucket]*bucketState)
+	var badOffsets int
+	visit := func(code uint64, digest []byte, offset uint64) {
+		report.Records++
+		if report.Records == 1 || offset < report.MinOffset {
+			report.MinOffset = offset
+		}
+		if offset > report.MaxOffset {
+			report.MaxOffset = offset
+		}
+		if offset == 0 || offset > math.MaxInt64 {
+			badOffsets++
+		}
+
+		k := bucket{code, len(digest)}
+		s, ok := buckets[k]
+		if !ok {
+			s = &bucketState{}
+			buckets[k] = s
+		}
+		switch c := bytes.Compare(s.last, digest); {
+		case s.last == nil || c < 0:
+			s.last = digest
+			s.lastOffsets = append(s.lastOffsets[:0], offset)
+		case c == 0:
+			report.DuplicateDigests++
+			for _, o := range s.lastOffsets {
+				if o == offset {
+					report.Problems = append(report.Problems, fmt.Sprintf("duplicate record of digest %x at offset %d", digest, offset))
+					break
+				}
+			}
+			s.lastOffsets = append(s.lastOffsets, offset)
+		default:
+			if !s.unsorted {
+				s.unsorted = true
+				report.Problems = append(report.Problems, fmt.Sprintf("records of multihash code 0x%x and digest length %d are not sorted: digest %x follows %x", code, len(digest), digest, s.last))
+			}
+			s.last = digest
+			s.lastOffsets = append(s.lastOffsets[:0], offset)
+		}
+	}
+
+	switch idx := idx.(type) {
+	case *multiWidthIndex:
+		// CarIndexSorted does not record multihash codes.
+		err = idx.forEachDigest(func(digest []byte, offset uint64) error {
+			visit(0, digest, offset)
+			return nil
+		})
+	case IterableIndex:
+		err = idx.ForEach(func(mh multihash.Multihash, offset uint64) error {
+			dmh, err := multihash.Decode(mh)
+			if err != nil {
+				return err
+			}
+			visit(dmh.Code, dmh.Digest, offset)
+			return nil
+		})
+	}
+	if err != nil {
+		report.Problems = append(report.Problems, fmt.Sprintf("cannot iterate over records: %v", err))
+	}
+	if badOffsets > 0 {
+		report.Problems = append(report.Problems, fmt.Sprintf("%d records have an offset of zero or beyond %d", badOffsets, int64(math.MaxInt64)))
+	}
+	return report, nil
+}
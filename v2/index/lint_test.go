@@ -0,0 +1,110 @@
+package index_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/multiformats/go-varint"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLint(t *testing.T) {
+	var records []index.Record
+	for i := 0; i < 10; i++ {
+		mh, err := multihash.Sum([]byte(fmt.Sprintf("lint-%d", i)), multihash.SHA2_256, -1)
+		require.NoError(t, err)
+		records = append(records, index.Record{Cid: cid.NewCidV1(cid.Raw, mh), Offset: uint64(100 + i)})
+	}
+	encode := func(t *testing.T, codec multicodec.Code, records []index.Record) []byte {
+		idx, err := index.New(codec)
+		require.NoError(t, err)
+		require.NoError(t, idx.Load(records))
+		var buf bytes.Buffer
+		_, err = index.WriteTo(idx, &buf)
+		require.NoError(t, err)
+		return buf.Bytes()
+	}
+
+	for _, codec := range []multicodec.Code{multicodec.CarIndexSorted, multicodec.CarMultihashIndexSorted, index.CarMappableIndexSorted} {
+		codec := codec
+		t.Run(codec.String(), func(t *testing.T) {
+			report, err := index.Lint(bytes.NewReader(encode(t, codec, records)))
+			require.NoError(t, err)
+			require.True(t, report.OK(), report.Problems)
+			require.Equal(t, index.LintReport{Codec: codec, Records: 10, MinOffset: 100, MaxOffset: 109}, report)
+
+			// Assert duplicate digests are only a problem if their offsets are equal too.
+			dup := append(append([]index.Record{}, records...), index.Record{Cid: records[3].Cid, Offset: 200})
+			report, err = index.Lint(bytes.NewReader(encode(t, codec, dup)))
+			require.NoError(t, err)
+			require.True(t, report.OK(), report.Problems)
+			require.Equal(t, 1, report.DuplicateDigests)
+			dup = append(dup, records[3])
+			report, err = index.Lint(bytes.NewReader(encode(t, codec, dup)))
+			require.NoError(t, err)
+			require.Len(t, report.Problems, 1)
+			require.Contains(t, report.Problems[0], "duplicate record")
+
+			// Assert zero offsets are a problem.
+			zero := append([]index.Record{}, records...)
+			zero[0].Offset = 0
+			report, err = index.Lint(bytes.NewReader(encode(t, codec, zero)))
+			require.NoError(t, err)
+			require.Len(t, report.Problems, 1)
+			require.Contains(t, report.Problems[0], "offset of zero")
+
+			// Assert leftover bytes are a problem.
+			report, err = index.Lint(bytes.NewReader(append(encode(t, codec, records), 0x01)))
+			require.NoError(t, err)
+			require.Equal(t, []string{"1 bytes left over after index"}, report.Problems)
+		})
+	}
+
+	// Assert the sample indices are free of problems.
+	for _, path := range []string{"../testdata/sample-index.carindex", "../testdata/sample-multihash-index-sorted.carindex"} {
+		f, err := os.Open(path)
+		require.NoError(t, err)
+		report, err := index.Lint(f)
+		require.NoError(t, f.Close())
+		require.NoError(t, err)
+		require.True(t, report.OK(), report.Problems)
+		require.NotZero(t, report.Records)
+	}
+
+	// Assert unsorted records are a problem, by encoding a MultihashIndexSorted by hand.
+	var unsorted bytes.Buffer
+	unsorted.Write(varint.ToUvarint(uint64(multicodec.CarMultihashIndexSorted)))
+	require.NoError(t, binary.Write(&unsorted, binary.LittleEndian, int32(1)))
+	require.NoError(t, binary.Write(&unsorted, binary.LittleEndian, uint64(multihash.SHA2_256)))
+	require.NoError(t, binary.Write(&unsorted, binary.LittleEndian, int32(1)))
+	require.NoError(t, binary.Write(&unsorted, binary.LittleEndian, uint32(32+8)))
+	require.NoError(t, binary.Write(&unsorted, binary.LittleEndian, int64(2*(32+8))))
+	for _, b := range []byte{0xff, 0x00} {
+		unsorted.Write(bytes.Repeat([]byte{b}, 32))
+		require.NoError(t, binary.Write(&unsorted, binary.LittleEndian, uint64(100)))
+	}
+	report, err := index.Lint(&unsorted)
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Records)
+	require.Len(t, report.Problems, 1)
+	require.Contains(t, report.Problems[0], "not sorted")
+
+	// Assert unknown codecs and truncated indices are problems.
+	report, err = index.Lint(bytes.NewReader(varint.ToUvarint(uint64(multicodec.Sha2_256))))
+	require.NoError(t, err)
+	require.False(t, report.OK())
+	encoded := encode(t, multicodec.CarMultihashIndexSorted, records)
+	report, err = index.Lint(bytes.NewReader(encoded[:len(encoded)-1]))
+	require.NoError(t, err)
+	require.False(t, report.OK())
+	report, err = index.Lint(bytes.NewReader(nil))
+	require.NoError(t, err)
+	require.False(t, report.OK())
+}
@@ -0,0 +1,71 @@
+package index
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+)
+
+// ManifestRecord describes a block in a CAR data payload: its whole CID, the offset of its section
+// and the length of its block data, i.e. the length of the section excluding the CID.
+type ManifestRecord struct {
+	Cid    cid.Cid
+	Offset uint64
+	Length uint64
+}
+
+// WriteManifest writes the given records to w as a manifest: an inventory of the blocks in a CAR,
+// intended to be consumed by humans and tools alike rather than for looking blocks up. Unlike an
+// index, a manifest retains whole CIDs and block lengths, and is written as text with one record
+// per line, in the given order. Each line consists of the CID as a string, followed by the offset
+// and the length in decimal, separated by a single space.
+//
+// See ReadManifest for reading the manifest back.
+func WriteManifest(w io.Writer, records []ManifestRecord) error {
+	bw := bufio.NewWriter(w)
+	for _, r := range records {
+		if _, err := fmt.Fprintf(bw, "%s %d %d\n", r.Cid, r.Offset, r.Length); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ReadManifest reads the records of a manifest written by WriteManifest from r, in the order in
+// which they appear. Empty lines are ignored.
+func ReadManifest(r io.Reader) ([]ManifestRecord, error) {
+	var records []ManifestRecord
+	scanner := bufio.NewScanner(r)
+	var line int
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("malformed manifest at line %d: expected 3 fields but got %d", line, len(fields))
+		}
+		c, err := cid.Decode(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("malformed manifest at line %d: %w", line, err)
+		}
+		offset, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed manifest at line %d: %w", line, err)
+		}
+		length, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed manifest at line %d: %w", line, err)
+		}
+		records = append(records, ManifestRecord{Cid: c, Offset: offset, Length: length})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
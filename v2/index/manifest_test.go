@@ -0,0 +1,51 @@
+package index_test
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifest_WriteRead(t *testing.T) {
+	rng := rand.New(rand.NewSource(1413))
+	var want []index.ManifestRecord
+	for i, r := range generateIndexRecords(t, multihash.SHA2_256, rng) {
+		want = append(want, index.ManifestRecord{Cid: r.Cid, Offset: r.Offset, Length: uint64(i)})
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, index.WriteManifest(&buf, want))
+	require.Equal(t, len(want), strings.Count(buf.String(), "\n"))
+	got, err := index.ReadManifest(&buf)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+}
+
+func TestReadManifest_MalformedIsError(t *testing.T) {
+	c := "bafkreifjjcie6lypi6ny7amxnfftagclbuxndqonfipmb64f2km2devei4"
+	tests := []struct {
+		name     string
+		manifest string
+	}{
+		{"MissingField", c + " 1\n"},
+		{"InvalidCid", "lobster 1 2\n"},
+		{"InvalidOffset", c + " -1 2\n"},
+		{"InvalidLength", c + " 1 two\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := index.ReadManifest(strings.NewReader(tt.manifest))
+			require.Error(t, err)
+		})
+	}
+
+	// Assert empty lines are ignored.
+	got, err := index.ReadManifest(strings.NewReader("\n" + c + " 1 2\n\n"))
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+}
@@ -0,0 +1,308 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+)
+
+// CarMappableIndexSorted is a reserved multicodec code used for MappableIndexSorted.
+// This index type is not defined in the CARv2 spec.
+const CarMappableIndexSorted = 0x300005
+
+const (
+	// mappableBucketHeaderSize is the size of each bucket header in bytes:
+	// multihash code (uint64), record width (uint32) and record count (uint64).
+	mappableBucketHeaderSize = 8 + 4 + 8
+	// mappableCountSize is the size of the bucket count at the start of the index in bytes.
+	mappableCountSize = 4
+)
+
+var (
+	_ Index         = (*MappableIndexSorted)(nil)
+	_ IterableIndex = (*MappableIndexSorted)(nil)
+	_ SortedLoader  = (*MappableIndexSorted)(nil)
+	_ RangeIndex    = (*MappableIndexSorted)(nil)
+)
+
+type (
+	// MappableIndexSorted is an index with a serialized form that can be used for lookups as is,
+	// e.g. when memory-mapped from a file, without decoding it onto the heap.
+	//
+	// The serialized index consists of a little-endian uint32 bucket count followed by buckets,
+	// one per pair of multihash code and digest length, in ascending order of code then length.
+	// Each bucket consists of a header, containing the little-endian uint64 multihash code, uint32
+	// record width and uint64 record count, followed by the records. Each record is exactly record
+	// width bytes long: the multihash digest followed by the little-endian uint64 offset. The
+	// records within a bucket are sorted by digest, allowing binary search over the raw bytes.
+	//
+	// Use NewMappableIndexSortedFromBytes to instantiate the index directly from its serialized
+	// form, with no copying.
+	MappableIndexSorted struct {
+		// data holds the index in serialized form.
+		data []byte
+		// buckets holds the views over the records in data, parsed from bucket headers.
+		buckets []mappableBucket
+	}
+	mappableBucket struct {
+		code    uint64
+		width   uint32
+		records []byte
+	}
+)
+
+// NewMappableIndexSorted instantiates a new empty MappableIndexSorted.
+func NewMappableIndexSorted() *MappableIndexSorted {
+	return &MappableIndexSorted{}
+}
+
+// NewMappableIndexSortedFromBytes instantiates a MappableIndexSorted backed by the given index in
+// serialized form, excluding the codec prefix written by WriteTo.
+// The given bytes are not copied and must not be modified while the index is in use. This allows
+// the index to be backed by a memory-mapped region, in which case lookups only touch the pages
+// that are needed for the binary search.
+//
+// Note that the bucket headers are validated to not exceed the given bytes, but the ordering of
+// records is not; attempting to use indices from untrusted sources is not recommended.
+func NewMappableIndexSortedFromBytes(b []byte) (*MappableIndexSorted, error) {
+	m := &MappableIndexSorted{}
+	if err := m.setData(b); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *MappableIndexSorted) setData(b []byte) error {
+	if len(b) < mappableCountSize {
+		return io.ErrUnexpectedEOF
+	}
+	count := binary.LittleEndian.Uint32(b)
+	rest := b[mappableCountSize:]
+	// Check the count against the bytes available before allocating, since it may be arbitrarily
+	// large in a malformed index.
+	if uint64(count) > uint64(len(rest))/mappableBucketHeaderSize {
+		return io.ErrUnexpectedEOF
+	}
+	buckets := make([]mappableBucket, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if len(rest) < mappableBucketHeaderSize {
+			return io.ErrUnexpectedEOF
+		}
+		bucket := mappableBucket{
+			code:  binary.LittleEndian.Uint64(rest),
+			width: binary.LittleEndian.Uint32(rest[8:]),
+		}
+		recordCount := binary.LittleEndian.Uint64(rest[12:])
+		rest = rest[mappableBucketHeaderSize:]
+		if bucket.width < 8 {
+			return errors.New("malformed index; width must be at least 8")
+		}
+		if recordCount > uint64(len(rest))/uint64(bucket.width) {
+			return io.ErrUnexpectedEOF
+		}
+		size := int(recordCount) * int(bucket.width)
+		bucket.records = rest[:size]
+		rest = rest[size:]
+		buckets = append(buckets, bucket)
+	}
+	if len(rest) != 0 {
+		return fmt.Errorf("malformed index; %d unexpected trailing bytes", len(rest))
+	}
+	m.data = b
+	m.buckets = buckets
+	return nil
+}
+
+func (m *MappableIndexSorted) Codec() multicodec.Code {
+	return CarMappableIndexSorted
+}
+
+// Bytes returns the index in serialized form, excluding the codec prefix written by WriteTo.
+// The returned bytes must not be modified.
+func (m *MappableIndexSorted) Bytes() []byte {
+	return m.data
+}
+
+func (m *MappableIndexSorted) Marshal(w io.Writer) (uint64, error) {
+	data := m.data
+	if data == nil {
+		// An empty index is serialized as a zero bucket count.
+		data = make([]byte, mappableCountSize)
+	}
+	n, err := w.Write(data)
+	return uint64(n), err
+}
+
+// Unmarshal reads the serialized index from r into memory.
+// To use an index without copying it see NewMappableIndexSortedFromBytes.
+func (m *MappableIndexSorted) Unmarshal(r io.Reader) error {
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, mappableCountSize); err != nil {
+		return unexpectedEOF(err)
+	}
+	count := binary.LittleEndian.Uint32(buf.Bytes())
+	header := make([]byte, mappableBucketHeaderSize)
+	for i := uint32(0); i < count; i++ {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return unexpectedEOF(err)
+		}
+		buf.Write(header)
+		width := uint64(binary.LittleEndian.Uint32(header[8:]))
+		recordCount := binary.LittleEndian.Uint64(header[12:])
+		size := width * recordCount
+		if (recordCount != 0 && size/recordCount != width) || int64(size) < 0 {
+			return errors.New("index too big; MappableIndexSorted bucket size is overflowing int64")
+		}
+		// Copy rather than allocating the bucket size upfront, so that a corrupt header cannot
+		// cause a large allocation.
+		if _, err := io.CopyN(&buf, r, int64(size)); err != nil {
+			return unexpectedEOF(err)
+		}
+	}
+	return m.setData(buf.Bytes())
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (m *MappableIndexSorted) Load(records []Record) error {
+	return m.load(records, false)
+}
+
+// LoadSorted loads the given records, which must be sorted as described by SortedLoader.
+func (m *MappableIndexSorted) LoadSorted(records []Record) error {
+	return m.load(records, true)
+}
+
+func (m *MappableIndexSorted) load(records []Record, sorted bool) error {
+	type bucketKey struct {
+		code  uint64
+		width uint32
+	}
+	groups := make(map[bucketKey][]digestRecord)
+	for _, r := range records {
+		dmh, err := multihash.Decode(r.Hash())
+		if err != nil {
+			return err
+		}
+		key := bucketKey{code: dmh.Code, width: uint32(len(dmh.Digest) + 8)}
+		groups[key] = append(groups[key], digestRecord{digest: dmh.Digest, index: r.Offset})
+	}
+	keys := make([]bucketKey, 0, len(groups))
+	size := mappableCountSize
+	for k, g := range groups {
+		keys = append(keys, k)
+		size += mappableBucketHeaderSize + int(k.width)*len(g)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].code == keys[j].code {
+			return keys[i].width < keys[j].width
+		}
+		return keys[i].code < keys[j].code
+	})
+
+	buf := make([]byte, size)
+	binary.LittleEndian.PutUint32(buf, uint32(len(keys)))
+	pos := mappableCountSize
+	for _, k := range keys {
+		g := groups[k]
+		if !sorted {
+			sort.Sort(recordSet(g))
+		}
+		binary.LittleEndian.PutUint64(buf[pos:], k.code)
+		binary.LittleEndian.PutUint32(buf[pos+8:], k.width)
+		binary.LittleEndian.PutUint64(buf[pos+12:], uint64(len(g)))
+		pos += mappableBucketHeaderSize
+		for _, r := range g {
+			r.write(buf[pos : pos+int(k.width)])
+			pos += int(k.width)
+		}
+	}
+	return m.setData(buf)
+}
+
+// GetAll calls fn with the offset of each indexed record with the same multihash as the given CID.
+// The lookup is performed directly over the serialized index.
+func (m *MappableIndexSorted) GetAll(c cid.Cid, fn func(uint64) bool) error {
+	dmh, err := multihash.Decode(c.Hash())
+	if err != nil {
+		return err
+	}
+	width := uint32(len(dmh.Digest) + 8)
+	for _, b := range m.buckets {
+		if b.code != dmh.Code || b.width != width {
+			continue
+		}
+		return b.getAll(dmh.Digest, fn)
+	}
+	return ErrNotFound
+}
+
+func (b *mappableBucket) getAll(digest []byte, fn func(uint64) bool) error {
+	w := int(b.width)
+	count := len(b.records) / w
+	i := sort.Search(count, func(i int) bool {
+		return bytes.Compare(b.records[i*w:(i+1)*w-8], digest) >= 0
+	})
+	var any bool
+	for ; i < count; i++ {
+		record := b.records[i*w : (i+1)*w]
+		if !bytes.Equal(record[:w-8], digest) {
+			break
+		}
+		any = true
+		if !fn(binary.LittleEndian.Uint64(record[w-8:])) {
+			break
+		}
+	}
+	if !any {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetRange returns the records whose multihash digest is within the range between the digests of
+// min and max, inclusive. See RangeIndex. The lookup is performed directly over the serialized
+// index.
+func (m *MappableIndexSorted) GetRange(min, max cid.Cid) ([]Record, error) {
+	lo, hi, err := rangeBounds(min, max)
+	if err != nil {
+		return nil, err
+	}
+	var found []rangeRecord
+	for _, b := range m.buckets {
+		if found, err = appendRange(found, b.records, int(b.width), b.code, lo, hi); err != nil {
+			return nil, err
+		}
+	}
+	return sortRangeRecords(found), nil
+}
+
+// ForEach calls f for every multihash and its associated offset stored by this index, in the
+// order in which they appear in its serialized form.
+func (m *MappableIndexSorted) ForEach(f func(mh multihash.Multihash, offset uint64) error) error {
+	for _, b := range m.buckets {
+		w := int(b.width)
+		for i := 0; i < len(b.records); i += w {
+			mh, err := multihash.Encode(b.records[i:i+w-8], b.code)
+			if err != nil {
+				return err
+			}
+			if err := f(mh, binary.LittleEndian.Uint64(b.records[i+w-8:i+w])); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
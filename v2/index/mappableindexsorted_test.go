@@ -0,0 +1,90 @@
+package index_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMappableIndexSorted_Codec(t *testing.T) {
+	subject, err := index.New(index.CarMappableIndexSorted)
+	require.NoError(t, err)
+	require.Equal(t, multicodec.Code(index.CarMappableIndexSorted), subject.Codec())
+}
+
+func TestMappableIndexSorted_MarshalUnmarshal(t *testing.T) {
+	rng := rand.New(rand.NewSource(1413))
+	records := generateIndexRecords(t, multihash.SHA2_256, rng)
+	records = append(records, generateIndexRecords(t, multihash.SHA2_512, rng)...)
+
+	subject := index.NewMappableIndexSorted()
+	require.NoError(t, subject.Load(records))
+	requireContainsAll(t, subject, records)
+
+	// Write the index with its codec and read it back in.
+	buf := new(bytes.Buffer)
+	_, err := index.WriteTo(subject, buf)
+	require.NoError(t, err)
+	// Append trailing bytes to assert unmarshal reads exactly the index bytes.
+	buf.WriteString("fish")
+	umSubject, err := index.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "fish", buf.String())
+	requireContainsAll(t, umSubject, records)
+
+	// Assert the index can be used directly over its serialized form.
+	mapped, err := index.NewMappableIndexSortedFromBytes(subject.Bytes())
+	require.NoError(t, err)
+	requireContainsAll(t, mapped, records)
+
+	nonExistingKey := merkledag.NewRawNode([]byte("lobstermuncher")).Block.Cid()
+	_, err = index.GetFirst(mapped, nonExistingKey)
+	require.Equal(t, index.ErrNotFound, err)
+}
+
+func TestMappableIndexSorted_ForEachIsConsistentWithMultihashSorted(t *testing.T) {
+	rng := rand.New(rand.NewSource(1414))
+	records := generateIndexRecords(t, multihash.SHA2_256, rng)
+	records = append(records, generateIndexRecords(t, multihash.SHA2_512, rng)...)
+
+	subject := index.NewMappableIndexSorted()
+	require.NoError(t, subject.Load(records))
+	want := index.NewMultihashSorted()
+	require.NoError(t, want.Load(records))
+
+	type entry struct {
+		mh     string
+		offset uint64
+	}
+	collect := func(idx index.IterableIndex) (entries []entry) {
+		require.NoError(t, idx.ForEach(func(mh multihash.Multihash, offset uint64) error {
+			entries = append(entries, entry{string(mh), offset})
+			return nil
+		}))
+		return
+	}
+	require.Equal(t, collect(want), collect(subject))
+}
+
+func TestNewMappableIndexSortedFromBytes_TruncatedIsError(t *testing.T) {
+	rng := rand.New(rand.NewSource(1415))
+	subject := index.NewMappableIndexSorted()
+	require.NoError(t, subject.Load(generateIndexRecords(t, multihash.SHA2_256, rng)))
+	b := subject.Bytes()
+	_, err := index.NewMappableIndexSortedFromBytes(b[:len(b)-1])
+	require.Error(t, err)
+}
+
+func TestNewMappableIndexSortedFromBytes_HugeBucketCountIsError(t *testing.T) {
+	// A bucket count of 0xffffffff with no bucket headers following it must be rejected without
+	// attempting to allocate room for that many buckets.
+	_, err := index.NewMappableIndexSortedFromBytes([]byte{0xff, 0xff, 0xff, 0xff})
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
@@ -15,6 +15,8 @@ import (
 var (
 	_ Index         = (*MultihashIndexSorted)(nil)
 	_ IterableIndex = (*MultihashIndexSorted)(nil)
+	_ SortedLoader  = (*MultihashIndexSorted)(nil)
+	_ RangeIndex    = (*MultihashIndexSorted)(nil)
 )
 
 type (
@@ -137,6 +139,15 @@ func (m *MultihashIndexSorted) put(mwci *multiWidthCodedIndex) {
 }
 
 func (m *MultihashIndexSorted) Load(records []Record) error {
+	return m.load(records, false)
+}
+
+// LoadSorted loads the given records, which must be sorted as described by SortedLoader.
+func (m *MultihashIndexSorted) LoadSorted(records []Record) error {
+	return m.load(records, true)
+}
+
+func (m *MultihashIndexSorted) load(records []Record, sorted bool) error {
 	// TODO optimize load by avoiding multihash decoding twice.
 	// This implementation decodes multihashes twice: once here to group by code, and once in the
 	// internals of multiWidthIndex to group by digest length. The code can be optimized by
@@ -163,7 +174,7 @@ func (m *MultihashIndexSorted) Load(records []Record) error {
 	for code, recsByCode := range byCode {
 		mwci := newMultiWidthCodedIndex()
 		mwci.code = code
-		if err := mwci.Load(recsByCode); err != nil {
+		if err := mwci.load(recsByCode, sorted); err != nil {
 			return err
 		}
 		m.put(mwci)
@@ -171,6 +182,36 @@ func (m *MultihashIndexSorted) Load(records []Record) error {
 	return nil
 }
 
+// GetRange returns the records whose multihash digest is within the range between the digests of
+// min and max, inclusive. See RangeIndex.
+func (m *MultihashIndexSorted) GetRange(min, max cid.Cid) ([]Record, error) {
+	lo, hi, err := rangeBounds(min, max)
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]uint64, 0, len(*m))
+	for code := range *m {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	var found []rangeRecord
+	for _, code := range codes {
+		mwci := (*m)[code]
+		widths := make([]uint32, 0, len(mwci.multiWidthIndex))
+		for width := range mwci.multiWidthIndex {
+			widths = append(widths, width)
+		}
+		sort.Slice(widths, func(i, j int) bool { return widths[i] < widths[j] })
+		for _, width := range widths {
+			swi := mwci.multiWidthIndex[width]
+			if found, err = appendRange(found, swi.index, int(swi.width), code, lo, hi); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return sortRangeRecords(found), nil
+}
+
 func (m *MultihashIndexSorted) GetAll(cid cid.Cid, f func(uint64) bool) error {
 	hash := cid.Hash()
 	dmh, err := multihash.Decode(hash)
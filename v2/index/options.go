@@ -0,0 +1,79 @@
+package index
+
+import (
+	"errors"
+	"io"
+
+	"github.com/ipld/go-car/v2/internal/carv1"
+	"github.com/ipld/go-car/v2/internal/carv1/util"
+)
+
+// Option describes an option which affects how the CARv1 data payload an index refers to is read,
+// e.g. when generating a SparseIndex or verifying an index against its data payload.
+type Option func(*Options)
+
+// Options holds the configured options after applying a number of Option funcs.
+//
+// This type should not be used directly by end users; it's only exposed as a
+// side effect of Option.
+type Options struct {
+	ZeroLengthSectionAsEOF bool
+	MaxAllowedHeaderSize   uint64
+	MaxAllowedSectionSize  uint64
+}
+
+// ApplyOptions applies given opts and returns the resulting Options.
+// This function should not be used directly by end users; it's only exposed as a
+// side effect of Option.
+func ApplyOptions(opt ...Option) Options {
+	opts := Options{
+		MaxAllowedHeaderSize:  carv1.DefaultMaxAllowedHeaderSize,
+		MaxAllowedSectionSize: carv1.DefaultMaxAllowedSectionSize,
+	}
+	for _, o := range opt {
+		o(&opts)
+	}
+	return opts
+}
+
+// ZeroLengthSectionAsEOF sets whether to treat a zero-length section as the end of the data
+// payload, e.g. to allow "null padding" after a CARv1. By default, a zero-length section is an
+// error. See car.ZeroLengthSectionAsEOF.
+func ZeroLengthSectionAsEOF(enable bool) Option {
+	return func(o *Options) {
+		o.ZeroLengthSectionAsEOF = enable
+	}
+}
+
+// MaxAllowedHeaderSize overrides the default maximum size (of 32 KiB) that the CARv1 header of a
+// data payload is allowed to be; reading a larger header is an error. See car.MaxAllowedHeaderSize.
+func MaxAllowedHeaderSize(max uint64) Option {
+	return func(o *Options) {
+		o.MaxAllowedHeaderSize = max
+	}
+}
+
+// MaxAllowedSectionSize overrides the default maximum size (of 8 MiB) that a section of a data
+// payload is allowed to be; reading a larger section is an error. See car.MaxAllowedSectionSize.
+func MaxAllowedSectionSize(max uint64) Option {
+	return func(o *Options) {
+		o.MaxAllowedSectionSize = max
+	}
+}
+
+// readSectionLength reads the length prefix of a section from r, capped at the maximum section size
+// set in o. An io.EOF is returned at the end of r, as well as for a zero-length section if o allows
+// it via ZeroLengthSectionAsEOF; otherwise a zero-length section is an error.
+func readSectionLength(r io.ByteReader, o Options) (uint64, error) {
+	l, err := util.ReadSectionLength(r, o.MaxAllowedSectionSize)
+	if err != nil {
+		return 0, err
+	}
+	if l == 0 {
+		if o.ZeroLengthSectionAsEOF {
+			return 0, io.EOF
+		}
+		return 0, errors.New("carv1 null padding not allowed by default; see ZeroLengthSectionAsEOF")
+	}
+	return l, nil
+}
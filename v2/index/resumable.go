@@ -0,0 +1,230 @@
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-varint"
+)
+
+// DefaultCheckpointInterval is the default number of records a ResumableBuilder accumulates before
+// checkpointing them.
+const DefaultCheckpointInterval = 1 << 16
+
+// ResumableBuilder accumulates the records of an index as the sections of a CAR are read, and
+// periodically checkpoints them to a file, such that building the index can be resumed from the
+// last checkpoint after a crash instead of from scratch. This is intended for building the index of
+// a large CAR in the background, e.g. while it is being imported by a long-running process.
+//
+// Records must be added in ascending order of offset, i.e. in the order in which their sections
+// appear in the CAR. Once all records are added, Finish encodes them as an index.
+//
+// Each checkpoint is appended to the checkpoint file as a frame holding the records added since
+// the previous one, followed by a checksum, and the file is synced. A frame that was only partially
+// written, e.g. due to a crash, is discarded when the file is read back. Note that records are
+// also held in memory until Finish is called, since they are loaded into an index then.
+//
+// ResumableBuilder is not safe for concurrent use.
+type ResumableBuilder struct {
+	path     string
+	interval int
+
+	records []Record
+	// checkpointed is the number of records in the checkpoint file.
+	checkpointed int
+	// validSize is the size of the checkpoint file up to the end of its last complete frame.
+	validSize int64
+}
+
+// NewResumableBuilder instantiates a new ResumableBuilder which checkpoints its records to the file
+// at path every interval records. If interval is not positive, DefaultCheckpointInterval is used.
+//
+// If the file exists, the records checkpointed in it are read back and the builder resumes from
+// them; see LastOffset. Otherwise, the file is created upon the first checkpoint.
+func NewResumableBuilder(path string, interval int) (*ResumableBuilder, error) {
+	if interval <= 0 {
+		interval = DefaultCheckpointInterval
+	}
+	b := &ResumableBuilder{
+		path:     path,
+		interval: interval,
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := b.readCheckpoints(bufio.NewReader(f)); err != nil {
+		return nil, fmt.Errorf("cannot read checkpoint file %s: %w", path, err)
+	}
+	b.checkpointed = len(b.records)
+	return b, nil
+}
+
+// LastOffset returns the offset of the last record added to the builder, including those read back
+// from the checkpoint file, along with whether there is one. Resuming from the section at this
+// offset rebuilds at most the records added since the last checkpoint; records added again at or
+// below this offset are ignored by Add.
+func (b *ResumableBuilder) LastOffset() (offset uint64, ok bool) {
+	if len(b.records) == 0 {
+		return 0, false
+	}
+	return b.records[len(b.records)-1].Offset, true
+}
+
+// Add adds the given record to the builder, checkpointing the records added since the previous
+// checkpoint if there are as many as the checkpoint interval. The record is ignored if its offset
+// is not greater than LastOffset, such that sections can be read again when resuming.
+func (b *ResumableBuilder) Add(r Record) error {
+	if last, ok := b.LastOffset(); ok && r.Offset <= last {
+		return nil
+	}
+	b.records = append(b.records, r)
+	if len(b.records)-b.checkpointed >= b.interval {
+		return b.Checkpoint()
+	}
+	return nil
+}
+
+// Checkpoint appends the records added since the previous checkpoint to the checkpoint file, and
+// syncs it. Calling Checkpoint when there are no such records is a no-op.
+func (b *ResumableBuilder) Checkpoint() error {
+	pending := b.records[b.checkpointed:]
+	if len(pending) == 0 {
+		return nil
+	}
+	var payload bytes.Buffer
+	payload.Write(varint.ToUvarint(uint64(len(pending))))
+	for _, r := range pending {
+		payload.Write(varint.ToUvarint(uint64(r.Cid.ByteLen())))
+		payload.Write(r.Cid.Bytes())
+		payload.Write(varint.ToUvarint(r.Offset))
+	}
+	frame := varint.ToUvarint(uint64(payload.Len()))
+	frame = append(frame, payload.Bytes()...)
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], crc32.ChecksumIEEE(payload.Bytes()))
+	frame = append(frame, sum[:]...)
+
+	f, err := os.OpenFile(b.path, os.O_WRONLY|os.O_CREATE, 0o666)
+	if err != nil {
+		return err
+	}
+	// Write at the end of the last complete frame, overwriting any partially written one.
+	if _, err := f.WriteAt(frame, b.validSize); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Truncate(b.validSize + int64(len(frame))); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	b.validSize += int64(len(frame))
+	b.checkpointed = len(b.records)
+	return nil
+}
+
+// Finish loads all records added to the builder into a new index of the given codec, writes the
+// encoded index to w as index.WriteTo does, and removes the checkpoint file. The index is returned.
+func (b *ResumableBuilder) Finish(codec multicodec.Code, w io.Writer) (Index, error) {
+	idx, err := New(codec)
+	if err != nil {
+		return nil, err
+	}
+	if err := idx.Load(b.records); err != nil {
+		return nil, err
+	}
+	if _, err := WriteTo(idx, w); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(b.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	b.checkpointed, b.validSize = 0, 0
+	return idx, nil
+}
+
+// readCheckpoints reads the records of the complete frames in the checkpoint file from r, stopping
+// at the first frame that is incomplete or fails its checksum.
+func (b *ResumableBuilder) readCheckpoints(r *bufio.Reader) error {
+	for {
+		size, err := varint.ReadUvarint(r)
+		if err != nil {
+			// The end of the file, or a partially written frame length.
+			return nil
+		}
+		// Copy rather than allocate the payload up front, since a partially written frame length
+		// may be arbitrarily large.
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, r, int64(size)); err != nil {
+			return nil
+		}
+		payload := buf.Bytes()
+		var sum [4]byte
+		if _, err := io.ReadFull(r, sum[:]); err != nil {
+			return nil
+		}
+		if binary.LittleEndian.Uint32(sum[:]) != crc32.ChecksumIEEE(payload) {
+			return nil
+		}
+		records, err := decodeCheckpoint(payload)
+		if err != nil {
+			return err
+		}
+		b.records = append(b.records, records...)
+		b.validSize += int64(varint.UvarintSize(size)) + int64(size) + int64(len(sum))
+	}
+}
+
+// decodeCheckpoint decodes the records in the payload of a checkpoint frame.
+func decodeCheckpoint(payload []byte) ([]Record, error) {
+	br := bytes.NewReader(payload)
+	count, err := varint.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(len(payload)) {
+		return nil, fmt.Errorf("record count %d exceeds checkpoint size", count)
+	}
+	records := make([]Record, 0, count)
+	for i := uint64(0); i < count; i++ {
+		cidLen, err := varint.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		if cidLen > uint64(br.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		cidBytes := make([]byte, cidLen)
+		if _, err := io.ReadFull(br, cidBytes); err != nil {
+			return nil, err
+		}
+		_, c, err := cid.CidFromBytes(cidBytes)
+		if err != nil {
+			return nil, err
+		}
+		offset, err := varint.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, Record{Cid: c, Offset: offset})
+	}
+	return records, nil
+}
@@ -0,0 +1,76 @@
+package index_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResumableBuilder(t *testing.T) {
+	var records []index.Record
+	for i := 0; i < 25; i++ {
+		mh, err := multihash.Sum([]byte(fmt.Sprintf("resumable-%d", i)), multihash.SHA2_256, -1)
+		require.NoError(t, err)
+		records = append(records, index.Record{Cid: cid.NewCidV1(cid.Raw, mh), Offset: uint64(100 + 10*i)})
+	}
+	path := filepath.Join(t.TempDir(), "checkpoint")
+
+	// Add 17 records with a checkpoint interval of 5, such that 15 are checkpointed.
+	subject, err := index.NewResumableBuilder(path, 5)
+	require.NoError(t, err)
+	_, ok := subject.LastOffset()
+	require.False(t, ok)
+	for _, r := range records[:17] {
+		require.NoError(t, subject.Add(r))
+	}
+
+	// Simulate a crash part way through writing a checkpoint by appending a partial frame.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0x7f, 0x01, 0x02})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// Assert the builder resumes from the last checkpointed record, and ignores records added again.
+	subject, err = index.NewResumableBuilder(path, 5)
+	require.NoError(t, err)
+	last, ok := subject.LastOffset()
+	require.True(t, ok)
+	require.Equal(t, records[14].Offset, last)
+	for _, r := range records[10:] {
+		require.NoError(t, subject.Add(r))
+	}
+
+	// Assert the resumed checkpoint overwrote the partial frame.
+	require.NoError(t, subject.Checkpoint())
+	resumed, err := index.NewResumableBuilder(path, 5)
+	require.NoError(t, err)
+	last, ok = resumed.LastOffset()
+	require.True(t, ok)
+	require.Equal(t, records[24].Offset, last)
+
+	// Assert the finished index is the same as one loaded with all records at once.
+	var got bytes.Buffer
+	gotIdx, err := subject.Finish(multicodec.CarMultihashIndexSorted, &got)
+	require.NoError(t, err)
+	wantIdx, err := index.New(multicodec.CarMultihashIndexSorted)
+	require.NoError(t, err)
+	require.NoError(t, wantIdx.Load(records))
+	var want bytes.Buffer
+	_, err = index.WriteTo(wantIdx, &want)
+	require.NoError(t, err)
+	require.Equal(t, want.Bytes(), got.Bytes())
+	require.Equal(t, wantIdx, gotIdx)
+
+	// Assert the checkpoint file is removed once finished.
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,191 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2/internal/carv1"
+	"github.com/ipld/go-car/v2/internal/carv1/util"
+	internalio "github.com/ipld/go-car/v2/internal/io"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+)
+
+// VerifyAgainst checks that idx matches the given CARv1 data payload exactly, by reading the CID of
+// every section in it. Every entry of idx must point at the start of a section whose CID has the
+// multihash of the entry, and every section must be indexed, i.e. its multihash must have at least
+// one entry. Sections of identity CIDs are not required to be indexed, since their data is in the
+// CID itself. The first inconsistency found is returned as an error, describing its offset and
+// multihash; entries are checked first, in ascending order of offset, followed by the sections.
+// When dealing with a CARv2, the data payload can be obtained via car.Reader.DataReader.
+//
+// Unlike Validate, which only reads the length prefix of each indexed section, the whole data
+// payload is read. Block data is skipped over rather than read, and not hashed.
+// The index must be an IterableIndex; its entries and the offsets of all sections are collected in
+// memory. A section that extends beyond the end of the data payload is an error, as is a
+// zero-length section unless ZeroLengthSectionAsEOF is set, in which case it is treated as the end
+// of the data payload.
+func VerifyAgainst(idx Index, car io.ReaderAt, opts ...Option) error {
+	iterable, ok := idx.(IterableIndex)
+	if !ok {
+		return fmt.Errorf("cannot verify index of codec %v: index is not iterable", idx.Codec())
+	}
+	o := ApplyOptions(opts...)
+	var records []Record
+	indexed := make(map[string]struct{})
+	if err := iterable.ForEach(func(mh multihash.Multihash, offset uint64) error {
+		records = append(records, Record{Cid: cid.NewCidV1(cid.Raw, mh), Offset: offset})
+		indexed[string(mh)] = struct{}{}
+		return nil
+	}); err != nil {
+		return err
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Offset < records[j].Offset })
+
+	// Collect the CID of the section at each offset in the data payload.
+	r, err := internalio.NewOffsetReadSeeker(car, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := carv1.ReadHeader(r, o.MaxAllowedHeaderSize); err != nil {
+		return fmt.Errorf("error reading car header: %w", err)
+	}
+	sectionOffset, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	var sections []Record
+	sectionsByOffset := make(map[uint64]cid.Cid)
+	for {
+		sectionLen, err := readSectionLength(r, o)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return fmt.Errorf("cannot read section length at offset %d: %w", sectionOffset, err)
+		}
+		cidLen, c, err := cid.CidFromReader(r)
+		if err != nil {
+			return fmt.Errorf("cannot read section CID at offset %d: %w", sectionOffset, err)
+		}
+		if uint64(cidLen) > sectionLen {
+			return fmt.Errorf("section CID %s at offset %d is longer than its section length %d", c, sectionOffset, sectionLen)
+		}
+		sections = append(sections, Record{Cid: c, Offset: uint64(sectionOffset)})
+		sectionsByOffset[uint64(sectionOffset)] = c
+		next, err := r.Seek(int64(sectionLen)-int64(cidLen), io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if err := checkSectionEnd(car, next); err != nil {
+			return fmt.Errorf("section of CID %s at offset %d: %w", c, sectionOffset, err)
+		}
+		sectionOffset = next
+	}
+
+	for _, rec := range records {
+		c, ok := sectionsByOffset[rec.Offset]
+		if !ok {
+			return fmt.Errorf("entry of multihash %s at offset %d does not point at the start of a section", rec.Hash(), rec.Offset)
+		}
+		if string(c.Hash()) != string(rec.Hash()) {
+			return fmt.Errorf("entry of multihash %s at offset %d points at section of CID %s", rec.Hash(), rec.Offset, c)
+		}
+	}
+	for _, s := range sections {
+		if _, ok := indexed[string(s.Hash())]; ok {
+			continue
+		}
+		if dmh, err := multihash.Decode(s.Hash()); err == nil && multicodec.Code(dmh.Code) == multicodec.Identity {
+			continue
+		}
+		return fmt.Errorf("section of CID %s at offset %d is not indexed", s.Cid, s.Offset)
+	}
+	return nil
+}
+
+// Probe is a fast, probabilistic check that idx matches the given CARv1 data payload, for payloads
+// too large to check via VerifyAgainst. Each entry of idx is sampled independently with the given
+// probability, and the section at the offset of each sampled entry is checked to be well-formed,
+// i.e. to start with a readable section length followed by a readable CID no longer than the
+// section, whose multihash is that of the entry. The first bad sample is returned as an error,
+// describing its offset and multihash.
+// When dealing with a CARv2, the data payload can be obtained via car.Reader.DataReader.
+//
+// The sample rate must be greater than zero and at most one; a rate of one checks every entry,
+// while smaller rates trade coverage for cost. Sampling is random, so successive calls may
+// check different entries. Block data is neither read nor hashed, and sections that are not
+// indexed go unnoticed. The index must be an IterableIndex. Sampled sections that extend beyond the
+// end of the data payload are bad, as are sections longer than the maximum allowed section size.
+func Probe(idx Index, car io.ReaderAt, sampleRate float64, opts ...Option) error {
+	iterable, ok := idx.(IterableIndex)
+	if !ok {
+		return fmt.Errorf("cannot probe index of codec %v: index is not iterable", idx.Codec())
+	}
+	if !(sampleRate > 0 && sampleRate <= 1) {
+		return fmt.Errorf("sample rate must be greater than 0 and at most 1; got %v", sampleRate)
+	}
+	o := ApplyOptions(opts...)
+	return iterable.ForEach(func(mh multihash.Multihash, offset uint64) error {
+		if sampleRate < 1 && rand.Float64() >= sampleRate {
+			return nil
+		}
+		if err := probeSection(car, mh, offset, o); err != nil {
+			return fmt.Errorf("entry of multihash %s at offset %d: %w", mh, offset, err)
+		}
+		return nil
+	})
+}
+
+// probeSection checks that a well-formed section of the given multihash starts at the given offset
+// of the data payload; see Probe.
+func probeSection(car io.ReaderAt, mh multihash.Multihash, offset uint64, o Options) error {
+	off, err := internalio.AddOffset(0, offset)
+	if err != nil {
+		return err
+	}
+	r, err := internalio.NewOffsetReadSeeker(car, off)
+	if err != nil {
+		return err
+	}
+	sectionLen, err := util.ReadSectionLength(r, o.MaxAllowedSectionSize)
+	if err != nil {
+		return fmt.Errorf("cannot read section length: %w", err)
+	}
+	if sectionLen == 0 {
+		return errors.New("section length is zero")
+	}
+	cidLen, c, err := cid.CidFromReader(r)
+	if err != nil {
+		return fmt.Errorf("cannot read section CID: %w", err)
+	}
+	if uint64(cidLen) > sectionLen {
+		return fmt.Errorf("section CID %s is longer than its section length %d", c, sectionLen)
+	}
+	if string(c.Hash()) != string(mh) {
+		return fmt.Errorf("points at section of CID %s", c)
+	}
+	next, err := r.Seek(int64(sectionLen)-int64(cidLen), io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	return checkSectionEnd(r, next)
+}
+
+// checkSectionEnd checks that a section ending at the given offset of r, exclusive, fits in r, by
+// reading its last byte. Seeking past the end of r succeeds, so this is needed to detect sections
+// truncated by the end of the data payload.
+func checkSectionEnd(r io.ReaderAt, end int64) error {
+	var last [1]byte
+	if _, err := r.ReadAt(last[:], end-1); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("section is truncated at the end of the data payload: %w", io.ErrUnexpectedEOF)
+		}
+		return err
+	}
+	return nil
+}
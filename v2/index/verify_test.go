@@ -0,0 +1,150 @@
+package index_test
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyAgainst(t *testing.T) {
+	data, err := os.ReadFile("../testdata/sample-v1.car")
+	require.NoError(t, err)
+	car := bytes.NewReader(data)
+	generated, err := carv2.GenerateIndex(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.NoError(t, index.VerifyAgainst(generated, car))
+
+	var records []index.Record
+	require.NoError(t, generated.(index.IterableIndex).ForEach(func(mh multihash.Multihash, offset uint64) error {
+		records = append(records, index.Record{Cid: cid.NewCidV1(cid.Raw, mh), Offset: offset})
+		return nil
+	}))
+	load := func(t *testing.T, records []index.Record) index.Index {
+		idx, err := index.New(multicodec.CarMultihashIndexSorted)
+		require.NoError(t, err)
+		require.NoError(t, idx.Load(records))
+		return idx
+	}
+	verify := func(t *testing.T, records []index.Record, wantErr string) {
+		err := index.VerifyAgainst(load(t, records), car)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), wantErr)
+	}
+
+	t.Run("OffsetNotAtSection", func(t *testing.T) {
+		modified := append([]index.Record{}, records...)
+		modified[3].Offset++
+		verify(t, modified, "does not point at the start of a section")
+	})
+	t.Run("OffsetAtOtherSection", func(t *testing.T) {
+		modified := append([]index.Record{}, records...)
+		modified[3].Offset, modified[4].Offset = modified[4].Offset, modified[3].Offset
+		verify(t, modified, "points at section of CID")
+	})
+	t.Run("MissingEntry", func(t *testing.T) {
+		modified := append(append([]index.Record{}, records[:3]...), records[4:]...)
+		verify(t, modified, "is not indexed")
+	})
+	t.Run("NotIterable", func(t *testing.T) {
+		idx, err := index.New(multicodec.CarIndexSorted)
+		require.NoError(t, err)
+		require.NoError(t, idx.Load(records))
+		verify := index.VerifyAgainst(idx, car)
+		require.Error(t, verify)
+		require.Contains(t, verify.Error(), "not iterable")
+	})
+	t.Run("Truncated", func(t *testing.T) {
+		err := index.VerifyAgainst(generated, bytes.NewReader(data[:len(data)-1]))
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		require.Contains(t, err.Error(), "truncated")
+	})
+	t.Run("SectionTooLarge", func(t *testing.T) {
+		err := index.VerifyAgainst(generated, car, index.MaxAllowedSectionSize(1))
+		require.ErrorIs(t, err, carv2.ErrSectionTooLarge)
+	})
+	t.Run("NullPadding", func(t *testing.T) {
+		padded, err := os.ReadFile("../testdata/sample-v1-with-zero-len-section.car")
+		require.NoError(t, err)
+		idx, err := carv2.GenerateIndex(bytes.NewReader(padded), carv2.ZeroLengthSectionAsEOF(true))
+		require.NoError(t, err)
+		err = index.VerifyAgainst(idx, bytes.NewReader(padded))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "null padding not allowed")
+		require.NoError(t, index.VerifyAgainst(idx, bytes.NewReader(padded), index.ZeroLengthSectionAsEOF(true)))
+	})
+}
+
+func TestProbe(t *testing.T) {
+	data, err := os.ReadFile("../testdata/sample-v1.car")
+	require.NoError(t, err)
+	car := bytes.NewReader(data)
+	generated, err := carv2.GenerateIndex(bytes.NewReader(data))
+	require.NoError(t, err)
+	for _, rate := range []float64{1, 0.5, 0.01} {
+		require.NoError(t, index.Probe(generated, car, rate))
+	}
+
+	var records []index.Record
+	require.NoError(t, generated.(index.IterableIndex).ForEach(func(mh multihash.Multihash, offset uint64) error {
+		records = append(records, index.Record{Cid: cid.NewCidV1(cid.Raw, mh), Offset: offset})
+		return nil
+	}))
+	probe := func(t *testing.T, records []index.Record, rate float64, wantErr string) {
+		idx, err := index.New(multicodec.CarMultihashIndexSorted)
+		require.NoError(t, err)
+		require.NoError(t, idx.Load(records))
+		err = index.Probe(idx, car, rate)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), wantErr)
+	}
+
+	t.Run("OffsetAtOtherSection", func(t *testing.T) {
+		modified := append([]index.Record{}, records...)
+		modified[3].Offset, modified[4].Offset = modified[4].Offset, modified[3].Offset
+		probe(t, modified, 1, "points at section of CID")
+	})
+	t.Run("OffsetOutOfBounds", func(t *testing.T) {
+		modified := append([]index.Record{}, records...)
+		modified[3].Offset = uint64(len(data))
+		probe(t, modified, 1, "cannot read section length")
+	})
+	t.Run("AllOffsetsShifted", func(t *testing.T) {
+		// With every entry bad, sampling half of them is all but certain to find one.
+		modified := append([]index.Record{}, records...)
+		for i := range modified {
+			modified[i].Offset++
+		}
+		probe(t, modified, 0.5, "entry of multihash")
+	})
+	t.Run("InvalidSampleRate", func(t *testing.T) {
+		for _, rate := range []float64{0, -1, 1.5, math.NaN()} {
+			require.Error(t, index.Probe(generated, car, rate))
+		}
+	})
+	t.Run("NotIterable", func(t *testing.T) {
+		idx, err := index.New(multicodec.CarIndexSorted)
+		require.NoError(t, err)
+		require.NoError(t, idx.Load(records))
+		err = index.Probe(idx, car, 1)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "not iterable")
+	})
+	t.Run("Truncated", func(t *testing.T) {
+		err := index.Probe(generated, bytes.NewReader(data[:len(data)-1]), 1)
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		require.Contains(t, err.Error(), "truncated")
+	})
+	t.Run("SectionTooLarge", func(t *testing.T) {
+		err := index.Probe(generated, car, 1, index.MaxAllowedSectionSize(1))
+		require.ErrorIs(t, err, carv2.ErrSectionTooLarge)
+	})
+}
@@ -1,6 +1,7 @@
 package car
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -8,11 +9,14 @@ import (
 	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-car/v2/index"
 	"github.com/ipld/go-car/v2/internal/carv1"
+	"github.com/ipld/go-car/v2/internal/carv1/util"
 	internalio "github.com/ipld/go-car/v2/internal/io"
-	"github.com/multiformats/go-multihash"
-	"github.com/multiformats/go-varint"
 )
 
+// indexCheckInterval is the number of sections read between checks for cancellation of the context
+// given to index generation, and between reports of its progress.
+const indexCheckInterval = 4096
+
 // GenerateIndex generates index for the given car payload reader.
 // The index can be stored in serialized format using index.WriteTo.
 //
@@ -20,12 +24,19 @@ import (
 // an index. To read existing index when available see ReadOrGenerateIndex.
 // See: LoadIndex.
 func GenerateIndex(v1r io.Reader, opts ...Option) (index.Index, error) {
+	return GenerateIndexCtx(context.Background(), v1r, opts...)
+}
+
+// GenerateIndexCtx is like GenerateIndex, but stops generating the index once ctx is done, in which
+// case the error of ctx is returned. The context is checked once every few thousand sections, so
+// that generation stops promptly without slowing it down.
+func GenerateIndexCtx(ctx context.Context, v1r io.Reader, opts ...Option) (index.Index, error) {
 	wopts := ApplyOptions(opts...)
 	idx, err := index.New(wopts.IndexCodec)
 	if err != nil {
 		return nil, err
 	}
-	if err := LoadIndex(idx, v1r, opts...); err != nil {
+	if err := loadIndex(ctx, idx, v1r, wopts); err != nil {
 		return nil, err
 	}
 	return idx, nil
@@ -36,12 +47,74 @@ func GenerateIndex(v1r io.Reader, opts ...Option) (index.Index, error) {
 //
 // Note, the index is re-generated every time even if r is in CARv2 format and already has an index.
 // To read existing index when available see ReadOrGenerateIndex.
+//
+// The payload may end cleanly at a section boundary. Otherwise, if it ends part way through the
+// length or CID of a section, an error wrapping ErrTruncated is returned.
 func LoadIndex(idx index.Index, r io.Reader, opts ...Option) error {
-	// Parse Options.
-	o := ApplyOptions(opts...)
+	return loadIndex(context.Background(), idx, r, ApplyOptions(opts...))
+}
+
+// LoadIndexResumable adds the index records generated from r to b, which checkpoints them
+// periodically. If b was resumed from a checkpoint, reading resumes from the section at
+// b.LastOffset instead of the first one, skipping over the data payload before it; this is
+// efficient if r is an io.Seeker. The records added are checkpointed before returning, including
+// when ctx is done or an error occurs, such that a later call resumes where this one stopped.
+//
+// Once all records are added, i.e. nil is returned, the index can be encoded via b.Finish.
+// See LoadIndex and index.ResumableBuilder.
+func LoadIndexResumable(ctx context.Context, b *index.ResumableBuilder, r io.Reader, opts ...Option) error {
+	from, _ := b.LastOffset()
+	err := forEachIndexRecord(ctx, r, from, ApplyOptions(opts...), b.Add)
+	if cerr := b.Checkpoint(); err == nil {
+		err = cerr
+	}
+	return err
+}
 
+func loadIndex(ctx context.Context, idx index.Index, r io.Reader, o Options) error {
+	var prealloc int
+	if o.IndexPreallocRecords > 0 {
+		prealloc = o.IndexPreallocRecords
+	}
+	records := make([]index.Record, 0, prealloc)
+	var grows int
+	if err := forEachIndexRecord(ctx, r, 0, o, func(r index.Record) error {
+		if len(records) == cap(records) {
+			grows++
+		}
+		records = append(records, r)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if o.OnIndexRecordStats != nil {
+		o.OnIndexRecordStats(IndexRecordStats{
+			PeakRecords: len(records),
+			Capacity:    cap(records),
+			Grows:       grows,
+		})
+	}
+
+	if err := idx.Load(records); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// forEachIndexRecord calls fn with the index record of each section read from r, in the order in
+// which the sections appear. If from is non-zero, sections are read starting from the one at that
+// offset in the data payload instead of the first one. The error of ctx is returned if it is done.
+// See LoadIndex.
+func forEachIndexRecord(ctx context.Context, r io.Reader, from uint64, o Options, fn func(index.Record) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Read everything through reader, so that the offset is tracked correctly even when r is not
+	// an io.Seeker.
 	reader := internalio.ToByteReadSeeker(r)
-	pragma, err := carv1.ReadHeader(r, o.MaxAllowedHeaderSize)
+	pragma, err := carv1.ReadHeader(reader, o.MaxAllowedHeaderSize)
 	if err != nil {
 		return fmt.Errorf("error reading car header: %w", err)
 	}
@@ -53,7 +126,7 @@ func LoadIndex(idx index.Index, r io.Reader, opts ...Option) error {
 	case 2:
 		// Read V2 header which should appear immediately after pragma according to CARv2 spec.
 		var v2h Header
-		_, err := v2h.ReadFrom(r)
+		_, err := v2h.ReadFrom(reader)
 		if err != nil {
 			return err
 		}
@@ -107,14 +180,39 @@ func LoadIndex(idx index.Index, r io.Reader, opts ...Option) error {
 	// CARv2 header.
 	sectionOffset -= dataOffset
 
-	records := make([]index.Record, 0)
-	for {
+	if from > uint64(sectionOffset) {
+		fromOffset, err := internalio.AddOffset(uint64(dataOffset), from)
+		if err != nil {
+			return fmt.Errorf("%w: resuming from offset %d", err, from)
+		}
+		if _, err := reader.Seek(fromOffset, io.SeekStart); err != nil {
+			return err
+		}
+		sectionOffset = int64(from)
+	}
+
+	var indexed int64
+	for sections := 1; ; sections++ {
+		if sections%indexCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if o.IndexProgress != nil {
+				o.IndexProgress(sectionOffset+dataOffset, indexed)
+			}
+		}
+
 		// Read the section's length.
-		sectionLen, err := varint.ReadUvarint(reader)
+		sectionLen, err := readSectionLength(reader, o)
 		if err != nil {
+			// EOF is only returned when no bytes were read, i.e. the payload ends at a section
+			// boundary. A partially read length means the payload ends part way through a section.
 			if err == io.EOF {
 				break
 			}
+			if err == io.ErrUnexpectedEOF {
+				return fmt.Errorf("%w: partial section length at offset %d", ErrTruncated, sectionOffset)
+			}
 			return err
 		}
 
@@ -130,19 +228,39 @@ func LoadIndex(idx index.Index, r io.Reader, opts ...Option) error {
 		// Read the CID.
 		cidLen, c, err := cid.CidFromReader(reader)
 		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return fmt.Errorf("%w: partial section CID at offset %d", ErrTruncated, sectionOffset)
+			}
 			return err
 		}
 
-		if o.StoreIdentityCIDs || c.Prefix().MhType != multihash.IDENTITY {
+		if o.indexes(c) {
 			if uint64(cidLen) > o.MaxIndexCidSize {
 				return &ErrCidTooLarge{MaxSize: o.MaxIndexCidSize, CurrentSize: uint64(cidLen)}
 			}
-			records = append(records, index.Record{Cid: c, Offset: uint64(sectionOffset)})
+			if err := fn(index.Record{Cid: c, Offset: uint64(sectionOffset)}); err != nil {
+				return err
+			}
+			indexed++
 		}
 
-		// Seek to the next section by skipping the block.
+		// Seek to the next section by skipping the block, unless it is a header block.
 		// The section length includes the CID, so subtract it.
 		remainingSectionLen := int64(sectionLen) - int64(cidLen)
+		if o.OnHeaderBlock != nil && o.HeaderBlockMatcher != nil && o.HeaderBlockMatcher(c) {
+			if remainingSectionLen < 0 {
+				return fmt.Errorf("cid length %d exceeds section length %d at offset %d", cidLen, sectionLen, sectionOffset)
+			}
+			data := make([]byte, remainingSectionLen)
+			if _, err := io.ReadFull(reader, data); err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					return fmt.Errorf("%w: partial section data at offset %d", ErrTruncated, sectionOffset)
+				}
+				return err
+			}
+			o.OnHeaderBlock(c, data)
+			remainingSectionLen = 0
+		}
 		if sectionOffset, err = reader.Seek(remainingSectionLen, io.SeekCurrent); err != nil {
 			return err
 		}
@@ -155,14 +273,21 @@ func LoadIndex(idx index.Index, r io.Reader, opts ...Option) error {
 			break
 		}
 	}
-
-	if err := idx.Load(records); err != nil {
-		return err
+	if o.IndexProgress != nil {
+		o.IndexProgress(sectionOffset+dataOffset, indexed)
 	}
-
 	return nil
 }
 
+// readSectionLength reads the length prefix of a section from r in the format set via
+// UseSectionLengthFormat.
+func readSectionLength(r io.ByteReader, o Options) (uint64, error) {
+	if o.SectionLengthFormat == SectionLengthFixed32 {
+		return util.ReadSectionLengthFixed32(r, o.MaxAllowedSectionSize)
+	}
+	return util.ReadSectionLength(r, o.MaxAllowedSectionSize)
+}
+
 // GenerateIndexFromFile walks a CAR file at the give path and generates an index of cid->byte offset.
 // The index can be stored using index.WriteTo. Both CARv1 and CARv2 formats are accepted.
 //
@@ -171,12 +296,18 @@ func LoadIndex(idx index.Index, r io.Reader, opts ...Option) error {
 //
 // See: GenerateIndex.
 func GenerateIndexFromFile(path string, opts ...Option) (index.Index, error) {
+	return GenerateIndexFromFileCtx(context.Background(), path, opts...)
+}
+
+// GenerateIndexFromFileCtx is like GenerateIndexFromFile, but stops generating the index once ctx is
+// done. See GenerateIndexCtx.
+func GenerateIndexFromFileCtx(ctx context.Context, path string, opts ...Option) (index.Index, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	return GenerateIndex(f, opts...)
+	return GenerateIndexCtx(ctx, f, opts...)
 }
 
 // ReadOrGenerateIndex accepts both CARv1 and CARv2 formats, and reads or generates an index for it.
@@ -185,7 +316,9 @@ func GenerateIndexFromFile(path string, opts ...Option) (index.Index, error) {
 // An error is returned for all other formats, i.e. pragma with versions other than 1 or 2.
 //
 // Note, the returned index lives entirely in memory and will not depend on the
-// given reader to fulfill index lookup.
+// given reader to fulfill index lookup. Its offsets are always relative to the CARv1 data payload:
+// an existing index with absolute offsets is rebased onto the data payload as it is read.
+// See UseAbsoluteIndexOffsets.
 func ReadOrGenerateIndex(rs io.ReadSeeker, opts ...Option) (index.Index, error) {
 	// Read version.
 	version, err := ReadVersion(rs, opts...)
@@ -213,7 +346,15 @@ func ReadOrGenerateIndex(rs io.ReadSeeker, opts ...Option) (index.Index, error)
 			if err != nil {
 				return nil, err
 			}
-			return index.ReadFrom(ir)
+			idx, err := index.ReadFrom(ir)
+			if err != nil {
+				return nil, err
+			}
+			// Rebase absolute offsets onto the data payload, consistent with a generated index.
+			if v2r.Header.Characteristics.HasAbsoluteIndexOffsets() {
+				return index.Rebase(idx, -int64(v2r.Header.DataOffset))
+			}
+			return idx, nil
 		}
 		// Otherwise, generate index from CARv1 payload wrapped within CARv2 format.
 		dr, err := v2r.DataReader()
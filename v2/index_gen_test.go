@@ -1,15 +1,25 @@
 package car_test
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"io"
 	"os"
+	"path/filepath"
 	"testing"
+	"testing/iotest"
 
+	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
 	carv2 "github.com/ipld/go-car/v2"
 	"github.com/ipld/go-car/v2/index"
 	"github.com/ipld/go-car/v2/internal/carv1"
+	"github.com/ipld/go-car/v2/internal/carv1/util"
 	internalio "github.com/ipld/go-car/v2/internal/io"
 	"github.com/multiformats/go-multicodec"
 	"github.com/multiformats/go-multihash"
@@ -85,6 +95,12 @@ func TestGenerateIndex(t *testing.T) {
 			carPath: "testdata/sample-v1-with-zero-len-section.car",
 			wantErr: true,
 		},
+		{
+			name:    "CarV1WithSectionLargerThanAllowedIsError",
+			carPath: "testdata/sample-v1.car",
+			opts:    []carv2.Option{carv2.MaxAllowedSectionSize(10)},
+			wantErr: true,
+		},
 		{
 			name:        "CarOtherThanV1OrV2IsError",
 			carPath:     "testdata/sample-rootless-v42.car",
@@ -139,6 +155,59 @@ func TestGenerateIndex(t *testing.T) {
 	}
 }
 
+func TestGenerateIndex_LinearIndexCodec(t *testing.T) {
+	v1, err := os.Open("testdata/sample-v1.car")
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, v1.Close()) })
+	subject, err := carv2.GenerateIndex(v1, carv2.UseIndexCodec(index.CarLinearIndex))
+	require.NoError(t, err)
+	require.Equal(t, multicodec.Code(index.CarLinearIndex), subject.Codec())
+
+	want, err := carv2.GenerateIndexFromFile("testdata/sample-v1.car")
+	require.NoError(t, err)
+	var count int
+	require.NoError(t, want.(index.IterableIndex).ForEach(func(mh multihash.Multihash, wantOffset uint64) error {
+		count++
+		gotOffset, err := index.GetFirst(subject, cid.NewCidV1(cid.Raw, mh))
+		require.NoError(t, err)
+		require.Equal(t, wantOffset, gotOffset)
+		return nil
+	}))
+	require.NotZero(t, count)
+}
+
+func TestGenerateIndex_PreallocIndexRecords(t *testing.T) {
+	generate := func(t *testing.T, opts ...carv2.Option) (index.Index, carv2.IndexRecordStats) {
+		var stats carv2.IndexRecordStats
+		var calls int
+		opts = append(opts, carv2.WithIndexRecordStats(func(s carv2.IndexRecordStats) {
+			calls++
+			stats = s
+		}))
+		idx, err := carv2.GenerateIndexFromFile("testdata/sample-v1.car", opts...)
+		require.NoError(t, err)
+		require.Equal(t, 1, calls)
+		return idx, stats
+	}
+
+	want, stats := generate(t)
+	require.NotZero(t, stats.PeakRecords)
+	require.GreaterOrEqual(t, stats.Capacity, stats.PeakRecords)
+	require.Greater(t, stats.Grows, 1)
+	peak, unpreallocGrows := stats.PeakRecords, stats.Grows
+
+	// Assert an accurate preallocation never grows, and yields the same index.
+	got, stats := generate(t, carv2.PreallocIndexRecords(peak))
+	require.Equal(t, want, got)
+	require.Equal(t, carv2.IndexRecordStats{PeakRecords: peak, Capacity: peak}, stats)
+
+	// Assert an underestimated preallocation grows past it.
+	_, stats = generate(t, carv2.PreallocIndexRecords(peak/2))
+	require.Equal(t, peak, stats.PeakRecords)
+	require.NotZero(t, stats.Grows)
+	require.Less(t, stats.Grows, unpreallocGrows)
+}
+
 func TestMultihashIndexSortedConsistencyWithIndexSorted(t *testing.T) {
 	path := "testdata/sample-v1.car"
 
@@ -271,3 +340,271 @@ func generateMultihashSortedIndex(t *testing.T, path string) *index.MultihashInd
 
 	return idx
 }
+
+func TestLoadIndex_TruncatedSectionIsErrTruncated(t *testing.T) {
+	data, err := os.ReadFile("testdata/sample-v1.car")
+	require.NoError(t, err)
+	reader := bytes.NewReader(data)
+	_, err = carv1.ReadHeader(reader, carv1.DefaultMaxAllowedHeaderSize)
+	require.NoError(t, err)
+	firstSection, err := reader.Seek(0, io.SeekCurrent)
+	require.NoError(t, err)
+
+	// Ending at a section boundary is a clean end of the payload.
+	got, err := carv2.GenerateIndex(bytes.NewReader(data[:firstSection]))
+	require.NoError(t, err)
+	require.NotNil(t, got)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{
+			name: "PartialSectionLength",
+			// A varint byte with the continuation bit set and no following byte.
+			data: append(append([]byte{}, data[:firstSection]...), 0x80),
+		},
+		{
+			name: "PartialSectionCid",
+			// The section length and the first byte of the CID.
+			data: data[:firstSection+3],
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := carv2.GenerateIndex(bytes.NewReader(tt.data))
+			require.ErrorIs(t, err, carv2.ErrTruncated)
+		})
+	}
+}
+
+func TestGenerateIndex_OnHeaderBlock(t *testing.T) {
+	for _, path := range []string{"testdata/sample-v1.car", "testdata/sample-wrapped-v2.car"} {
+		path := path
+		t.Run(path, func(t *testing.T) {
+			f, err := os.Open(path)
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, f.Close()) })
+			br, err := carv2.NewBlockReader(f)
+			require.NoError(t, err)
+			var all []blocks.Block
+			for {
+				b, err := br.Next()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				all = append(all, b)
+			}
+			require.Greater(t, len(all), 5)
+			want := []blocks.Block{all[2], all[5]}
+			match := func(c cid.Cid) bool { return c.Equals(want[0].Cid()) || c.Equals(want[1].Cid()) }
+
+			var got []blocks.Block
+			_, err = f.Seek(0, io.SeekStart)
+			require.NoError(t, err)
+			gotIdx, err := carv2.GenerateIndex(f, carv2.OnHeaderBlock(match, func(c cid.Cid, data []byte) {
+				b, err := blocks.NewBlockWithCid(data, c)
+				require.NoError(t, err)
+				got = append(got, b)
+			}))
+			require.NoError(t, err)
+			require.Equal(t, want, got)
+
+			// Assert the hook has no effect on the generated index.
+			_, err = f.Seek(0, io.SeekStart)
+			require.NoError(t, err)
+			wantIdx, err := carv2.GenerateIndex(f)
+			require.NoError(t, err)
+			require.Equal(t, wantIdx, gotIdx)
+
+			// Assert a nil matcher recognises no blocks.
+			_, err = f.Seek(0, io.SeekStart)
+			require.NoError(t, err)
+			got = nil
+			gotIdx, err = carv2.GenerateIndex(f, carv2.OnHeaderBlock(nil, func(c cid.Cid, data []byte) {
+				got = append(got, nil)
+			}))
+			require.NoError(t, err)
+			require.Empty(t, got)
+			require.Equal(t, wantIdx, gotIdx)
+		})
+	}
+}
+
+func TestGenerateIndex_IncludeInIndex(t *testing.T) {
+	// Write a CARv1 of raw leaves along with the dag-pb nodes linking to them.
+	var buf bytes.Buffer
+	var nodes []format.Node
+	for i := 0; i < 5; i++ {
+		leaf := merkledag.NewRawNode([]byte(fmt.Sprintf("plankton-%d", i)))
+		parent := &merkledag.ProtoNode{}
+		require.NoError(t, parent.AddNodeLink("leaf", leaf))
+		nodes = append(nodes, parent, leaf)
+	}
+	require.NoError(t, carv1.WriteHeader(&carv1.CarHeader{Roots: []cid.Cid{nodes[0].Cid()}, Version: 1}, &buf))
+	for _, nd := range nodes {
+		require.NoError(t, util.LdWrite(&buf, nd.Cid().Bytes(), nd.RawData()))
+	}
+
+	wantIdx, err := carv2.GenerateIndex(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	isRaw := func(c cid.Cid) bool { return c.Prefix().Codec == cid.Raw }
+	subject, err := carv2.GenerateIndex(bytes.NewReader(buf.Bytes()), carv2.IncludeInIndex(isRaw))
+	require.NoError(t, err)
+
+	// Assert only the raw blocks are indexed, at the same offsets as in the full index.
+	br, err := carv2.NewBlockReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	var raw, other int
+	for {
+		b, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		c := b.Cid()
+		got, err := index.GetFirst(subject, c)
+		if !isRaw(c) {
+			require.Equal(t, index.ErrNotFound, err)
+			other++
+			continue
+		}
+		require.NoError(t, err)
+		want, err := index.GetFirst(wantIdx, c)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+		raw++
+	}
+	require.Equal(t, 5, raw)
+	require.Equal(t, 5, other)
+}
+
+// cancelAfterReader cancels a context once n bytes have been read through it.
+type cancelAfterReader struct {
+	r      io.Reader
+	n      int
+	cancel context.CancelFunc
+}
+
+func (c *cancelAfterReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if c.n -= n; c.n <= 0 {
+		c.cancel()
+	}
+	return n, err
+}
+
+// writeManyBlocksCarV1 returns a CARv1 of n small raw blocks, i.e. enough sections for index
+// generation to check its context and report progress part way through it.
+func writeManyBlocksCarV1(t *testing.T, n int) *bytes.Buffer {
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		blk := merkledag.NewRawNode([]byte(fmt.Sprintf("krill-%d", i)))
+		if i == 0 {
+			require.NoError(t, carv1.WriteHeader(&carv1.CarHeader{Roots: []cid.Cid{blk.Cid()}, Version: 1}, &buf))
+		}
+		require.NoError(t, util.LdWrite(&buf, blk.Cid().Bytes(), blk.RawData()))
+	}
+	return &buf
+}
+
+func TestGenerateIndexCtx(t *testing.T) {
+	buf := writeManyBlocksCarV1(t, 10000)
+
+	want, err := carv2.GenerateIndex(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	got, err := carv2.GenerateIndexCtx(context.Background(), bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = carv2.GenerateIndexCtx(ctx, bytes.NewReader(buf.Bytes()))
+	require.ErrorIs(t, err, context.Canceled)
+
+	// Assert generation stops part way through once the context is cancelled, i.e. before reaching
+	// the end of the payload where no error would be returned.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	r := &cancelAfterReader{r: bytes.NewReader(buf.Bytes()), n: buf.Len() / 10, cancel: cancel}
+	_, err = carv2.GenerateIndexCtx(ctx, r)
+	require.ErrorIs(t, err, context.Canceled)
+
+	path := filepath.Join(t.TempDir(), "krill.car")
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0o644))
+	got, err = carv2.GenerateIndexFromFileCtx(context.Background(), path)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+	_, err = carv2.GenerateIndexFromFileCtx(ctx, path)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestGenerateIndex_WithIndexProgress(t *testing.T) {
+	v1 := writeManyBlocksCarV1(t, 10000)
+	var v2 bytes.Buffer
+	require.NoError(t, carv2.WrapV1(bytes.NewReader(v1.Bytes()), &v2))
+
+	for _, tc := range []struct {
+		name    string
+		car     []byte
+		wantEnd int64
+	}{
+		{"CarV1", v1.Bytes(), int64(v1.Len())},
+		{"CarV2", v2.Bytes(), int64(carv2.PragmaSize+carv2.HeaderSize) + int64(v1.Len())},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var scanned, indexed []int64
+			_, err := carv2.GenerateIndex(bytes.NewReader(tc.car), carv2.WithIndexProgress(func(bytesScanned, blocksIndexed int64) {
+				scanned = append(scanned, bytesScanned)
+				indexed = append(indexed, blocksIndexed)
+			}))
+			require.NoError(t, err)
+
+			// Assert progress is reported periodically, and once more at the end.
+			require.Len(t, indexed, 3)
+			require.IsIncreasing(t, scanned)
+			require.IsIncreasing(t, indexed)
+			require.Equal(t, tc.wantEnd, scanned[len(scanned)-1])
+			require.Equal(t, int64(10000), indexed[len(indexed)-1])
+		})
+	}
+}
+
+func TestLoadIndexResumable(t *testing.T) {
+	for _, path := range []string{"testdata/sample-v1.car", "testdata/sample-wrapped-v2.car"} {
+		path := path
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+			checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+
+			// Simulate the source failing half way through, after some records are checkpointed.
+			subject, err := index.NewResumableBuilder(checkpoint, 100)
+			require.NoError(t, err)
+			errSource := errors.New("source failed")
+			failing := io.MultiReader(bytes.NewReader(data[:len(data)/2]), iotest.ErrReader(errSource))
+			err = carv2.LoadIndexResumable(context.Background(), subject, failing)
+			require.ErrorIs(t, err, errSource)
+
+			// Assert that resuming picks up from the checkpoint, and yields the same index as
+			// generating it in one go.
+			subject, err = index.NewResumableBuilder(checkpoint, 100)
+			require.NoError(t, err)
+			last, ok := subject.LastOffset()
+			require.True(t, ok)
+			require.NotZero(t, last)
+			require.NoError(t, carv2.LoadIndexResumable(context.Background(), subject, bytes.NewReader(data)))
+			var got bytes.Buffer
+			_, err = subject.Finish(multicodec.CarMultihashIndexSorted, &got)
+			require.NoError(t, err)
+
+			wantIdx, err := carv2.GenerateIndex(bytes.NewReader(data))
+			require.NoError(t, err)
+			var want bytes.Buffer
+			_, err = index.WriteTo(wantIdx, &want)
+			require.NoError(t, err)
+			require.Equal(t, want.Bytes(), got.Bytes())
+		})
+	}
+}
@@ -14,7 +14,7 @@ import (
 	"github.com/ipfs/go-merkledag"
 )
 
-const DefaultMaxAllowedHeaderSize uint64 = 32 << 20 // 32MiB
+const DefaultMaxAllowedHeaderSize uint64 = 32 << 10 // 32KiB
 const DefaultMaxAllowedSectionSize uint64 = 8 << 20 // 8MiB
 
 func init() {
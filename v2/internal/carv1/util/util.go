@@ -65,22 +65,51 @@ func LdSize(d ...[]byte) uint64 {
 	return sum + uint64(s)
 }
 
-func LdRead(r io.Reader, zeroLenAsEOF bool, maxReadBytes uint64) ([]byte, error) {
-	l, err := varint.ReadUvarint(internalio.ToByteReader(r))
+// ReadSectionLength reads the varint length prefix of a section from r.
+// ErrSectionTooLarge is returned if the length is larger than maxReadBytes, so that callers
+// never allocate or skip past a section based on an untrusted, arbitrarily large length.
+//
+// An io.EOF is returned only if no bytes were read; a partially read length results in
+// io.ErrUnexpectedEOF.
+func ReadSectionLength(r io.ByteReader, maxReadBytes uint64) (uint64, error) {
+	l, err := varint.ReadUvarint(r)
 	if err != nil {
-		// If the length of bytes read is non-zero when the error is EOF then signal an unclean EOF.
-		if l > 0 && err == io.EOF {
-			return nil, io.ErrUnexpectedEOF
+		return 0, err
+	}
+	if l > maxReadBytes { // Don't OOM
+		return 0, ErrSectionTooLarge
+	}
+	return l, nil
+}
+
+// ReadSectionLengthFixed32 reads a non-standard fixed 4-byte big-endian length prefix of a section
+// from r, as found in some malformed CARs, with the same semantics as ReadSectionLength.
+func ReadSectionLengthFixed32(r io.ByteReader, maxReadBytes uint64) (uint64, error) {
+	var l uint64
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF && i > 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, err
 		}
+		l = l<<8 | uint64(b)
+	}
+	if l > maxReadBytes { // Don't OOM
+		return 0, ErrSectionTooLarge
+	}
+	return l, nil
+}
+
+func LdRead(r io.Reader, zeroLenAsEOF bool, maxReadBytes uint64) ([]byte, error) {
+	l, err := ReadSectionLength(internalio.ToByteReader(r), maxReadBytes)
+	if err != nil {
 		return nil, err
 	} else if l == 0 && zeroLenAsEOF {
 		return nil, io.EOF
 	}
 
-	if l > maxReadBytes { // Don't OOM
-		return nil, ErrSectionTooLarge
-	}
-
 	buf := make([]byte, l)
 	if _, err := io.ReadFull(r, buf); err != nil {
 		return nil, err
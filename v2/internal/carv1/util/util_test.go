@@ -2,6 +2,7 @@ package util_test
 
 import (
 	"bytes"
+	"io"
 	"math/rand"
 	"testing"
 
@@ -25,3 +26,37 @@ func TestLdSize(t *testing.T) {
 		require.Equal(t, uint64(len(buf.Bytes())), size)
 	}
 }
+
+func TestReadSectionLength(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, util.LdWrite(&buf, make([]byte, 42)))
+
+	got, err := util.ReadSectionLength(bytes.NewReader(buf.Bytes()), 42)
+	require.NoError(t, err)
+	require.Equal(t, uint64(42), got)
+
+	_, err = util.ReadSectionLength(bytes.NewReader(buf.Bytes()), 41)
+	require.Equal(t, util.ErrSectionTooLarge, err)
+
+	_, err = util.ReadSectionLength(bytes.NewReader(nil), 41)
+	require.Equal(t, io.EOF, err)
+
+	_, err = util.ReadSectionLength(bytes.NewReader([]byte{0xff}), 41)
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestReadSectionLengthFixed32(t *testing.T) {
+	prefix := []byte{0, 0, 1, 2}
+	got, err := util.ReadSectionLengthFixed32(bytes.NewReader(prefix), 258)
+	require.NoError(t, err)
+	require.Equal(t, uint64(258), got)
+
+	_, err = util.ReadSectionLengthFixed32(bytes.NewReader(prefix), 257)
+	require.Equal(t, util.ErrSectionTooLarge, err)
+
+	_, err = util.ReadSectionLengthFixed32(bytes.NewReader(nil), 41)
+	require.Equal(t, io.EOF, err)
+
+	_, err = util.ReadSectionLengthFixed32(bytes.NewReader(prefix[:3]), 41)
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+}
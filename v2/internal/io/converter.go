@@ -113,5 +113,10 @@ func (rsa *readSeekerAt) ReadAt(p []byte, off int64) (n int, err error) {
 	if _, err := rsa.rs.Seek(off, io.SeekStart); err != nil {
 		return 0, err
 	}
-	return rsa.rs.Read(p)
+	// Unlike io.Reader, io.ReaderAt must fill p unless an error occurs.
+	n, err = io.ReadFull(rsa.rs, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
 }
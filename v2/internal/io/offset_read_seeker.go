@@ -3,8 +3,13 @@ package io
 import (
 	"errors"
 	"io"
+	"math"
 )
 
+// ErrOffsetTooLarge signals that an offset cannot be represented as an int64, as required by
+// io.ReaderAt and io.Seeker.
+var ErrOffsetTooLarge = errors.New("offset too large; exceeds maximum int64")
+
 var (
 	_ io.ReaderAt   = (*offsetReadSeeker)(nil)
 	_ io.ReadSeeker = (*offsetReadSeeker)(nil)
@@ -55,6 +60,15 @@ func NewOffsetReadSeeker(r io.ReaderAt, off int64) (ReadSeekerAt, error) {
 	}, nil
 }
 
+// AddOffset returns the sum of base and off as an int64, or ErrOffsetTooLarge if it exceeds the
+// maximum int64, so that an offset read from a CAR is never silently cast to a negative one.
+func AddOffset(base, off uint64) (int64, error) {
+	if base > math.MaxInt64 || off > math.MaxInt64-base {
+		return 0, ErrOffsetTooLarge
+	}
+	return int64(base + off), nil
+}
+
 func (o *offsetReadSeeker) Read(p []byte) (n int, err error) {
 	n, err = o.r.ReadAt(p, o.off)
 	oldOffset := o.off
@@ -12,6 +12,8 @@ import (
 // counter tracks how much data has been read.
 type counter struct {
 	totalRead uint64
+	// seen tracks the links read so far, so that each block is counted once.
+	seen map[ipld.Link]struct{}
 }
 
 func (c *counter) Size() uint64 {
@@ -40,14 +42,20 @@ func (c *countingReader) Read(p []byte) (int, error) {
 // link system which trigger block reads, the size of the block as it would
 // appear in a CAR file is added to the counter (included the size of the
 // CID and the varint length for the block data).
+// Blocks that are loaded more than once are only counted once, consistent with TeeingLinkSystem
+// only writing each block once.
 func CountingLinkSystem(ls ipld.LinkSystem) (ipld.LinkSystem, ReadCounter) {
-	c := counter{}
+	c := counter{seen: make(map[ipld.Link]struct{})}
 	clc := ls
 	clc.StorageReadOpener = func(lc linking.LinkContext, l ipld.Link) (io.Reader, error) {
 		r, err := ls.StorageReadOpener(lc, l)
 		if err != nil {
 			return nil, err
 		}
+		if _, ok := c.seen[l]; ok {
+			return r, nil
+		}
+		c.seen[l] = struct{}{}
 		buf := bytes.NewBuffer(nil)
 		n, err := buf.ReadFrom(r)
 		if err != nil {
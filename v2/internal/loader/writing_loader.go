@@ -13,10 +13,11 @@ import (
 )
 
 type writerOutput struct {
-	w     io.Writer
-	size  uint64
-	code  multicodec.Code
-	rcrds map[cid.Cid]index.Record
+	w         io.Writer
+	size      uint64
+	code      multicodec.Code
+	rcrds     map[cid.Cid]index.Record
+	onSection func(cid.Cid, []byte) error
 }
 
 func (w *writerOutput) Size() uint64 {
@@ -55,20 +56,22 @@ type writingReader struct {
 
 func (w *writingReader) Read(p []byte) (int, error) {
 	if w.wo != nil {
-		// write the cid
-		size := varint.ToUvarint(uint64(w.len) + uint64(len(w.cid)))
-		if _, err := w.wo.w.Write(size); err != nil {
-			return 0, err
-		}
-		if _, err := w.wo.w.Write([]byte(w.cid)); err != nil {
+		_, c, err := cid.CidFromBytes([]byte(w.cid))
+		if err != nil {
 			return 0, err
 		}
-		cpy := bytes.NewBuffer(w.r.(*bytes.Buffer).Bytes())
-		if _, err := cpy.WriteTo(w.wo.w); err != nil {
-			return 0, err
+		// write the section, i.e. its length, cid and data, in one go.
+		size := varint.ToUvarint(uint64(w.len) + uint64(len(w.cid)))
+		section := make([]byte, 0, len(size)+len(w.cid)+int(w.len))
+		section = append(section, size...)
+		section = append(section, w.cid...)
+		section = append(section, w.r.(*bytes.Buffer).Bytes()...)
+		if w.wo.onSection != nil {
+			if err := w.wo.onSection(c, section); err != nil {
+				return 0, err
+			}
 		}
-		_, c, err := cid.CidFromBytes([]byte(w.cid))
-		if err != nil {
+		if _, err := w.wo.w.Write(section); err != nil {
 			return 0, err
 		}
 		w.wo.rcrds[c] = index.Record{
@@ -89,12 +92,15 @@ func (w *writingReader) Read(p []byte) (int, error) {
 // The `initialOffset` is used to calculate the offsets recorded for the index, and will be
 //   included in the `.Size()` of the IndexTracker.
 // An indexCodec of `index.CarIndexNoIndex` can be used to not track these offsets.
-func TeeingLinkSystem(ls ipld.LinkSystem, w io.Writer, initialOffset uint64, indexCodec multicodec.Code) (ipld.LinkSystem, IndexTracker) {
+// If onSection is not nil, it is called with the CID and bytes of each section before it is
+// written, and an error returned by it aborts the load.
+func TeeingLinkSystem(ls ipld.LinkSystem, w io.Writer, initialOffset uint64, indexCodec multicodec.Code, onSection func(cid.Cid, []byte) error) (ipld.LinkSystem, IndexTracker) {
 	wo := writerOutput{
-		w:     w,
-		size:  initialOffset,
-		code:  indexCodec,
-		rcrds: make(map[cid.Cid]index.Record),
+		w:         w,
+		size:      initialOffset,
+		code:      indexCodec,
+		rcrds:     make(map[cid.Cid]index.Record),
+		onSection: onSection,
 	}
 
 	tls := ls
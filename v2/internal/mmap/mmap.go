@@ -0,0 +1,85 @@
+// Package mmap provides read-only memory-mapped files, similar to golang.org/x/exp/mmap, except
+// that the mapped bytes are exposed so that regions of a file can be used in place, e.g. as the
+// backing of an index.MappableIndexSorted.
+package mmap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	expmmap "golang.org/x/exp/mmap"
+)
+
+var _ io.ReaderAt = (*ReaderAt)(nil)
+
+var errClosed = errors.New("mmap: closed")
+
+// ReaderAt reads a memory-mapped file.
+//
+// Like any io.ReaderAt, clients can execute parallel ReadAt calls, but it is not safe to call
+// Close and reading methods concurrently.
+type ReaderAt struct {
+	data []byte
+	// fallback reads the file on platforms where the mapped bytes are not exposed, in which case
+	// data is nil.
+	fallback *expmmap.ReaderAt
+	closed   bool
+}
+
+// Open memory-maps the named file for reading. On platforms other than linux and darwin, the file
+// is opened via golang.org/x/exp/mmap instead, which memory-maps it where supported, e.g. on
+// windows, but does not expose the mapped bytes; see Bytes.
+func Open(filename string) (*ReaderAt, error) {
+	return open(filename)
+}
+
+// Bytes returns the mapped bytes of the file, which must not be modified, nor used once the reader
+// is closed. Nil is returned on platforms where the mapped bytes are not exposed, in which case the
+// file can only be read via ReadAt.
+func (r *ReaderAt) Bytes() []byte {
+	return r.data
+}
+
+// Len returns the length of the mapped file.
+func (r *ReaderAt) Len() int {
+	if r.fallback != nil {
+		return r.fallback.Len()
+	}
+	return len(r.data)
+}
+
+// ReadAt implements the io.ReaderAt interface.
+func (r *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if r.closed {
+		return 0, errClosed
+	}
+	if r.fallback != nil {
+		return r.fallback.ReadAt(p, off)
+	}
+	if off < 0 || int64(len(r.data)) < off {
+		return 0, fmt.Errorf("mmap: invalid ReadAt offset %d", off)
+	}
+	n := copy(p, r.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Close unmaps the file.
+func (r *ReaderAt) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	if r.fallback != nil {
+		return r.fallback.Close()
+	}
+	data := r.data
+	r.data = nil
+	if data == nil {
+		return nil
+	}
+	return unmap(data)
+}
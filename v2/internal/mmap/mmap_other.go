@@ -0,0 +1,22 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package mmap
+
+import (
+	expmmap "golang.org/x/exp/mmap"
+)
+
+// open opens the file via golang.org/x/exp/mmap, which memory-maps it on windows and reads it from
+// disk on platforms that do not support memory-mapping; either way, the mapped bytes are not exposed.
+func open(filename string) (*ReaderAt, error) {
+	f, err := expmmap.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &ReaderAt{fallback: f}, nil
+}
+
+func unmap([]byte) error {
+	return nil
+}
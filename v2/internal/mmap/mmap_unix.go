@@ -0,0 +1,38 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package mmap
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func open(filename string) (*ReaderAt, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size == 0 {
+		return &ReaderAt{}, nil
+	}
+	if size < 0 || size != int64(int(size)) {
+		return nil, fmt.Errorf("mmap: file %q has invalid size %d", filename, size)
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return &ReaderAt{data: data}, nil
+}
+
+func unmap(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -3,9 +3,11 @@ package car
 import (
 	"math"
 
+	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-car/v2/index"
 	"github.com/ipld/go-ipld-prime/traversal"
 	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
 
 	"github.com/ipld/go-car/v2/internal/carv1"
 )
@@ -17,7 +19,8 @@ const DefaultMaxIndexCidSize = 2 << 10 // 2 KiB
 // decode (including within a CARv2 container) will allow a header to be without
 // erroring. This is to prevent OOM errors where a header prefix includes a
 // too-large size specifier.
-// Currently set to 32 MiB.
+// A header only holds the roots, so this is a small value that fits hundreds of
+// roots. Currently set to 32 KiB.
 const DefaultMaxAllowedHeaderSize = carv1.DefaultMaxAllowedHeaderSize
 
 // DefaultMaxAllowedHeaderSize specifies the default maximum size that a CARv1
@@ -50,19 +53,74 @@ type ReadWriteOption = Option
 type Options struct {
 	DataPadding            uint64
 	IndexPadding           uint64
+	IndexAlignment         uint64
 	IndexCodec             multicodec.Code
 	ZeroLengthSectionAsEOF bool
 	MaxIndexCidSize        uint64
 	StoreIdentityCIDs      bool
+	AbsoluteIndexOffsets   bool
+	ExternalIndexSort      bool
+	ExternalIndexSortDir   string
+	EmitRootsTrailer       bool
+	Metadata               map[string]string
+	IndexIncludeFilter     func(cid.Cid) bool
 
-	BlockstoreAllowDuplicatePuts bool
-	BlockstoreUseWholeCIDs       bool
-	MaxTraversalLinks            uint64
-	WriteAsCarV1                 bool
-	TraversalPrototypeChooser    traversal.LinkTargetNodePrototypeChooser
+	BlockstoreAllowDuplicatePuts    bool
+	BlockstoreUseWholeCIDs          bool
+	BlockstoreNotFoundError         error
+	BlockstorePrefetchWindow        int
+	BlockstoreTrustedReads          bool
+	BlockstoreEquivalentCidVersions bool
+	BlockstoreGzipInMemory          bool
+	BlockstoreWarmData              bool
+	MaxTraversalLinks               uint64
+	DetectCycles                    bool
+	WriteAsCarV1                    bool
+	TraversalPrototypeChooser       traversal.LinkTargetNodePrototypeChooser
+	BlockFilter                     func(cid.Cid) bool
+	FollowFilteredLinks             bool
+	HeaderBlockMatcher              func(cid.Cid) bool
+	OnHeaderBlock                   func(cid.Cid, []byte)
+	IndexProgress                   func(bytesScanned, blocksIndexed int64)
+	IndexPreallocRecords            int
+	OnIndexRecordStats              func(IndexRecordStats)
+	OnSection                       func(cid.Cid, []byte) error
+	PostOrderWalk                   bool
+	GroupByCodec                    bool
+	MaxBlocks                       int
+	UnixFSChunkSize                 int64
 
 	MaxAllowedHeaderSize  uint64
 	MaxAllowedSectionSize uint64
+	SectionLengthFormat   SectionLengthFormat
+}
+
+// SectionLengthFormat is the encoding of the length prefix of each section in a CARv1 data
+// payload. See UseSectionLengthFormat.
+type SectionLengthFormat uint8
+
+const (
+	// SectionLengthUvarint is the unsigned varint length prefix defined by the CAR specification.
+	SectionLengthUvarint SectionLengthFormat = iota
+	// SectionLengthFixed32 is a fixed 4-byte big-endian length prefix. It is NOT part of the CAR
+	// specification, and is only supported to recover data from malformed CARs.
+	SectionLengthFixed32
+)
+
+// indexPaddingAt returns the padding to write before the index of a CARv2 whose data payload ends
+// at the given offset, i.e. IndexPadding extended to align the index according to IndexAlignment.
+func (o Options) indexPaddingAt(dataEnd uint64) uint64 {
+	_, p := PaddingForAlignment(dataEnd, o.IndexPadding, o.IndexAlignment)
+	return o.IndexPadding + p
+}
+
+// indexes returns whether a section with the given CID is indexed, i.e. whether it is not an
+// identity CID, unless StoreIdentityCIDs is enabled, and is included by IndexIncludeFilter if set.
+func (o Options) indexes(c cid.Cid) bool {
+	if !o.StoreIdentityCIDs && c.Prefix().MhType == multihash.IDENTITY {
+		return false
+	}
+	return o.IndexIncludeFilter == nil || o.IndexIncludeFilter(c)
 }
 
 // ApplyOptions applies given opts and returns the resulting Options.
@@ -71,6 +129,7 @@ type Options struct {
 func ApplyOptions(opt ...Option) Options {
 	opts := Options{
 		MaxTraversalLinks:     math.MaxInt64, //default: traverse all
+		DetectCycles:          true,
 		MaxAllowedHeaderSize:  carv1.DefaultMaxAllowedHeaderSize,
 		MaxAllowedSectionSize: carv1.DefaultMaxAllowedSectionSize,
 	}
@@ -111,6 +170,16 @@ func UseIndexPadding(p uint64) Option {
 	}
 }
 
+// AlignIndexTo sets the alignment of the offset at which the index of a CARv2 begins, e.g. the page
+// size, such that the index can be memory-mapped directly from the file. The index is aligned by
+// extending the padding before it, on top of any padding set via UseIndexPadding, by the minimal
+// amount; see PaddingForAlignment. An alignment of zero or one has no effect.
+func AlignIndexTo(align uint64) Option {
+	return func(o *Options) {
+		o.IndexAlignment = align
+	}
+}
+
 // UseIndexCodec sets the codec used for index generation.
 func UseIndexCodec(c multicodec.Code) Option {
 	return func(o *Options) {
@@ -137,6 +206,52 @@ func StoreIdentityCIDs(b bool) Option {
 	}
 }
 
+// UseAbsoluteIndexOffsets sets whether the offsets in a generated CARv2 index should be relative
+// to the start of the CARv2 file, rather than the start of its CARv1 data payload. This allows
+// blocks to be read directly from the file via a single io.ReaderAt over it, by seeking to the
+// offset found in the index. When enabled, Characteristics.HasAbsoluteIndexOffsets is set in the
+// CARv2 header to tag the index accordingly.
+//
+// The index readers in this module, such as blockstore.NewReadOnly and ReadOrGenerateIndex, are
+// aware of the tag and rebase absolute offsets onto the data payload as the index is read.
+// However, tools that are unaware of the tag will assume offsets relative to the data payload, and
+// would therefore misread blocks. Since the offsets depend on the data padding, a standalone copy
+// of such an index is only valid for the CARv2 it was generated for. Absolute offsets require an
+// index.IterableIndex codec, i.e. CarIndexSorted is not supported.
+//
+// This option is disabled by default.
+func UseAbsoluteIndexOffsets(b bool) Option {
+	return func(o *Options) {
+		o.AbsoluteIndexOffsets = b
+	}
+}
+
+// ExternalIndexSort sets whether the index records of a CAR should be sorted on disk as it is
+// written, rather than in memory. When enabled, the records are spilled to temporary files as
+// sorted runs of bounded size, which are merged as the index is written; see index.ExternalSorter.
+// This bounds the memory used to generate the index regardless of the number of blocks, at the
+// cost of writing the records to disk, which makes it suitable for writing CARs with very many
+// small blocks. The temporary files are created in the directory set via ExternalIndexSortDir, and
+// are removed once the index is written.
+//
+// This option is supported by WriteFromBlockstore, WriteV1WithSidecar and WrapV1, and requires the
+// CarMultihashIndexSorted index codec, which is the default.
+//
+// This option is disabled by default.
+func ExternalIndexSort(enable bool) Option {
+	return func(o *Options) {
+		o.ExternalIndexSort = enable
+	}
+}
+
+// ExternalIndexSortDir sets the directory in which the temporary files of ExternalIndexSort are
+// created, as are those of WriteSortedStream. Defaults to os.TempDir when unset.
+func ExternalIndexSortDir(dir string) Option {
+	return func(o *Options) {
+		o.ExternalIndexSortDir = dir
+	}
+}
+
 // MaxIndexCidSize specifies the maximum allowed size for indexed CIDs in bytes.
 // Indexing a CID with larger than the allowed size results in ErrCidTooLarge error.
 func MaxIndexCidSize(s uint64) Option {
@@ -153,9 +268,238 @@ func WithTraversalPrototypeChooser(t traversal.LinkTargetNodePrototypeChooser) O
 	}
 }
 
-// MaxAllowedHeaderSize overrides the default maximum size (of 32 MiB) that a
+// OnHeaderBlock sets a hook that is called with the CID and data of each block recognised by
+// match during index generation, e.g. blocks with a well-known CID that carry producer-specific
+// metadata such as ordering hints. This allows such metadata to be extracted while the index is
+// generated, without a second pass over the data payload. Recognised blocks are indexed like any
+// other block; the hook only observes them.
+//
+// The hook is called in the order in which blocks appear in the data payload, including
+// duplicates, by LoadIndex and GenerateIndex, and therefore by blockstore.OpenReadOnly and
+// blockstore.NewReadOnly when an index is generated. It is not called when an existing index is
+// read from a CARv2. A nil match or fn recognises no blocks, i.e. disables the hook.
+//
+// This option is disabled by default.
+func OnHeaderBlock(match func(cid.Cid) bool, fn func(cid.Cid, []byte)) Option {
+	return func(o *Options) {
+		o.HeaderBlockMatcher = match
+		o.OnHeaderBlock = fn
+	}
+}
+
+// UseSectionLengthFormat sets the encoding of the section length prefixes expected when reading
+// the data payload of a CAR. The default, SectionLengthUvarint, is the only encoding defined by the
+// CAR specification.
+//
+// SectionLengthFixed32 is non-standard, and is intended only to recover or migrate the contents of
+// malformed CARs that use fixed 4-byte length prefixes for their sections, e.g. by reading their
+// blocks and writing them to a valid CAR. The CARv1 header is still expected to have a varint
+// length prefix. The format is honoured by index generation, i.e. GenerateIndex and LoadIndex, and
+// by blockstore.ReadOnly, including its prefetching; it is not supported by BlockReader nor by
+// any writer, and blockstore.OpenReadWrite rejects it.
+func UseSectionLengthFormat(f SectionLengthFormat) Option {
+	return func(o *Options) {
+		o.SectionLengthFormat = f
+	}
+}
+
+// WithIndexProgress sets a callback through which the progress of index generation is reported,
+// e.g. to display the percentage of a CAR that has been indexed given its total size. The callback
+// is called with the number of bytes of the CAR scanned so far, counted from its start, including
+// the CARv2 header if any, and the number of blocks indexed so far. It is called once every few
+// thousand sections, so as not to slow down index generation, and once more when the end of the
+// data payload is reached.
+//
+// The callback is called synchronously by LoadIndex and GenerateIndex, and by the functions that
+// use them to generate an index, such as blockstore.OpenReadOnly.
+//
+// This option is disabled by default.
+func WithIndexProgress(fn func(bytesScanned, blocksIndexed int64)) Option {
+	return func(o *Options) {
+		o.IndexProgress = fn
+	}
+}
+
+// IndexRecordStats describes the memory used to hold index records while generating an index,
+// as reported via WithIndexRecordStats.
+type IndexRecordStats struct {
+	// PeakRecords is the largest number of records held in memory at once. Since all records are
+	// held until they are loaded into the index, this is the number of indexed sections.
+	PeakRecords int
+	// Capacity is the number of records the memory held could fit. A capacity much larger than
+	// PeakRecords means the preallocation set via PreallocIndexRecords was overestimated.
+	Capacity int
+	// Grows is the number of times memory was allocated for the records because their capacity was
+	// exceeded, including the first allocation if none was preallocated. Zero means the
+	// preallocation was sufficient.
+	Grows int
+}
+
+// PreallocIndexRecords sets the number of records to allocate memory for upfront when generating
+// an index, which avoids repeatedly growing the allocation as sections are read when the number of
+// blocks in the CAR is roughly known. The records of all sections are held in memory until they are
+// loaded into the index, so for large CARs they dominate the memory used by index generation.
+// Overestimating wastes the excess memory; underestimating still grows the allocation once the
+// preallocated capacity is exceeded.
+//
+// This option only affects LoadIndex and GenerateIndex, and the functions that use them to generate
+// an index, such as blockstore.OpenReadOnly. See WithIndexRecordStats for measuring its effect, and
+// ExternalIndexSort for bounding the memory used when writing a CAR instead.
+//
+// This option is disabled by default, i.e. the records are grown as they are read.
+func PreallocIndexRecords(n int) Option {
+	return func(o *Options) {
+		o.IndexPreallocRecords = n
+	}
+}
+
+// WithIndexRecordStats sets a callback through which the memory used to hold index records is
+// reported once index generation has read all sections, before the records are loaded into the
+// index. The callback is called synchronously, by the same functions as the one set via
+// WithIndexProgress; it is not called if reading the sections fails.
+//
+// This option is disabled by default.
+func WithIndexRecordStats(fn func(IndexRecordStats)) Option {
+	return func(o *Options) {
+		o.OnIndexRecordStats = fn
+	}
+}
+
+// OnSection sets a hook that is called with the CID and encoded bytes of each section written to
+// the data payload by a Writer returned by NewSelectiveWriter, and by TraverseV1 and
+// TraverseToFile. The section bytes consist of the length prefix, the CID and the block data, i.e.
+// exactly the bytes written to the data payload for the block. This allows sections to be
+// observed as they are written, e.g. to mirror them to another sink or to compute a rolling hash,
+// without changing the output.
+//
+// The hook is called in the order in which sections are written, before each is written. If it
+// returns an error, writing is aborted and an error carrying its message is returned. The given
+// bytes must not be modified, nor retained after the hook returns. The hook is not called by
+// Writer.Size.
+//
+// This option is disabled by default.
+func OnSection(fn func(c cid.Cid, section []byte) error) Option {
+	return func(o *Options) {
+		o.OnSection = fn
+	}
+}
+
+// PostOrderWalk sets whether the DAGs written by WriteFromBlockstore and WriteV1WithSidecar are
+// walked in post-order, such that the blocks a block links to, i.e. its children, are written
+// before it, and leaves are written first. This can improve locality or allow streaming for
+// storage backends that consume blocks bottom-up. Each block is still written once, at the first
+// point it is reached in the walk.
+//
+// Only the layout of the data payload changes; lookups via the index are unaffected. The walk
+// holds the blocks along the current path in memory until their children are written.
+//
+// This option is disabled by default, i.e. blocks are written in pre-order with each block
+// preceding its children.
+func PostOrderWalk(enable bool) Option {
+	return func(o *Options) {
+		o.PostOrderWalk = enable
+	}
+}
+
+// GroupByCodec sets whether the blocks written by WriteFromBlockstore and WriteV1WithSidecar are
+// grouped by the codec of their CID, such that blocks of the same codec are stored contiguously,
+// e.g. all dag-pb blocks followed by all raw blocks. This allows range reads to target all blocks
+// of a codec, such as the raw leaves of a DAG, as a contiguous span of the data payload. The
+// groups are written in the order in which their codec is first reached in the walk, and the
+// blocks within each group in the order in which they are reached; see PostOrderWalk.
+//
+// Only the layout of the data payload changes; lookups via the index are unaffected. Since the
+// whole walk must complete before the first group is written, the CIDs of all reached blocks are
+// buffered in memory, and each block is fetched twice: once during the walk and once when written.
+//
+// This option is disabled by default.
+func GroupByCodec(enable bool) Option {
+	return func(o *Options) {
+		o.GroupByCodec = enable
+	}
+}
+
+// MaxBlocks sets the maximum number of blocks written by WriteFromBlockstore and WriteV1WithSidecar,
+// e.g. to export a preview of a large DAG. The walk stops once n blocks are reached, so the blocks
+// written are the first n blocks of the walk, in the order described by PostOrderWalk; with
+// GroupByCodec, the first n blocks reached are then grouped as usual. Any trailers are written
+// after them; see EmitRootsTrailer and WithMetadata.
+//
+// Note that the resulting CAR is incomplete unless the DAGs have at most n blocks: links to the
+// blocks that are not written dangle, and the roots may not be among the blocks written with
+// post-order. The index only records the blocks written.
+//
+// This option is disabled by default, i.e. all reachable blocks are written; zero or a negative n
+// also disables it.
+func MaxBlocks(n int) Option {
+	return func(o *Options) {
+		o.MaxBlocks = n
+	}
+}
+
+// IncludeInIndex sets a predicate that decides which sections are recorded in generated indices:
+// only sections whose CID the predicate returns true for are indexed, e.g. only blocks of the raw
+// codec to index the leaves of a DAG but not its intermediate nodes. All sections are still read
+// past, and the data payload is unaffected; only the index is partial.
+//
+// This deliberately produces a partial index, intended for specialised retrieval patterns: looking
+// up an excluded CID via the index, e.g. via blockstore.ReadOnly.Get, returns not found even though
+// the block is present in the CAR. Identity CIDs remain excluded unless StoreIdentityCIDs is
+// enabled. The predicate is honoured by index generation, i.e. GenerateIndex, LoadIndex and the
+// blockstore.ReadOnly functions that generate an index, and by the writers in this package that
+// generate the index as they write, such as WriteFromBlockstore and Prune. It is not honoured by
+// blockstore.ReadWrite.
+//
+// By default all sections, other than those of identity CIDs, are indexed.
+func IncludeInIndex(filter func(cid.Cid) bool) Option {
+	return func(o *Options) {
+		o.IndexIncludeFilter = filter
+	}
+}
+
+// EmitRootsTrailer sets whether to append a roots trailer to the data payload when writing a CAR,
+// i.e. a section listing the roots after all the blocks. This allows clients that join a stream
+// after the CARv1 header has been sent to learn the roots once the stream ends; see
+// BlockReader.LateRoots.
+//
+// The trailer is non-standard: it is an ordinary section whose block has the multicodec.Car codec
+// and a sha2-256 multihash, and whose data is the dag-cbor encoded CARv1 header. Therefore, readers
+// unaware of it read it as any other block, and it is indexed like any other block. The option is
+// honoured by WriteFromBlockstore, WriteV1WithSidecar, WriteSortedStream and WriteToRotating.
+//
+// This option is disabled by default.
+func EmitRootsTrailer(enable bool) Option {
+	return func(o *Options) {
+		o.EmitRootsTrailer = enable
+	}
+}
+
+// WithMetadata sets metadata to embed in the data payload when writing a CAR, e.g. a creation
+// timestamp, the name of the producer or the version of the tool that wrote it. The metadata is
+// written as a metadata trailer, i.e. a section after all the blocks and before the roots trailer,
+// if any. It can be read back via Reader.Inspect or BlockReader.Metadata.
+//
+// Like the roots trailer, the metadata trailer is an ordinary section whose block has the
+// multicodec.Car codec and a sha2-256 multihash, so readers unaware of it read it as any other
+// block. Its data is the dag-cbor encoding of a map with the single key "carMetadata", whose value
+// is a map of the given metadata, i.e. {"carMetadata": {"key": "value", ...}}. Map keys are sorted
+// as dag-cbor requires, so the same metadata is always encoded identically. The option is honoured
+// by the same functions as EmitRootsTrailer.
+//
+// No metadata is written if md is empty, which is the default.
+func WithMetadata(md map[string]string) Option {
+	return func(o *Options) {
+		o.Metadata = md
+	}
+}
+
+// MaxAllowedHeaderSize overrides the default maximum size (of 32 KiB) that a
 // CARv1 decode (including within a CARv2 container) will allow a header to be
-// without erroring.
+// without erroring. This applies to every read path that decodes a header,
+// including reading the version, roots and blocks; reading a larger header
+// results in ErrHeaderTooLarge.
+// Since each root takes roughly 40 bytes, this only needs raising for CARs with
+// many hundreds of roots.
 func MaxAllowedHeaderSize(max uint64) Option {
 	return func(o *Options) {
 		o.MaxAllowedHeaderSize = max
@@ -163,8 +507,10 @@ func MaxAllowedHeaderSize(max uint64) Option {
 }
 
 // MaxAllowedSectionSize overrides the default maximum size (of 8 MiB) that a
-// CARv1 decode (including within a CARv2 container) will allow a header to be
-// without erroring.
+// CARv1 decode (including within a CARv2 container) will allow a section to be
+// without erroring. This applies to every read path that decodes a section
+// length, including index generation and blockstore lookups; reading a larger
+// section results in ErrSectionTooLarge.
 // Typically IPLD blocks should be under 2 MiB (ideally under 1 MiB), so unless
 // atypical data is expected, this should not be a large value.
 func MaxAllowedSectionSize(max uint64) Option {
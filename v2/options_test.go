@@ -15,7 +15,8 @@ func TestApplyOptions_SetsExpectedDefaults(t *testing.T) {
 		IndexCodec:            multicodec.CarMultihashIndexSorted,
 		MaxIndexCidSize:       carv2.DefaultMaxIndexCidSize,
 		MaxTraversalLinks:     math.MaxInt64,
-		MaxAllowedHeaderSize:  32 << 20,
+		DetectCycles:          true,
+		MaxAllowedHeaderSize:  32 << 10,
 		MaxAllowedSectionSize: 8 << 20,
 	}, carv2.ApplyOptions())
 }
@@ -32,6 +33,7 @@ func TestApplyOptions_AppliesOptions(t *testing.T) {
 			BlockstoreAllowDuplicatePuts: true,
 			BlockstoreUseWholeCIDs:       true,
 			MaxTraversalLinks:            math.MaxInt64,
+			DetectCycles:                 false,
 			MaxAllowedHeaderSize:         101,
 			MaxAllowedSectionSize:        202,
 		},
@@ -44,6 +46,7 @@ func TestApplyOptions_AppliesOptions(t *testing.T) {
 			carv2.StoreIdentityCIDs(true),
 			carv2.MaxAllowedHeaderSize(101),
 			carv2.MaxAllowedSectionSize(202),
+			carv2.DetectCycles(false),
 			blockstore.AllowDuplicatePuts(true),
 			blockstore.UseWholeCIDs(true),
 		))
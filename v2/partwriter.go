@@ -0,0 +1,99 @@
+package car
+
+import (
+	"errors"
+	"fmt"
+)
+
+var errPartWriterClosed = errors.New("part writer is closed")
+
+// PartWriter is an io.Writer that splits the bytes written to it into sequential parts of a fixed
+// size, and passes each part to an upload function as soon as it is full. This allows a CAR to be
+// written directly to object storage that cannot be written at arbitrary offsets, such as an
+// S3-compatible store via a multipart upload, while buffering at most one part in memory.
+//
+// Object storage cannot patch bytes once they are uploaded. A CARv2 begins with a header that
+// specifies the size of its data payload, and the format has no trailing layout for it, so only
+// the writers that know the payload size before writing it can write a CARv2 to a PartWriter, e.g.
+// WriteFromBlockstore, which walks the DAGs twice for this reason. The writers that patch the
+// header once the payload is written, e.g. WriteSortedStream, WriteOrdered and
+// DeferredRootsWriter, require an io.WriteSeeker and cannot. The index follows the data payload,
+// so it is uploaded as part of the last parts. A CARv1 has no such constraint.
+//
+// See NewPartWriter.
+type PartWriter struct {
+	upload func(partNumber int, part []byte) error
+	buf    []byte
+	parts  int
+	err    error
+}
+
+// NewPartWriter instantiates a PartWriter that passes parts of exactly partSize bytes to upload,
+// except for the last part, which is passed by PartWriter.Close and may be smaller. Parts are
+// numbered sequentially starting from 1, as S3-compatible multipart uploads expect; note that such
+// stores typically require all parts but the last to be at least 5 MiB.
+//
+// The part passed to upload is only valid until it returns, since its buffer is reused for the
+// next part. If upload returns an error, the write in progress and all subsequent writes fail
+// with it.
+func NewPartWriter(partSize int, upload func(partNumber int, part []byte) error) (*PartWriter, error) {
+	if partSize < 1 {
+		return nil, fmt.Errorf("part size must be at least 1; got %d", partSize)
+	}
+	return &PartWriter{
+		upload: upload,
+		buf:    make([]byte, 0, partSize),
+	}, nil
+}
+
+// Write buffers p, uploading each part that becomes full.
+func (pw *PartWriter) Write(p []byte) (int, error) {
+	if pw.err != nil {
+		return 0, pw.err
+	}
+	var n int
+	for len(p) > 0 {
+		c := copy(pw.buf[len(pw.buf):cap(pw.buf)], p)
+		pw.buf = pw.buf[:len(pw.buf)+c]
+		p = p[c:]
+		n += c
+		if len(pw.buf) == cap(pw.buf) {
+			if err := pw.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush uploads the buffered bytes as the next part.
+func (pw *PartWriter) flush() error {
+	if err := pw.upload(pw.parts+1, pw.buf); err != nil {
+		pw.err = fmt.Errorf("failed to upload part %d: %w", pw.parts+1, err)
+		return pw.err
+	}
+	pw.parts++
+	pw.buf = pw.buf[:0]
+	return nil
+}
+
+// Close uploads the remaining buffered bytes as the last part. An empty part is uploaded if
+// nothing was written, such that there is always at least one part. After this call, the writer
+// can no longer be used.
+func (pw *PartWriter) Close() error {
+	if pw.err != nil {
+		return pw.err
+	}
+	if len(pw.buf) > 0 || pw.parts == 0 {
+		if err := pw.flush(); err != nil {
+			return err
+		}
+	}
+	pw.err = errPartWriterClosed
+	return nil
+}
+
+// Parts returns the number of parts uploaded so far.
+func (pw *PartWriter) Parts() int {
+	return pw.parts
+}
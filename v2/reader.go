@@ -1,6 +1,7 @@
 package car
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -13,7 +14,6 @@ import (
 	internalio "github.com/ipld/go-car/v2/internal/io"
 	"github.com/multiformats/go-multicodec"
 	"github.com/multiformats/go-multihash"
-	"github.com/multiformats/go-varint"
 	"golang.org/x/exp/mmap"
 )
 
@@ -50,7 +50,26 @@ func OpenReader(path string, opts ...Option) (*Reader, error) {
 // Note that any other version other than 1 or 2 will result in an error. The caller may use
 // Reader.Version to get the actual version r represents. In the case where r represents a CARv1
 // Reader.Header will not be populated and is left as zero-valued.
+//
+// For a CARv2, if the size of r can be determined, e.g. if r has a Size method or is a file as
+// opened by OpenReader, it is checked against the header: an ErrFileSizeMismatch is returned if
+// the data payload or index would extend past the end of r, which catches truncated files upon
+// instantiation rather than when reading from them.
 func NewReader(r io.ReaderAt, opts ...Option) (*Reader, error) {
+	cr, err := newReader(r, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if cr.Version == 2 {
+		if err := cr.checkSize(); err != nil {
+			return nil, err
+		}
+	}
+	return cr, nil
+}
+
+// newReader is NewReader without checking the size of r against the CARv2 header.
+func newReader(r io.ReaderAt, opts ...Option) (*Reader, error) {
 	cr := &Reader{
 		r: r,
 	}
@@ -60,7 +79,7 @@ func NewReader(r io.ReaderAt, opts ...Option) (*Reader, error) {
 	if err != nil {
 		return nil, err
 	}
-	cr.Version, err = ReadVersion(or, opts...)
+	cr.Version, _, err = ReadPragma(or, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -102,6 +121,24 @@ func (r *Reader) readV2Header() (err error) {
 	return
 }
 
+// checkSize checks that the CARv2 is at least as large as its header claims, i.e. that its data
+// payload and index, if any, start and end within it. The check is skipped if the size of the
+// underlying io.ReaderAt cannot be determined; see readerAtSize.
+func (r *Reader) checkSize() error {
+	size := readerAtSize(r.r)
+	if size < 0 {
+		return nil
+	}
+	want := r.Header.DataOffset + r.Header.DataSize
+	if r.Header.HasIndex() && r.Header.IndexOffset > want {
+		want = r.Header.IndexOffset
+	}
+	if uint64(size) < want {
+		return &ErrFileSizeMismatch{HeaderSize: want, ActualSize: uint64(size)}
+	}
+	return nil
+}
+
 // SectionReader implements both io.ReadSeeker and io.ReaderAt.
 // It is the interface version of io.SectionReader, but note that the
 // implementation is not guaranteed to be an io.SectionReader.
@@ -112,6 +149,12 @@ type SectionReader interface {
 }
 
 // DataReader provides a reader containing the data payload in CARv1 format.
+// For a CARv2, the returned reader is bounded to the data payload, i.e. the byte range
+// [Header.DataOffset, Header.DataOffset+Header.DataSize), and reading past it returns io.EOF.
+// For a CARv1, the returned reader covers the entire underlying payload.
+//
+// The returned reader can be passed as is to streaming CARv1 consumers, e.g. NewBlockReader,
+// without the need to construct an io.SectionReader manually.
 func (r *Reader) DataReader() (SectionReader, error) {
 	if r.Version == 2 {
 		return io.NewSectionReader(r.r, int64(r.Header.DataOffset), int64(r.Header.DataSize)), nil
@@ -145,6 +188,8 @@ type Stats struct {
 	MaxBlockLength uint64
 	MinBlockLength uint64
 	IndexCodec     multicodec.Code
+	// Metadata is the metadata held by the metadata trailer, if present; see WithMetadata.
+	Metadata map[string]string
 }
 
 // Inspect does a quick scan of a CAR, performing basic validation of the format
@@ -223,14 +268,10 @@ func (r *Reader) Inspect(validateBlockHash bool) (Stats, error) {
 
 	// read block sections
 	for {
-		sectionLength, err := varint.ReadUvarint(bdr)
+		sectionLength, err := util.ReadSectionLength(bdr, r.opts.MaxAllowedSectionSize)
 		if err != nil {
 			if err == io.EOF {
-				// if the length of bytes read is non-zero when the error is EOF then signal an unclean EOF.
-				if sectionLength > 0 {
-					return Stats{}, io.ErrUnexpectedEOF
-				}
-				// otherwise, this is a normal ending
+				// this is a normal ending; an unclean EOF is signalled as io.ErrUnexpectedEOF.
 				break
 			}
 			return Stats{}, err
@@ -239,9 +280,6 @@ func (r *Reader) Inspect(validateBlockHash bool) (Stats, error) {
 			// normal ending for this read mode
 			break
 		}
-		if sectionLength > r.opts.MaxAllowedSectionSize {
-			return Stats{}, util.ErrSectionTooLarge
-		}
 
 		// decode just the CID bytes
 		cidLen, c, err := cid.CidFromReader(dr)
@@ -276,12 +314,25 @@ func (r *Reader) Inspect(validateBlockHash bool) (Stats, error) {
 
 		blockLength := sectionLength - uint64(cidLen)
 
+		var blockReader io.Reader = io.LimitReader(dr, int64(blockLength))
+		if cp.Codec == rootsTrailerPrefix.Codec {
+			// Read trailer blocks in full, in order to decode their metadata; their size is
+			// bounded by MaxAllowedSectionSize.
+			data := make([]byte, blockLength)
+			if _, err := io.ReadFull(dr, data); err != nil {
+				return Stats{}, err
+			}
+			if md, ok := decodeMetadataTrailer(data); ok {
+				stats.Metadata = md
+			}
+			blockReader = bytes.NewReader(data)
+		}
+
 		if validateBlockHash {
 			// Use multihash.SumStream to avoid having to copy the entire block content into memory.
 			// The SumStream uses a buffered copy to write bytes into the hasher which will take
 			// advantage of streaming hash calculation depending on the hash function.
 			// TODO: introduce SumStream in go-cid to simplify the code here.
-			blockReader := io.LimitReader(dr, int64(blockLength))
 			mhl := cp.MhLength
 			if mhtype == multicodec.Identity {
 				mhl = -1
@@ -302,7 +353,7 @@ func (r *Reader) Inspect(validateBlockHash bool) (Stats, error) {
 			if !gotCid.Equals(c) {
 				return Stats{}, fmt.Errorf("mismatch in content integrity, expected: %s, got: %s", c, gotCid)
 			}
-		} else {
+		} else if cp.Codec != rootsTrailerPrefix.Codec {
 			// otherwise, skip over it
 			if _, err := dr.Seek(int64(blockLength), io.SeekCurrent); err != nil {
 				return Stats{}, err
@@ -367,3 +418,25 @@ func ReadVersion(r io.Reader, opts ...Option) (uint64, error) {
 	}
 	return header.Version, nil
 }
+
+// ReadPragma reads the pragma from r, i.e. the length-prefixed header at the start of a CAR, and
+// returns the version it declares along with the number of bytes read. This allows stream
+// processors to detect the version of a CAR, and to know where the remainder of it starts, without
+// parsing the pragma by hand.
+//
+// Both CARv1 and CARv2 payloads are accepted. For a CARv1, the pragma is the CARv1 header itself,
+// whose length depends on its roots. For a CARv2, the pragma must be exactly the PragmaSize bytes
+// of Pragma; otherwise ErrInvalidPragma is returned. Versions other than 1 and 2 are returned as
+// is, without an error. MaxAllowedHeaderSize is honoured.
+func ReadPragma(r io.Reader, opts ...Option) (version uint64, n int, err error) {
+	o := ApplyOptions(opts...)
+	var read bytes.Buffer
+	header, err := carv1.ReadHeader(io.TeeReader(r, &read), o.MaxAllowedHeaderSize)
+	if err != nil {
+		return 0, read.Len(), err
+	}
+	if header.Version == 2 && !bytes.Equal(read.Bytes(), Pragma) {
+		return 0, read.Len(), ErrInvalidPragma
+	}
+	return header.Version, read.Len(), nil
+}
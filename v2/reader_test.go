@@ -3,8 +3,10 @@ package car_test
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -86,6 +88,58 @@ func TestReadVersion(t *testing.T) {
 	}
 }
 
+func TestReadPragma(t *testing.T) {
+	v1, err := os.ReadFile("testdata/sample-v1.car")
+	require.NoError(t, err)
+	v1h, err := carv1.ReadHeader(bytes.NewReader(v1), carv1.DefaultMaxAllowedHeaderSize)
+	require.NoError(t, err)
+	var v1Header bytes.Buffer
+	require.NoError(t, carv1.WriteHeader(v1h, &v1Header))
+	v42, err := os.ReadFile("testdata/sample-rootless-v42.car")
+	require.NoError(t, err)
+
+	// A header declaring version 2 that carries roots is a valid CARv1 header but not a pragma.
+	var notPragma bytes.Buffer
+	require.NoError(t, carv1.WriteHeader(&carv1.CarHeader{Roots: v1h.Roots, Version: 2}, &notPragma))
+
+	tests := []struct {
+		name        string
+		payload     []byte
+		wantVersion uint64
+		wantN       int
+		wantErr     error
+	}{
+		{"CarV1", v1, 1, v1Header.Len(), nil},
+		{"CarV2", append(append([]byte{}, carv2.Pragma...), 0x01), 2, carv2.PragmaSize, nil},
+		{"FutureVersion", v42, 42, 0, nil},
+		{"NonCanonicalPragma", notPragma.Bytes(), 0, notPragma.Len(), carv2.ErrInvalidPragma},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			r := bytes.NewReader(tt.payload)
+			version, n, err := carv2.ReadPragma(r)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.wantVersion, version)
+			if tt.wantN != 0 {
+				require.Equal(t, tt.wantN, n)
+			}
+			// Assert exactly the pragma is consumed.
+			require.Equal(t, len(tt.payload)-n, r.Len())
+		})
+	}
+
+	// Assert truncated pragmas are errors, and NewReader rejects non-canonical pragmas.
+	_, _, err = carv2.ReadPragma(bytes.NewReader(carv2.Pragma[:5]))
+	require.Error(t, err)
+	_, err = carv2.NewReader(bytes.NewReader(notPragma.Bytes()))
+	require.ErrorIs(t, err, carv2.ErrInvalidPragma)
+}
+
 func TestReaderFailsOnUnknownVersion(t *testing.T) {
 	_, err := carv2.OpenReader("testdata/sample-rootless-v42.car")
 	require.EqualError(t, err, "invalid car version: 42")
@@ -188,6 +242,32 @@ func TestReader_WithCarV2Consistency(t *testing.T) {
 	}
 }
 
+func TestReader_DataReaderIsBoundedToDataPayload(t *testing.T) {
+	subject, err := carv2.OpenReader("testdata/sample-wrapped-v2.car")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+
+	dr, err := subject.DataReader()
+	require.NoError(t, err)
+	payload, err := io.ReadAll(dr)
+	require.NoError(t, err)
+	require.Equal(t, int(subject.Header.DataSize), len(payload))
+
+	// Assert the payload can be consumed by a streaming CARv1 reader.
+	_, err = dr.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	br, err := carv2.NewBlockReader(dr)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), br.Version)
+	for {
+		_, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+	}
+}
+
 func TestOpenReader_DoesNotPanicForReadersCreatedBeforeClosure(t *testing.T) {
 	subject, err := carv2.OpenReader("testdata/sample-wrapped-v2.car")
 	require.NoError(t, err)
@@ -284,6 +364,40 @@ func requireNewCarV1Reader(t *testing.T, r io.Reader, zerLenAsEOF bool) *carv1.C
 	return cr
 }
 
+func TestReader_FailsOnFileSizeMismatch(t *testing.T) {
+	data, err := os.ReadFile("testdata/sample-wrapped-v2.car")
+	require.NoError(t, err)
+	cr, err := carv2.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.True(t, cr.Header.HasIndex())
+	indexOffset := cr.Header.IndexOffset
+	dataEnd := cr.Header.DataOffset + cr.Header.DataSize
+
+	// Assert truncating the index, but not past its offset, is not detected.
+	_, err = carv2.NewReader(bytes.NewReader(data[:indexOffset]))
+	require.NoError(t, err)
+
+	// Assert truncating the data payload or index offset is detected, reporting both sizes.
+	for _, size := range []uint64{indexOffset - 1, dataEnd - 1, carv2.PragmaSize + carv2.HeaderSize} {
+		_, err = carv2.NewReader(bytes.NewReader(data[:size]))
+		var mismatch *carv2.ErrFileSizeMismatch
+		require.True(t, errors.As(err, &mismatch), "got %v", err)
+		require.Equal(t, indexOffset, mismatch.HeaderSize)
+		require.Equal(t, size, mismatch.ActualSize)
+	}
+
+	// Assert the check is made for files opened by OpenReader.
+	path := filepath.Join(t.TempDir(), "truncated.car")
+	require.NoError(t, os.WriteFile(path, data[:dataEnd-1], 0o600))
+	_, err = carv2.OpenReader(path)
+	var mismatch *carv2.ErrFileSizeMismatch
+	require.True(t, errors.As(err, &mismatch), "got %v", err)
+
+	// Assert the check is skipped if the size cannot be determined.
+	_, err = carv2.NewReader(struct{ io.ReaderAt }{bytes.NewReader(data[:dataEnd-1])})
+	require.NoError(t, err)
+}
+
 func TestInspect(t *testing.T) {
 	tests := []struct {
 		name          string
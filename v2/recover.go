@@ -0,0 +1,197 @@
+package car
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2/internal/carv1"
+	"github.com/ipld/go-car/v2/internal/carv1/util"
+	internalio "github.com/ipld/go-car/v2/internal/io"
+	"github.com/multiformats/go-varint"
+)
+
+var errZeroLengthSection = errors.New("zero-length section")
+
+// RecoverBlocks salvages as many blocks as possible from the CAR read from r, which may be
+// partially corrupt. Both CARv1 and CARv2 are accepted; for a CARv2, only its data payload is
+// scanned, and its index is ignored.
+//
+// The sections of the data payload are scanned in order, calling onBlock with the CID and data of
+// each section that can be read and whose data matches the hash of its CID. For each section that
+// cannot be read, e.g. because its length is malformed, its CID cannot be decoded or its data does
+// not match its CID, onError is called with the offset of the section in r and the error. If
+// onError returns false, scanning stops and the error is returned. Otherwise, scanning resumes at
+// the next plausible section boundary, i.e. the next offset at which a section that matches its
+// CID can be read; the bytes in between are skipped. A malformed CAR header is handled the same
+// way, as a section at the offset of the header.
+//
+// Nil is returned once the end of the data payload is reached, or if the data payload ends with
+// a zero-length section and ZeroLengthSectionAsEOF is enabled. Sections larger than
+// MaxAllowedSectionSize, and CIDs larger than MaxIndexCidSize, are considered malformed.
+//
+// Since every byte offset is tried when looking for the next plausible section boundary, resuming
+// after a large corrupt region can be slow; the data passed to onBlock is never corrupt, however.
+func RecoverBlocks(r io.ReaderAt, onBlock func(cid.Cid, []byte), onError func(offset int64, err error) bool, opts ...Option) error {
+	o := ApplyOptions(opts...)
+	start, end := int64(0), readerAtSize(r)
+
+	off, err := recoverHeader(r, &start, &end, opts...)
+	if err != nil {
+		if !onError(start, err) {
+			return err
+		}
+		if off = resyncSection(r, start+1, end, o); off < 0 {
+			return nil
+		}
+	}
+
+	for end < 0 || off < end {
+		c, data, size, err := readSectionAt(r, off, end, o)
+		switch {
+		case err == nil:
+			onBlock(c, data)
+			off += size
+			continue
+		case err == io.EOF:
+			return nil
+		case err == errZeroLengthSection && o.ZeroLengthSectionAsEOF:
+			return nil
+		}
+		if !onError(off, err) {
+			return err
+		}
+		if off = resyncSection(r, off+1, end, o); off < 0 {
+			return nil
+		}
+	}
+	return nil
+}
+
+// recoverHeader reads the header of the CAR read from r, and returns the offset of its first
+// section. The start and end offsets of the data payload are updated if the CAR is a CARv2; end is
+// -1 if it is unknown.
+func recoverHeader(r io.ReaderAt, start, end *int64, opts ...Option) (int64, error) {
+	// Do not check the size of r against the header, since recovering truncated CARs is expected.
+	cr, err := newReader(r, opts...)
+	if err != nil {
+		return 0, err
+	}
+	if cr.Version == 2 {
+		h := cr.Header
+		if h.DataOffset > math.MaxInt64 || h.DataSize > math.MaxInt64-h.DataOffset {
+			return 0, fmt.Errorf("malformed CARv2; data payload out of bounds: offset %d, size %d", h.DataOffset, h.DataSize)
+		}
+		*start = int64(h.DataOffset)
+		*end = int64(h.DataOffset + h.DataSize)
+	}
+	or, err := internalio.NewOffsetReadSeeker(r, *start)
+	if err != nil {
+		return 0, err
+	}
+	header, err := carv1.ReadHeader(or, cr.opts.MaxAllowedHeaderSize)
+	if err != nil {
+		return 0, err
+	}
+	if header.Version != 1 {
+		return 0, fmt.Errorf("expected data payload header version of 1; got %d", header.Version)
+	}
+	pos, err := or.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	return *start + pos, nil
+}
+
+// resyncSection returns the first offset from the given offset at which a section can be read, or
+// -1 if there is none before end.
+func resyncSection(r io.ReaderAt, from, end int64, o Options) int64 {
+	for off := from; end < 0 || off < end; off++ {
+		_, _, _, err := readSectionAt(r, off, end, o)
+		if err == nil {
+			return off
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return -1
+}
+
+// readSectionAt reads the section at the given offset of r, which must end before end unless it is
+// -1, and returns its CID, its data and its total size including the length prefix. The data is
+// verified against the CID. io.EOF is returned if there are no more bytes to read at the offset.
+func readSectionAt(r io.ReaderAt, off, end int64, o Options) (cid.Cid, []byte, int64, error) {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n, err := r.ReadAt(lenBuf[:], off)
+	if end >= 0 && off+int64(n) > end {
+		n = int(end - off)
+	}
+	if n <= 0 {
+		if err == nil || err == io.EOF {
+			return cid.Undef, nil, 0, io.EOF
+		}
+		return cid.Undef, nil, 0, err
+	}
+	sectionLen, lenSize, err := varint.FromUvarint(lenBuf[:n])
+	if err != nil {
+		if err == varint.ErrUnderflow && n < len(lenBuf) {
+			return cid.Undef, nil, 0, fmt.Errorf("%w: partial section length", ErrTruncated)
+		}
+		return cid.Undef, nil, 0, fmt.Errorf("malformed section length: %w", err)
+	}
+	if sectionLen == 0 {
+		return cid.Undef, nil, 0, errZeroLengthSection
+	}
+	if sectionLen > o.MaxAllowedSectionSize {
+		return cid.Undef, nil, 0, util.ErrSectionTooLarge
+	}
+	dataOff := off + int64(lenSize)
+	if end >= 0 && int64(sectionLen) > end-dataOff {
+		return cid.Undef, nil, 0, fmt.Errorf("%w: section length %d exceeds remaining data payload", ErrTruncated, sectionLen)
+	}
+
+	// Decode the CID before reading the entire section, so that a malformed length does not cause
+	// a large read when looking for the next plausible section boundary.
+	headLen := sectionLen
+	if headLen > o.MaxIndexCidSize {
+		headLen = o.MaxIndexCidSize
+	}
+	head := make([]byte, headLen)
+	if err := readFullAt(r, head, dataOff); err != nil {
+		return cid.Undef, nil, 0, err
+	}
+	cidLen, c, err := cid.CidFromBytes(head)
+	if err != nil {
+		return cid.Undef, nil, 0, fmt.Errorf("malformed section CID: %w", err)
+	}
+
+	data := make([]byte, sectionLen-uint64(cidLen))
+	if err := readFullAt(r, data, dataOff+int64(cidLen)); err != nil {
+		return cid.Undef, nil, 0, err
+	}
+	got, err := c.Prefix().Sum(data)
+	if err != nil {
+		return cid.Undef, nil, 0, err
+	}
+	if !got.Equals(c) {
+		return cid.Undef, nil, 0, fmt.Errorf("mismatch in content integrity, expected: %s, got: %s", c, got)
+	}
+	return c, data, int64(lenSize) + int64(sectionLen), nil
+}
+
+// readFullAt reads exactly len(buf) bytes of r at the given offset, returning ErrTruncated if r ends
+// before then.
+func readFullAt(r io.ReaderAt, buf []byte, off int64) error {
+	n, err := r.ReadAt(buf, off)
+	if n == len(buf) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		return fmt.Errorf("%w: partial section data", ErrTruncated)
+	}
+	return err
+}
@@ -0,0 +1,129 @@
+package car_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoverBlocks(t *testing.T) {
+	for _, path := range []string{"testdata/sample-v1.car", "testdata/sample-wrapped-v2.car"} {
+		path := path
+		t.Run(path, func(t *testing.T) {
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+			cr, err := carv2.NewReader(bytes.NewReader(data))
+			require.NoError(t, err)
+			var dataOffset int64
+			if cr.Version == 2 {
+				dataOffset = int64(cr.Header.DataOffset)
+			}
+
+			// Record the multihash and offset of every section, in order.
+			dr, err := cr.DataReader()
+			require.NoError(t, err)
+			idx := index.NewLinear()
+			require.NoError(t, carv2.LoadIndex(idx, dr, carv2.StoreIdentityCIDs(true)))
+			var mhs []multihash.Multihash
+			var offsets []int64
+			require.NoError(t, idx.ForEach(func(mh multihash.Multihash, offset uint64) error {
+				mhs = append(mhs, mh)
+				offsets = append(offsets, dataOffset+int64(offset))
+				return nil
+			}))
+			require.Greater(t, len(mhs), 4)
+
+			type recovered struct {
+				mhs   []multihash.Multihash
+				errAt []int64
+				err   error
+			}
+			scan := func(car []byte, cont bool) recovered {
+				var got recovered
+				got.err = carv2.RecoverBlocks(bytes.NewReader(car),
+					func(c cid.Cid, data []byte) {
+						mh, err := c.Prefix().Sum(data)
+						require.NoError(t, err)
+						require.True(t, mh.Equals(c))
+						got.mhs = append(got.mhs, c.Hash())
+					},
+					func(offset int64, err error) bool {
+						got.errAt = append(got.errAt, offset)
+						return cont
+					})
+				return got
+			}
+
+			// Assert all blocks are recovered from an intact CAR.
+			got := scan(data, true)
+			require.NoError(t, got.err)
+			require.Empty(t, got.errAt)
+			require.Equal(t, mhs, got.mhs)
+
+			// Corrupt the last byte of the data of the third section, and assert every other block
+			// is recovered, reporting the corrupt section.
+			corrupt := append([]byte{}, data...)
+			corrupt[offsets[3]-1] ^= 0xff
+			got = scan(corrupt, true)
+			require.NoError(t, got.err)
+			require.Equal(t, []int64{offsets[2]}, got.errAt)
+			require.Equal(t, append(append([]multihash.Multihash{}, mhs[:2]...), mhs[3:]...), got.mhs)
+
+			// Corrupt the length of the second section, such that it overlaps the following ones.
+			corrupt = append([]byte{}, data...)
+			corrupt[offsets[1]] = 0x7f
+			got = scan(corrupt, true)
+			require.NoError(t, got.err)
+			require.Equal(t, []int64{offsets[1]}, got.errAt)
+			require.Equal(t, mhs[0], got.mhs[0])
+			require.Equal(t, mhs[len(mhs)-1], got.mhs[len(got.mhs)-1])
+
+			// Assert recovery stops with the error if onError returns false.
+			corrupt = append([]byte{}, data...)
+			corrupt[offsets[3]-1] ^= 0xff
+			got = scan(corrupt, false)
+			require.Error(t, got.err)
+			require.Equal(t, []int64{offsets[2]}, got.errAt)
+			require.Equal(t, mhs[:2], got.mhs)
+
+			// Assert a truncated CAR recovers all complete sections.
+			got = scan(data[:offsets[4]+3], true)
+			require.NoError(t, got.err)
+			require.Equal(t, mhs[:4], got.mhs)
+			require.Len(t, got.errAt, 1)
+		})
+	}
+}
+
+func TestRecoverBlocks_CorruptHeader(t *testing.T) {
+	data, err := os.ReadFile("testdata/sample-v1.car")
+	require.NoError(t, err)
+	want, err := carv2.NewBlockReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	var wantCount int
+	for _, err = want.Next(); err == nil; _, err = want.Next() {
+		wantCount++
+	}
+
+	// Corrupt the header, and assert the blocks following it are still recovered.
+	data[1] ^= 0xff
+	var gotCount int
+	var gotErr error
+	require.NoError(t, carv2.RecoverBlocks(bytes.NewReader(data),
+		func(cid.Cid, []byte) { gotCount++ },
+		func(offset int64, err error) bool {
+			require.Zero(t, offset)
+			gotErr = err
+			return true
+		}))
+	require.Error(t, gotErr)
+	require.False(t, errors.Is(gotErr, carv2.ErrTruncated))
+	require.Equal(t, wantCount, gotCount)
+}
@@ -40,17 +40,59 @@ func MaxTraversalLinks(MaxTraversalLinks uint64) Option {
 	}
 }
 
+// DetectCycles sets whether selector traversals keep track of the blocks visited so far and skip
+// any link to an already visited block. This guarantees that the traversal terminates even if
+// the blocks form a cycle, which is possible when the given link system is configured with
+// TrustedStorage and therefore does not verify block hashes. Each block is written at most once
+// regardless of this option.
+//
+// This option is enabled by default. Disabling it allows traversals to revisit blocks reachable
+// via multiple paths when duplicate puts are allowed; see blockstore.AllowDuplicatePuts. In that
+// case, consider bounding the traversal via MaxTraversalLinks.
+func DetectCycles(enable bool) Option {
+	return func(sco *Options) {
+		sco.DetectCycles = enable
+	}
+}
+
+// BlockFilter sets a predicate that decides which blocks are written by selector traversals: a
+// block is written only if filter returns true for its CID. Whether the links of a filtered out
+// block are traversed is set by FollowFilteredLinks.
+//
+// Note that filtering blocks out can produce a CAR that does not contain a complete DAG, even
+// when the selector matches a complete DAG.
+func BlockFilter(filter func(cid.Cid) bool) Option {
+	return func(sco *Options) {
+		sco.BlockFilter = filter
+	}
+}
+
+// FollowFilteredLinks sets whether selector traversals load and traverse the links of blocks that
+// are filtered out by BlockFilter. When disabled, which is the default, filtered out blocks are not
+// loaded at all and the parts of the DAG only reachable via them are skipped. If the root itself is
+// filtered out, the resulting CAR contains no blocks.
+//
+// Note that skipping blocks is not supported by ADLs that load blocks themselves, such as the
+// UnixFS reifiers; enable this option when traversing DAGs via such ADLs.
+func FollowFilteredLinks(enable bool) Option {
+	return func(sco *Options) {
+		sco.FollowFilteredLinks = enable
+	}
+}
+
 // NewSelectiveWriter walks through the proposed dag traversal to learn its total size in order to be able to
 // stream out a car to a writer in the expected traversal order in one go.
 func NewSelectiveWriter(ctx context.Context, ls *ipld.LinkSystem, root cid.Cid, selector ipld.Node, opts ...Option) (Writer, error) {
+	o := ApplyOptions(opts...)
 	cls, cntr := loader.CountingLinkSystem(*ls)
+	cls = filteringLinkSystem(*ls, cls, o)
 
 	c1h := carv1.CarHeader{Roots: []cid.Cid{root}, Version: 1}
 	headSize, err := carv1.HeaderSize(&c1h)
 	if err != nil {
 		return nil, err
 	}
-	if err := traverse(ctx, &cls, root, selector, ApplyOptions(opts...)); err != nil {
+	if err := traverse(ctx, &cls, root, selector, o); err != nil {
 		return nil, err
 	}
 	tc := traversalCar{
@@ -59,7 +101,7 @@ func NewSelectiveWriter(ctx context.Context, ls *ipld.LinkSystem, root cid.Cid,
 		root:     root,
 		selector: selector,
 		ls:       ls,
-		opts:     ApplyOptions(opts...),
+		opts:     o,
 	}
 	return &tc, nil
 }
@@ -117,11 +159,26 @@ func TraverseV1(ctx context.Context, ls *ipld.LinkSystem, root cid.Cid, selector
 }
 
 // Writer is an interface allowing writing a car prepared by PrepareTraversal
+//
+// Writer never seeks, and can therefore write to append-only sinks: the data payload size
+// required by the CARv2 header is learned by NewSelectiveWriter ahead of writing.
 type Writer interface {
 	io.WriterTo
 }
 
-var _ Writer = (*traversalCar)(nil)
+// SizedWriter is a Writer that can also compute the number of bytes it writes ahead of writing
+// them. The Writer returned by NewSelectiveWriter implements SizedWriter, which can be checked via
+// a type assertion.
+type SizedWriter interface {
+	Writer
+
+	// Size returns the total number of bytes that WriteTo would write, including the header,
+	// padding, data payload and index, without writing them anywhere.
+	// Note that computing the size requires a full traversal, including index computation.
+	Size() (int64, error)
+}
+
+var _ SizedWriter = (*traversalCar)(nil)
 
 type traversalCar struct {
 	size     uint64
@@ -137,6 +194,8 @@ func (tc *traversalCar) WriteTo(w io.Writer) (int64, error) {
 	if err != nil {
 		return n, err
 	}
+	// The data payload starts right after the header and its padding.
+	dataOffset := n
 	v1s, idx, err := tc.WriteV1(w)
 	n += int64(v1s)
 
@@ -146,8 +205,13 @@ func (tc *traversalCar) WriteTo(w io.Writer) (int64, error) {
 
 	// index padding, then index
 	if tc.opts.IndexCodec != index.CarIndexNone {
-		if tc.opts.IndexPadding > 0 {
-			buf := make([]byte, tc.opts.IndexPadding)
+		if tc.opts.AbsoluteIndexOffsets {
+			if idx, err = index.Rebase(idx, dataOffset); err != nil {
+				return n, err
+			}
+		}
+		if p := tc.opts.indexPaddingAt(uint64(n)); p > 0 {
+			buf := make([]byte, p)
 			pn, err := w.Write(buf)
 			n += int64(pn)
 			if err != nil {
@@ -164,6 +228,14 @@ func (tc *traversalCar) WriteTo(w io.Writer) (int64, error) {
 	return n, err
 }
 
+func (tc *traversalCar) Size() (int64, error) {
+	// Perform an actual write into a discarding sink, so that the size is consistent with WriteTo
+	// by construction. The sections are not actually written, so are not passed to OnSection.
+	sized := *tc
+	sized.opts.OnSection = nil
+	return sized.WriteTo(&countingWriter{})
+}
+
 func (tc *traversalCar) WriteV2Header(w io.Writer) (int64, error) {
 	n, err := w.Write(Pragma)
 	if err != nil {
@@ -174,11 +246,13 @@ func (tc *traversalCar) WriteV2Header(w io.Writer) (int64, error) {
 	if p := tc.opts.DataPadding; p > 0 {
 		h = h.WithDataPadding(p)
 	}
-	if p := tc.opts.IndexPadding; p > 0 {
+	if p := tc.opts.indexPaddingAt(h.DataOffset + h.DataSize); p > 0 {
 		h = h.WithIndexPadding(p)
 	}
 	if tc.opts.IndexCodec == index.CarIndexNone {
 		h.IndexOffset = 0
+	} else {
+		h.Characteristics.SetAbsoluteIndexOffsets(tc.opts.AbsoluteIndexOffsets)
 	}
 	hn, err := h.WriteTo(w)
 	if err != nil {
@@ -214,7 +288,8 @@ func (tc *traversalCar) WriteV1(w io.Writer) (uint64, index.Index, error) {
 	}
 
 	// write the block.
-	wls, writer := loader.TeeingLinkSystem(*tc.ls, w, v1Size, tc.opts.IndexCodec)
+	wls, writer := loader.TeeingLinkSystem(*tc.ls, w, v1Size, tc.opts.IndexCodec, tc.opts.OnSection)
+	wls = filteringLinkSystem(*tc.ls, wls, tc.opts)
 	err = traverse(tc.ctx, &wls, tc.root, tc.selector, tc.opts)
 	v1Size = writer.Size()
 	if err != nil {
@@ -232,6 +307,30 @@ func (tc *traversalCar) WriteV1(w io.Writer) (uint64, index.Index, error) {
 	return v1Size, idx, err
 }
 
+// filteringLinkSystem returns wrapped, which wraps ls to count or write the blocks it loads, such
+// that blocks filtered out by opts.BlockFilter are loaded directly from ls, or skipped altogether
+// unless opts.FollowFilteredLinks is set.
+func filteringLinkSystem(ls, wrapped ipld.LinkSystem, opts Options) ipld.LinkSystem {
+	if opts.BlockFilter == nil {
+		return wrapped
+	}
+	fls := wrapped
+	fls.StorageReadOpener = func(lc linking.LinkContext, l ipld.Link) (io.Reader, error) {
+		_, c, err := cid.CidFromBytes([]byte(l.Binary()))
+		if err != nil {
+			return nil, err
+		}
+		if opts.BlockFilter(c) {
+			return wrapped.StorageReadOpener(lc, l)
+		}
+		if !opts.FollowFilteredLinks {
+			return nil, traversal.SkipMe{}
+		}
+		return ls.StorageReadOpener(lc, l)
+	}
+	return fls
+}
+
 func traverse(ctx context.Context, ls *ipld.LinkSystem, root cid.Cid, s ipld.Node, opts Options) error {
 	sel, err := selector.CompileSelector(s)
 	if err != nil {
@@ -250,7 +349,7 @@ func traverse(ctx context.Context, ls *ipld.LinkSystem, root cid.Cid, s ipld.Nod
 			Ctx:                            ctx,
 			LinkSystem:                     *ls,
 			LinkTargetNodePrototypeChooser: chooser,
-			LinkVisitOnlyOnce:              !opts.BlockstoreAllowDuplicatePuts,
+			LinkVisitOnlyOnce:              opts.DetectCycles || !opts.BlockstoreAllowDuplicatePuts,
 		},
 	}
 	if opts.MaxTraversalLinks < math.MaxInt64 {
@@ -267,7 +366,10 @@ func traverse(ctx context.Context, ls *ipld.LinkSystem, root cid.Cid, s ipld.Nod
 		return err
 	}
 	rootNode, err := ls.Load(ipld.LinkContext{}, lnk, rp)
-	if err != nil {
+	if _, ok := err.(traversal.SkipMe); ok {
+		// The root is filtered out; see FollowFilteredLinks.
+		return nil
+	} else if err != nil {
 		return fmt.Errorf("root blk load failed: %s", err)
 	}
 	err = progress.WalkMatching(rootNode, sel, func(_ traversal.Progress, node ipld.Node) error {
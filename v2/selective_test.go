@@ -3,6 +3,7 @@ package car_test
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
 	"os"
 	"path"
@@ -14,17 +15,22 @@ import (
 	"github.com/ipfs/go-unixfsnode/data/builder"
 	"github.com/ipld/go-car/v2"
 	"github.com/ipld/go-car/v2/blockstore"
+	"github.com/ipld/go-car/v2/internal/carv1"
+	"github.com/ipld/go-car/v2/internal/carv1/util"
 	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
 	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
 	"github.com/ipld/go-ipld-prime/linking"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
 	"github.com/ipld/go-ipld-prime/storage/bsadapter"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
 	sb "github.com/ipld/go-ipld-prime/traversal/selector/builder"
 	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/multiformats/go-multihash"
 	"github.com/stretchr/testify/require"
 
-	_ "github.com/ipld/go-ipld-prime/codec/dagcbor"
 	_ "github.com/ipld/go-ipld-prime/codec/raw"
 )
 
@@ -55,6 +61,103 @@ func TestPrepareTraversal(t *testing.T) {
 	require.Equal(t, buf.Bytes()[:h1h.Len()], h1h.Bytes())
 }
 
+func TestSelectiveWriter_SizeMatchesWriteTo(t *testing.T) {
+	from, err := blockstore.OpenReadOnly("testdata/sample-unixfs-v2.car")
+	require.NoError(t, err)
+	ls := cidlink.DefaultLinkSystem()
+	bsa := bsadapter.Adapter{Wrapped: from}
+	ls.SetReadStorage(&bsa)
+
+	rts, _ := from.Roots()
+	tests := []struct {
+		name string
+		opts []car.Option
+	}{
+		{"Default", nil},
+		{"WithPadding", []car.Option{car.UseDataPadding(13), car.UseIndexPadding(7)}},
+		{"WithIndexAlignment", []car.Option{car.UseDataPadding(13), car.UseIndexPadding(7), car.AlignIndexTo(4096)}},
+		{"WithoutIndex", []car.Option{car.WithoutIndex()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writer, err := car.NewSelectiveWriter(context.Background(), &ls, rts[0], selectorparse.CommonSelector_ExploreAllRecursively, tt.opts...)
+			require.NoError(t, err)
+
+			size, err := writer.(car.SizedWriter).Size()
+			require.NoError(t, err)
+
+			buf := bytes.Buffer{}
+			n, err := writer.WriteTo(&buf)
+			require.NoError(t, err)
+			require.Equal(t, n, size)
+			require.Equal(t, int64(buf.Len()), size)
+		})
+	}
+}
+
+func TestSelectiveWriter_OnSection(t *testing.T) {
+	from, err := blockstore.OpenReadOnly("testdata/sample-unixfs-v2.car")
+	require.NoError(t, err)
+	ls := cidlink.DefaultLinkSystem()
+	bsa := bsadapter.Adapter{Wrapped: from}
+	ls.SetReadStorage(&bsa)
+	rts, _ := from.Roots()
+
+	var want bytes.Buffer
+	writer, err := car.NewSelectiveWriter(context.Background(), &ls, rts[0], selectorparse.CommonSelector_ExploreAllRecursively)
+	require.NoError(t, err)
+	_, err = writer.WriteTo(&want)
+	require.NoError(t, err)
+
+	var mirror bytes.Buffer
+	var cids []cid.Cid
+	writer, err = car.NewSelectiveWriter(context.Background(), &ls, rts[0], selectorparse.CommonSelector_ExploreAllRecursively,
+		car.OnSection(func(c cid.Cid, section []byte) error {
+			cids = append(cids, c)
+			mirror.Write(section)
+			return nil
+		}))
+	require.NoError(t, err)
+	_, err = writer.(car.SizedWriter).Size()
+	require.NoError(t, err)
+	require.Empty(t, cids, "hook must not be called by Size")
+
+	// Assert the output is unchanged, and the sections passed to the hook make up the data payload
+	// after its header.
+	var got bytes.Buffer
+	_, err = writer.WriteTo(&got)
+	require.NoError(t, err)
+	require.Equal(t, want.Bytes(), got.Bytes())
+	cr, err := car.NewReader(bytes.NewReader(got.Bytes()))
+	require.NoError(t, err)
+	dr, err := cr.DataReader()
+	require.NoError(t, err)
+	_, err = carv1.ReadHeader(dr, carv1.DefaultMaxAllowedHeaderSize)
+	require.NoError(t, err)
+	sections, err := io.ReadAll(dr)
+	require.NoError(t, err)
+	require.Equal(t, sections, mirror.Bytes())
+
+	br, err := car.NewBlockReader(bytes.NewReader(got.Bytes()))
+	require.NoError(t, err)
+	for _, c := range cids {
+		blk, err := br.Next()
+		require.NoError(t, err)
+		require.Equal(t, blk.Cid(), c)
+	}
+	_, err = br.Next()
+	require.Equal(t, io.EOF, err)
+
+	// Assert an error returned by the hook aborts the write.
+	errAbort := errors.New("abort")
+	writer, err = car.NewSelectiveWriter(context.Background(), &ls, rts[0], selectorparse.CommonSelector_ExploreAllRecursively,
+		car.OnSection(func(cid.Cid, []byte) error { return errAbort }))
+	require.NoError(t, err)
+	_, err = writer.WriteTo(io.Discard)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), errAbort.Error())
+}
+
 func TestFileTraversal(t *testing.T) {
 	from, err := blockstore.OpenReadOnly("testdata/sample-unixfs-v2.car")
 	require.NoError(t, err)
@@ -135,3 +238,136 @@ func TestPartialTraversal(t *testing.T) {
 	}
 	require.Equal(t, 2, len(fnd))
 }
+
+func TestSelectiveWriter_CyclicBlocksAreWrittenOnce(t *testing.T) {
+	// Construct two blocks that link to each other. Such blocks cannot be content-addressed;
+	// they are stored under arbitrary CIDs and rely on the link system trusting its storage.
+	newCid := func(seed string) cid.Cid {
+		mh, err := multihash.Sum([]byte(seed), multihash.SHA2_256, -1)
+		require.NoError(t, err)
+		return cid.NewCidV1(cid.DagCBOR, mh)
+	}
+	a, b := newCid("a"), newCid("b")
+	encodeLinkTo := func(target cid.Cid) []byte {
+		n, err := qp.BuildMap(basicnode.Prototype.Any, 1, func(ma datamodel.MapAssembler) {
+			qp.MapEntry(ma, "next", qp.Link(cidlink.Link{Cid: target}))
+		})
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		require.NoError(t, dagcbor.Encode(n, &buf))
+		return buf.Bytes()
+	}
+	store := &memstore.Store{}
+	ctx := context.Background()
+	require.NoError(t, store.Put(ctx, cidlink.Link{Cid: a}.Binary(), encodeLinkTo(b)))
+	require.NoError(t, store.Put(ctx, cidlink.Link{Cid: b}.Binary(), encodeLinkTo(a)))
+	ls := cidlink.DefaultLinkSystem()
+	ls.SetReadStorage(store)
+	ls.TrustedStorage = true
+
+	writer, err := car.NewSelectiveWriter(ctx, &ls, a, selectorparse.CommonSelector_ExploreAllRecursively, blockstore.AllowDuplicatePuts(true))
+	require.NoError(t, err)
+	buf := bytes.Buffer{}
+	_, err = writer.WriteTo(&buf)
+	require.NoError(t, err)
+
+	// Read the payload without verifying block hashes, since the blocks are not content-addressed.
+	reader, err := car.NewReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	dr, err := reader.DataReader()
+	require.NoError(t, err)
+	_, err = carv1.ReadHeader(dr, carv1.DefaultMaxAllowedHeaderSize)
+	require.NoError(t, err)
+	var gotCids []cid.Cid
+	for {
+		c, _, err := util.ReadNode(dr, false, carv1.DefaultMaxAllowedSectionSize)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		gotCids = append(gotCids, c)
+	}
+	require.Equal(t, []cid.Cid{a, b}, gotCids)
+
+	// Assert that without cycle detection the traversal does not terminate on its own.
+	_, err = car.NewSelectiveWriter(ctx, &ls, a, selectorparse.CommonSelector_ExploreAllRecursively,
+		blockstore.AllowDuplicatePuts(true),
+		car.DetectCycles(false),
+		car.MaxTraversalLinks(100))
+	require.Error(t, err)
+}
+
+func TestSelectiveWriter_BlockFilter(t *testing.T) {
+	from, err := blockstore.OpenReadOnly("testdata/sample-unixfs-v2.car")
+	require.NoError(t, err)
+	ls := cidlink.DefaultLinkSystem()
+	bsa := bsadapter.Adapter{Wrapped: from}
+	ls.SetReadStorage(&bsa)
+	rts, err := from.Roots()
+	require.NoError(t, err)
+	root := rts[0]
+
+	// Collect the CIDs in the sample by codec.
+	var allCids, intermediateCids []cid.Cid
+	f, err := os.Open("testdata/sample-unixfs-v2.car")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, f.Close()) })
+	br, err := car.NewBlockReader(f)
+	require.NoError(t, err)
+	for {
+		b, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		allCids = append(allCids, b.Cid())
+		if b.Cid().Prefix().Codec != cid.Raw {
+			intermediateCids = append(intermediateCids, b.Cid())
+		}
+	}
+	require.NotEmpty(t, intermediateCids)
+	require.Less(t, len(intermediateCids), len(allCids))
+
+	writtenCids := func(t *testing.T, opts ...car.Option) []cid.Cid {
+		writer, err := car.NewSelectiveWriter(context.Background(), &ls, root, selectorparse.CommonSelector_ExploreAllRecursively, opts...)
+		require.NoError(t, err)
+		buf := bytes.Buffer{}
+		n, err := writer.WriteTo(&buf)
+		require.NoError(t, err)
+		size, err := writer.(car.SizedWriter).Size()
+		require.NoError(t, err)
+		require.Equal(t, n, size)
+
+		br, err := car.NewBlockReader(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+		var got []cid.Cid
+		for {
+			b, err := br.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			got = append(got, b.Cid())
+		}
+		return got
+	}
+
+	t.Run("ExcludeRawLeaves", func(t *testing.T) {
+		got := writtenCids(t, car.BlockFilter(func(c cid.Cid) bool { return c.Prefix().Codec != cid.Raw }))
+		require.ElementsMatch(t, intermediateCids, got)
+	})
+	notRoot := car.BlockFilter(func(c cid.Cid) bool { return !c.Equals(root) })
+	t.Run("ExcludeRootWithoutFollowingLinks", func(t *testing.T) {
+		require.Empty(t, writtenCids(t, notRoot))
+	})
+	t.Run("ExcludeRootFollowingLinks", func(t *testing.T) {
+		var want []cid.Cid
+		for _, c := range allCids {
+			if !c.Equals(root) {
+				want = append(want, c)
+			}
+		}
+		got := writtenCids(t, notRoot, car.FollowFilteredLinks(true))
+		require.ElementsMatch(t, want, got)
+	})
+}
@@ -0,0 +1,70 @@
+package car
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+)
+
+// DefaultUnixFSChunkSize is the default size of the chunks that WriteFile splits a file into.
+const DefaultUnixFSChunkSize = 256 << 10 // 256 KiB
+
+// UnixFSChunkSize sets the size in bytes of the chunks that WriteFile splits a file into, i.e. the
+// maximum size of the leaves of the UnixFS DAG it builds. Sizes that are not positive result in
+// DefaultUnixFSChunkSize being used.
+func UnixFSChunkSize(size int64) Option {
+	return func(o *Options) {
+		o.UnixFSChunkSize = size
+	}
+}
+
+// WriteFile writes a CARv2 to w containing the UnixFS DAG of the file at the given path, and
+// returns the CID of its root, which is also the only root of the CAR.
+//
+// The DAG is built in memory as by go-unixfsnode's builder.BuildUnixFSFile: the file is split into
+// fixed-size chunks, see UnixFSChunkSize, which become raw leaves linked to by a balanced tree of
+// dag-pb nodes, all with CIDv1 and sha2-256 multihashes. Since the entire DAG is held in memory
+// while it is written, this is intended for files of modest size; larger files are best chunked
+// into a blockstore and written via WriteFromBlockstore.
+//
+// The blocks are written in the depth-first order of the DAG, and the index is written according
+// to the given options. See UseIndexCodec, WithoutIndex, UseDataPadding and UseIndexPadding.
+func WriteFile(ctx context.Context, filePath string, w io.Writer, opts ...Option) (cid.Cid, error) {
+	o := ApplyOptions(opts...)
+	chunkSize := o.UnixFSChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultUnixFSChunkSize
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return cid.Undef, err
+	}
+	defer f.Close()
+
+	store := &memstore.Store{}
+	ls := cidlink.DefaultLinkSystem()
+	ls.SetReadStorage(store)
+	ls.SetWriteStorage(store)
+	lnk, _, err := builder.BuildUnixFSFile(f, fmt.Sprintf("size-%d", chunkSize), &ls)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("cannot build UnixFS DAG of %s: %w", filePath, err)
+	}
+	root := lnk.(cidlink.Link).Cid
+
+	sw, err := NewSelectiveWriter(ctx, &ls, root, selectorparse.CommonSelector_ExploreAllRecursively, opts...)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if _, err := sw.WriteTo(w); err != nil {
+		return cid.Undef, err
+	}
+	return root, nil
+}
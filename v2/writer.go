@@ -2,20 +2,1741 @@ package car
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"sort"
 
+	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
 	"github.com/ipld/go-car/v2/index"
 	"github.com/ipld/go-car/v2/internal/carv1"
+	"github.com/ipld/go-car/v2/internal/carv1/util"
 	internalio "github.com/ipld/go-car/v2/internal/io"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/multiformats/go-varint"
 )
 
 // ErrAlreadyV1 signals that the given payload is already in CARv1 format.
 var ErrAlreadyV1 = errors.New("already a CARv1")
 
+var _ format.NodeGetter = (*blockstoreNodeGetter)(nil)
+
+// blockstoreNodeGetter adapts a blockstore.Blockstore to format.NodeGetter.
+// Blocks are decoded into nodes using the decoders registered with go-ipld-format.
+type blockstoreNodeGetter struct {
+	bs blockstore.Blockstore
+}
+
+func (g *blockstoreNodeGetter) Get(ctx context.Context, c cid.Cid) (format.Node, error) {
+	blk, err := g.bs.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return format.Decode(blk)
+}
+
+func (g *blockstoreNodeGetter) GetMany(ctx context.Context, cids []cid.Cid) <-chan *format.NodeOption {
+	// The channel is buffered to fit all results, so there is no need to populate it asynchronously.
+	ch := make(chan *format.NodeOption, len(cids))
+	defer close(ch)
+	for _, c := range cids {
+		nd, err := g.Get(ctx, c)
+		ch <- &format.NodeOption{Node: nd, Err: err}
+	}
+	return ch
+}
+
+var _ format.NodeGetter = (multiNodeGetter)(nil)
+
+type multiNodeGetter []format.NodeGetter
+
+// MultiNodeGetter returns a format.NodeGetter that gets nodes from the given getters, trying each
+// in the given order until the node is found. This allows a CAR to be written from blocks that are
+// spread across several stores, e.g. via WriteV1WithSidecar, without merging the stores first.
+//
+// An error other than format.ErrNotFound from a getter does not prevent the following getters
+// from being tried; it is returned only if none of them has the node. GetMany asks each getter
+// in turn for the nodes that the previous getters did not return. Since the errors reported by
+// GetMany do not necessarily identify a node, the nodes that none of the getters returned are
+// then retried via Get, so that each of them is reported with its own error.
+func MultiNodeGetter(getters ...format.NodeGetter) format.NodeGetter {
+	return multiNodeGetter(getters)
+}
+
+func (m multiNodeGetter) Get(ctx context.Context, c cid.Cid) (format.Node, error) {
+	var firstErr error
+	for _, g := range m {
+		nd, err := g.Get(ctx, c)
+		if err == nil {
+			return nd, nil
+		}
+		if !format.IsNotFound(err) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, format.ErrNotFound{Cid: c}
+}
+
+func (m multiNodeGetter) GetMany(ctx context.Context, cids []cid.Cid) <-chan *format.NodeOption {
+	ch := make(chan *format.NodeOption, len(cids))
+	go func() {
+		defer close(ch)
+		pending := cid.NewSet()
+		for _, c := range cids {
+			pending.Add(c)
+		}
+		for _, g := range m {
+			if pending.Len() == 0 {
+				return
+			}
+			for opt := range g.GetMany(ctx, pending.Keys()) {
+				// Errors are not necessarily attributable to a CID; nodes that are still pending
+				// once all getters are exhausted are looked up individually below.
+				if opt.Err == nil && pending.Has(opt.Node.Cid()) {
+					pending.Remove(opt.Node.Cid())
+					ch <- opt
+				}
+			}
+		}
+		_ = pending.ForEach(func(c cid.Cid) error {
+			nd, err := m.Get(ctx, c)
+			ch <- &format.NodeOption{Node: nd, Err: err}
+			return nil
+		})
+	}()
+	return ch
+}
+
+// countingWriter is an io.Writer that counts the bytes written to it.
+// If w is nil the written bytes are discarded.
+type countingWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.w == nil {
+		cw.n += uint64(len(p))
+		return len(p), nil
+	}
+	n, err := cw.w.Write(p)
+	cw.n += uint64(n)
+	return n, err
+}
+
+// WriteFromBlockstore writes a CARv2 to w containing the DAGs under the given roots, reading the
+// blocks from the given blockstore.
+// The DAGs are walked depth-first, decoding the links of each block using the decoders registered
+// with go-ipld-format, and each block is written once even if it is reachable via multiple paths.
+//
+// Since the CARv2 header must specify the data payload size before the payload is written, the
+// DAGs are walked twice: once to learn the payload size and once to write it.
+// The index is generated from the written payload and is written after it according to the given
+// options. See UseIndexCodec, WithoutIndex, UseDataPadding and UseIndexPadding.
+func WriteFromBlockstore(ctx context.Context, bs blockstore.Blockstore, roots []cid.Cid, w io.Writer, opts ...Option) error {
+	o := ApplyOptions(opts...)
+	if err := checkExternalIndexSort(o); err != nil {
+		return err
+	}
+	ng := &blockstoreNodeGetter{bs: bs}
+
+	// Walk the DAGs once, discarding the output, to learn the data payload size.
+	sizer := &countingWriter{}
+	if err := writeCar(ctx, ng, roots, sizer, o); err != nil {
+		return err
+	}
+
+	h := NewHeader(sizer.n)
+	if p := o.DataPadding; p > 0 {
+		h = h.WithDataPadding(p)
+	}
+	indexPadding := o.indexPaddingAt(h.DataOffset + h.DataSize)
+	if indexPadding > 0 {
+		h = h.WithIndexPadding(indexPadding)
+	}
+	if o.IndexCodec == index.CarIndexNone {
+		h.IndexOffset = 0
+	} else {
+		h.Characteristics.SetAbsoluteIndexOffsets(o.AbsoluteIndexOffsets)
+	}
+	if _, err := w.Write(Pragma); err != nil {
+		return err
+	}
+	if _, err := h.WriteTo(w); err != nil {
+		return err
+	}
+	if o.DataPadding > 0 {
+		if _, err := w.Write(make([]byte, o.DataPadding)); err != nil {
+			return err
+		}
+	}
+
+	payload := &countingWriter{w: w}
+	if o.IndexCodec == index.CarIndexNone {
+		if err := writeCar(ctx, ng, roots, payload, o); err != nil {
+			return err
+		}
+		if payload.n != sizer.n {
+			return ErrSizeMismatch
+		}
+		return nil
+	}
+
+	if o.ExternalIndexSort {
+		sorter := index.NewExternalSorter(o.ExternalIndexSortDir, 0)
+		defer sorter.Close()
+		var delta uint64
+		if o.AbsoluteIndexOffsets {
+			delta = h.DataOffset
+		}
+		if err := writeCarAndIndex(ctx, ng, roots, payload, o, func(r io.Reader) error {
+			return sortIndexRecords(ctx, sorter, r, delta, o)
+		}); err != nil {
+			return err
+		}
+		if payload.n != sizer.n {
+			return ErrSizeMismatch
+		}
+		if indexPadding > 0 {
+			if _, err := w.Write(make([]byte, indexPadding)); err != nil {
+				return err
+			}
+		}
+		_, err := sorter.WriteTo(w)
+		return err
+	}
+
+	idx, err := index.New(o.IndexCodec)
+	if err != nil {
+		return err
+	}
+	if err := writeCarAndIndex(ctx, ng, roots, payload, o, func(r io.Reader) error {
+		return loadIndex(ctx, idx, r, o)
+	}); err != nil {
+		return err
+	}
+	if payload.n != sizer.n {
+		return ErrSizeMismatch
+	}
+
+	if o.AbsoluteIndexOffsets {
+		if idx, err = index.Rebase(idx, int64(h.DataOffset)); err != nil {
+			return err
+		}
+	}
+	if indexPadding > 0 {
+		if _, err := w.Write(make([]byte, indexPadding)); err != nil {
+			return err
+		}
+	}
+	_, err = index.WriteTo(idx, w)
+	return err
+}
+
+// WriteV1WithSidecar writes a CARv1 file at carPath containing the DAGs under the given roots,
+// along with a standalone index of it at indexPath. The paths are overwritten if they exist.
+// Note that the paths might still be created even if an error occurred.
+//
+// The index is generated from the CARv1 payload as it is written, and is encoded according to
+// UseIndexCodec along with its codec as written by index.WriteTo. Therefore, it can be read via
+// index.ReadFrom and used to look up blocks in the CARv1 file, e.g. by passing both to
+// blockstore.NewReadOnly. Since no index is written, WithoutIndex is not supported.
+func WriteV1WithSidecar(ctx context.Context, ng format.NodeGetter, roots []cid.Cid, carPath, indexPath string, opts ...Option) error {
+	o := ApplyOptions(opts...)
+	if o.IndexCodec == index.CarIndexNone {
+		return errors.New("index codec must be specified when writing an index sidecar")
+	}
+	if err := checkExternalIndexSort(o); err != nil {
+		return err
+	}
+	var idx io.WriterTo
+	var load func(io.Reader) error
+	if o.ExternalIndexSort {
+		sorter := index.NewExternalSorter(o.ExternalIndexSortDir, 0)
+		defer sorter.Close()
+		idx = sorter
+		load = func(r io.Reader) error { return sortIndexRecords(ctx, sorter, r, 0, o) }
+	} else {
+		memIdx, err := index.New(o.IndexCodec)
+		if err != nil {
+			return err
+		}
+		idx = indexWriterTo{memIdx}
+		load = func(r io.Reader) error { return loadIndex(ctx, memIdx, r, o) }
+	}
+
+	carFile, err := os.Create(carPath)
+	if err != nil {
+		return err
+	}
+	defer carFile.Close()
+	if err := writeCarAndIndex(ctx, ng, roots, carFile, o, load); err != nil {
+		return err
+	}
+	if err := carFile.Close(); err != nil {
+		return err
+	}
+
+	indexFile, err := os.Create(indexPath)
+	if err != nil {
+		return err
+	}
+	defer indexFile.Close()
+	if _, err := idx.WriteTo(indexFile); err != nil {
+		return err
+	}
+	return indexFile.Close()
+}
+
+// WriteSortedStream writes a CARv2 to w with the given roots, containing the blocks received from
+// sortedBlocks until the channel is closed. The blocks must be sorted by the multihash of their
+// CID in strictly increasing order, i.e. in the order in which indices sort their records; an
+// error is returned as soon as a block is received out of order, leaving any remaining blocks
+// unconsumed.
+//
+// Unlike other write paths, the blocks are written as they are received without walking a DAG
+// and without retaining block data in memory. The index records are added to an
+// index.ExternalSorter as the blocks are written, which spills them to temporary files in the
+// directory set via ExternalIndexSortDir once index.DefaultExternalSortRunSize of them are
+// buffered. Since they are already sorted, the runs are spilled and merged without sorting them,
+// and the memory used to write the index is bounded regardless of the number of blocks. This
+// requires the CarMultihashIndexSorted index codec, which is the default; with other codecs, the
+// records are retained in memory and loaded via index.LoadSorted.
+//
+// Once the data payload is written, the header is re-written with the data payload size, which is
+// why w must be an io.WriteSeeker. The CAR is written starting at the current position of w, and
+// w is left positioned at its end.
+//
+// The index is written according to the given options. See UseIndexCodec, WithoutIndex,
+// UseDataPadding and UseIndexPadding.
+func WriteSortedStream(roots []cid.Cid, sortedBlocks <-chan blocks.Block, w io.WriteSeeker, opts ...Option) error {
+	o := ApplyOptions(opts...)
+	sw, err := newStreamingV2Writer(w, roots, o)
+	if err != nil {
+		return err
+	}
+	sw.sorted = true
+	if o.IndexCodec == multicodec.CarMultihashIndexSorted {
+		sw.sorter = index.NewExternalSorter(o.ExternalIndexSortDir, 0)
+		defer sw.sorter.Close()
+		if o.AbsoluteIndexOffsets {
+			sw.recordDelta = NewHeader(0).WithDataPadding(o.DataPadding).DataOffset
+		}
+	}
+	var prev cid.Cid
+	for b := range sortedBlocks {
+		c := b.Cid()
+		if prev.Defined() && bytes.Compare(prev.Hash(), c.Hash()) >= 0 {
+			return fmt.Errorf("blocks must be sorted by multihash in strictly increasing order; got %s after %s", c, prev)
+		}
+		prev = c
+		if err := sw.put(c, b.RawData()); err != nil {
+			return err
+		}
+	}
+	if err := sw.putTrailers(roots); err != nil {
+		return err
+	}
+	return sw.finish()
+}
+
+// WriteOrdered writes a CARv2 to w with the given roots, containing the blocks of the given CIDs in
+// exactly the given order, each of which is fetched via get. This decouples the layout of a CAR
+// from any traversal of its DAGs, giving full control over the order of blocks, e.g. to experiment
+// with layouts that improve locality for a given access pattern. A CID given more than once is
+// written more than once.
+//
+// An error is returned if get fails for any CID, or returns a block whose multihash differs from
+// the CID it is fetched by; the block is written with the given CID. The blocks are written as
+// described by WriteSortedStream, i.e. without retaining their data in memory, which is why w must
+// be an io.WriteSeeker.
+//
+// The index is written according to the given options. See UseIndexCodec, WithoutIndex,
+// UseDataPadding and UseIndexPadding.
+func WriteOrdered(roots []cid.Cid, orderedCids []cid.Cid, get func(cid.Cid) (blocks.Block, error), w io.WriteSeeker, opts ...Option) error {
+	o := ApplyOptions(opts...)
+	sw, err := newStreamingV2Writer(w, roots, o)
+	if err != nil {
+		return err
+	}
+	for _, c := range orderedCids {
+		b, err := get(c)
+		if err != nil {
+			return fmt.Errorf("cannot get block %s: %w", c, err)
+		}
+		if !bytes.Equal(b.Cid().Hash(), c.Hash()) {
+			return fmt.Errorf("got block %s for %s; multihashes differ", b.Cid(), c)
+		}
+		if err := sw.put(c, b.RawData()); err != nil {
+			return err
+		}
+	}
+	if err := sw.putTrailers(roots); err != nil {
+		return err
+	}
+	return sw.finish()
+}
+
+// streamingV2Writer writes a CARv2 to an io.WriteSeeker as its blocks are put, retaining only the
+// index records in memory, or in sorter if set. A placeholder header is written first, which is
+// re-written with the data payload size once the payload is written.
+type streamingV2Writer struct {
+	w       io.WriteSeeker
+	o       Options
+	start   int64
+	payload *countingWriter
+	records []index.Record
+	// sorted is whether the blocks are put in the order in which indices sort their records, as
+	// WriteSortedStream requires, such that the index is loaded without sorting its records.
+	sorted bool
+	// trailersAt is the number of records of the blocks put before the trailers.
+	trailersAt int
+	// sorter, if set, is added the index records instead of records, with their offsets shifted by
+	// recordDelta; see WriteSortedStream.
+	sorter      *index.ExternalSorter
+	recordDelta uint64
+}
+
+// newStreamingV2Writer writes the placeholder header of a CARv2 with the given roots to w, starting
+// at its current position.
+func newStreamingV2Writer(w io.WriteSeeker, roots []cid.Cid, o Options) (*streamingV2Writer, error) {
+	start, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	// Write a placeholder header, which is re-written once the data payload size is known.
+	if _, err := w.Write(Pragma); err != nil {
+		return nil, err
+	}
+	if _, err := (Header{}).WriteTo(w); err != nil {
+		return nil, err
+	}
+	if o.DataPadding > 0 {
+		if _, err := w.Write(make([]byte, o.DataPadding)); err != nil {
+			return nil, err
+		}
+	}
+
+	payload := &countingWriter{w: w}
+	if err := carv1.WriteHeader(&carv1.CarHeader{Roots: roots, Version: 1}, payload); err != nil {
+		return nil, err
+	}
+	return &streamingV2Writer{w: w, o: o, start: start, payload: payload}, nil
+}
+
+// put writes a section with the given CID and block data to the data payload.
+func (sw *streamingV2Writer) put(c cid.Cid, data []byte) error {
+	if sw.o.IndexCodec != index.CarIndexNone && sw.o.indexes(c) {
+		if uint64(c.ByteLen()) > sw.o.MaxIndexCidSize {
+			return &ErrCidTooLarge{MaxSize: sw.o.MaxIndexCidSize, CurrentSize: uint64(c.ByteLen())}
+		}
+		if sw.sorter != nil {
+			if err := sw.sorter.Add(index.Record{Cid: c, Offset: sw.payload.n + sw.recordDelta}); err != nil {
+				return err
+			}
+		} else {
+			sw.records = append(sw.records, index.Record{Cid: c, Offset: sw.payload.n})
+		}
+	}
+	return util.LdWrite(sw.payload, c.Bytes(), data)
+}
+
+// putTrailers writes the trailers to write according to the options after all the blocks of a CAR
+// with the given roots; see trailers.
+func (sw *streamingV2Writer) putTrailers(roots []cid.Cid) error {
+	ts, err := trailers(roots, sw.o)
+	if err != nil {
+		return err
+	}
+	sw.trailersAt = len(sw.records)
+	for _, t := range ts {
+		if err := sw.put(t.Cid(), t.RawData()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finish writes the index after the data payload and re-writes the header, leaving w positioned at
+// the end of the CARv2.
+func (sw *streamingV2Writer) finish() error {
+	return sw.finishWith(sw.o.DataPadding, sw.payload.n)
+}
+
+// finishWith is finish with the given data padding and data payload size, which differ from those
+// in the options and written so far when the CARv1 header is written last; see DeferredRootsWriter.
+func (sw *streamingV2Writer) finishWith(dataPadding, dataSize uint64) error {
+	o := sw.o
+	h := NewHeader(dataSize)
+	if dataPadding > 0 {
+		h = h.WithDataPadding(dataPadding)
+	}
+	indexPadding := o.indexPaddingAt(h.DataOffset + h.DataSize)
+	if indexPadding > 0 {
+		h = h.WithIndexPadding(indexPadding)
+	}
+	if o.IndexCodec == index.CarIndexNone {
+		h.IndexOffset = 0
+	} else if sw.sorter != nil {
+		h.Characteristics.SetAbsoluteIndexOffsets(o.AbsoluteIndexOffsets)
+		if indexPadding > 0 {
+			if _, err := sw.w.Write(make([]byte, indexPadding)); err != nil {
+				return err
+			}
+		}
+		if _, err := sw.sorter.WriteTo(sw.w); err != nil {
+			return err
+		}
+	} else {
+		idx, err := index.New(o.IndexCodec)
+		if err != nil {
+			return err
+		}
+		if sw.sorted {
+			// Only the records of the trailers, which follow all the blocks, are out of order.
+			insertSorted(sw.records, sw.trailersAt)
+			err = index.LoadSorted(idx, sw.records)
+		} else {
+			err = idx.Load(sw.records)
+		}
+		if err != nil {
+			return err
+		}
+		if o.AbsoluteIndexOffsets {
+			h.Characteristics.SetAbsoluteIndexOffsets(true)
+			if idx, err = index.Rebase(idx, int64(h.DataOffset)); err != nil {
+				return err
+			}
+		}
+		if indexPadding > 0 {
+			if _, err := sw.w.Write(make([]byte, indexPadding)); err != nil {
+				return err
+			}
+		}
+		if _, err := index.WriteTo(idx, sw.w); err != nil {
+			return err
+		}
+	}
+
+	end, err := sw.w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := sw.w.Seek(sw.start+PragmaSize, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := h.WriteTo(sw.w); err != nil {
+		return err
+	}
+	_, err = sw.w.Seek(end, io.SeekStart)
+	return err
+}
+
+// insertSorted moves each of the given records after the first n, which must be sorted by
+// multihash, to its position in that order, such that all the records are sorted.
+func insertSorted(records []index.Record, n int) {
+	for ; n < len(records); n++ {
+		r := records[n]
+		i := sort.Search(n, func(i int) bool {
+			return bytes.Compare(records[i].Cid.Hash(), r.Cid.Hash()) > 0
+		})
+		copy(records[i+1:n+1], records[i:n])
+		records[i] = r
+	}
+}
+
+// DefaultReservedHeaderSize is a reservation for the CARv1 header that is enough for up to five
+// roots that are CIDv1 with SHA2-256 multihash. See NewDeferredRootsWriter.
+const DefaultReservedHeaderSize = 256
+
+var errFinalized = errors.New("cannot use a DeferredRootsWriter after finalizing")
+
+// DeferredRootsWriter writes a CARv2 whose roots are only known once all of its blocks are written,
+// e.g. when building a DAG bottom-up, where the root links to, and therefore depends on the CIDs
+// of, the blocks under it. Blocks are written as they are put, as described by WriteSortedStream,
+// in any order. The roots are set once all blocks are put, via SetRootsAndFinalize.
+//
+// Since the CARv1 header that lists the roots precedes the blocks in the data payload, and its
+// size is not known until the roots are, a fixed amount of space is reserved for it ahead of the
+// blocks. Upon finalization, the header is written such that it ends right where the blocks begin,
+// and the unused remainder of the reserved space becomes part of the data padding of the CARv2.
+// This is why w must be an io.WriteSeeker, and why only CARv2 can be written this way.
+//
+// DeferredRootsWriter is not safe for concurrent use.
+type DeferredRootsWriter struct {
+	sw *streamingV2Writer
+	// reserved is the number of bytes reserved for the CARv1 header.
+	reserved  uint64
+	finalized bool
+}
+
+// NewDeferredRootsWriter instantiates a new DeferredRootsWriter that writes a CARv2 to w, starting
+// at its current position, reserving reservedHeaderSize bytes for the CARv1 header.
+// SetRootsAndFinalize fails if the header with the given roots is larger than the reservation; see
+// DefaultReservedHeaderSize. The data padding set via UseDataPadding, if any, is in addition to
+// the reservation.
+//
+// The index is written according to the given options. See UseIndexCodec, WithoutIndex,
+// UseDataPadding and UseIndexPadding.
+func NewDeferredRootsWriter(w io.WriteSeeker, reservedHeaderSize uint64, opts ...Option) (*DeferredRootsWriter, error) {
+	o := ApplyOptions(opts...)
+	start, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	// Write a placeholder header, followed by the data padding and the space reserved for the CARv1
+	// header, all of which are re-written once the roots are known.
+	if _, err := w.Write(Pragma); err != nil {
+		return nil, err
+	}
+	if _, err := (Header{}).WriteTo(w); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(make([]byte, o.DataPadding+reservedHeaderSize)); err != nil {
+		return nil, err
+	}
+	return &DeferredRootsWriter{
+		sw: &streamingV2Writer{
+			w:       w,
+			o:       o,
+			start:   start,
+			payload: &countingWriter{w: w},
+		},
+		reserved: reservedHeaderSize,
+	}, nil
+}
+
+// Put writes the given block to the data payload.
+func (d *DeferredRootsWriter) Put(b blocks.Block) error {
+	if d.finalized {
+		return errFinalized
+	}
+	return d.sw.put(b.Cid(), b.RawData())
+}
+
+// SetRootsAndFinalize writes the CARv1 header with the given roots into the space reserved for it,
+// followed by the index and the CARv2 header, leaving w positioned at the end of the CARv2.
+// The roots need not be among the blocks put.
+// After this call, the writer can no longer be used.
+func (d *DeferredRootsWriter) SetRootsAndFinalize(roots []cid.Cid) error {
+	if d.finalized {
+		return errFinalized
+	}
+	d.finalized = true
+	sw := d.sw
+	if err := sw.putTrailers(roots); err != nil {
+		return err
+	}
+
+	v1h := &carv1.CarHeader{Roots: roots, Version: 1}
+	headerSize, err := carv1.HeaderSize(v1h)
+	if err != nil {
+		return err
+	}
+	if headerSize > d.reserved {
+		return fmt.Errorf("car header of %d bytes exceeds the %d bytes reserved for it", headerSize, d.reserved)
+	}
+	// The offsets of the blocks put so far are relative to the end of the reserved space, i.e. the
+	// end of the header.
+	for i := range sw.records {
+		sw.records[i].Offset += headerSize
+	}
+
+	end, err := sw.w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	dataPadding := sw.o.DataPadding + d.reserved - headerSize
+	if _, err := sw.w.Seek(sw.start+PragmaSize+HeaderSize+int64(dataPadding), io.SeekStart); err != nil {
+		return err
+	}
+	if err := carv1.WriteHeader(v1h, sw.w); err != nil {
+		return err
+	}
+	if _, err := sw.w.Seek(end, io.SeekStart); err != nil {
+		return err
+	}
+	return sw.finishWith(dataPadding, headerSize+sw.payload.n)
+}
+
+// ShardInfo describes a shard written by WriteToRotating.
+type ShardInfo struct {
+	// Blocks is the number of blocks in the shard, not counting any trailers.
+	Blocks int
+	// DataSize is the size of the data payload of the shard, including its CARv1 header.
+	DataSize uint64
+	// Size is the total size of the shard in bytes, including its CARv2 header and index.
+	Size int64
+}
+
+// WriteToRotating writes the DAGs under the given roots, reading the blocks from the given
+// blockstore, as a sequence of CARv2 shards. The writer of each shard is obtained by calling next
+// with the zero-based index of the shard. A new shard is started whenever writing the next block
+// to the current one would make it exceed maxShardBytes, counting everything written before its
+// index; a block is never split across shards, and a block larger than maxShardBytes is written
+// to a shard on its own. This allows a CAR to be written to rotating files as it is generated,
+// without it ever existing in one place. The written shards are described by the returned
+// ShardInfo, in order.
+//
+// The DAGs are walked once, as described by WriteFromBlockstore, and each block is written once.
+// Each shard is a valid CARv2 with its own header and index, written as described by
+// WriteSortedStream, whose CARv1 header lists all the roots, even though the roots themselves are
+// only written to the shards their blocks fall in. Since the DAGs may span several shards, the
+// shards should be read together to traverse them, e.g. via MultiNodeGetter.
+//
+// Any trailers are written to the last shard only, after its blocks; see EmitRootsTrailer and
+// WithMetadata. They are not counted towards maxShardBytes, such that the last shard may exceed it
+// by their size.
+//
+// The index of each shard is written according to the given options. See UseIndexCodec,
+// WithoutIndex, UseDataPadding and UseIndexPadding.
+func WriteToRotating(ctx context.Context, bs blockstore.Blockstore, roots []cid.Cid, next func(shardIndex int) (io.WriteSeeker, error), maxShardBytes int64, opts ...Option) ([]ShardInfo, error) {
+	o := ApplyOptions(opts...)
+	if maxShardBytes <= 0 {
+		return nil, fmt.Errorf("maximum shard size must be positive; got %d", maxShardBytes)
+	}
+
+	var shards []ShardInfo
+	var sw *streamingV2Writer
+	finish := func() error {
+		if err := sw.finish(); err != nil {
+			return err
+		}
+		end, err := sw.w.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		info := &shards[len(shards)-1]
+		info.DataSize = sw.payload.n
+		info.Size = end - sw.start
+		return nil
+	}
+	rotate := func() error {
+		if sw != nil {
+			if err := finish(); err != nil {
+				return err
+			}
+		}
+		w, err := next(len(shards))
+		if err != nil {
+			return err
+		}
+		if sw, err = newStreamingV2Writer(w, roots, o); err != nil {
+			return err
+		}
+		shards = append(shards, ShardInfo{})
+		return nil
+	}
+	if err := rotate(); err != nil {
+		return nil, err
+	}
+
+	ng := &blockstoreNodeGetter{bs: bs}
+	seen := cid.NewSet()
+	for _, root := range roots {
+		err := merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*format.Link, error) {
+			nd, err := ng.Get(ctx, c)
+			if err != nil {
+				return nil, err
+			}
+			sectionLen := uint64(c.ByteLen() + len(nd.RawData()))
+			sectionLen += uint64(varint.UvarintSize(sectionLen))
+			shardSize := int64(PragmaSize + HeaderSize + o.DataPadding + sw.payload.n + sectionLen)
+			if shards[len(shards)-1].Blocks > 0 && shardSize > maxShardBytes {
+				if err := rotate(); err != nil {
+					return nil, err
+				}
+			}
+			if err := sw.put(c, nd.RawData()); err != nil {
+				return nil, err
+			}
+			shards[len(shards)-1].Blocks++
+			return nd.Links(), nil
+		}, root, seen.Visit)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := sw.putTrailers(roots); err != nil {
+		return nil, err
+	}
+	if err := finish(); err != nil {
+		return nil, err
+	}
+	return shards, nil
+}
+
+// SingleBlockCar writes to w a CARv1 containing only the given block, which is also its sole root.
+// The block is written as is, i.e. its CID is not verified against its data.
+//
+// Note that the CARv1 header must have at least one root to be readable via this module; therefore
+// the block is always set as the root.
+func SingleBlockCar(block blocks.Block, w io.Writer) error {
+	if err := carv1.WriteHeader(&carv1.CarHeader{Roots: []cid.Cid{block.Cid()}, Version: 1}, w); err != nil {
+		return err
+	}
+	return util.LdWrite(w, block.Cid().Bytes(), block.RawData())
+}
+
+// WriteDeterministic writes a CARv2 to w containing the DAGs under the given roots, reading the
+// blocks from the given blockstore, such that the output is a pure function of the roots and the
+// set of blocks reachable from them: writing the same DAGs always produces byte-identical output,
+// regardless of the blockstore implementation or the order in which links are walked.
+//
+// To that end, each reachable block is written once in ascending order of its CID bytes, rather
+// than in walk order. The roots are written to the CARv1 header in the given order. No padding is
+// used before the data payload or the index, and the index is a MultihashIndexSorted, which sorts
+// its records independently of insertion order.
+//
+// The DAGs are walked as described by SubgraphSize to collect the CIDs and sizes of the reachable
+// blocks, after which the blocks are read again from the blockstore to be written.
+func WriteDeterministic(ctx context.Context, bs blockstore.Blockstore, roots []cid.Cid, w io.Writer) error {
+	sizes := make(map[string]int)
+	var cids []cid.Cid
+	for _, root := range roots {
+		err := walkSubgraph(ctx, bs, root, func(c cid.Cid, size int) error {
+			if _, ok := sizes[c.KeyString()]; !ok {
+				sizes[c.KeyString()] = size
+				cids = append(cids, c)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	sort.Slice(cids, func(i, j int) bool { return cids[i].KeyString() < cids[j].KeyString() })
+
+	v1Header := &carv1.CarHeader{Roots: roots, Version: 1}
+	dataSize, err := carv1.HeaderSize(v1Header)
+	if err != nil {
+		return err
+	}
+	for _, c := range cids {
+		sectionLen := uint64(c.ByteLen() + sizes[c.KeyString()])
+		dataSize += uint64(varint.UvarintSize(sectionLen)) + sectionLen
+	}
+
+	if _, err := w.Write(Pragma); err != nil {
+		return err
+	}
+	if _, err := NewHeader(dataSize).WriteTo(w); err != nil {
+		return err
+	}
+	payload := &countingWriter{w: w}
+	if err := carv1.WriteHeader(v1Header, payload); err != nil {
+		return err
+	}
+	records := make([]index.Record, 0, len(cids))
+	for _, c := range cids {
+		blk, err := bs.Get(ctx, c)
+		if err != nil {
+			return err
+		}
+		if len(blk.RawData()) != sizes[c.KeyString()] {
+			return ErrSizeMismatch
+		}
+		if c.Prefix().MhType != multihash.IDENTITY {
+			records = append(records, index.Record{Cid: c, Offset: payload.n})
+		}
+		if err := util.LdWrite(payload, c.Bytes(), blk.RawData()); err != nil {
+			return err
+		}
+	}
+	if payload.n != dataSize {
+		return ErrSizeMismatch
+	}
+
+	idx := index.NewMultihashSorted()
+	if err := idx.Load(records); err != nil {
+		return err
+	}
+	_, err = index.WriteTo(idx, w)
+	return err
+}
+
+// writeCar writes a CARv1 containing the DAGs under the given roots to w, followed by the trailers
+// to write according to the given options; see trailers. Blocks are written in post-order if PostOrderWalk is
+// enabled, and grouped by codec if GroupByCodec is enabled. At most MaxBlocks blocks are written,
+// if set.
+func writeCar(ctx context.Context, ng format.NodeGetter, roots []cid.Cid, w io.Writer, o Options) error {
+	var err error
+	switch {
+	case o.GroupByCodec:
+		err = writeCarGroupedByCodec(ctx, ng, roots, w, o.PostOrderWalk, o.MaxBlocks)
+	case o.PostOrderWalk || o.MaxBlocks > 0:
+		err = writeCarWalked(ctx, ng, roots, w, o.PostOrderWalk, o.MaxBlocks)
+	default:
+		err = carv1.WriteCar(ctx, ng, roots, w)
+	}
+	if err != nil {
+		return err
+	}
+	ts, err := trailers(roots, o)
+	if err != nil {
+		return err
+	}
+	for _, t := range ts {
+		if err := util.LdWrite(w, t.Cid().Bytes(), t.RawData()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCarWalked writes a CARv1 containing the DAGs under the given roots to w, like
+// carv1.WriteCar, except that the DAGs are walked in post-order if postOrder is true: each block
+// is written after all the blocks it links to. Each block is written once, when it is first
+// reached, and the walk stops once maxBlocks blocks are written unless it is zero or negative.
+func writeCarWalked(ctx context.Context, ng format.NodeGetter, roots []cid.Cid, w io.Writer, postOrder bool, maxBlocks int) error {
+	if err := carv1.WriteHeader(&carv1.CarHeader{Roots: roots, Version: 1}, w); err != nil {
+		return fmt.Errorf("failed to write car header: %s", err)
+	}
+	return walkDAGUpTo(ctx, ng, roots, postOrder, maxBlocks, func(nd format.Node) error {
+		return util.LdWrite(w, nd.Cid().Bytes(), nd.RawData())
+	})
+}
+
+// writeCarGroupedByCodec writes a CARv1 containing the DAGs under the given roots to w, with the
+// blocks of each codec written contiguously. The groups are written in the order in which their
+// codec is first reached, and the blocks within each group in the order in which they are reached,
+// walking the DAGs in pre-order or, if postOrder is true, in post-order. Only the first maxBlocks
+// blocks reached are written, unless it is zero or negative.
+//
+// Only the CIDs of the blocks are held in memory between the walk and writing the groups; the
+// blocks are then fetched again from ng.
+func writeCarGroupedByCodec(ctx context.Context, ng format.NodeGetter, roots []cid.Cid, w io.Writer, postOrder bool, maxBlocks int) error {
+	var codecs []uint64
+	groups := make(map[uint64][]cid.Cid)
+	if err := walkDAGUpTo(ctx, ng, roots, postOrder, maxBlocks, func(nd format.Node) error {
+		codec := nd.Cid().Prefix().Codec
+		if _, ok := groups[codec]; !ok {
+			codecs = append(codecs, codec)
+		}
+		groups[codec] = append(groups[codec], nd.Cid())
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := carv1.WriteHeader(&carv1.CarHeader{Roots: roots, Version: 1}, w); err != nil {
+		return fmt.Errorf("failed to write car header: %s", err)
+	}
+	for _, codec := range codecs {
+		for _, c := range groups[codec] {
+			nd, err := ng.Get(ctx, c)
+			if err != nil {
+				return err
+			}
+			if err := util.LdWrite(w, nd.Cid().Bytes(), nd.RawData()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// errMaxBlocksReached stops walkDAG once the maximum number of blocks is reached.
+// See walkDAGUpTo.
+var errMaxBlocksReached = errors.New("maximum number of blocks reached")
+
+// walkDAGUpTo walks the DAGs as described by walkDAG, except that the walk stops once fn has been
+// called with maxBlocks blocks, unless maxBlocks is zero or negative.
+func walkDAGUpTo(ctx context.Context, ng format.NodeGetter, roots []cid.Cid, postOrder bool, maxBlocks int, fn func(format.Node) error) error {
+	if maxBlocks <= 0 {
+		return walkDAG(ctx, ng, roots, postOrder, fn)
+	}
+	var n int
+	err := walkDAG(ctx, ng, roots, postOrder, func(nd format.Node) error {
+		if err := fn(nd); err != nil {
+			return err
+		}
+		if n++; n == maxBlocks {
+			return errMaxBlocksReached
+		}
+		return nil
+	})
+	if err == errMaxBlocksReached {
+		return nil
+	}
+	return err
+}
+
+// walkDAG walks the DAGs under the given roots depth-first, calling fn once with each block
+// reachable from them, the first time it is reached. If postOrder is false, fn is called with a
+// block before the blocks it links to, in the same order as carv1.WriteCar writes them; otherwise,
+// it is called after them.
+func walkDAG(ctx context.Context, ng format.NodeGetter, roots []cid.Cid, postOrder bool, fn func(format.Node) error) error {
+	// Walk iteratively rather than recursively, so that deep DAGs do not exhaust the stack.
+	type frame struct {
+		nd   format.Node
+		next int
+	}
+	seen := cid.NewSet()
+	var stack []frame
+	visit := func(c cid.Cid) error {
+		if !seen.Visit(c) {
+			return nil
+		}
+		nd, err := ng.Get(ctx, c)
+		if err != nil {
+			return err
+		}
+		if !postOrder {
+			if err := fn(nd); err != nil {
+				return err
+			}
+		}
+		stack = append(stack, frame{nd: nd})
+		return nil
+	}
+	for _, r := range roots {
+		if err := visit(r); err != nil {
+			return err
+		}
+		for len(stack) > 0 {
+			top := &stack[len(stack)-1]
+			if links := top.nd.Links(); top.next < len(links) {
+				top.next++
+				if err := visit(links[top.next-1].Cid); err != nil {
+					return err
+				}
+				continue
+			}
+			if postOrder {
+				if err := fn(top.nd); err != nil {
+					return err
+				}
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	return nil
+}
+
+// rootsTrailer returns the block of the roots trailer listing the given roots.
+// See EmitRootsTrailer.
+func rootsTrailer(roots []cid.Cid) (blocks.Block, error) {
+	data, err := cbor.DumpObject(&carv1.CarHeader{Roots: roots, Version: 1})
+	if err != nil {
+		return nil, err
+	}
+	c, err := rootsTrailerPrefix.Sum(data)
+	if err != nil {
+		return nil, err
+	}
+	return blocks.NewBlockWithCid(data, c)
+}
+
+// trailers returns the blocks of the trailers to write after all the blocks of a CAR with the given
+// roots, i.e. a metadata trailer if WithMetadata is set, followed by a roots trailer if
+// EmitRootsTrailer is enabled.
+func trailers(roots []cid.Cid, o Options) ([]blocks.Block, error) {
+	var ts []blocks.Block
+	if len(o.Metadata) != 0 {
+		t, err := metadataTrailer(o.Metadata)
+		if err != nil {
+			return nil, err
+		}
+		ts = append(ts, t)
+	}
+	if o.EmitRootsTrailer {
+		t, err := rootsTrailer(roots)
+		if err != nil {
+			return nil, err
+		}
+		ts = append(ts, t)
+	}
+	return ts, nil
+}
+
+// metadataTrailerKey is the key of the metadata in the data of metadata trailer blocks.
+// See WithMetadata.
+const metadataTrailerKey = "carMetadata"
+
+// metadataTrailer returns the block of the metadata trailer holding the given metadata.
+// See WithMetadata.
+func metadataTrailer(md map[string]string) (blocks.Block, error) {
+	data, err := cbor.DumpObject(map[string]map[string]string{metadataTrailerKey: md})
+	if err != nil {
+		return nil, err
+	}
+	c, err := rootsTrailerPrefix.Sum(data)
+	if err != nil {
+		return nil, err
+	}
+	return blocks.NewBlockWithCid(data, c)
+}
+
+// readMetadataTrailer returns the metadata held by the last metadata trailer in the CAR read from
+// r, or nil if there is none. Like Reader.Inspect does to find the trailers, the sections are
+// skipped through, reading only their CIDs and the data of the sections with the codec of trailer
+// blocks.
+func readMetadataTrailer(r io.ReaderAt, o Options) (map[string]string, error) {
+	rs, err := internalio.NewOffsetReadSeeker(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	var md map[string]string
+	var trailerErr error
+	o.IndexIncludeFilter = func(cid.Cid) bool { return false }
+	o.HeaderBlockMatcher = isTrailer
+	o.OnHeaderBlock = func(c cid.Cid, data []byte) {
+		if trailerErr != nil {
+			return
+		}
+		if hashed, err := c.Prefix().Sum(data); err != nil {
+			trailerErr = err
+		} else if !hashed.Equals(c) {
+			trailerErr = fmt.Errorf("mismatch in content integrity, expected: %s, got: %s", c, hashed)
+		} else if got, ok := decodeMetadataTrailer(data); ok {
+			md = got
+		}
+	}
+	if err := forEachIndexRecord(context.Background(), rs, 0, o, func(index.Record) error { return nil }); err != nil {
+		return nil, fmt.Errorf("failed to read metadata trailer: %w", err)
+	}
+	if trailerErr != nil {
+		return nil, trailerErr
+	}
+	return md, nil
+}
+
+// decodeMetadataTrailer returns the metadata held by the given block data, and whether it is the
+// data of a metadata trailer. The block must have the codec of trailer blocks.
+func decodeMetadataTrailer(data []byte) (map[string]string, bool) {
+	var trailer map[string]map[string]string
+	if err := cbor.DecodeInto(data, &trailer); err != nil || len(trailer) != 1 {
+		return nil, false
+	}
+	md, ok := trailer[metadataTrailerKey]
+	return md, ok
+}
+
+// rootsTrailerPrefix is the CID prefix of trailer blocks, i.e. of roots and metadata trailers.
+var rootsTrailerPrefix = cid.Prefix{
+	Version:  1,
+	Codec:    uint64(multicodec.Car),
+	MhType:   multihash.SHA2_256,
+	MhLength: -1,
+}
+
+// isTrailer returns whether the given CID has the codec of trailer blocks. Trailers have no links,
+// and there is no go-ipld-format decoder for their codec.
+func isTrailer(c cid.Cid) bool {
+	return c.Prefix().Codec == rootsTrailerPrefix.Codec
+}
+
+// writeCarAndIndex writes a CARv1 containing the DAGs under the given roots to w as described by
+// writeCar, and calls load with a reader of the written payload, e.g. to load an index with its
+// records. The payload is teed into load as it is written, so that the index is generated in the
+// same pass without having to re-read the payload.
+func writeCarAndIndex(ctx context.Context, ng format.NodeGetter, roots []cid.Cid, w io.Writer, o Options, load func(io.Reader) error) error {
+	pr, pw := io.Pipe()
+	idxErr := make(chan error, 1)
+	go func() {
+		err := load(pr)
+		// Unblock the writer if index loading stopped before consuming the whole payload.
+		pr.CloseWithError(err)
+		idxErr <- err
+	}()
+	err := writeCar(ctx, ng, roots, io.MultiWriter(w, pw), o)
+	pw.CloseWithError(err)
+	if lerr := <-idxErr; err == nil {
+		err = lerr
+	}
+	return err
+}
+
+// checkExternalIndexSort checks that the given options are supported when ExternalIndexSort is
+// enabled.
+func checkExternalIndexSort(o Options) error {
+	if !o.ExternalIndexSort || o.IndexCodec == index.CarIndexNone || o.IndexCodec == multicodec.CarMultihashIndexSorted {
+		return nil
+	}
+	return fmt.Errorf("external index sort requires %v index codec; got %v", multicodec.CarMultihashIndexSorted, o.IndexCodec)
+}
+
+// sortIndexRecords adds the index records of the CAR read from r to sorter, with their offsets
+// shifted by delta.
+func sortIndexRecords(ctx context.Context, sorter *index.ExternalSorter, r io.Reader, delta uint64, o Options) error {
+	return forEachIndexRecord(ctx, r, 0, o, func(rec index.Record) error {
+		rec.Offset += delta
+		return sorter.Add(rec)
+	})
+}
+
+// indexWriterTo writes an index along with its codec via index.WriteTo.
+type indexWriterTo struct {
+	index.Index
+}
+
+func (w indexWriterTo) WriteTo(dst io.Writer) (int64, error) {
+	n, err := index.WriteTo(w.Index, dst)
+	return int64(n), err
+}
+
+// SubgraphSize walks the DAG under the given root, reading blocks from the given blockstore, and
+// returns the number of unique blocks in it along with the sum of their sizes in bytes.
+// Blocks reachable via multiple paths are only counted once.
+//
+// Blocks with the raw codec cannot have links and are therefore sized via Blockstore.GetSize
+// without reading their data. All other blocks are decoded using the decoders registered with
+// go-ipld-format in order to discover their links.
+//
+// Note that the returned size only accounts for block data. See WriteFromBlockstore for writing
+// the DAG as a CAR.
+func SubgraphSize(ctx context.Context, bs blockstore.Blockstore, root cid.Cid) (blocks int, size uint64, err error) {
+	err = walkSubgraph(ctx, bs, root, func(_ cid.Cid, s int) error {
+		blocks++
+		size += uint64(s)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return blocks, size, nil
+}
+
+// VerifyExact checks that the given blockstore contains exactly the blocks of a complete DAG under
+// the given root: every block reachable from the root must be present, and every block present
+// must be reachable from the root. This is useful for checking that a CAR, e.g. opened as a
+// blockstore via blockstore.OpenReadOnly, holds a single canonical DAG and nothing else.
+//
+// Blocks are compared by multihash, since blockstores may list their keys with a codec other than
+// the one used by the links to them. Blocks with multihash.IDENTITY code are ignored, since their
+// data is inlined in their CID.
+//
+// The DAG is walked as described by SubgraphSize.
+func VerifyExact(ctx context.Context, bs blockstore.Blockstore, root cid.Cid) error {
+	reached := make(map[string]struct{})
+	err := walkSubgraph(ctx, bs, root, func(c cid.Cid, _ int) error {
+		if c.Prefix().MhType != multihash.IDENTITY {
+			reached[string(c.Hash())] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("incomplete DAG under root %s: %w", root, err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	keys, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]struct{}, len(reached))
+	for c := range keys {
+		if c.Prefix().MhType == multihash.IDENTITY {
+			continue
+		}
+		if _, ok := reached[string(c.Hash())]; !ok {
+			return fmt.Errorf("block %s is not reachable from root %s", c, root)
+		}
+		listed[string(c.Hash())] = struct{}{}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// AllKeysChan may stop early without an error; make sure every reached block was listed.
+	if len(listed) != len(reached) {
+		return fmt.Errorf("expected %d blocks under root %s; listed %d", len(reached), root, len(listed))
+	}
+	return nil
+}
+
+// OrderKind is an order in which the blocks of a DAG may be laid out in a CAR.
+// See VerifyOrder.
+type OrderKind int
+
+const (
+	// PreOrder is the order in which each block precedes the blocks it links to, as written by
+	// default; see carv1.WriteCar.
+	PreOrder OrderKind = iota
+	// PostOrder is the order in which each block follows the blocks it links to, as written when
+	// PostOrderWalk is enabled.
+	PostOrder
+)
+
+// VerifyOrder checks that the blocks of the DAG under the given root are listed by the given
+// blockstore in the given order, i.e. in the order in which a depth-first walk of the DAG in
+// pre-order or post-order first reaches them. The blocks are listed via Blockstore.AllKeysChan,
+// which for a blockstore.ReadOnly is the order of the sections in the data payload of the CAR.
+// This lets consumers that rely on a layout, e.g. to stream a DAG without buffering, reject CARs
+// that do not meet it.
+//
+// Blocks are compared by multihash, as VerifyExact does, and only the first occurrence of each
+// block is considered. Blocks that are not reachable from the root, and blocks with
+// multihash.IDENTITY code, are ignored. The DAG is walked as described by WriteFromBlockstore, and
+// every block reachable from the root must be present.
+//
+// The first block listed out of order is reported as an ErrOutOfOrder, along with the block
+// expected in its place.
+func VerifyOrder(ctx context.Context, bs blockstore.Blockstore, root cid.Cid, order OrderKind) error {
+	if order != PreOrder && order != PostOrder {
+		return fmt.Errorf("unknown order kind: %d", order)
+	}
+	var want []cid.Cid
+	reached := make(map[string]struct{})
+	err := walkDAG(ctx, &blockstoreNodeGetter{bs: bs}, []cid.Cid{root}, order == PostOrder, func(nd format.Node) error {
+		c := nd.Cid()
+		if _, ok := reached[string(c.Hash())]; ok || c.Prefix().MhType == multihash.IDENTITY {
+			return nil
+		}
+		reached[string(c.Hash())] = struct{}{}
+		want = append(want, c)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("incomplete DAG under root %s: %w", root, err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	keys, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]struct{}, len(want))
+	for c := range keys {
+		if _, ok := reached[string(c.Hash())]; !ok {
+			continue
+		}
+		if _, ok := listed[string(c.Hash())]; ok {
+			continue
+		}
+		if next := want[len(listed)]; !bytes.Equal(next.Hash(), c.Hash()) {
+			return &ErrOutOfOrder{Expected: next, Got: c}
+		}
+		listed[string(c.Hash())] = struct{}{}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// AllKeysChan may stop early without an error; make sure every reached block was listed.
+	if len(listed) != len(want) {
+		return fmt.Errorf("expected %d blocks under root %s; listed %d", len(want), root, len(listed))
+	}
+	return nil
+}
+
+// Orphans returns the CIDs of the blocks in the given blockstore that are not reachable from any of
+// the given roots, in the order in which they are listed by Blockstore.AllKeysChan. These are the
+// blocks that Prune would remove from a CAR opened as a blockstore, e.g. via
+// blockstore.OpenReadOnly, which makes Orphans suitable for reporting on a CAR before pruning it.
+//
+// Blocks are compared by multihash, as VerifyExact does, and blocks with multihash.IDENTITY code are
+// never orphans. Unlike VerifyExact, links to blocks that are not present in the blockstore are not
+// followed, since a CAR may hold a partial DAG. Otherwise, the DAGs are walked as described by
+// SubgraphSize, except that raw blocks are not read at all.
+func Orphans(ctx context.Context, bs blockstore.Blockstore, roots []cid.Cid) ([]cid.Cid, error) {
+	ng := &blockstoreNodeGetter{bs: bs}
+	reached := make(map[string]struct{})
+	stack := append([]cid.Cid{}, roots...)
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if _, ok := reached[string(c.Hash())]; ok {
+			continue
+		}
+		reached[string(c.Hash())] = struct{}{}
+		if c.Prefix().Codec == cid.Raw {
+			continue
+		}
+		nd, err := ng.Get(ctx, c)
+		if format.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range nd.Links() {
+			stack = append(stack, l.Cid)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	keys, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var orphans []cid.Cid
+	for c := range keys {
+		if c.Prefix().MhType == multihash.IDENTITY {
+			continue
+		}
+		if _, ok := reached[string(c.Hash())]; !ok {
+			orphans = append(orphans, c)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return orphans, nil
+}
+
+// InferRoots returns the CIDs of the blocks in the given blockstore that are not linked to by any
+// other block in it, i.e. the roots of the DAGs it holds, in the order in which they are listed by
+// Blockstore.AllKeysChan. This allows the roots declared by the producer of a CAR to be validated,
+// and a CAR with no declared roots to be repaired, e.g. via ReplaceRootsInFile.
+//
+// Every block is read in order to discover its links, as described by VerifyStreaming, and blocks
+// are compared by multihash. Blocks with multihash.IDENTITY code are never roots, since their data
+// is inlined in the CIDs that link to them, and neither are trailers; see EmitRootsTrailer and
+// WithMetadata. Note that no roots are found for blocks that only form
+// cycles, since every such block is linked to.
+//
+// Since the codec of each block is needed to decode its links, the blockstore must list whole
+// CIDs, such as a blockstore.ReadOnly with UseWholeCIDs enabled. Blockstores that list keys with
+// the raw codec, as many do, would have every block treated as if it had no links.
+func InferRoots(ctx context.Context, bs blockstore.Blockstore) ([]cid.Cid, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	keys, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []cid.Cid
+	linked := make(map[string]struct{})
+	for c := range keys {
+		if c.Prefix().MhType == multihash.IDENTITY || isTrailer(c) {
+			continue
+		}
+		candidates = append(candidates, c)
+		if c.Prefix().Codec == cid.Raw {
+			continue
+		}
+		blk, err := bs.Get(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		links, err := blockLinks(blk)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range links {
+			linked[string(l.Hash())] = struct{}{}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var roots []cid.Cid
+	for _, c := range candidates {
+		if _, ok := linked[string(c.Hash())]; !ok {
+			roots = append(roots, c)
+		}
+	}
+	return roots, nil
+}
+
+// Prune writes to dst a CARv2 containing only the blocks of the CAR read from src that are
+// reachable from its roots, and returns the number of blocks pruned along with the sum of their
+// sizes in bytes. Either CARv1 or CARv2 is accepted as src. This produces a minimal CAR, e.g. from
+// one that carries extra blocks; see VerifyExact for detecting such blocks instead.
+//
+// The data payload of src is read twice: once to discover the links of each block and the size of
+// the output, and once to write the reachable blocks in the order in which they appear in src.
+// Blocks are deduplicated by multihash, keeping the first occurrence, such that duplicates count
+// towards the pruned blocks. Links to blocks that are not present in src are not followed, since a
+// CAR may hold a partial DAG. Links are discovered as described by VerifyStreaming, and the pruned
+// size only accounts for block data. Trailers are not reachable from the roots, and are therefore
+// pruned; see EmitRootsTrailer and WithMetadata.
+//
+// The index of dst is generated from the written payload according to the given options.
+// See UseIndexCodec, WithoutIndex, UseDataPadding and UseIndexPadding.
+func Prune(src io.ReaderAt, dst io.Writer, opts ...Option) (prunedBlocks int, prunedBytes uint64, err error) {
+	o := ApplyOptions(opts...)
+	type section struct {
+		links []cid.Cid
+		size  uint64
+	}
+	newBlockReader := func() (*BlockReader, error) {
+		return NewBlockReader(io.NewSectionReader(src, 0, math.MaxInt64), opts...)
+	}
+
+	// Discover the links and section size of the first occurrence of every block.
+	br, err := newBlockReader()
+	if err != nil {
+		return 0, 0, err
+	}
+	roots := br.Roots
+	sections := make(map[string]section)
+	var total int
+	var totalBytes uint64
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		total++
+		totalBytes += uint64(len(blk.RawData()))
+		if _, ok := sections[string(blk.Cid().Hash())]; ok {
+			continue
+		}
+		links, err := blockLinks(blk)
+		if err != nil {
+			return 0, 0, err
+		}
+		size := uint64(blk.Cid().ByteLen() + len(blk.RawData()))
+		sections[string(blk.Cid().Hash())] = section{links: links, size: size}
+	}
+
+	// Walk the DAGs under the roots to find the blocks to keep and the resulting payload size.
+	reachable := make(map[string]struct{})
+	v1h := &carv1.CarHeader{Roots: roots, Version: 1}
+	dataSize, err := carv1.HeaderSize(v1h)
+	if err != nil {
+		return 0, 0, err
+	}
+	stack := append([]cid.Cid{}, roots...)
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		s, ok := sections[string(c.Hash())]
+		if !ok {
+			continue
+		}
+		if _, ok := reachable[string(c.Hash())]; ok {
+			continue
+		}
+		reachable[string(c.Hash())] = struct{}{}
+		dataSize += uint64(varint.UvarintSize(s.size)) + s.size
+		stack = append(stack, s.links...)
+	}
+
+	kept, keptBytes, err := writeSelectedSections(newBlockReader, dst, v1h, reachable, dataSize, o)
+	if err != nil {
+		return 0, 0, err
+	}
+	return total - kept, totalBytes - keptBytes, nil
+}
+
+// Delta writes to out a CARv2 containing the blocks of the CAR read from target that are not
+// present in the CAR read from base, with the roots of target. Either CARv1 or CARv2 is accepted
+// as base and target. This allows a CAR to be synced incrementally: the receiver of the delta
+// reconstructs target by merging the blocks of the delta into its copy of base.
+//
+// Blocks are matched by multihash, as indices do, and the first occurrence of each block of target
+// is written in the order in which they appear in target. The roots of target are written as is,
+// regardless of whether the root blocks are present in the delta; they are absent if base holds
+// them, e.g. when target only adds blocks to the DAGs of base, whereas an empty delta is written
+// if base holds every block of target. Similarly, base and target need not share any roots.
+//
+// The multihashes of the blocks of base are held in memory, and the data payload of target is read
+// twice: once to find the blocks of the delta and the size of the output, and once to write them.
+// The index of out is generated from the written payload according to the given options.
+// See UseIndexCodec, WithoutIndex, UseDataPadding and UseIndexPadding.
+func Delta(base, target io.ReaderAt, out io.Writer, opts ...Option) error {
+	o := ApplyOptions(opts...)
+
+	// Collect the multihashes of the blocks of base.
+	br, err := NewBlockReader(io.NewSectionReader(base, 0, math.MaxInt64), opts...)
+	if err != nil {
+		return err
+	}
+	inBase := make(map[string]struct{})
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		inBase[string(blk.Cid().Hash())] = struct{}{}
+	}
+
+	// Find the blocks of target that are not in base, along with the resulting payload size.
+	newBlockReader := func() (*BlockReader, error) {
+		return NewBlockReader(io.NewSectionReader(target, 0, math.MaxInt64), opts...)
+	}
+	br, err = newBlockReader()
+	if err != nil {
+		return err
+	}
+	v1h := &carv1.CarHeader{Roots: br.Roots, Version: 1}
+	dataSize, err := carv1.HeaderSize(v1h)
+	if err != nil {
+		return err
+	}
+	delta := make(map[string]struct{})
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		key := string(blk.Cid().Hash())
+		if _, ok := inBase[key]; ok {
+			continue
+		}
+		if _, ok := delta[key]; ok {
+			continue
+		}
+		delta[key] = struct{}{}
+		size := uint64(blk.Cid().ByteLen() + len(blk.RawData()))
+		dataSize += uint64(varint.UvarintSize(size)) + size
+	}
+
+	_, _, err = writeSelectedSections(newBlockReader, out, v1h, delta, dataSize, o)
+	return err
+}
+
+// writeSelectedSections writes to dst a CARv2 with the given CARv1 header, containing the first
+// occurrence of every block read via newBlockReader whose multihash is in selected, in the order
+// in which they appear. The given dataSize must be the size of the resulting data payload, and
+// selected is emptied as the blocks are written. The index is generated according to the given
+// options. It returns the number of blocks written along with the sum of their sizes in bytes.
+func writeSelectedSections(newBlockReader func() (*BlockReader, error), dst io.Writer, v1h *carv1.CarHeader, selected map[string]struct{}, dataSize uint64, o Options) (int, uint64, error) {
+	h := NewHeader(dataSize)
+	if p := o.DataPadding; p > 0 {
+		h = h.WithDataPadding(p)
+	}
+	indexPadding := o.indexPaddingAt(h.DataOffset + h.DataSize)
+	if indexPadding > 0 {
+		h = h.WithIndexPadding(indexPadding)
+	}
+	if o.IndexCodec == index.CarIndexNone {
+		h.IndexOffset = 0
+	} else {
+		h.Characteristics.SetAbsoluteIndexOffsets(o.AbsoluteIndexOffsets)
+	}
+	if _, err := dst.Write(Pragma); err != nil {
+		return 0, 0, err
+	}
+	if _, err := h.WriteTo(dst); err != nil {
+		return 0, 0, err
+	}
+	if o.DataPadding > 0 {
+		if _, err := dst.Write(make([]byte, o.DataPadding)); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	// Write the first occurrence of every selected block, in the order in which they appear.
+	br, err := newBlockReader()
+	if err != nil {
+		return 0, 0, err
+	}
+	payload := &countingWriter{w: dst}
+	if err := carv1.WriteHeader(v1h, payload); err != nil {
+		return 0, 0, err
+	}
+	var records []index.Record
+	var kept int
+	var keptBytes uint64
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		c := blk.Cid()
+		if _, ok := selected[string(c.Hash())]; !ok {
+			continue
+		}
+		delete(selected, string(c.Hash()))
+		if o.IndexCodec != index.CarIndexNone && o.indexes(c) {
+			if uint64(c.ByteLen()) > o.MaxIndexCidSize {
+				return 0, 0, &ErrCidTooLarge{MaxSize: o.MaxIndexCidSize, CurrentSize: uint64(c.ByteLen())}
+			}
+			records = append(records, index.Record{Cid: c, Offset: payload.n})
+		}
+		if err := util.LdWrite(payload, c.Bytes(), blk.RawData()); err != nil {
+			return 0, 0, err
+		}
+		kept++
+		keptBytes += uint64(len(blk.RawData()))
+	}
+	if payload.n != dataSize {
+		return 0, 0, ErrSizeMismatch
+	}
+
+	if o.IndexCodec != index.CarIndexNone {
+		idx, err := index.New(o.IndexCodec)
+		if err != nil {
+			return 0, 0, err
+		}
+		if err := idx.Load(records); err != nil {
+			return 0, 0, err
+		}
+		if o.AbsoluteIndexOffsets {
+			if idx, err = index.Rebase(idx, int64(h.DataOffset)); err != nil {
+				return 0, 0, err
+			}
+		}
+		if indexPadding > 0 {
+			if _, err := dst.Write(make([]byte, indexPadding)); err != nil {
+				return 0, 0, err
+			}
+		}
+		if _, err := index.WriteTo(idx, dst); err != nil {
+			return 0, 0, err
+		}
+	}
+	return kept, keptBytes, nil
+}
+
+// walkSubgraph walks the DAG under the given root depth-first, calling fn once with the CID and
+// size of each unique block reachable from it, including the root.
+func walkSubgraph(ctx context.Context, bs blockstore.Blockstore, root cid.Cid, fn func(cid.Cid, int) error) error {
+	ng := &blockstoreNodeGetter{bs: bs}
+	seen := cid.NewSet()
+	stack := []cid.Cid{root}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if !seen.Visit(c) {
+			continue
+		}
+		if c.Prefix().Codec == cid.Raw {
+			s, err := bs.GetSize(ctx, c)
+			if err != nil {
+				return err
+			}
+			if err := fn(c, s); err != nil {
+				return err
+			}
+			continue
+		}
+		nd, err := ng.Get(ctx, c)
+		if err != nil {
+			return err
+		}
+		if err := fn(c, len(nd.RawData())); err != nil {
+			return err
+		}
+		for _, l := range nd.Links() {
+			stack = append(stack, l.Cid)
+		}
+	}
+	return nil
+}
+
 // WrapV1File is a wrapper around WrapV1 that takes filesystem paths.
 // The source path is assumed to exist, and the destination path is overwritten.
 // Note that the destination path might still be created even if an error
@@ -54,13 +1775,30 @@ func WrapV1(src io.ReadSeeker, dst io.Writer, opts ...Option) error {
 	// GenerateIndex should probably be in charge of that.
 
 	o := ApplyOptions(opts...)
-	idx, err := index.New(o.IndexCodec)
-	if err != nil {
+	if err := checkExternalIndexSort(o); err != nil {
 		return err
 	}
-
-	if err := LoadIndex(idx, src, opts...); err != nil {
-		return err
+	var idx index.Index
+	var sorter *index.ExternalSorter
+	if o.ExternalIndexSort {
+		sorter = index.NewExternalSorter(o.ExternalIndexSortDir, 0)
+		defer sorter.Close()
+		// The data offset of the CARv2 is fixed, since no padding is used.
+		var delta uint64
+		if o.AbsoluteIndexOffsets {
+			delta = PragmaSize + HeaderSize
+		}
+		if err := sortIndexRecords(context.Background(), sorter, src, delta, o); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if idx, err = index.New(o.IndexCodec); err != nil {
+			return err
+		}
+		if err := LoadIndex(idx, src, opts...); err != nil {
+			return err
+		}
 	}
 
 	// Use Seek to learn the size of the CARv1 before reading it.
@@ -75,6 +1813,14 @@ func WrapV1(src io.ReadSeeker, dst io.Writer, opts ...Option) error {
 	// Similar to the writer API, write all components of a CARv2 to the
 	// destination file: Pragma, Header, CARv1, Index.
 	v2Header := NewHeader(uint64(v1Size))
+	if o.AbsoluteIndexOffsets {
+		v2Header.Characteristics.SetAbsoluteIndexOffsets(true)
+		if sorter == nil {
+			if idx, err = index.Rebase(idx, int64(v2Header.DataOffset)); err != nil {
+				return err
+			}
+		}
+	}
 	if _, err := dst.Write(Pragma); err != nil {
 		return err
 	}
@@ -84,11 +1830,109 @@ func WrapV1(src io.ReadSeeker, dst io.Writer, opts ...Option) error {
 	if _, err := io.Copy(dst, src); err != nil {
 		return err
 	}
-	if _, err := index.WriteTo(idx, dst); err != nil {
+	if sorter != nil {
+		_, err = sorter.WriteTo(dst)
+	} else {
+		_, err = index.WriteTo(idx, dst)
+	}
+	return err
+}
+
+// Repad rewrites the CARv2 read from src to dst with the given padding before its data payload
+// and before its index, e.g. to strip excessive padding. The data payload and the index are copied
+// verbatim, and the header is re-written with offsets matching the new padding; the header
+// characteristics are preserved. If src has no index, indexPadding is ignored.
+//
+// Index offsets are relative to the start of the data payload, so the copied index remains valid
+// as long as the payload is unchanged. This is verified prior to writing: the index is decoded,
+// and if it is an index.IterableIndex, every offset in it must fall within the data payload;
+// otherwise an error is returned and nothing is written. If the index has absolute offsets, as
+// signalled by Characteristics.HasAbsoluteIndexOffsets, it is instead rebased onto the new data
+// offset and re-written. See UseAbsoluteIndexOffsets.
+//
+// If src represents a CARv1 ErrAlreadyV1 error is returned, since a CARv1 has no padding.
+func Repad(src io.ReaderAt, dst io.Writer, carV1Padding, indexPadding uint64) error {
+	r, err := NewReader(src)
+	if err != nil {
 		return err
 	}
+	if r.Version == 1 {
+		return ErrAlreadyV1
+	}
 
-	return nil
+	h := NewHeader(r.Header.DataSize).WithDataPadding(carV1Padding)
+	h.Characteristics = r.Header.Characteristics
+	var rebased index.Index
+	if r.Header.HasIndex() {
+		h = h.WithIndexPadding(indexPadding)
+		ir, err := r.IndexReader()
+		if err != nil {
+			return err
+		}
+		idx, err := index.ReadFrom(ir)
+		if err != nil {
+			return err
+		}
+		var start uint64
+		absolute := r.Header.Characteristics.HasAbsoluteIndexOffsets()
+		if absolute {
+			start = r.Header.DataOffset
+		}
+		if iterable, ok := idx.(index.IterableIndex); ok {
+			if err := iterable.ForEach(func(mh multihash.Multihash, offset uint64) error {
+				if offset < start || offset-start >= r.Header.DataSize {
+					return fmt.Errorf("index offset %d of multihash %s is beyond the data payload of size %d at offset %d", offset, mh, r.Header.DataSize, start)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		if absolute && h.DataOffset != r.Header.DataOffset {
+			if rebased, err = index.Rebase(idx, int64(h.DataOffset)-int64(r.Header.DataOffset)); err != nil {
+				return err
+			}
+		}
+	} else {
+		h.IndexOffset = 0
+	}
+
+	if _, err := dst.Write(Pragma); err != nil {
+		return err
+	}
+	if _, err := h.WriteTo(dst); err != nil {
+		return err
+	}
+	if carV1Padding > 0 {
+		if _, err := dst.Write(make([]byte, carV1Padding)); err != nil {
+			return err
+		}
+	}
+	dr, err := r.DataReader()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, dr); err != nil {
+		return err
+	}
+	if !h.HasIndex() {
+		return nil
+	}
+	if indexPadding > 0 {
+		if _, err := dst.Write(make([]byte, indexPadding)); err != nil {
+			return err
+		}
+	}
+	if rebased != nil {
+		_, err = index.WriteTo(rebased, dst)
+		return err
+	}
+	ir, err := r.IndexReader()
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, ir)
+	return err
 }
 
 // ExtractV1File takes a CARv2 file and extracts its CARv1 data payload, unmodified.
@@ -200,19 +2044,249 @@ func ExtractV1File(srcPath, dstPath string, opts ...Option) (err error) {
 	return err
 }
 
+// ExtractV1 is like ExtractV1File, except that it copies the CARv1 data payload of the CARv2 read
+// from src to dst, i.e. exactly the bytes in the range [DataOffset, DataOffset+DataSize) of src,
+// which make up a standalone CARv1.
+//
+// Before anything is written to dst, the data payload is checked to start with a valid CARv1
+// header; its roots are therefore those of the CARv2. The blocks are copied without being read.
+// If src represents a CARv1 ErrAlreadyV1 error is returned.
+func ExtractV1(src io.ReaderAt, dst io.Writer, opts ...Option) error {
+	r, err := NewReader(src, opts...)
+	if err != nil {
+		return err
+	}
+	if r.Version == 1 {
+		return ErrAlreadyV1
+	}
+	dr, err := r.DataReader()
+	if err != nil {
+		return err
+	}
+	header, err := carv1.ReadHeader(dr, r.opts.MaxAllowedHeaderSize)
+	if err != nil {
+		return fmt.Errorf("invalid data payload: %w", err)
+	}
+	if header.Version != 1 {
+		return fmt.Errorf("invalid data payload: expected header version of 1; got %d", header.Version)
+	}
+	if _, err := dr.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	written, err := io.Copy(dst, dr)
+	if err != nil {
+		return err
+	}
+	if uint64(written) != r.Header.DataSize {
+		return fmt.Errorf("%w: expected to write exactly %d but wrote %d", ErrTruncated, r.Header.DataSize, written)
+	}
+	return nil
+}
+
 // AttachIndex attaches a given index to an existing CARv2 file at given path and offset.
 func AttachIndex(path string, idx index.Index, offset uint64) error {
 	// TODO: instead of offset, maybe take padding?
 	// TODO: check that the given path is indeed a CARv2.
 	// TODO: update CARv2 header according to the offset at which index is written out.
-	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	// Note, the file is explicitly not opened with os.O_APPEND, since writing at an offset is not
+	// permitted on files opened in append mode.
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0o640)
 	if err != nil {
 		return err
 	}
 	defer out.Close()
 	indexWriter := internalio.NewOffsetWriter(out, int64(offset))
-	_, err = index.WriteTo(idx, indexWriter)
-	return err
+	if _, err = index.WriteTo(idx, indexWriter); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// AttachIndexV1ToV2 converts the CARv1 file at v1Path into a CARv2 file at v2Path, with an index
+// generated from the CARv1 payload attached after it. The CARv1 payload is left unmodified, and
+// no padding is used before the payload or the index. The destination path is overwritten.
+// Note that the destination path might still be created even if an error occurred.
+//
+// The conversion cannot be done in place: a CARv2 starts with the pragma and header, followed by
+// the data payload, and files can only be extended at their end. Prepending to the CARv1 file
+// would therefore require shifting the entire payload, which is no cheaper than copying it.
+// Instead, the payload is streamed into v2Path after the pragma and header, and the index is then
+// written at the index offset specified by the header via AttachIndex. Finally, the resulting file
+// is read back to validate its header and index.
+//
+// See WrapV1File for wrapping without validation.
+func AttachIndexV1ToV2(v1Path, v2Path string, opts ...Option) error {
+	src, err := os.Open(v1Path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	version, err := ReadVersion(src, opts...)
+	if err != nil {
+		return err
+	}
+	if version != 1 {
+		return fmt.Errorf("source version must be 1; got: %d", version)
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	idx, err := GenerateIndex(src, opts...)
+	if err != nil {
+		return err
+	}
+	v1Size, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	dst, err := os.Create(v2Path)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	v2Header := NewHeader(uint64(v1Size))
+	if _, err := dst.Write(Pragma); err != nil {
+		return err
+	}
+	if _, err := v2Header.WriteTo(dst); err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	if err := AttachIndex(v2Path, idx, v2Header.IndexOffset); err != nil {
+		return err
+	}
+
+	// Validate that the written file is a CARv2 with the expected header and a readable index.
+	v2r, err := OpenReader(v2Path, opts...)
+	if err != nil {
+		return err
+	}
+	defer v2r.Close()
+	if v2r.Version != 2 {
+		return fmt.Errorf("invalid car version after conversion: %d", v2r.Version)
+	}
+	if v2r.Header != v2Header {
+		return fmt.Errorf("unexpected CARv2 header after conversion: %+v", v2r.Header)
+	}
+	ir, err := v2r.IndexReader()
+	if err != nil {
+		return err
+	}
+	gotIdx, err := index.ReadFrom(ir)
+	if err != nil {
+		return fmt.Errorf("invalid index after conversion: %w", err)
+	}
+	if gotIdx.Codec() != idx.Codec() {
+		return fmt.Errorf("unexpected index codec after conversion: %v", gotIdx.Codec())
+	}
+	return nil
+}
+
+// ReindexWithCodec re-encodes the index of the CARv2 file at the given path in the given codec, in
+// place, leaving the data payload untouched. This allows the index codec of a CAR to be changed
+// without rewriting it, e.g. to one that is better suited to how the CAR is read.
+//
+// The records of the existing index are converted as described by index.Convert. If the existing
+// index is not an index.IterableIndex, the records are instead generated from the data payload.
+// The new index is written at the offset of the existing one, replacing it, and the file is then
+// truncated to the end of the new index. Since the index is the last part of a CARv2, this holds
+// regardless of whether the new index is smaller or larger than the existing one, and the CARv2
+// header is left unmodified. Finally, the file is read back to validate its index.
+//
+// The file must be a CARv2 with an index, and the codec must be one supported by index.New.
+// Note that the index is replaced in place, so if an error occurs while writing it, the file may
+// be left with a partially written index; it can be regenerated from the data payload.
+func ReindexWithCodec(path string, codec multicodec.Code, opts ...Option) error {
+	if codec == index.CarIndexNone {
+		return errors.New("cannot reindex with no index codec")
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0o666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cr, err := NewReader(f, opts...)
+	if err != nil {
+		return err
+	}
+	if cr.Version != 2 {
+		return fmt.Errorf("cannot reindex CARv%d; only CARv2 has an index", cr.Version)
+	}
+	if !cr.Header.HasIndex() {
+		return errors.New("cannot reindex CARv2 without an index")
+	}
+	ir, err := cr.IndexReader()
+	if err != nil {
+		return err
+	}
+	existing, err := index.ReadFrom(ir)
+	if err != nil {
+		return fmt.Errorf("cannot read existing index: %w", err)
+	}
+	var idx index.Index
+	if _, ok := existing.(index.IterableIndex); ok {
+		if idx, err = index.Convert(existing, codec); err != nil {
+			return err
+		}
+	} else {
+		dr, err := cr.DataReader()
+		if err != nil {
+			return err
+		}
+		if idx, err = GenerateIndex(dr, append(opts, UseIndexCodec(codec))...); err != nil {
+			return err
+		}
+		if cr.Header.Characteristics.HasAbsoluteIndexOffsets() {
+			if idx, err = index.Rebase(idx, int64(cr.Header.DataOffset)); err != nil {
+				return err
+			}
+		}
+	}
+
+	n, err := index.WriteTo(idx, internalio.NewOffsetWriter(f, int64(cr.Header.IndexOffset)))
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(int64(cr.Header.IndexOffset + n)); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// Validate that the file has a readable index of the given codec.
+	v2r, err := OpenReader(path, opts...)
+	if err != nil {
+		return err
+	}
+	defer v2r.Close()
+	if v2r.Header != cr.Header {
+		return fmt.Errorf("unexpected CARv2 header after reindexing: %+v", v2r.Header)
+	}
+	ir, err = v2r.IndexReader()
+	if err != nil {
+		return err
+	}
+	gotIdx, err := index.ReadFrom(ir)
+	if err != nil {
+		return fmt.Errorf("invalid index after reindexing: %w", err)
+	}
+	if gotIdx.Codec() != codec {
+		return fmt.Errorf("unexpected index codec after reindexing: %v", gotIdx.Codec())
+	}
+	return nil
 }
 
 // ReplaceRootsInFile replaces the root CIDs in CAR file at given path with the given roots.
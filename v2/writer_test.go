@@ -1,21 +1,31 @@
 package car
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
 	"testing"
 
 	"github.com/ipld/go-car/v2/index"
 	"github.com/ipld/go-car/v2/internal/carv1"
+	"github.com/ipld/go-car/v2/internal/carv1/util"
 	"github.com/stretchr/testify/require"
 
+	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	format "github.com/ipfs/go-ipld-format"
 	"github.com/ipfs/go-merkledag"
 	dstest "github.com/ipfs/go-merkledag/test"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -63,35 +73,1560 @@ func TestWrapV1(t *testing.T) {
 	require.Equal(t, wantIdx, gotIdx)
 }
 
+func TestAttachIndexV1ToV2(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "attached-v2.car")
+	require.NoError(t, AttachIndexV1ToV2("testdata/sample-v1.car", dest))
+
+	// Assert the result is identical to wrapping the same CARv1.
+	wrapped := filepath.Join(t.TempDir(), "wrapped-v2.car")
+	require.NoError(t, WrapV1File("testdata/sample-v1.car", wrapped))
+	want, err := ioutil.ReadFile(wrapped)
+	require.NoError(t, err)
+	got, err := ioutil.ReadFile(dest)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+
+	// Assert a CARv2 source is rejected.
+	err = AttachIndexV1ToV2("testdata/sample-wrapped-v2.car", dest)
+	require.EqualError(t, err, "source version must be 1; got: 2")
+}
+
+func TestReindexWithCodec(t *testing.T) {
+	original, err := ioutil.ReadFile("testdata/sample-wrapped-v2.car")
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "reindexed-v2.car")
+	require.NoError(t, ioutil.WriteFile(path, original, 0o666))
+
+	wantIdx, err := GenerateIndexFromFile("testdata/sample-wrapped-v2.car")
+	require.NoError(t, err)
+	var wantRecords []index.Record
+	require.NoError(t, wantIdx.(index.IterableIndex).ForEach(func(mh multihash.Multihash, offset uint64) error {
+		wantRecords = append(wantRecords, index.Record{Cid: cid.NewCidV1(cid.Raw, mh), Offset: offset})
+		return nil
+	}))
+	require.NotEmpty(t, wantRecords)
+
+	// Reindex with codecs of different encoded sizes, including one that is not iterable, and
+	// therefore requires the next reindexing to generate the records from the data payload.
+	for _, codec := range []multicodec.Code{
+		index.CarLinearIndex,
+		multicodec.CarIndexSorted,
+		index.CarMappableIndexSorted,
+		multicodec.CarMultihashIndexSorted,
+	} {
+		require.NoError(t, ReindexWithCodec(path, codec))
+
+		subject, err := OpenReader(path)
+		require.NoError(t, err)
+		ir, err := subject.IndexReader()
+		require.NoError(t, err)
+		gotIdx, err := index.ReadFrom(ir)
+		require.NoError(t, err)
+		require.Equal(t, codec, gotIdx.Codec())
+		for _, r := range wantRecords {
+			offset, err := index.GetFirst(gotIdx, r.Cid)
+			require.NoError(t, err)
+			require.Equal(t, r.Offset, offset)
+		}
+		require.NoError(t, subject.Close())
+	}
+
+	// Assert the header and data payload are untouched, and that reindexing with the original
+	// codec results in the original file.
+	got, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, original, got)
+
+	// Assert a CARv1 and unknown codecs are rejected.
+	require.Error(t, ReindexWithCodec(path, index.CarIndexNone))
+	require.Error(t, ReindexWithCodec(path, multicodec.Cidv1))
+	v1Path := filepath.Join(t.TempDir(), "reindexed-v1.car")
+	v1, err := ioutil.ReadFile("testdata/sample-v1.car")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(v1Path, v1, 0o666))
+	require.Error(t, ReindexWithCodec(v1Path, multicodec.CarMultihashIndexSorted))
+}
+
 func TestExtractV1(t *testing.T) {
 	// Produce a CARv1 file to test.
 	dagSvc := dstest.Mock()
 	v1Src := filepath.Join(t.TempDir(), "original-test-v1.car")
 	v1f, err := os.Create(v1Src)
 	require.NoError(t, err)
-	t.Cleanup(func() { require.NoError(t, v1f.Close()) })
-	require.NoError(t, carv1.WriteCar(context.Background(), dagSvc, generateRootCid(t, dagSvc), v1f))
-	_, err = v1f.Seek(0, io.SeekStart)
+	t.Cleanup(func() { require.NoError(t, v1f.Close()) })
+	require.NoError(t, carv1.WriteCar(context.Background(), dagSvc, generateRootCid(t, dagSvc), v1f))
+	_, err = v1f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	wantV1, err := ioutil.ReadAll(v1f)
+	require.NoError(t, err)
+
+	// Wrap the produced CARv1 into a CARv2 to use for testing.
+	v2path := filepath.Join(t.TempDir(), "wrapped-for-extract-test-v2.car")
+	require.NoError(t, WrapV1File(v1Src, v2path))
+
+	// Assert extract from CARv2 file is as expected.
+	dstPath := filepath.Join(t.TempDir(), "extract-file-test-v1.car")
+	require.NoError(t, ExtractV1File(v2path, dstPath))
+	gotFromFile, err := ioutil.ReadFile(dstPath)
+	require.NoError(t, err)
+	require.Equal(t, wantV1, gotFromFile)
+
+	// Assert extract from CARv2 file in-place is as expected
+	require.NoError(t, ExtractV1File(v2path, v2path))
+	gotFromInPlaceFile, err := ioutil.ReadFile(v2path)
+	require.NoError(t, err)
+	require.Equal(t, wantV1, gotFromInPlaceFile)
+}
+
+func TestExtractV1FromReaderAt(t *testing.T) {
+	data, err := os.ReadFile("testdata/sample-wrapped-v2.car")
+	require.NoError(t, err)
+	cr, err := NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	wantRoots, err := cr.Roots()
+	require.NoError(t, err)
+	dataStart, dataEnd := cr.Header.DataOffset, cr.Header.DataOffset+cr.Header.DataSize
+
+	// Assert exactly the data payload is extracted, as a CARv1 with the same roots.
+	var buf bytes.Buffer
+	require.NoError(t, ExtractV1(bytes.NewReader(data), &buf))
+	require.Equal(t, data[dataStart:dataEnd], buf.Bytes())
+	got, err := NewBlockReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), got.Version)
+	require.Equal(t, wantRoots, got.Roots)
+
+	// Assert a CARv1 is rejected.
+	v1, err := os.ReadFile("testdata/sample-v1.car")
+	require.NoError(t, err)
+	buf.Reset()
+	require.Equal(t, ErrAlreadyV1, ExtractV1(bytes.NewReader(v1), &buf))
+
+	// Assert a data payload with a corrupt header is rejected, without writing anything.
+	corrupt := append([]byte{}, data...)
+	corrupt[dataStart+1] ^= 0xff
+	require.Error(t, ExtractV1(bytes.NewReader(corrupt), &buf))
+	require.Zero(t, buf.Len())
+
+	// Assert a truncated data payload is rejected, even if the size of src is unknown.
+	err = ExtractV1(struct{ io.ReaderAt }{bytes.NewReader(data[:dataEnd-1])}, &buf)
+	require.ErrorIs(t, err, ErrTruncated)
+}
+
+func TestWriteFromBlockstore(t *testing.T) {
+	ctx := context.Background()
+	bserv := dstest.Bserv()
+	roots := generateRootCid(t, merkledag.NewDAGService(bserv))
+
+	// Produce the expected CARv1 payload via the NodeGetter based writer.
+	var wantV1 bytes.Buffer
+	require.NoError(t, carv1.WriteCar(ctx, merkledag.NewDAGService(bserv), roots, &wantV1))
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteFromBlockstore(ctx, bserv.Blockstore(), roots, &buf, UseDataPadding(3), UseIndexPadding(5)))
+
+	subject, err := NewReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), subject.Version)
+	require.Equal(t, uint64(PragmaSize+HeaderSize+3), subject.Header.DataOffset)
+	require.Equal(t, subject.Header.DataOffset+subject.Header.DataSize+5, subject.Header.IndexOffset)
+
+	// Assert the data payload is identical to the CARv1 written from the DAG service.
+	dr, err := subject.DataReader()
+	require.NoError(t, err)
+	gotV1, err := ioutil.ReadAll(dr)
+	require.NoError(t, err)
+	require.Equal(t, wantV1.Bytes(), gotV1)
+
+	// Assert the embedded index is the same as one generated from the payload.
+	wantIdx, err := GenerateIndex(bytes.NewReader(wantV1.Bytes()))
+	require.NoError(t, err)
+	ir, err := subject.IndexReader()
+	require.NoError(t, err)
+	gotIdx, err := index.ReadFrom(ir)
+	require.NoError(t, err)
+	require.Equal(t, wantIdx, gotIdx)
+
+	// Assert no index is written when disabled.
+	buf.Reset()
+	require.NoError(t, WriteFromBlockstore(ctx, bserv.Blockstore(), roots, &buf, WithoutIndex()))
+	subject, err = NewReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.False(t, subject.Header.HasIndex())
+	require.Equal(t, uint64(buf.Len()), subject.Header.DataOffset+subject.Header.DataSize)
+}
+
+func TestPostOrderWalk(t *testing.T) {
+	ctx := context.Background()
+	bserv := dstest.Bserv()
+	dagSvc := merkledag.NewDAGService(bserv)
+	roots := generateRootCid(t, dagSvc)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteFromBlockstore(ctx, bserv.Blockstore(), roots, &buf, PostOrderWalk(true)))
+	subject, err := NewReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	ir, err := subject.IndexReader()
+	require.NoError(t, err)
+	idx, err := index.ReadFrom(ir)
+	require.NoError(t, err)
+	dr, err := subject.DataReader()
+	require.NoError(t, err)
+	br, err := NewBlockReader(dr)
+	require.NoError(t, err)
+
+	// Assert every block's children appear at lower offsets than the block itself.
+	var got []cid.Cid
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		got = append(got, blk.Cid())
+
+		offset, err := index.GetFirst(idx, blk.Cid())
+		require.NoError(t, err)
+		nd, err := dagSvc.Get(ctx, blk.Cid())
+		require.NoError(t, err)
+		for _, l := range nd.Links() {
+			childOffset, err := index.GetFirst(idx, l.Cid)
+			require.NoError(t, err)
+			require.Less(t, childOffset, offset)
+		}
+	}
+	require.Equal(t, roots[0], got[len(got)-1])
+
+	// Assert the same blocks are written as in pre-order.
+	var want []cid.Cid
+	preOrder, err := carv1.NewCarReader(bytes.NewReader(mustWriteCar(t, dagSvc, roots)))
+	require.NoError(t, err)
+	for {
+		blk, err := preOrder.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		want = append(want, blk.Cid())
+	}
+	require.NotEqual(t, want, got)
+	require.ElementsMatch(t, want, got)
+}
+
+func TestGroupByCodec(t *testing.T) {
+	ctx := context.Background()
+	bserv := dstest.Bserv()
+	dagSvc := merkledag.NewDAGService(bserv)
+
+	// Build a DAG whose blocks of different codecs are interleaved in pre-order.
+	leafA := merkledag.NewRawNode([]byte("fish"))
+	leafB := merkledag.NewRawNode([]byte("lobster"))
+	inner := &merkledag.ProtoNode{}
+	assertAddNodeLink(t, inner, leafB, "leaf")
+	root := &merkledag.ProtoNode{}
+	assertAddNodeLink(t, root, leafA, "a")
+	assertAddNodeLink(t, root, inner, "b")
+	assertAddNodes(t, dagSvc, leafA, leafB, inner, root)
+	roots := []cid.Cid{root.Cid()}
+
+	readCids := func(t *testing.T, r io.Reader) []cid.Cid {
+		br, err := NewBlockReader(r)
+		require.NoError(t, err)
+		var cids []cid.Cid
+		for {
+			blk, err := br.Next()
+			if err == io.EOF {
+				return cids
+			}
+			require.NoError(t, err)
+			cids = append(cids, blk.Cid())
+		}
+	}
+	preOrder := readCids(t, bytes.NewReader(mustWriteCar(t, dagSvc, roots)))
+	require.Equal(t, []cid.Cid{root.Cid(), leafA.Cid(), inner.Cid(), leafB.Cid()}, preOrder)
+	// The blocks are grouped by codec, in order of first appearance of each codec, and each group
+	// retains the pre-order.
+	want := []cid.Cid{root.Cid(), inner.Cid(), leafA.Cid(), leafB.Cid()}
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteFromBlockstore(ctx, bserv.Blockstore(), roots, &buf, GroupByCodec(true)))
+	subject, err := NewReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	dr, err := subject.DataReader()
+	require.NoError(t, err)
+	require.Equal(t, want, readCids(t, dr))
+
+	// Assert the embedded index is the same as one generated from the payload.
+	dr, err = subject.DataReader()
+	require.NoError(t, err)
+	wantIdx, err := GenerateIndex(dr)
+	require.NoError(t, err)
+	ir, err := subject.IndexReader()
+	require.NoError(t, err)
+	gotIdx, err := index.ReadFrom(ir)
+	require.NoError(t, err)
+	require.Equal(t, wantIdx, gotIdx)
+}
+
+func TestMaxBlocks(t *testing.T) {
+	ctx := context.Background()
+	bserv := dstest.Bserv()
+	roots := generateRootCid(t, merkledag.NewDAGService(bserv))
+
+	// write writes the DAG with the given options, and returns the CIDs of the blocks written along
+	// with the number of records in the index.
+	write := func(opts ...Option) ([]cid.Cid, int) {
+		var buf bytes.Buffer
+		require.NoError(t, WriteFromBlockstore(ctx, bserv.Blockstore(), roots, &buf, opts...))
+		subject, err := NewReader(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+		dr, err := subject.DataReader()
+		require.NoError(t, err)
+		br, err := NewBlockReader(dr)
+		require.NoError(t, err)
+		var got []cid.Cid
+		for {
+			blk, err := br.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			got = append(got, blk.Cid())
+		}
+		ir, err := subject.IndexReader()
+		require.NoError(t, err)
+		idx, err := index.ReadFrom(ir)
+		require.NoError(t, err)
+		var records int
+		require.NoError(t, idx.(index.IterableIndex).ForEach(func(multihash.Multihash, uint64) error {
+			records++
+			return nil
+		}))
+		return got, records
+	}
+
+	all, _ := write()
+	allPostOrder, _ := write(PostOrderWalk(true))
+	require.Greater(t, len(all), 3)
+
+	// Assert exactly the first n blocks in walk order are written and indexed.
+	got, records := write(MaxBlocks(3))
+	require.Equal(t, all[:3], got)
+	require.Equal(t, 3, records)
+	got, records = write(MaxBlocks(2), PostOrderWalk(true))
+	require.Equal(t, allPostOrder[:2], got)
+	require.Equal(t, 2, records)
+	got, records = write(MaxBlocks(3), GroupByCodec(true))
+	require.ElementsMatch(t, all[:3], got)
+	require.Equal(t, 3, records)
+
+	// Assert a limit of at least the number of blocks, or of zero, writes them all.
+	got, _ = write(MaxBlocks(len(all)))
+	require.Equal(t, all, got)
+	got, _ = write(MaxBlocks(0))
+	require.Equal(t, all, got)
+}
+
+func TestPartWriter(t *testing.T) {
+	ctx := context.Background()
+	bserv := dstest.Bserv()
+	roots := generateRootCid(t, merkledag.NewDAGService(bserv))
+	var want bytes.Buffer
+	require.NoError(t, WriteFromBlockstore(ctx, bserv.Blockstore(), roots, &want))
+
+	const partSize = 100
+	var parts [][]byte
+	var numbers []int
+	subject, err := NewPartWriter(partSize, func(partNumber int, part []byte) error {
+		numbers = append(numbers, partNumber)
+		parts = append(parts, append([]byte{}, part...))
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Assert a CARv2 is written seeklessly in parts of the given size, except for the last one.
+	require.NoError(t, WriteFromBlockstore(ctx, bserv.Blockstore(), roots, subject))
+	require.NoError(t, subject.Close())
+	wantParts := (want.Len() + partSize - 1) / partSize
+	require.Greater(t, wantParts, 2)
+	require.Equal(t, wantParts, subject.Parts())
+	require.Len(t, parts, wantParts)
+	for i, part := range parts {
+		require.Equal(t, i+1, numbers[i])
+		if i < len(parts)-1 {
+			require.Len(t, part, partSize)
+		}
+	}
+	require.Equal(t, want.Bytes(), bytes.Join(parts, nil))
+	_, err = subject.Write([]byte("fish"))
+	require.Error(t, err)
+
+	// Assert an empty part is uploaded if nothing is written.
+	parts = nil
+	subject, err = NewPartWriter(partSize, func(_ int, part []byte) error {
+		parts = append(parts, append([]byte{}, part...))
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, subject.Close())
+	require.Equal(t, [][]byte{{}}, parts)
+
+	// Assert upload errors are returned, and subsequent writes fail.
+	uploadErr := errors.New("lobstermuncher")
+	subject, err = NewPartWriter(partSize, func(partNumber int, _ []byte) error {
+		if partNumber == 2 {
+			return uploadErr
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.ErrorIs(t, WriteFromBlockstore(ctx, bserv.Blockstore(), roots, subject), uploadErr)
+	require.Equal(t, 1, subject.Parts())
+	_, err = subject.Write([]byte("fish"))
+	require.ErrorIs(t, err, uploadErr)
+	require.ErrorIs(t, subject.Close(), uploadErr)
+
+	_, err = NewPartWriter(0, nil)
+	require.Error(t, err)
+}
+
+func mustWriteCar(t *testing.T, ng format.NodeGetter, roots []cid.Cid) []byte {
+	var buf bytes.Buffer
+	require.NoError(t, carv1.WriteCar(context.Background(), ng, roots, &buf))
+	return buf.Bytes()
+}
+
+func TestEmitRootsTrailer(t *testing.T) {
+	ctx := context.Background()
+	bserv := dstest.Bserv()
+	roots := generateRootCid(t, merkledag.NewDAGService(bserv))
+
+	var wantV1 bytes.Buffer
+	require.NoError(t, carv1.WriteCar(ctx, merkledag.NewDAGService(bserv), roots, &wantV1))
+	wantReader, err := carv1.NewCarReader(bytes.NewReader(wantV1.Bytes()))
+	require.NoError(t, err)
+	var wantBlocks []blocks.Block
+	for {
+		b, err := wantReader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		wantBlocks = append(wantBlocks, b)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteFromBlockstore(ctx, bserv.Blockstore(), roots, &buf, EmitRootsTrailer(true)))
+
+	// Assert the trailer follows all the blocks, and surfaces the roots once read.
+	subject, err := NewBlockReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, roots, subject.Roots)
+	for _, want := range wantBlocks {
+		got, err := subject.Next()
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+		require.Nil(t, subject.LateRoots())
+	}
+	trailer, err := subject.Next()
+	require.NoError(t, err)
+	require.Equal(t, uint64(multicodec.Car), trailer.Cid().Prefix().Codec)
+	require.Equal(t, roots, subject.LateRoots())
+	_, err = subject.Next()
+	require.Equal(t, io.EOF, err)
+
+	// Assert the trailer is indexed like any other block.
+	v2r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	ir, err := v2r.IndexReader()
+	require.NoError(t, err)
+	idx, err := index.ReadFrom(ir)
+	require.NoError(t, err)
+	offset, err := index.GetFirst(idx, trailer.Cid())
+	require.NoError(t, err)
+	require.Equal(t, uint64(wantV1.Len()), offset)
+
+	// Assert the trailer is written by WriteSortedStream too.
+	sorted := append([]blocks.Block{}, wantBlocks...)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i].Cid().Hash(), sorted[j].Cid().Hash()) < 0 })
+	ch := make(chan blocks.Block, len(sorted))
+	for _, b := range sorted {
+		ch <- b
+	}
+	close(ch)
+	f, err := os.Create(filepath.Join(t.TempDir(), "sorted-trailer.car"))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, f.Close()) })
+	require.NoError(t, WriteSortedStream(roots, ch, f, EmitRootsTrailer(true)))
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	subject, err = NewBlockReader(f)
+	require.NoError(t, err)
+	for {
+		_, err := subject.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+	}
+	require.Equal(t, roots, subject.LateRoots())
+
+	// Assert the trailer does not prevent verifying nor pruning the CAR, and is pruned.
+	require.NoError(t, VerifyStreaming(bytes.NewReader(buf.Bytes()), nil))
+	var pruned bytes.Buffer
+	prunedBlocks, prunedBytes, err := Prune(bytes.NewReader(buf.Bytes()), &pruned)
+	require.NoError(t, err)
+	require.Equal(t, 1, prunedBlocks)
+	require.Equal(t, uint64(len(trailer.RawData())), prunedBytes)
+	require.NoError(t, VerifyStreaming(bytes.NewReader(pruned.Bytes()), nil))
+	v2r, err = NewReader(bytes.NewReader(pruned.Bytes()))
+	require.NoError(t, err)
+	dr, err := v2r.DataReader()
+	require.NoError(t, err)
+	gotV1, err := io.ReadAll(dr)
+	require.NoError(t, err)
+	require.Equal(t, wantV1.Bytes(), gotV1)
+
+	// Assert no trailer is written by default.
+	buf.Reset()
+	require.NoError(t, WriteFromBlockstore(ctx, bserv.Blockstore(), roots, &buf))
+	subject, err = NewBlockReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	for {
+		_, err := subject.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+	}
+	require.Nil(t, subject.LateRoots())
+}
+
+func TestWithMetadata(t *testing.T) {
+	ctx := context.Background()
+	bserv := dstest.Bserv()
+	roots := generateRootCid(t, merkledag.NewDAGService(bserv))
+	md := map[string]string{
+		"created":  "2022-01-02T03:04:05Z",
+		"producer": "go-car",
+		"version":  "v2.0.0",
+	}
+
+	// Assert the metadata trailer is encoded identically regardless of map iteration order.
+	want, err := metadataTrailer(md)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		got, err := metadataTrailer(md)
+		require.NoError(t, err)
+		require.Equal(t, want.RawData(), got.RawData())
+	}
+	decoded, ok := decodeMetadataTrailer(want.RawData())
+	require.True(t, ok)
+	require.Equal(t, md, decoded)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteFromBlockstore(ctx, bserv.Blockstore(), roots, &buf, WithMetadata(md), EmitRootsTrailer(true)))
+
+	// Assert the metadata trailer precedes the roots trailer, and is read like any other block.
+	subject, err := NewBlockReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	var got []blocks.Block
+	for {
+		b, err := subject.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		got = append(got, b)
+	}
+	require.Greater(t, len(got), 2)
+	require.Equal(t, want, got[len(got)-2])
+	require.Equal(t, md, subject.Metadata())
+	require.Equal(t, roots, subject.LateRoots())
+
+	// Assert the metadata is surfaced by Inspect, with or without validating blocks.
+	for _, validate := range []bool{false, true} {
+		cr, err := NewReader(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+		stats, err := cr.Inspect(validate)
+		require.NoError(t, err)
+		require.Equal(t, md, stats.Metadata)
+		require.Equal(t, uint64(len(got)), stats.BlockCount)
+	}
+
+	// Assert the metadata is surfaced by Describe, without repurposing the header characteristics.
+	requireDescribedMetadata := func(car []byte) {
+		d, err := Describe(bytes.NewReader(car))
+		require.NoError(t, err)
+		require.Equal(t, md, d.Metadata)
+		require.Zero(t, d.Characteristics.Lo)
+	}
+	requireDescribedMetadata(buf.Bytes())
+
+	// Assert the metadata of a CARv1 is surfaced by Describe too.
+	v2r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	dr, err := v2r.DataReader()
+	require.NoError(t, err)
+	v1, err := io.ReadAll(dr)
+	require.NoError(t, err)
+	d, err := Describe(bytes.NewReader(v1))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), d.Version)
+	require.Equal(t, md, d.Metadata)
+
+	// Assert the metadata trailer does not prevent verifying the CAR.
+	require.NoError(t, VerifyStreaming(bytes.NewReader(buf.Bytes()), nil))
+
+	// Assert the metadata is written by WriteSortedStream too.
+	f, err := os.Create(filepath.Join(t.TempDir(), "sorted-metadata.car"))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, f.Close()) })
+	ch := make(chan blocks.Block)
+	close(ch)
+	require.NoError(t, WriteSortedStream(roots, ch, f, WithMetadata(md)))
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	subject, err = NewBlockReader(f)
+	require.NoError(t, err)
+	b, err := subject.Next()
+	require.NoError(t, err)
+	require.Equal(t, want, b)
+	require.Equal(t, md, subject.Metadata())
+	require.Nil(t, subject.LateRoots())
+	sorted, err := os.ReadFile(f.Name())
+	require.NoError(t, err)
+	requireDescribedMetadata(sorted)
+
+	// Assert the metadata written by DeferredRootsWriter is surfaced by Describe.
+	df, err := os.Create(filepath.Join(t.TempDir(), "deferred-metadata.car"))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, df.Close()) })
+	drw, err := NewDeferredRootsWriter(df, DefaultReservedHeaderSize, WithMetadata(md), EmitRootsTrailer(true))
+	require.NoError(t, err)
+	for _, b := range got[:len(got)-2] {
+		require.NoError(t, drw.Put(b))
+	}
+	require.NoError(t, drw.SetRootsAndFinalize(roots))
+	deferred, err := os.ReadFile(df.Name())
+	require.NoError(t, err)
+	requireDescribedMetadata(deferred)
+
+	// Assert no metadata is written by default.
+	buf.Reset()
+	require.NoError(t, WriteFromBlockstore(ctx, bserv.Blockstore(), roots, &buf))
+	cr, err := NewReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	stats, err := cr.Inspect(false)
+	require.NoError(t, err)
+	require.Nil(t, stats.Metadata)
+	d, err = Describe(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Nil(t, d.Metadata)
+}
+
+func TestWriteToRotating(t *testing.T) {
+	ctx := context.Background()
+	bserv := dstest.Bserv()
+	roots := generateRootCid(t, merkledag.NewDAGService(bserv))
+
+	var wantV1 bytes.Buffer
+	require.NoError(t, carv1.WriteCar(ctx, merkledag.NewDAGService(bserv), roots, &wantV1))
+	wantReader, err := carv1.NewCarReader(bytes.NewReader(wantV1.Bytes()))
+	require.NoError(t, err)
+	var wantBlocks []blocks.Block
+	for {
+		b, err := wantReader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		wantBlocks = append(wantBlocks, b)
+	}
+
+	for _, maxShardBytes := range []int64{1, 256, 1 << 20} {
+		maxShardBytes := maxShardBytes
+		t.Run(fmt.Sprint(maxShardBytes), func(t *testing.T) {
+			dir := t.TempDir()
+			var paths []string
+			next := func(shardIndex int) (io.WriteSeeker, error) {
+				require.Equal(t, len(paths), shardIndex)
+				path := filepath.Join(dir, fmt.Sprintf("shard-%d.car", shardIndex))
+				paths = append(paths, path)
+				f, err := os.Create(path)
+				if err == nil {
+					t.Cleanup(func() { require.NoError(t, f.Close()) })
+				}
+				return f, err
+			}
+			shards, err := WriteToRotating(ctx, bserv.Blockstore(), roots, next, maxShardBytes)
+			require.NoError(t, err)
+			require.Len(t, shards, len(paths))
+			switch maxShardBytes {
+			case 1:
+				require.Len(t, shards, len(wantBlocks))
+			case 1 << 20:
+				require.Len(t, shards, 1)
+			default:
+				require.Greater(t, len(shards), 1)
+				require.Less(t, len(shards), len(wantBlocks))
+			}
+
+			// Assert the shards hold the blocks in order, each along with a matching index.
+			var gotBlocks []blocks.Block
+			for i, path := range paths {
+				subject, err := OpenReader(path)
+				require.NoError(t, err)
+				t.Cleanup(func() { require.NoError(t, subject.Close()) })
+				gotRoots, err := subject.Roots()
+				require.NoError(t, err)
+				require.Equal(t, roots, gotRoots)
+				stat, err := os.Stat(path)
+				require.NoError(t, err)
+				require.Equal(t, stat.Size(), shards[i].Size)
+				require.Equal(t, subject.Header.DataSize, shards[i].DataSize)
+				if shards[i].Blocks > 1 {
+					require.LessOrEqual(t, int64(subject.Header.DataOffset+subject.Header.DataSize), maxShardBytes)
+				}
+
+				dr, err := subject.DataReader()
+				require.NoError(t, err)
+				wantIdx, err := GenerateIndex(dr)
+				require.NoError(t, err)
+				ir, err := subject.IndexReader()
+				require.NoError(t, err)
+				gotIdx, err := index.ReadFrom(ir)
+				require.NoError(t, err)
+				require.Equal(t, wantIdx, gotIdx)
+
+				dr, err = subject.DataReader()
+				require.NoError(t, err)
+				br, err := NewBlockReader(dr)
+				require.NoError(t, err)
+				var n int
+				for {
+					b, err := br.Next()
+					if err == io.EOF {
+						break
+					}
+					require.NoError(t, err)
+					gotBlocks = append(gotBlocks, b)
+					n++
+				}
+				require.Equal(t, shards[i].Blocks, n)
+			}
+			require.Equal(t, wantBlocks, gotBlocks)
+		})
+	}
+
+	// Assert the trailers are written to the last shard only, and that each shard is readable as a
+	// CARv1 by readers that require roots.
+	dir := t.TempDir()
+	var paths []string
+	next := func(shardIndex int) (io.WriteSeeker, error) {
+		path := filepath.Join(dir, fmt.Sprintf("trailed-shard-%d.car", shardIndex))
+		paths = append(paths, path)
+		f, err := os.Create(path)
+		if err == nil {
+			t.Cleanup(func() { require.NoError(t, f.Close()) })
+		}
+		return f, err
+	}
+	md := map[string]string{"producer": "go-car"}
+	shards, err := WriteToRotating(ctx, bserv.Blockstore(), roots, next, 256, EmitRootsTrailer(true), WithMetadata(md))
+	require.NoError(t, err)
+	require.Greater(t, len(shards), 1)
+	var gotBlocks int
+	for i, path := range paths {
+		subject, err := OpenReader(path)
+		require.NoError(t, err)
+		t.Cleanup(func() { require.NoError(t, subject.Close()) })
+		dr, err := subject.DataReader()
+		require.NoError(t, err)
+		v1r, err := carv1.NewCarReaderWithoutDefaults(dr, false, carv1.DefaultMaxAllowedHeaderSize, carv1.DefaultMaxAllowedSectionSize)
+		require.NoError(t, err)
+		require.Equal(t, roots, v1r.Header.Roots)
+
+		dr, err = subject.DataReader()
+		require.NoError(t, err)
+		br, err := NewBlockReader(dr)
+		require.NoError(t, err)
+		var n int
+		for {
+			b, err := br.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			if !isTrailer(b.Cid()) {
+				n++
+			}
+		}
+		require.Equal(t, shards[i].Blocks, n)
+		gotBlocks += n
+		if i == len(paths)-1 {
+			require.Equal(t, roots, br.LateRoots())
+			require.Equal(t, md, br.Metadata())
+		} else {
+			require.Nil(t, br.LateRoots())
+			require.Nil(t, br.Metadata())
+		}
+	}
+	require.Equal(t, len(wantBlocks), gotBlocks)
+
+	// Assert the maximum shard size must be positive.
+	_, err = WriteToRotating(ctx, bserv.Blockstore(), roots, func(int) (io.WriteSeeker, error) {
+		require.Fail(t, "no shard is expected")
+		return nil, nil
+	}, 0)
+	require.Error(t, err)
+}
+
+func TestWriteV1WithSidecar(t *testing.T) {
+	ctx := context.Background()
+	dagSvc := dstest.Mock()
+	roots := generateRootCid(t, dagSvc)
+	carPath := filepath.Join(t.TempDir(), "sidecar-test.car")
+	indexPath := filepath.Join(t.TempDir(), "sidecar-test.carindex")
+
+	require.NoError(t, WriteV1WithSidecar(ctx, dagSvc, roots, carPath, indexPath))
+
+	// Assert the CAR is identical to the CARv1 written from the DAG service.
+	var wantV1 bytes.Buffer
+	require.NoError(t, carv1.WriteCar(ctx, dagSvc, roots, &wantV1))
+	gotV1, err := ioutil.ReadFile(carPath)
+	require.NoError(t, err)
+	require.Equal(t, wantV1.Bytes(), gotV1)
+
+	// Assert the sidecar is readable and is the same as the index generated from the CAR.
+	idxFile, err := os.Open(indexPath)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, idxFile.Close()) })
+	gotIdx, err := index.ReadFrom(idxFile)
+	require.NoError(t, err)
+	wantIdx, err := GenerateIndexFromFile(carPath)
+	require.NoError(t, err)
+	require.Equal(t, wantIdx, gotIdx)
+
+	// Assert the sidecar offsets point at the corresponding sections in the CAR.
+	br, err := NewBlockReader(bytes.NewReader(gotV1))
+	require.NoError(t, err)
+	for {
+		wantBlock, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		offset, err := index.GetFirst(gotIdx, wantBlock.Cid())
+		require.NoError(t, err)
+		gotCid, gotData, err := util.ReadNode(bytes.NewReader(gotV1[offset:]), false, carv1.DefaultMaxAllowedSectionSize)
+		require.NoError(t, err)
+		require.Equal(t, wantBlock.Cid(), gotCid)
+		require.Equal(t, wantBlock.RawData(), gotData)
+	}
+
+	// Assert writing a sidecar without an index is an error.
+	require.Error(t, WriteV1WithSidecar(ctx, dagSvc, roots, carPath, indexPath, WithoutIndex()))
+}
+
+func TestVerifyExact(t *testing.T) {
+	ctx := context.Background()
+	bserv := dstest.Bserv()
+	roots := generateRootCid(t, merkledag.NewDAGService(bserv))
+	bs := bserv.Blockstore()
+
+	// Note, generateRootCid adds a block that is not reachable from the root.
+	unreachable := merkledag.NewRawNode([]byte("🌊")).Cid()
+	require.Error(t, VerifyExact(ctx, bs, roots[0]))
+	require.NoError(t, bs.DeleteBlock(ctx, unreachable))
+	require.NoError(t, VerifyExact(ctx, bs, roots[0]))
+
+	// Assert an unreachable block is an error.
+	extra := merkledag.NewRawNode([]byte("lobstermuncher"))
+	require.NoError(t, bs.Put(ctx, extra))
+	require.Error(t, VerifyExact(ctx, bs, roots[0]))
+	require.NoError(t, bs.DeleteBlock(ctx, extra.Cid()))
+	require.NoError(t, VerifyExact(ctx, bs, roots[0]))
+
+	// Assert a missing block reachable from the root is an error.
+	root, err := merkledag.NewDAGService(bserv).Get(ctx, roots[0])
+	require.NoError(t, err)
+	require.NotEmpty(t, root.Links())
+	require.NoError(t, bs.DeleteBlock(ctx, root.Links()[0].Cid))
+	err = VerifyExact(ctx, bs, roots[0])
+	require.Error(t, err)
+	require.True(t, format.IsNotFound(errors.Unwrap(err)))
+}
+
+// listedBlockstore is a blockstore.Blockstore that lists the given keys via AllKeysChan, in order.
+type listedBlockstore struct {
+	blockstore.Blockstore
+	keys []cid.Cid
+}
+
+func (l listedBlockstore) AllKeysChan(context.Context) (<-chan cid.Cid, error) {
+	ch := make(chan cid.Cid, len(l.keys))
+	for _, k := range l.keys {
+		ch <- k
+	}
+	close(ch)
+	return ch, nil
+}
+
+func TestVerifyOrder(t *testing.T) {
+	ctx := context.Background()
+	bserv := dstest.Bserv()
+	roots := generateRootCid(t, merkledag.NewDAGService(bserv))
+	bs := bserv.Blockstore()
+
+	// Lay out the DAG in pre-order and post-order, as written by WriteFromBlockstore.
+	layout := func(opts ...Option) []cid.Cid {
+		var buf bytes.Buffer
+		require.NoError(t, WriteFromBlockstore(ctx, bs, roots, &buf, opts...))
+		br, err := NewBlockReader(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+		var keys []cid.Cid
+		for {
+			b, err := br.Next()
+			if err == io.EOF {
+				return keys
+			}
+			require.NoError(t, err)
+			keys = append(keys, b.Cid())
+		}
+	}
+	pre, post := layout(), layout(PostOrderWalk(true))
+	require.Greater(t, len(pre), 2)
+	require.NotEqual(t, pre, post)
+
+	require.NoError(t, VerifyOrder(ctx, listedBlockstore{bs, pre}, roots[0], PreOrder))
+	require.NoError(t, VerifyOrder(ctx, listedBlockstore{bs, post}, roots[0], PostOrder))
+
+	// Assert the wrong order is reported, along with the offending pair of blocks.
+	err := VerifyOrder(ctx, listedBlockstore{bs, post}, roots[0], PreOrder)
+	var outOfOrder *ErrOutOfOrder
+	require.True(t, errors.As(err, &outOfOrder))
+	require.Equal(t, roots[0], outOfOrder.Expected)
+	require.Equal(t, post[0], outOfOrder.Got)
+	err = VerifyOrder(ctx, listedBlockstore{bs, pre}, roots[0], PostOrder)
+	require.True(t, errors.As(err, &outOfOrder))
+	require.Equal(t, pre[0], outOfOrder.Got)
+
+	// Assert unreachable blocks and repeated blocks are ignored.
+	unreachable := merkledag.NewRawNode([]byte("lobstermuncher")).Cid()
+	keys := append([]cid.Cid{unreachable}, pre...)
+	keys = append(keys, pre[1], unreachable)
+	require.NoError(t, VerifyOrder(ctx, listedBlockstore{bs, keys}, roots[0], PreOrder))
+
+	// Assert a block that is not listed is an error.
+	require.Error(t, VerifyOrder(ctx, listedBlockstore{bs, pre[:len(pre)-1]}, roots[0], PreOrder))
+
+	// Assert an unknown order is an error.
+	require.Error(t, VerifyOrder(ctx, listedBlockstore{bs, pre}, roots[0], OrderKind(42)))
+}
+
+func TestOrphans(t *testing.T) {
+	ctx := context.Background()
+	bserv := dstest.Bserv()
+	roots := generateRootCid(t, merkledag.NewDAGService(bserv))
+	bs := bserv.Blockstore()
+
+	// Note, generateRootCid adds a block that is not reachable from the root.
+	unreachable := merkledag.NewRawNode([]byte("🌊")).Cid()
+	got, err := Orphans(ctx, bs, roots)
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{unreachable}, got)
+
+	// Assert every block is an orphan without roots, and none with all blocks as roots.
+	all, err := bs.AllKeysChan(ctx)
+	require.NoError(t, err)
+	var keys []cid.Cid
+	for c := range all {
+		keys = append(keys, c)
+	}
+	got, err = Orphans(ctx, bs, nil)
+	require.NoError(t, err)
+	require.ElementsMatch(t, keys, got)
+	got, err = Orphans(ctx, bs, keys)
+	require.NoError(t, err)
+	require.Empty(t, got)
+
+	// Assert a missing block reachable from the root is skipped rather than an error.
+	root, err := merkledag.NewDAGService(bserv).Get(ctx, roots[0])
+	require.NoError(t, err)
+	require.NotEmpty(t, root.Links())
+	require.NoError(t, bs.DeleteBlock(ctx, root.Links()[0].Cid))
+	got, err = Orphans(ctx, bs, roots)
+	require.NoError(t, err)
+	require.Contains(t, got, unreachable)
+	require.NotContains(t, got, roots[0])
+}
+
+// wholeCidBlockstore is a blockstore.Blockstore that lists the whole CIDs of the blocks put to it,
+// rather than CIDs with the raw codec as the blockstore it wraps does.
+type wholeCidBlockstore struct {
+	blockstore.Blockstore
+	keys []cid.Cid
+}
+
+func (w *wholeCidBlockstore) Put(ctx context.Context, blk blocks.Block) error {
+	w.keys = append(w.keys, blk.Cid())
+	return w.Blockstore.Put(ctx, blk)
+}
+
+func (w *wholeCidBlockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	for _, blk := range blks {
+		w.keys = append(w.keys, blk.Cid())
+	}
+	return w.Blockstore.PutMany(ctx, blks)
+}
+
+func (w *wholeCidBlockstore) AllKeysChan(context.Context) (<-chan cid.Cid, error) {
+	ch := make(chan cid.Cid, len(w.keys))
+	for _, c := range w.keys {
+		ch <- c
+	}
+	close(ch)
+	return ch, nil
+}
+
+func TestInferRoots(t *testing.T) {
+	ctx := context.Background()
+	dagSvc := dstest.Mock()
+	roots := generateRootCid(t, dagSvc)
+
+	// Copy the blocks of the DAG into a blockstore that lists whole CIDs, along with a block that
+	// is not reachable from the root, and is therefore a root of its own.
+	bs := &wholeCidBlockstore{Blockstore: dstest.Bserv().Blockstore()}
+	var v1 bytes.Buffer
+	require.NoError(t, carv1.WriteCar(ctx, dagSvc, roots, &v1))
+	br, err := NewBlockReader(&v1)
+	require.NoError(t, err)
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, bs.Put(ctx, blk))
+	}
+	unreachable := merkledag.NewRawNode([]byte("🌊"))
+	require.NoError(t, bs.Put(ctx, unreachable))
+
+	got, err := InferRoots(ctx, bs)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []cid.Cid{roots[0], unreachable.Cid()}, got)
+
+	// Assert a block linking to an existing root becomes the only root of their DAG.
+	parent := merkledag.NodeWithData([]byte("parent"))
+	rootNode, err := dagSvc.Get(ctx, roots[0])
+	require.NoError(t, err)
+	require.NoError(t, parent.AddNodeLink("root", rootNode))
+	require.NoError(t, bs.Put(ctx, parent))
+	got, err = InferRoots(ctx, bs)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []cid.Cid{parent.Cid(), unreachable.Cid()}, got)
+
+	// Assert trailers are neither decoded nor inferred as roots.
+	var withTrailers bytes.Buffer
+	require.NoError(t, WriteFromBlockstore(ctx, bs, roots, &withTrailers, EmitRootsTrailer(true), WithMetadata(map[string]string{"producer": "go-car"})))
+	trailerBs := &wholeCidBlockstore{Blockstore: dstest.Bserv().Blockstore()}
+	br, err = NewBlockReader(bytes.NewReader(withTrailers.Bytes()))
+	require.NoError(t, err)
+	var trailers int
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if blk.Cid().Prefix().Codec == uint64(multicodec.Car) {
+			trailers++
+		}
+		require.NoError(t, trailerBs.Put(ctx, blk))
+	}
+	require.Equal(t, 2, trailers)
+	got, err = InferRoots(ctx, trailerBs)
+	require.NoError(t, err)
+	require.Equal(t, roots, got)
+
+	// Assert an empty blockstore has no roots.
+	got, err = InferRoots(ctx, &wholeCidBlockstore{Blockstore: dstest.Bserv().Blockstore()})
+	require.NoError(t, err)
+	require.Empty(t, got)
+}
+
+func TestVerifyStreaming(t *testing.T) {
+	ctx := context.Background()
+	dagSvc := dstest.Mock()
+	roots := generateRootCid(t, dagSvc)
+	var v1 bytes.Buffer
+	require.NoError(t, carv1.WriteCar(ctx, dagSvc, roots, &v1))
+	br, err := NewBlockReader(&v1)
+	require.NoError(t, err)
+	// Note, generateRootCid adds a block that is not reachable from the root.
+	unreachable := merkledag.NewRawNode([]byte("🌊"))
+	blks := []blocks.Block{unreachable}
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		blks = append(blks, blk)
+	}
+	// Write blocks in reverse order of writing, to assert that links are resolved regardless of
+	// the order in which blocks appear.
+	sort.Slice(blks, func(i, j int) bool { return blks[i].Cid().KeyString() > blks[j].Cid().KeyString() })
+
+	writeCar := func(t *testing.T, blks []blocks.Block, mutate func(blocks.Block) []byte) io.Reader {
+		var buf bytes.Buffer
+		require.NoError(t, carv1.WriteHeader(&carv1.CarHeader{Roots: roots, Version: 1}, &buf))
+		for _, blk := range blks {
+			data := blk.RawData()
+			if mutate != nil {
+				data = mutate(blk)
+			}
+			require.NoError(t, util.LdWrite(&buf, blk.Cid().Bytes(), data))
+		}
+		// Hide all methods other than Read.
+		return struct{ io.Reader }{&buf}
+	}
+
+	require.NoError(t, VerifyStreaming(writeCar(t, blks, nil), nil))
+	require.NoError(t, VerifyStreaming(writeCar(t, blks, nil), roots))
+
+	// Assert that a missing root is an error.
+	missingRoot := merkledag.NewRawNode([]byte("lobstermuncher")).Cid()
+	err = VerifyStreaming(writeCar(t, blks, nil), []cid.Cid{missingRoot})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), missingRoot.String())
+
+	// Assert that a missing block reachable from the root is an error, and that a missing block
+	// that is not reachable is not.
+	for _, missing := range []struct {
+		data    string
+		wantErr bool
+	}{{"lobster", true}, {"🌊", false}} {
+		missingCid := merkledag.NewRawNode([]byte(missing.data)).Cid()
+		var remaining []blocks.Block
+		for _, blk := range blks {
+			if !blk.Cid().Equals(missingCid) {
+				remaining = append(remaining, blk)
+			}
+		}
+		require.Len(t, remaining, len(blks)-1)
+		err = VerifyStreaming(writeCar(t, remaining, nil), nil)
+		if missing.wantErr {
+			require.Error(t, err)
+			require.Contains(t, err.Error(), missingCid.String())
+		} else {
+			require.NoError(t, err)
+		}
+	}
+
+	// Assert that a block whose data does not match its CID is an error.
+	err = VerifyStreaming(writeCar(t, blks, func(blk blocks.Block) []byte {
+		if blk.Cid().Prefix().Codec == cid.Raw {
+			return []byte("not " + string(blk.RawData()))
+		}
+		return blk.RawData()
+	}), nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "mismatch in content integrity")
+}
+
+func TestWriteSortedStream(t *testing.T) {
+	var blks []blocks.Block
+	for i := 0; i < 64; i++ {
+		blks = append(blks, merkledag.NewRawNode([]byte(fmt.Sprintf("sorted-stream-block-%d", i))))
+	}
+	sort.Slice(blks, func(i, j int) bool {
+		return bytes.Compare(blks[i].Cid().Hash(), blks[j].Cid().Hash()) < 0
+	})
+	stream := func(blks []blocks.Block) <-chan blocks.Block {
+		ch := make(chan blocks.Block, len(blks))
+		for _, b := range blks {
+			ch <- b
+		}
+		close(ch)
+		return ch
+	}
+	roots := []cid.Cid{blks[0].Cid()}
+
+	path := filepath.Join(t.TempDir(), "sorted-stream.car")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, f.Close()) })
+	require.NoError(t, WriteSortedStream(roots, stream(blks), f, UseDataPadding(3), UseIndexPadding(5)))
+
+	// Assert w is left at the end of the written CAR.
+	end, err := f.Seek(0, io.SeekCurrent)
+	require.NoError(t, err)
+	info, err := f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, info.Size(), end)
+
+	subject, err := OpenReader(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+	require.Equal(t, uint64(2), subject.Version)
+	require.Equal(t, uint64(PragmaSize+HeaderSize+3), subject.Header.DataOffset)
+	require.Equal(t, subject.Header.DataOffset+subject.Header.DataSize+5, subject.Header.IndexOffset)
+	gotRoots, err := subject.Roots()
+	require.NoError(t, err)
+	require.Equal(t, roots, gotRoots)
+
+	// Assert the blocks are written in the given order.
+	dr, err := subject.DataReader()
+	require.NoError(t, err)
+	br, err := NewBlockReader(dr)
+	require.NoError(t, err)
+	for _, want := range blks {
+		got, err := br.Next()
+		require.NoError(t, err)
+		require.Equal(t, want.Cid(), got.Cid())
+		require.Equal(t, want.RawData(), got.RawData())
+	}
+	_, err = br.Next()
+	require.Equal(t, io.EOF, err)
+
+	// Assert the index is the same as one generated from the data payload.
+	dr, err = subject.DataReader()
+	require.NoError(t, err)
+	wantIdx, err := GenerateIndex(dr)
+	require.NoError(t, err)
+	ir, err := subject.IndexReader()
 	require.NoError(t, err)
-	wantV1, err := ioutil.ReadAll(v1f)
+	gotIdx, err := index.ReadFrom(ir)
 	require.NoError(t, err)
+	require.Equal(t, wantIdx, gotIdx)
 
-	// Wrap the produced CARv1 into a CARv2 to use for testing.
-	v2path := filepath.Join(t.TempDir(), "wrapped-for-extract-test-v2.car")
-	require.NoError(t, WrapV1File(v1Src, v2path))
+	// Assert the records of the trailers are loaded in order along with those of the blocks.
+	for _, codec := range []multicodec.Code{multicodec.CarIndexSorted, multicodec.CarMultihashIndexSorted, index.CarMappableIndexSorted} {
+		trailedFile, err := os.Create(filepath.Join(t.TempDir(), "sorted-stream-trailers.car"))
+		require.NoError(t, err)
+		opts := []Option{UseIndexCodec(codec), EmitRootsTrailer(true), WithMetadata(map[string]string{"producer": "go-car"})}
+		require.NoError(t, WriteSortedStream(roots, stream(blks), trailedFile, opts...))
+		require.NoError(t, trailedFile.Close())
+		trailed, err := os.ReadFile(trailedFile.Name())
+		require.NoError(t, err)
+		cr, err := NewReader(bytes.NewReader(trailed))
+		require.NoError(t, err)
+		dr, err := cr.DataReader()
+		require.NoError(t, err)
+		wantIdx, err := GenerateIndex(dr, opts...)
+		require.NoError(t, err)
+		ir, err := cr.IndexReader()
+		require.NoError(t, err)
+		gotIdx, err := index.ReadFrom(ir)
+		require.NoError(t, err)
+		require.Equal(t, wantIdx, gotIdx)
+	}
 
-	// Assert extract from CARv2 file is as expected.
-	dstPath := filepath.Join(t.TempDir(), "extract-file-test-v1.car")
-	require.NoError(t, ExtractV1File(v2path, dstPath))
-	gotFromFile, err := ioutil.ReadFile(dstPath)
+	// Assert the index is correct for blocks of differing multihash codes with the same digest
+	// length, which IndexSorted does not tell apart.
+	var mixed []blocks.Block
+	for i := 0; i < 50; i++ {
+		data := []byte(fmt.Sprintf("sorted-stream-mixed-%d", i))
+		for _, code := range []uint64{multihash.SHA2_256, multihash.SHA3_256, multihash.BLAKE2B_MIN + 31} {
+			mh, err := multihash.Sum(data, code, -1)
+			require.NoError(t, err)
+			blk, err := blocks.NewBlockWithCid(data, cid.NewCidV1(cid.Raw, mh))
+			require.NoError(t, err)
+			mixed = append(mixed, blk)
+		}
+	}
+	sort.Slice(mixed, func(i, j int) bool {
+		return bytes.Compare(mixed[i].Cid().Hash(), mixed[j].Cid().Hash()) < 0
+	})
+	for _, codec := range []multicodec.Code{multicodec.CarIndexSorted, multicodec.CarMultihashIndexSorted, index.CarMappableIndexSorted} {
+		mixedFile, err := os.Create(filepath.Join(t.TempDir(), "sorted-stream-mixed.car"))
+		require.NoError(t, err)
+		require.NoError(t, WriteSortedStream([]cid.Cid{mixed[0].Cid()}, stream(mixed), mixedFile, UseIndexCodec(codec)))
+		require.NoError(t, mixedFile.Close())
+		mixedCar, err := os.ReadFile(mixedFile.Name())
+		require.NoError(t, err)
+		cr, err := NewReader(bytes.NewReader(mixedCar))
+		require.NoError(t, err)
+		ir, err := cr.IndexReader()
+		require.NoError(t, err)
+		gotIdx, err := index.ReadFrom(ir)
+		require.NoError(t, err)
+		for _, blk := range mixed {
+			_, err := index.GetFirst(gotIdx, blk.Cid())
+			require.NoError(t, err, "codec %s: %s", codec, blk.Cid())
+		}
+	}
+
+	// Assert the records added to the external sorter are shifted when offsets are absolute, and
+	// that no temporary files are left behind.
+	sortDir := t.TempDir()
+	absFile, err := os.Create(filepath.Join(t.TempDir(), "sorted-stream-absolute.car"))
 	require.NoError(t, err)
-	require.Equal(t, wantV1, gotFromFile)
+	require.NoError(t, WriteSortedStream(roots, stream(blks), absFile, UseDataPadding(3), UseAbsoluteIndexOffsets(true), ExternalIndexSortDir(sortDir)))
+	require.NoError(t, absFile.Close())
+	entries, err := os.ReadDir(sortDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	absolute, err := os.ReadFile(absFile.Name())
+	require.NoError(t, err)
+	cr, err := NewReader(bytes.NewReader(absolute))
+	require.NoError(t, err)
+	require.True(t, cr.Header.Characteristics.HasAbsoluteIndexOffsets())
+	ir, err = cr.IndexReader()
+	require.NoError(t, err)
+	gotIdx, err = index.ReadFrom(ir)
+	require.NoError(t, err)
+	wantIdx, err = index.Rebase(wantIdx, int64(cr.Header.DataOffset))
+	require.NoError(t, err)
+	require.Equal(t, wantIdx, gotIdx)
 
-	// Assert extract from CARv2 file in-place is as expected
-	require.NoError(t, ExtractV1File(v2path, v2path))
-	gotFromInPlaceFile, err := ioutil.ReadFile(v2path)
+	// Assert out of order and duplicate blocks are errors.
+	unsorted, err := os.Create(filepath.Join(t.TempDir(), "unsorted-stream.car"))
 	require.NoError(t, err)
-	require.Equal(t, wantV1, gotFromInPlaceFile)
+	t.Cleanup(func() { require.NoError(t, unsorted.Close()) })
+	require.Error(t, WriteSortedStream(roots, stream([]blocks.Block{blks[1], blks[0]}), unsorted))
+	require.Error(t, WriteSortedStream(roots, stream([]blocks.Block{blks[0], blks[0]}), unsorted))
+}
+
+func TestWriteOrdered(t *testing.T) {
+	ctx := context.Background()
+	bs := dstest.Bserv().Blockstore()
+	var cids []cid.Cid
+	for i := 0; i < 32; i++ {
+		blk := merkledag.NewRawNode([]byte(fmt.Sprintf("ordered-block-%d", i)))
+		require.NoError(t, bs.Put(ctx, blk))
+		cids = append(cids, blk.Cid())
+	}
+	// Write the blocks in an order that is neither insertion nor sorted order.
+	ordered := append([]cid.Cid{}, cids...)
+	rand.New(rand.NewSource(1418)).Shuffle(len(ordered), func(i, j int) {
+		ordered[i], ordered[j] = ordered[j], ordered[i]
+	})
+	get := func(c cid.Cid) (blocks.Block, error) { return bs.Get(ctx, c) }
+	roots := []cid.Cid{ordered[0]}
+
+	path := filepath.Join(t.TempDir(), "ordered.car")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, f.Close()) })
+	require.NoError(t, WriteOrdered(roots, ordered, get, f))
+
+	subject, err := OpenReader(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+	gotRoots, err := subject.Roots()
+	require.NoError(t, err)
+	require.Equal(t, roots, gotRoots)
+
+	// Assert the blocks are written in exactly the given order.
+	dr, err := subject.DataReader()
+	require.NoError(t, err)
+	br, err := NewBlockReader(dr)
+	require.NoError(t, err)
+	for _, want := range ordered {
+		got, err := br.Next()
+		require.NoError(t, err)
+		require.Equal(t, want, got.Cid())
+	}
+	_, err = br.Next()
+	require.Equal(t, io.EOF, err)
+
+	// Assert the index is the same as one generated from the data payload.
+	dr, err = subject.DataReader()
+	require.NoError(t, err)
+	wantIdx, err := GenerateIndex(dr)
+	require.NoError(t, err)
+	ir, err := subject.IndexReader()
+	require.NoError(t, err)
+	gotIdx, err := index.ReadFrom(ir)
+	require.NoError(t, err)
+	require.Equal(t, wantIdx, gotIdx)
+
+	// Assert a block that cannot be fetched, or that does not match its CID, is an error.
+	other, err := os.Create(filepath.Join(t.TempDir(), "ordered-missing.car"))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, other.Close()) })
+	missing := merkledag.NewRawNode([]byte("lobstermuncher")).Cid()
+	err = WriteOrdered(roots, append(ordered, missing), get, other)
+	require.Error(t, err)
+	require.True(t, format.IsNotFound(errors.Unwrap(err)))
+	mismatched := func(c cid.Cid) (blocks.Block, error) { return bs.Get(ctx, cids[0]) }
+	require.Error(t, WriteOrdered(roots, cids[1:2], mismatched, other))
+}
+
+func TestWriteFile(t *testing.T) {
+	ctx := context.Background()
+	content := make([]byte, 1<<20+1413)
+	rand.New(rand.NewSource(1413)).Read(content)
+	path := filepath.Join(t.TempDir(), "file.bin")
+	require.NoError(t, os.WriteFile(path, content, 0o600))
+
+	for _, chunkSize := range []int64{0, 64 << 10} {
+		var opts []Option
+		wantChunkSize := int64(DefaultUnixFSChunkSize)
+		if chunkSize > 0 {
+			opts = append(opts, UnixFSChunkSize(chunkSize))
+			wantChunkSize = chunkSize
+		}
+		var buf bytes.Buffer
+		root, err := WriteFile(ctx, path, &buf, opts...)
+		require.NoError(t, err)
+		require.Equal(t, uint64(cid.DagProtobuf), root.Prefix().Codec)
+
+		// Assert the leaves hold the file content in order, chunked at the configured size.
+		br, err := NewBlockReader(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), br.Version)
+		require.Equal(t, []cid.Cid{root}, br.Roots)
+		var got []byte
+		var leaves int64
+		for {
+			blk, err := br.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			if blk.Cid().Prefix().Codec == cid.Raw {
+				require.LessOrEqual(t, int64(len(blk.RawData())), wantChunkSize)
+				got = append(got, blk.RawData()...)
+				leaves++
+			}
+		}
+		require.Equal(t, content, got)
+		require.Equal(t, (int64(len(content))+wantChunkSize-1)/wantChunkSize, leaves)
+
+		// Assert the written CAR is indexed.
+		cr, err := NewReader(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+		require.True(t, cr.Header.HasIndex())
+	}
+
+	_, err := WriteFile(ctx, filepath.Join(t.TempDir(), "absent.bin"), io.Discard)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestDeferredRootsWriter(t *testing.T) {
+	// Build a DAG bottom-up, putting the root last.
+	root := merkledag.NodeWithData([]byte("deferred-root"))
+	var blks []blocks.Block
+	for i := 0; i < 16; i++ {
+		leaf := merkledag.NewRawNode([]byte(fmt.Sprintf("deferred-leaf-%d", i)))
+		blks = append(blks, leaf)
+		require.NoError(t, root.AddNodeLink(fmt.Sprintf("leaf-%d", i), leaf))
+	}
+	blks = append(blks, root)
+	roots := []cid.Cid{root.Cid()}
+
+	path := filepath.Join(t.TempDir(), "deferred-roots.car")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, f.Close()) })
+	subject, err := NewDeferredRootsWriter(f, DefaultReservedHeaderSize, UseDataPadding(3), UseIndexPadding(5))
+	require.NoError(t, err)
+	for _, b := range blks {
+		require.NoError(t, subject.Put(b))
+	}
+	require.NoError(t, subject.SetRootsAndFinalize(roots))
+
+	// Assert the writer can no longer be used.
+	require.Error(t, subject.Put(blks[0]))
+	require.Error(t, subject.SetRootsAndFinalize(roots))
+
+	// Assert w is left at the end of the written CAR.
+	end, err := f.Seek(0, io.SeekCurrent)
+	require.NoError(t, err)
+	info, err := f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, info.Size(), end)
+
+	cr, err := OpenReader(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, cr.Close()) })
+	require.Equal(t, uint64(2), cr.Version)
+	headerSize, err := carv1.HeaderSize(&carv1.CarHeader{Roots: roots, Version: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(PragmaSize+HeaderSize+3+DefaultReservedHeaderSize)-headerSize, cr.Header.DataOffset)
+	require.Equal(t, cr.Header.DataOffset+cr.Header.DataSize+5, cr.Header.IndexOffset)
+	gotRoots, err := cr.Roots()
+	require.NoError(t, err)
+	require.Equal(t, roots, gotRoots)
+
+	// Assert the blocks are written in the order in which they were put.
+	dr, err := cr.DataReader()
+	require.NoError(t, err)
+	br, err := NewBlockReader(dr)
+	require.NoError(t, err)
+	for _, want := range blks {
+		got, err := br.Next()
+		require.NoError(t, err)
+		require.Equal(t, want.Cid(), got.Cid())
+		require.Equal(t, want.RawData(), got.RawData())
+	}
+	_, err = br.Next()
+	require.Equal(t, io.EOF, err)
+
+	// Assert the index is the same as one generated from the data payload.
+	dr, err = cr.DataReader()
+	require.NoError(t, err)
+	wantIdx, err := GenerateIndex(dr)
+	require.NoError(t, err)
+	ir, err := cr.IndexReader()
+	require.NoError(t, err)
+	gotIdx, err := index.ReadFrom(ir)
+	require.NoError(t, err)
+	require.Equal(t, wantIdx, gotIdx)
+
+	// Assert the default reservation fits five CIDv1 roots with SHA2-256 multihash.
+	fiveRoots := make([]cid.Cid, 5)
+	for i := range fiveRoots {
+		fiveRoots[i] = merkledag.NewRawNode([]byte(fmt.Sprintf("deferred-root-%d", i))).Cid()
+	}
+	fiveRootsSize, err := carv1.HeaderSize(&carv1.CarHeader{Roots: fiveRoots, Version: 1})
+	require.NoError(t, err)
+	require.LessOrEqual(t, fiveRootsSize, uint64(DefaultReservedHeaderSize))
+
+	// Assert a header larger than the reservation is an error.
+	small, err := os.Create(filepath.Join(t.TempDir(), "deferred-roots-small.car"))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, small.Close()) })
+	subject, err = NewDeferredRootsWriter(small, headerSize-1)
+	require.NoError(t, err)
+	require.NoError(t, subject.Put(blks[0]))
+	require.Error(t, subject.SetRootsAndFinalize(roots))
+}
+
+func TestSubgraphSize(t *testing.T) {
+	ctx := context.Background()
+	bserv := dstest.Bserv()
+	roots := generateRootCid(t, merkledag.NewDAGService(bserv))
+
+	// Count the blocks and their sizes via the CARv1 of the same DAG.
+	var v1 bytes.Buffer
+	require.NoError(t, carv1.WriteCar(ctx, merkledag.NewDAGService(bserv), roots, &v1))
+	br, err := NewBlockReader(&v1)
+	require.NoError(t, err)
+	var wantBlocks int
+	var wantSize uint64
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		wantBlocks++
+		wantSize += uint64(len(blk.RawData()))
+	}
+
+	gotBlocks, gotSize, err := SubgraphSize(ctx, bserv.Blockstore(), roots[0])
+	require.NoError(t, err)
+	require.Equal(t, wantBlocks, gotBlocks)
+	require.Equal(t, wantSize, gotSize)
+
+	// Assert a missing root is an error.
+	_, _, err = SubgraphSize(ctx, bserv.Blockstore(), merkledag.NewRawNode([]byte("lobstermuncher")).Cid())
+	require.Error(t, err)
 }
 
 func TestExtractV1WithUnknownVersionIsError(t *testing.T) {
@@ -281,3 +1816,488 @@ func requireTmpCopy(t *testing.T, src string) string {
 	require.NoError(t, err)
 	return dst
 }
+
+func TestWriteDeterministic(t *testing.T) {
+	ctx := context.Background()
+	bserv := dstest.Bserv()
+	roots := generateRootCid(t, merkledag.NewDAGService(bserv))
+	bs := bserv.Blockstore()
+
+	// Copy the blocks into another blockstore, so that the second write reads them from a
+	// different store.
+	other := dstest.Bserv().Blockstore()
+	keys, err := bs.AllKeysChan(ctx)
+	require.NoError(t, err)
+	for c := range keys {
+		b, err := bs.Get(ctx, c)
+		require.NoError(t, err)
+		require.NoError(t, other.Put(ctx, b))
+	}
+
+	var first, second bytes.Buffer
+	require.NoError(t, WriteDeterministic(ctx, bs, roots, &first))
+	require.NoError(t, WriteDeterministic(ctx, other, roots, &second))
+	require.Equal(t, first.Bytes(), second.Bytes())
+
+	subject, err := NewReader(bytes.NewReader(first.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, uint64(PragmaSize+HeaderSize), subject.Header.DataOffset)
+	require.Equal(t, subject.Header.DataOffset+subject.Header.DataSize, subject.Header.IndexOffset)
+
+	// Assert the blocks are written in ascending order of CID bytes.
+	dr, err := subject.DataReader()
+	require.NoError(t, err)
+	br, err := NewBlockReader(dr)
+	require.NoError(t, err)
+	require.Equal(t, roots, br.Roots)
+	var prev cid.Cid
+	var count int
+	for {
+		b, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if prev.Defined() {
+			require.Less(t, prev.KeyString(), b.Cid().KeyString())
+		}
+		prev = b.Cid()
+		count++
+	}
+	wantBlocks, _, err := SubgraphSize(ctx, bs, roots[0])
+	require.NoError(t, err)
+	require.Equal(t, wantBlocks, count)
+
+	// Assert the index matches the one generated from the payload.
+	ir, err := subject.IndexReader()
+	require.NoError(t, err)
+	gotIdx, err := index.ReadFrom(ir)
+	require.NoError(t, err)
+	dr, err = subject.DataReader()
+	require.NoError(t, err)
+	wantIdx, err := GenerateIndex(dr)
+	require.NoError(t, err)
+	require.Equal(t, wantIdx, gotIdx)
+}
+
+func TestRepad(t *testing.T) {
+	original, err := os.ReadFile("testdata/sample-wrapped-v2.car")
+	require.NoError(t, err)
+
+	var padded bytes.Buffer
+	require.NoError(t, Repad(bytes.NewReader(original), &padded, 1413, 42))
+	subject, err := NewReader(bytes.NewReader(padded.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, uint64(PragmaSize+HeaderSize+1413), subject.Header.DataOffset)
+	require.Equal(t, subject.Header.DataOffset+subject.Header.DataSize+42, subject.Header.IndexOffset)
+
+	// Assert the payload and index are unchanged.
+	want, err := NewReader(bytes.NewReader(original))
+	require.NoError(t, err)
+	wantDr, err := want.DataReader()
+	require.NoError(t, err)
+	wantData, err := io.ReadAll(wantDr)
+	require.NoError(t, err)
+	gotDr, err := subject.DataReader()
+	require.NoError(t, err)
+	gotData, err := io.ReadAll(gotDr)
+	require.NoError(t, err)
+	require.Equal(t, wantData, gotData)
+	wantIr, err := want.IndexReader()
+	require.NoError(t, err)
+	wantIdx, err := index.ReadFrom(wantIr)
+	require.NoError(t, err)
+	gotIr, err := subject.IndexReader()
+	require.NoError(t, err)
+	gotIdx, err := index.ReadFrom(gotIr)
+	require.NoError(t, err)
+	require.Equal(t, wantIdx, gotIdx)
+
+	// Assert zeroing the padding again results in the original CAR, which has no padding.
+	require.Equal(t, PragmaSize+HeaderSize, int(want.Header.DataOffset))
+	var unpadded bytes.Buffer
+	require.NoError(t, Repad(bytes.NewReader(padded.Bytes()), &unpadded, 0, 0))
+	require.Equal(t, original, unpadded.Bytes())
+
+	// Assert a CARv1 is rejected.
+	v1, err := os.ReadFile("testdata/sample-v1.car")
+	require.NoError(t, err)
+	require.Equal(t, ErrAlreadyV1, Repad(bytes.NewReader(v1), &bytes.Buffer{}, 0, 0))
+
+	// Assert an index with offsets beyond the data payload is rejected.
+	c := merkledag.NewRawNode([]byte("lobstermuncher")).Cid()
+	badIdx := index.NewMultihashSorted()
+	require.NoError(t, badIdx.Load([]index.Record{{Cid: c, Offset: uint64(len(wantData))}}))
+	var bad bytes.Buffer
+	_, err = bad.Write(Pragma)
+	require.NoError(t, err)
+	_, err = NewHeader(uint64(len(wantData))).WriteTo(&bad)
+	require.NoError(t, err)
+	_, err = bad.Write(wantData)
+	require.NoError(t, err)
+	_, err = index.WriteTo(badIdx, &bad)
+	require.NoError(t, err)
+	var dst bytes.Buffer
+	require.Error(t, Repad(bytes.NewReader(bad.Bytes()), &dst, 0, 0))
+	require.Zero(t, dst.Len())
+}
+
+func TestMultiNodeGetter(t *testing.T) {
+	ctx := context.Background()
+	whole := dstest.Mock()
+	roots := generateRootCid(t, whole)
+
+	// Spread the blocks across two stores.
+	first, second := dstest.Mock(), dstest.Mock()
+	var cids []cid.Cid
+	require.NoError(t, merkledag.Walk(ctx, merkledag.GetLinksWithDAG(whole), roots[0], func(c cid.Cid) bool {
+		cids = append(cids, c)
+		return true
+	}))
+	for i, c := range cids {
+		nd, err := whole.Get(ctx, c)
+		require.NoError(t, err)
+		if i%2 == 0 {
+			require.NoError(t, first.Add(ctx, nd))
+		} else {
+			require.NoError(t, second.Add(ctx, nd))
+		}
+	}
+	subject := MultiNodeGetter(first, second)
+
+	// Assert the CAR written via the multi getter is identical to one written from a single store.
+	var want, got bytes.Buffer
+	require.NoError(t, carv1.WriteCar(ctx, whole, roots, &want))
+	require.Error(t, carv1.WriteCar(ctx, first, roots, &bytes.Buffer{}))
+	require.NoError(t, carv1.WriteCar(ctx, subject, roots, &got))
+	require.Equal(t, want.Bytes(), got.Bytes())
+
+	// Assert GetMany aggregates the nodes from all getters, and reports absent nodes.
+	absent := merkledag.NewRawNode([]byte("lobstermuncher")).Cid()
+	_, err := subject.Get(ctx, absent)
+	require.True(t, format.IsNotFound(err))
+	var gotCids []cid.Cid
+	var errs []error
+	for opt := range subject.GetMany(ctx, append(cids, absent)) {
+		if opt.Err != nil {
+			errs = append(errs, opt.Err)
+			continue
+		}
+		gotCids = append(gotCids, opt.Node.Cid())
+	}
+	require.ElementsMatch(t, cids, gotCids)
+	require.Len(t, errs, 1)
+	require.True(t, format.IsNotFound(errs[0]), "%v", errs[0])
+}
+
+func TestUseAbsoluteIndexOffsets(t *testing.T) {
+	ctx := context.Background()
+	bserv := dstest.Bserv()
+	roots := generateRootCid(t, merkledag.NewDAGService(bserv))
+	var v1 bytes.Buffer
+	require.NoError(t, carv1.WriteCar(ctx, merkledag.NewDAGService(bserv), roots, &v1))
+	wantIdx, err := GenerateIndex(bytes.NewReader(v1.Bytes()))
+	require.NoError(t, err)
+
+	requireAbsoluteIndex := func(t *testing.T, v2 []byte) {
+		subject, err := NewReader(bytes.NewReader(v2))
+		require.NoError(t, err)
+		require.True(t, subject.Header.Characteristics.HasAbsoluteIndexOffsets())
+
+		// Assert every offset in the index points directly at its section within the whole CARv2.
+		ir, err := subject.IndexReader()
+		require.NoError(t, err)
+		gotIdx, err := index.ReadFrom(ir)
+		require.NoError(t, err)
+		require.NoError(t, wantIdx.(index.IterableIndex).ForEach(func(mh multihash.Multihash, offset uint64) error {
+			got, err := index.GetFirst(gotIdx, cid.NewCidV1(cid.Raw, mh))
+			require.NoError(t, err)
+			require.Equal(t, subject.Header.DataOffset+offset, got)
+			c, _, err := util.ReadNode(io.NewSectionReader(bytes.NewReader(v2), int64(got), int64(len(v2))-int64(got)), false, DefaultMaxAllowedSectionSize)
+			require.NoError(t, err)
+			require.Equal(t, mh, c.Hash())
+			return nil
+		}))
+
+		// Assert the index is rebased onto the data payload when read.
+		gotIdx, err = ReadOrGenerateIndex(bytes.NewReader(v2))
+		require.NoError(t, err)
+		require.Equal(t, wantIdx, gotIdx)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteFromBlockstore(ctx, bserv.Blockstore(), roots, &buf, UseDataPadding(3), UseAbsoluteIndexOffsets(true)))
+	requireAbsoluteIndex(t, buf.Bytes())
+
+	// Assert repadding rebases the index onto the new data offset.
+	var repadded bytes.Buffer
+	require.NoError(t, Repad(bytes.NewReader(buf.Bytes()), &repadded, 1413, 0))
+	requireAbsoluteIndex(t, repadded.Bytes())
+
+	var wrapped bytes.Buffer
+	require.NoError(t, WrapV1(bytes.NewReader(v1.Bytes()), &wrapped, UseAbsoluteIndexOffsets(true)))
+	requireAbsoluteIndex(t, wrapped.Bytes())
+
+	// Assert offsets are relative to the data payload by default.
+	buf.Reset()
+	require.NoError(t, WriteFromBlockstore(ctx, bserv.Blockstore(), roots, &buf, UseDataPadding(3)))
+	subject, err := NewReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.False(t, subject.Header.Characteristics.HasAbsoluteIndexOffsets())
+	ir, err := subject.IndexReader()
+	require.NoError(t, err)
+	gotIdx, err := index.ReadFrom(ir)
+	require.NoError(t, err)
+	require.Equal(t, wantIdx, gotIdx)
+}
+
+func TestPrune(t *testing.T) {
+	ctx := context.Background()
+	dagSvc := dstest.Mock()
+	roots := generateRootCid(t, dagSvc)
+	var wantV1 bytes.Buffer
+	require.NoError(t, carv1.WriteCar(ctx, dagSvc, roots, &wantV1))
+
+	// Append a block that is not reachable from the root, and a duplicate of the root.
+	unreachable := merkledag.NewRawNode([]byte("🌊"))
+	root, err := dagSvc.Get(ctx, roots[0])
+	require.NoError(t, err)
+	src := bytes.NewBuffer(append([]byte{}, wantV1.Bytes()...))
+	require.NoError(t, util.LdWrite(src, unreachable.Cid().Bytes(), unreachable.RawData()))
+	require.NoError(t, util.LdWrite(src, root.Cid().Bytes(), root.RawData()))
+
+	var dst bytes.Buffer
+	prunedBlocks, prunedBytes, err := Prune(bytes.NewReader(src.Bytes()), &dst, UseDataPadding(3))
+	require.NoError(t, err)
+	require.Equal(t, 2, prunedBlocks)
+	require.Equal(t, uint64(len(unreachable.RawData())+len(root.RawData())), prunedBytes)
+
+	// Assert the pruned payload is the one written from the DAG, along with a matching index.
+	subject, err := NewReader(bytes.NewReader(dst.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, uint64(PragmaSize+HeaderSize+3), subject.Header.DataOffset)
+	dr, err := subject.DataReader()
+	require.NoError(t, err)
+	gotV1, err := io.ReadAll(dr)
+	require.NoError(t, err)
+	require.Equal(t, wantV1.Bytes(), gotV1)
+	wantIdx, err := GenerateIndex(bytes.NewReader(wantV1.Bytes()))
+	require.NoError(t, err)
+	ir, err := subject.IndexReader()
+	require.NoError(t, err)
+	gotIdx, err := index.ReadFrom(ir)
+	require.NoError(t, err)
+	require.Equal(t, wantIdx, gotIdx)
+	require.NoError(t, VerifyStreaming(bytes.NewReader(dst.Bytes()), nil))
+
+	// Assert pruning a minimal CAR prunes nothing.
+	var again bytes.Buffer
+	prunedBlocks, prunedBytes, err = Prune(bytes.NewReader(dst.Bytes()), &again, UseDataPadding(3))
+	require.NoError(t, err)
+	require.Zero(t, prunedBlocks)
+	require.Zero(t, prunedBytes)
+	require.Equal(t, dst.Bytes(), again.Bytes())
+}
+
+func TestDelta(t *testing.T) {
+	ctx := context.Background()
+	dagSvc := dstest.Mock()
+	roots := generateRootCid(t, dagSvc)
+	var base bytes.Buffer
+	require.NoError(t, carv1.WriteCar(ctx, dagSvc, roots, &base))
+	root, err := dagSvc.Get(ctx, roots[0])
+	require.NoError(t, err)
+
+	// Write a target that shares no roots with base, holding a block of base and duplicates.
+	added := []format.Node{merkledag.NewRawNode([]byte("🦞")), merkledag.NewRawNode([]byte("🦀"))}
+	targetRoots := []cid.Cid{added[0].Cid()}
+	var target bytes.Buffer
+	require.NoError(t, carv1.WriteHeader(&carv1.CarHeader{Roots: targetRoots, Version: 1}, &target))
+	for _, nd := range []format.Node{added[0], root, added[1], added[0]} {
+		require.NoError(t, util.LdWrite(&target, nd.Cid().Bytes(), nd.RawData()))
+	}
+
+	var wantV1 bytes.Buffer
+	require.NoError(t, carv1.WriteHeader(&carv1.CarHeader{Roots: targetRoots, Version: 1}, &wantV1))
+	for _, nd := range added {
+		require.NoError(t, util.LdWrite(&wantV1, nd.Cid().Bytes(), nd.RawData()))
+	}
+
+	var delta bytes.Buffer
+	require.NoError(t, Delta(bytes.NewReader(base.Bytes()), bytes.NewReader(target.Bytes()), &delta))
+
+	// Assert the delta holds the first occurrence of the added blocks, along with a matching index.
+	subject, err := NewReader(bytes.NewReader(delta.Bytes()))
+	require.NoError(t, err)
+	dr, err := subject.DataReader()
+	require.NoError(t, err)
+	gotV1, err := io.ReadAll(dr)
+	require.NoError(t, err)
+	require.Equal(t, wantV1.Bytes(), gotV1)
+	wantIdx, err := GenerateIndex(bytes.NewReader(wantV1.Bytes()))
+	require.NoError(t, err)
+	ir, err := subject.IndexReader()
+	require.NoError(t, err)
+	gotIdx, err := index.ReadFrom(ir)
+	require.NoError(t, err)
+	require.Equal(t, wantIdx, gotIdx)
+
+	// Assert the delta against a base holding every block of target is empty, with either version
+	// of CAR as base.
+	for _, b := range [][]byte{target.Bytes(), delta.Bytes()} {
+		var empty bytes.Buffer
+		require.NoError(t, Delta(bytes.NewReader(b), bytes.NewReader(delta.Bytes()), &empty))
+		br, err := NewBlockReader(bytes.NewReader(empty.Bytes()))
+		require.NoError(t, err)
+		require.Equal(t, targetRoots, br.Roots)
+		_, err = br.Next()
+		require.Equal(t, io.EOF, err)
+	}
+}
+
+func TestExternalIndexSort(t *testing.T) {
+	ctx := context.Background()
+	bserv := dstest.Bserv()
+	roots := generateRootCid(t, merkledag.NewDAGService(bserv))
+	var v1 bytes.Buffer
+	require.NoError(t, carv1.WriteCar(ctx, merkledag.NewDAGService(bserv), roots, &v1))
+
+	dir := t.TempDir()
+	sortOpts := []Option{ExternalIndexSort(true), ExternalIndexSortDir(dir)}
+	requireNoRuns := func(t *testing.T) {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	}
+
+	// Assert the output is identical to that written with the index sorted in memory.
+	for _, opts := range [][]Option{
+		nil,
+		{UseDataPadding(3), UseIndexPadding(5)},
+		{UseDataPadding(3), UseAbsoluteIndexOffsets(true)},
+	} {
+		var want, got bytes.Buffer
+		require.NoError(t, WriteFromBlockstore(ctx, bserv.Blockstore(), roots, &want, opts...))
+		require.NoError(t, WriteFromBlockstore(ctx, bserv.Blockstore(), roots, &got, append(opts, sortOpts...)...))
+		require.Equal(t, want.Bytes(), got.Bytes())
+		requireNoRuns(t)
+	}
+
+	for _, opts := range [][]Option{nil, {UseAbsoluteIndexOffsets(true)}} {
+		var want, got bytes.Buffer
+		require.NoError(t, WrapV1(bytes.NewReader(v1.Bytes()), &want, opts...))
+		require.NoError(t, WrapV1(bytes.NewReader(v1.Bytes()), &got, append(opts, sortOpts...)...))
+		require.Equal(t, want.Bytes(), got.Bytes())
+		requireNoRuns(t)
+	}
+
+	out := t.TempDir()
+	wantIdxPath, gotIdxPath := filepath.Join(out, "want.idx"), filepath.Join(out, "got.idx")
+	require.NoError(t, WriteV1WithSidecar(ctx, merkledag.NewDAGService(bserv), roots, filepath.Join(out, "want.car"), wantIdxPath))
+	require.NoError(t, WriteV1WithSidecar(ctx, merkledag.NewDAGService(bserv), roots, filepath.Join(out, "got.car"), gotIdxPath, sortOpts...))
+	wantIdx, err := os.ReadFile(wantIdxPath)
+	require.NoError(t, err)
+	gotIdx, err := os.ReadFile(gotIdxPath)
+	require.NoError(t, err)
+	require.Equal(t, wantIdx, gotIdx)
+	requireNoRuns(t)
+
+	// Assert other index codecs are rejected.
+	err = WriteFromBlockstore(ctx, bserv.Blockstore(), roots, io.Discard, append(sortOpts, UseIndexCodec(multicodec.CarIndexSorted))...)
+	require.Error(t, err)
+}
+
+func TestPaddingForAlignment(t *testing.T) {
+	for _, tc := range []struct {
+		dataOffset, dataSize, align uint64
+		wantIndexPadding            uint64
+	}{
+		{PragmaSize + HeaderSize, 100, 0, 0},
+		{PragmaSize + HeaderSize, 100, 1, 0},
+		{PragmaSize + HeaderSize, 100, 4096, 4096 - (PragmaSize + HeaderSize + 100)},
+		{PragmaSize + HeaderSize, 4096 - PragmaSize - HeaderSize, 4096, 0},
+		{PragmaSize + HeaderSize + 3, 4096, 8, 2},
+		{13, 0, 8, 3},
+	} {
+		carV1Padding, indexPadding := PaddingForAlignment(tc.dataOffset, tc.dataSize, tc.align)
+		require.Zero(t, carV1Padding)
+		require.Equal(t, tc.wantIndexPadding, indexPadding)
+	}
+}
+
+func TestAlignIndexTo(t *testing.T) {
+	ctx := context.Background()
+	bserv := dstest.Bserv()
+	roots := generateRootCid(t, merkledag.NewDAGService(bserv))
+	opts := []Option{UseDataPadding(3), UseIndexPadding(5), AlignIndexTo(4096)}
+
+	requireAligned := func(t *testing.T, v2 []byte) {
+		subject, err := NewReader(bytes.NewReader(v2))
+		require.NoError(t, err)
+		h := subject.Header
+		require.Zero(t, h.IndexOffset%4096)
+		require.GreaterOrEqual(t, h.IndexOffset, h.DataOffset+h.DataSize+5)
+		require.Less(t, h.IndexOffset, h.DataOffset+h.DataSize+5+4096)
+
+		ir, err := subject.IndexReader()
+		require.NoError(t, err)
+		gotIdx, err := index.ReadFrom(ir)
+		require.NoError(t, err)
+		dr, err := subject.DataReader()
+		require.NoError(t, err)
+		wantIdx, err := GenerateIndex(dr)
+		require.NoError(t, err)
+		require.Equal(t, wantIdx, gotIdx)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteFromBlockstore(ctx, bserv.Blockstore(), roots, &buf, opts...))
+	requireAligned(t, buf.Bytes())
+
+	var pruned bytes.Buffer
+	_, _, err := Prune(bytes.NewReader(buf.Bytes()), &pruned, opts...)
+	require.NoError(t, err)
+	requireAligned(t, pruned.Bytes())
+
+	br, err := NewBlockReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	var blks []blocks.Block
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		blks = append(blks, blk)
+	}
+	sort.Slice(blks, func(i, j int) bool { return bytes.Compare(blks[i].Cid().Hash(), blks[j].Cid().Hash()) < 0 })
+	sorted := make(chan blocks.Block, len(blks))
+	for _, blk := range blks {
+		sorted <- blk
+	}
+	close(sorted)
+	f, err := os.Create(filepath.Join(t.TempDir(), "sorted.car"))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, f.Close()) })
+	require.NoError(t, WriteSortedStream(roots, sorted, f, opts...))
+	written, err := os.ReadFile(f.Name())
+	require.NoError(t, err)
+	requireAligned(t, written)
+}
+
+func TestSingleBlockCar(t *testing.T) {
+	blk := merkledag.NewRawNode([]byte("🐠"))
+	var buf bytes.Buffer
+	require.NoError(t, SingleBlockCar(blk, &buf))
+
+	br, err := NewBlockReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), br.Version)
+	require.Equal(t, []cid.Cid{blk.Cid()}, br.Roots)
+	got, err := br.Next()
+	require.NoError(t, err)
+	require.Equal(t, blk.Cid(), got.Cid())
+	require.Equal(t, blk.RawData(), got.RawData())
+	_, err = br.Next()
+	require.Equal(t, io.EOF, err)
+}